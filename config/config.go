@@ -1,5 +1,12 @@
 package config
 
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
 // Config holds server configuration
 type Config struct {
 	DNSPort  int // DNS server port (default 53)
@@ -14,3 +21,80 @@ func DefaultConfig() *Config {
 	}
 }
 
+// DomainConfig holds the settings of one served domain in a --domain-config file
+type DomainConfig struct {
+	Name           string `json:"name"`             // Domain suffix (required)
+	OutputDir      string `json:"output_dir"`       // Default: <output-dir>/<name>
+	PSK            string `json:"psk"`              // Pre-shared passphrase for this domain
+	PSKFile        string `json:"psk_file"`         // Read the passphrase from a file
+	PayloadDir     string `json:"payload_dir"`      // Extra payloads served only under this domain
+	MaxFileSize    int64  `json:"max_file_size"`    // Bytes, 0 for no limit
+	MaxStoredBytes int64  `json:"max_stored_bytes"` // Bytes, 0 for no limit
+	MaxTransfers   int    `json:"max_transfers"`    // Incomplete transfers, 0 for no limit
+}
+
+// LoadDomains reads a JSON array of domain settings
+func LoadDomains(path string) ([]DomainConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var domains []DomainConfig
+	if err := json.Unmarshal(data, &domains); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i, d := range domains {
+		if strings.Trim(d.Name, ". ") == "" {
+			return nil, fmt.Errorf("%s: domain %d has no name", path, i+1)
+		}
+	}
+	return domains, nil
+}
+
+// AuthConfig holds the dashboard users and API tokens of a --web-auth-config file
+type AuthConfig struct {
+	Users  []UserConfig  `json:"users"`
+	Tokens []TokenConfig `json:"tokens"`
+}
+
+// UserConfig is a dashboard login
+type UserConfig struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"` // bcrypt hash (see --hash-password)
+	Role         string `json:"role"`          // viewer (default) or operator
+}
+
+// TokenConfig is a bearer token for API clients. Only its hash is kept.
+type TokenConfig struct {
+	Name   string `json:"name"`   // Shown in logs
+	SHA256 string `json:"sha256"` // Hex SHA-256 of the token
+	Role   string `json:"role"`   // viewer (default) or operator
+}
+
+// LoadAuth reads the dashboard users and API tokens
+func LoadAuth(path string) (*AuthConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var auth AuthConfig
+	if err := json.Unmarshal(data, &auth); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i, u := range auth.Users {
+		if u.Username == "" || u.PasswordHash == "" {
+			return nil, fmt.Errorf("%s: user %d needs a username and password_hash", path, i+1)
+		}
+	}
+	for i, t := range auth.Tokens {
+		if len(t.SHA256) != 64 {
+			return nil, fmt.Errorf("%s: token %d needs a hex sha256 of 64 characters", path, i+1)
+		}
+	}
+	if len(auth.Users) == 0 && len(auth.Tokens) == 0 {
+		return nil, fmt.Errorf("%s: no users or tokens", path)
+	}
+	return &auth, nil
+}
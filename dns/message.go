@@ -92,9 +92,12 @@ func (m *Message) ToBytes() ([]byte, error) {
 		binary.Write(buf, binary.BigEndian, q.Class)
 	}
 
-	// Write answers
+	// Write answers. Names repeating the first question's name are written
+	// as a pointer to it (offset 12, right after the header).
 	for _, rr := range m.Answers {
-		if err := encodeName(buf, rr.Name); err != nil {
+		if len(m.Questions) > 0 && rr.Name != "" && rr.Name == m.Questions[0].Name {
+			binary.Write(buf, binary.BigEndian, uint16(0xC000|12))
+		} else if err := encodeName(buf, rr.Name); err != nil {
 			return nil, err
 		}
 		binary.Write(buf, binary.BigEndian, rr.Type)
@@ -163,6 +166,16 @@ func decodeName(data []byte, offset int) (string, int, error) {
 	return string(name), offset, nil
 }
 
+// EncodeName encodes a DNS name to wire format, for names inside record
+// data such as CNAME and MX targets
+func EncodeName(name string) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := encodeName(buf, name); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 // encodeName encodes a DNS name to bytes
 func encodeName(buf *bytes.Buffer, name string) error {
 	if len(name) == 0 {
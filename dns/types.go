@@ -2,20 +2,26 @@ package dns
 
 // DNS record types
 const (
-	TypeA   uint16 = 1  // IPv4 address
-	TypeTXT uint16 = 16 // Text string
+	TypeA     uint16 = 1  // IPv4 address
+	TypeCNAME uint16 = 5  // Canonical name
+	TypeNULL  uint16 = 10 // Raw data
+	TypeMX    uint16 = 15 // Mail exchange
+	TypeTXT   uint16 = 16 // Text string
+	TypeAAAA  uint16 = 28 // IPv6 address
 )
 
 // DNS response codes
 const (
 	RcodeNoError  = 0 // No error
 	RcodeNXDomain = 3 // Name does not exist
+	RcodeRefused  = 5 // Query refused by policy
 )
 
 // DNS message flags
 const (
 	FlagQR     = 0x8000 // Query/Response
 	FlagAA     = 0x0400 // Authoritative Answer
+	FlagTC     = 0x0200 // Truncated
 	FlagRD     = 0x0100 // Recursion Desired
 	FlagRA     = 0x0080 // Recursion Available
 	FlagResponse = FlagQR | FlagAA
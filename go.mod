@@ -1,3 +1,10 @@
 module youkaidns
 
 go 1.21.4
+
+require (
+	github.com/klauspost/compress v1.17.9
+	golang.org/x/crypto v0.31.0
+)
+
+require golang.org/x/sys v0.28.0 // indirect
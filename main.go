@@ -1,18 +1,33 @@
 package main
 
 import (
+	"bufio"
+	_ "embed"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
+	"time"
 	"youkaidns/config"
 	"youkaidns/server"
 	"youkaidns/stats"
 	"youkaidns/web"
 )
 
+// Transfer scripts served as the default linux and windows payloads
+var (
+	//go:embed script.sh
+	linuxScript []byte
+
+	//go:embed script.ps1
+	windowsScript []byte
+)
+
 func main() {
 	// Customize flag usage to show double dashes
 	flag.Usage = func() {
@@ -22,28 +37,339 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  --web-listen string\n")
 		fmt.Fprintf(os.Stderr, "    \tIP address to listen on for web dashboard (default: localhost) (default \"localhost\")\n")
 		fmt.Fprintf(os.Stderr, "  --domain string\n")
-		fmt.Fprintf(os.Stderr, "    \tDomain suffix for dynamic records (e.g., example.com)\n")
+		fmt.Fprintf(os.Stderr, "    \tDomain suffix for dynamic records (e.g., example.com); comma-separate to serve several, the first is primary\n")
+		fmt.Fprintf(os.Stderr, "  --domain-config string\n")
+		fmt.Fprintf(os.Stderr, "    \tJSON file of served domains with their own output directories, keys, payloads and quotas\n")
 		fmt.Fprintf(os.Stderr, "  --output-dir string\n")
 		fmt.Fprintf(os.Stderr, "    \tDirectory to save received files (default \"received_files\")\n")
+		fmt.Fprintf(os.Stderr, "  --outbox-dir string\n")
+		fmt.Fprintf(os.Stderr, "    \tDirectory whose files clients can download over DNS (disabled if empty)\n")
+		fmt.Fprintf(os.Stderr, "  --payload-dir string\n")
+		fmt.Fprintf(os.Stderr, "    \tDirectory of extra payloads to serve via <name>.script queries\n")
+		fmt.Fprintf(os.Stderr, "  --script-chunk-size int\n")
+		fmt.Fprintf(os.Stderr, "    \tDefault chunk size baked into served transfer scripts (default 100)\n")
+		fmt.Fprintf(os.Stderr, "  --script-parallel int\n")
+		fmt.Fprintf(os.Stderr, "    \tDefault parallel queries baked into served transfer scripts (default 20)\n")
+		fmt.Fprintf(os.Stderr, "  --script-dns-server string\n")
+		fmt.Fprintf(os.Stderr, "    \tDNS server baked into served transfer scripts (default: the client's resolver)\n")
+		fmt.Fprintf(os.Stderr, "  --collision string\n")
+		fmt.Fprintf(os.Stderr, "    \tWhat to do when a received filename already exists: overwrite, suffix, timestamp or hash-prefix (default \"suffix\")\n")
+		fmt.Fprintf(os.Stderr, "  --transfer-timeout duration\n")
+		fmt.Fprintf(os.Stderr, "    \tFail incomplete transfers after this long without activity (default 10m0s)\n")
+		fmt.Fprintf(os.Stderr, "  --psk string\n")
+		fmt.Fprintf(os.Stderr, "    \tPre-shared passphrase for decrypting encrypted transfers (prefer --psk-file or YOUKAIDNS_PSK)\n")
+		fmt.Fprintf(os.Stderr, "  --psk-file string\n")
+		fmt.Fprintf(os.Stderr, "    \tRead the pre-shared passphrase from a file\n")
+		fmt.Fprintf(os.Stderr, "  --auth-secret string\n")
+		fmt.Fprintf(os.Stderr, "    \tShared secret for HMAC-tagged records; untagged records are dropped when set (prefer --auth-secret-file or YOUKAIDNS_AUTH_SECRET)\n")
+		fmt.Fprintf(os.Stderr, "  --auth-secret-file string\n")
+		fmt.Fprintf(os.Stderr, "    \tRead the record authentication secret from a file\n")
+		fmt.Fprintf(os.Stderr, "  --rate-limit float\n")
+		fmt.Fprintf(os.Stderr, "    \tQueries per second allowed per client IP (0 for no limit)\n")
+		fmt.Fprintf(os.Stderr, "  --rate-burst int\n")
+		fmt.Fprintf(os.Stderr, "    \tQueries a client IP may send at once (default: one second's worth)\n")
+		fmt.Fprintf(os.Stderr, "  --subnet-rate-limit float\n")
+		fmt.Fprintf(os.Stderr, "    \tQueries per second allowed per client subnet (0 for no limit)\n")
+		fmt.Fprintf(os.Stderr, "  --subnet-burst int\n")
+		fmt.Fprintf(os.Stderr, "    \tQueries a client subnet may send at once (default: one second's worth)\n")
+		fmt.Fprintf(os.Stderr, "  --subnet-prefix int\n")
+		fmt.Fprintf(os.Stderr, "    \tPrefix length of IPv4 client subnets, for subnet rate limits and RRL (default 24)\n")
+		fmt.Fprintf(os.Stderr, "  --subnet-prefix-v6 int\n")
+		fmt.Fprintf(os.Stderr, "    \tPrefix length of IPv6 client subnets, for subnet rate limits and RRL (default 56)\n")
+		fmt.Fprintf(os.Stderr, "  --transfer-rate-limit float\n")
+		fmt.Fprintf(os.Stderr, "    \tStart and data records per second allowed per transfer (0 for no limit)\n")
+		fmt.Fprintf(os.Stderr, "  --transfer-burst int\n")
+		fmt.Fprintf(os.Stderr, "    \tRecords a transfer may send at once (default: one second's worth)\n")
+		fmt.Fprintf(os.Stderr, "  --rate-limit-action string\n")
+		fmt.Fprintf(os.Stderr, "    \tWhat to do with a query over a rate limit: drop, refuse or truncate (default \"drop\")\n")
+		fmt.Fprintf(os.Stderr, "  --rrl-responses-per-second int\n")
+		fmt.Fprintf(os.Stderr, "    \tResponse rate limiting: answers per second to one client subnet and domain (0 disables RRL)\n")
+		fmt.Fprintf(os.Stderr, "  --rrl-nxdomains-per-second int\n")
+		fmt.Fprintf(os.Stderr, "    \tNXDOMAIN responses per second to one client subnet and domain (default: --rrl-responses-per-second)\n")
+		fmt.Fprintf(os.Stderr, "  --rrl-errors-per-second int\n")
+		fmt.Fprintf(os.Stderr, "    \tError responses per second to one client subnet (default: --rrl-responses-per-second)\n")
+		fmt.Fprintf(os.Stderr, "  --rrl-window int\n")
+		fmt.Fprintf(os.Stderr, "    \tSeconds of excess responses RRL remembers (default 15)\n")
+		fmt.Fprintf(os.Stderr, "  --rrl-slip int\n")
+		fmt.Fprintf(os.Stderr, "    \tSend every Nth limited response truncated instead of dropping it (0 never) (default 2)\n")
+		fmt.Fprintf(os.Stderr, "  --rrl-log-only\n")
+		fmt.Fprintf(os.Stderr, "    \tLog and count responses RRL would limit, but send them\n")
+		fmt.Fprintf(os.Stderr, "  --dns-allow [feature=]CIDR[,CIDR...]\n")
+		fmt.Fprintf(os.Stderr, "    \tOnly allow these clients to use a DNS feature: all, transfer, scripts, outbox, agents or zone (default all); repeatable\n")
+		fmt.Fprintf(os.Stderr, "  --dns-deny [feature=]CIDR[,CIDR...]\n")
+		fmt.Fprintf(os.Stderr, "    \tRefuse a DNS feature to these clients (default feature all); repeatable, wins over --dns-allow\n")
+		fmt.Fprintf(os.Stderr, "  --web-allow CIDR[,CIDR...]\n")
+		fmt.Fprintf(os.Stderr, "    \tOnly allow these clients to use the web dashboard and API\n")
+		fmt.Fprintf(os.Stderr, "  --web-deny CIDR[,CIDR...]\n")
+		fmt.Fprintf(os.Stderr, "    \tDeny these clients the web dashboard and API; wins over --web-allow\n")
+		fmt.Fprintf(os.Stderr, "  --audit-log string\n")
+		fmt.Fprintf(os.Stderr, "    \tAppend denied DNS queries and web requests to this file as JSON lines\n")
+		fmt.Fprintf(os.Stderr, "  --web-auth-config string\n")
+		fmt.Fprintf(os.Stderr, "    \tJSON file of dashboard users (bcrypt hashes) and API tokens (SHA-256 hashes); the API requires a login or token when set\n")
+		fmt.Fprintf(os.Stderr, "  --web-session-ttl duration\n")
+		fmt.Fprintf(os.Stderr, "    \tHow long a dashboard login lasts (default 12h0m0s)\n")
+		fmt.Fprintf(os.Stderr, "  --web-cors-origin string\n")
+		fmt.Fprintf(os.Stderr, "    \tComma-separated origins allowed to call the API from other sites, * for any (default: none)\n")
+		fmt.Fprintf(os.Stderr, "  --web-tls-cert string\n")
+		fmt.Fprintf(os.Stderr, "    \tPEM certificate for serving the dashboard over HTTPS\n")
+		fmt.Fprintf(os.Stderr, "  --web-tls-key string\n")
+		fmt.Fprintf(os.Stderr, "    \tPEM private key of --web-tls-cert\n")
+		fmt.Fprintf(os.Stderr, "  --web-tls-self-signed\n")
+		fmt.Fprintf(os.Stderr, "    \tServe HTTPS with a self-signed certificate, generated into --web-tls-cert/--web-tls-key (default youkaidns-web.crt/.key) and reused\n")
+		fmt.Fprintf(os.Stderr, "  --web-http-redirect-port int\n")
+		fmt.Fprintf(os.Stderr, "    \tAlso listen for plain HTTP on this port and redirect to HTTPS (0 disables)\n")
+		fmt.Fprintf(os.Stderr, "  --hash-password\n")
+		fmt.Fprintf(os.Stderr, "    \tRead a password from standard input, print its bcrypt hash for --web-auth-config and exit\n")
 	}
 
 	// Parse command-line flags
 	verbose := flag.Bool("verbose", false, "Show all DNS logs")
 	webListenIP := flag.String("web-listen", "localhost", "IP address to listen on for web dashboard (default: localhost)")
-	domain := flag.String("domain", "", "Domain suffix for dynamic records (e.g., example.com)")
+	domain := flag.String("domain", "", "Domain suffix for dynamic records (e.g., example.com); comma-separate to serve several, the first is primary")
+	domainConfig := flag.String("domain-config", "", "JSON file of served domains with their own output directories, keys, payloads and quotas")
 	outputDir := flag.String("output-dir", "received_files", "Directory to save received files")
+	outboxDir := flag.String("outbox-dir", "", "Directory whose files clients can download over DNS (disabled if empty)")
+	outboxMaxUpload := flag.Int64("outbox-max-upload", server.DefaultOutboxUploadLimit, "Largest file in bytes that can be uploaded to the outbox through the API")
+	payloadDir := flag.String("payload-dir", "", "Directory of extra payloads to serve via <name>.script queries")
+	scriptChunkSize := flag.Int("script-chunk-size", 100, "Default chunk size baked into served transfer scripts")
+	scriptParallel := flag.Int("script-parallel", 20, "Default parallel queries baked into served transfer scripts")
+	scriptDNSServer := flag.String("script-dns-server", "", "DNS server baked into served transfer scripts (default: the client's resolver)")
+	collision := flag.String("collision", "suffix", "What to do when a received filename already exists: overwrite, suffix, timestamp or hash-prefix")
+	transferTimeout := flag.Duration("transfer-timeout", 10*time.Minute, "Fail incomplete transfers after this long without activity")
+	psk := flag.String("psk", "", "Pre-shared passphrase for decrypting encrypted transfers (prefer --psk-file or YOUKAIDNS_PSK)")
+	pskFile := flag.String("psk-file", "", "Read the pre-shared passphrase from a file")
+	authSecret := flag.String("auth-secret", "", "Shared secret for HMAC-tagged records; untagged records are dropped when set (prefer --auth-secret-file or YOUKAIDNS_AUTH_SECRET)")
+	authSecretFile := flag.String("auth-secret-file", "", "Read the record authentication secret from a file")
+	rateLimit := flag.Float64("rate-limit", 0, "Queries per second allowed per client IP (0 for no limit)")
+	rateBurst := flag.Int("rate-burst", 0, "Queries a client IP may send at once (default: one second's worth)")
+	subnetRateLimit := flag.Float64("subnet-rate-limit", 0, "Queries per second allowed per client subnet (0 for no limit)")
+	subnetBurst := flag.Int("subnet-burst", 0, "Queries a client subnet may send at once (default: one second's worth)")
+	subnetPrefix := flag.Int("subnet-prefix", 24, "Prefix length of IPv4 client subnets, for subnet rate limits and RRL")
+	subnetPrefixV6 := flag.Int("subnet-prefix-v6", 56, "Prefix length of IPv6 client subnets, for subnet rate limits and RRL")
+	transferRateLimit := flag.Float64("transfer-rate-limit", 0, "Start and data records per second allowed per transfer (0 for no limit)")
+	transferBurst := flag.Int("transfer-burst", 0, "Records a transfer may send at once (default: one second's worth)")
+	rateLimitAction := flag.String("rate-limit-action", "drop", "What to do with a query over a rate limit: drop, refuse or truncate")
+	rrlResponses := flag.Int("rrl-responses-per-second", 0, "Response rate limiting: answers per second to one client subnet and domain (0 disables RRL)")
+	rrlNXDomains := flag.Int("rrl-nxdomains-per-second", 0, "NXDOMAIN responses per second to one client subnet and domain (default: --rrl-responses-per-second)")
+	rrlErrors := flag.Int("rrl-errors-per-second", 0, "Error responses per second to one client subnet (default: --rrl-responses-per-second)")
+	rrlWindow := flag.Int("rrl-window", 15, "Seconds of excess responses RRL remembers")
+	rrlSlip := flag.Int("rrl-slip", 2, "Send every Nth limited response truncated instead of dropping it (0 never)")
+	rrlLogOnly := flag.Bool("rrl-log-only", false, "Log and count responses RRL would limit, but send them")
+	var dnsAllow, dnsDeny listFlag
+	flag.Var(&dnsAllow, "dns-allow", "Only allow these clients to use a DNS feature, as [feature=]CIDR[,CIDR...]; repeatable")
+	flag.Var(&dnsDeny, "dns-deny", "Refuse a DNS feature to these clients, as [feature=]CIDR[,CIDR...]; repeatable")
+	webAllow := flag.String("web-allow", "", "Only allow these clients (comma-separated CIDRs or IPs) to use the web dashboard and API")
+	webDeny := flag.String("web-deny", "", "Deny these clients (comma-separated CIDRs or IPs) the web dashboard and API")
+	auditLog := flag.String("audit-log", "", "Append denied DNS queries and web requests to this file as JSON lines")
+	webAuthConfig := flag.String("web-auth-config", "", "JSON file of dashboard users (bcrypt hashes) and API tokens (SHA-256 hashes); the API requires a login or token when set")
+	webSessionTTL := flag.Duration("web-session-ttl", web.DefaultSessionTTL, "How long a dashboard login lasts")
+	webCORSOrigin := flag.String("web-cors-origin", "", "Comma-separated origins allowed to call the API from other sites, * for any (default: none)")
+	webTLSCert := flag.String("web-tls-cert", "", "PEM certificate for serving the dashboard over HTTPS")
+	webTLSKey := flag.String("web-tls-key", "", "PEM private key of --web-tls-cert")
+	webTLSSelfSigned := flag.Bool("web-tls-self-signed", false, "Serve HTTPS with a self-signed certificate, generated into --web-tls-cert/--web-tls-key (default youkaidns-web.crt/.key) and reused")
+	webRedirectPort := flag.Int("web-http-redirect-port", 0, "Also listen for plain HTTP on this port and redirect to HTTPS (0 disables)")
+	hashPassword := flag.Bool("hash-password", false, "Read a password from standard input, print its bcrypt hash for --web-auth-config and exit")
 	flag.Parse()
 
+	if *hashPassword {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && password == "" {
+			log.Fatalf("Failed to read password: %v", err)
+		}
+		hash, err := web.HashPassword(strings.TrimRight(password, "\r\n"))
+		if err != nil {
+			log.Fatalf("Failed to hash password: %v", err)
+		}
+		fmt.Println(hash)
+		return
+	}
+
+	collisionPolicy, err := server.ParseCollisionPolicy(*collision)
+	if err != nil {
+		log.Fatalf("Invalid --collision: %v", err)
+	}
+
+	if *outboxMaxUpload <= 0 {
+		log.Fatalf("Invalid --outbox-max-upload: %d (must be positive)", *outboxMaxUpload)
+	}
+
+	if *transferTimeout <= 0 {
+		log.Fatalf("Invalid --transfer-timeout: %v (must be positive)", *transferTimeout)
+	}
+
+	throttleAction, err := server.ParseRateLimitAction(*rateLimitAction)
+	if err != nil {
+		log.Fatalf("Invalid --rate-limit-action: %v", err)
+	}
+
+	dnsACLs, err := parseDNSACLs(dnsAllow, dnsDeny)
+	if err != nil {
+		log.Fatalf("Invalid --dns-allow/--dns-deny: %v", err)
+	}
+	var webACL *server.ACL
+	if *webAllow != "" || *webDeny != "" {
+		webACL, err = server.ParseACL(strings.Split(*webAllow, ","), strings.Split(*webDeny, ","))
+		if err != nil {
+			log.Fatalf("Invalid --web-allow/--web-deny: %v", err)
+		}
+	}
+	var webAuth *web.Auth
+	if *webAuthConfig != "" {
+		authConfig, err := config.LoadAuth(*webAuthConfig)
+		if err != nil {
+			log.Fatalf("Failed to load --web-auth-config: %v", err)
+		}
+		webAuth, err = web.NewAuth(authConfig, *webSessionTTL)
+		if err != nil {
+			log.Fatalf("Invalid --web-auth-config: %v", err)
+		}
+	}
+	var corsOrigins []string
+	for _, origin := range strings.Split(*webCORSOrigin, ",") {
+		if origin = strings.TrimRight(strings.TrimSpace(origin), "/"); origin != "" {
+			corsOrigins = append(corsOrigins, origin)
+		}
+	}
+	audit := server.NewAuditLog()
+	if *auditLog != "" {
+		audit, err = server.OpenAuditLog(*auditLog)
+		if err != nil {
+			log.Fatalf("Failed to open --audit-log: %v", err)
+		}
+	}
+
+	passphrase, err := readSecret(*psk, *pskFile, "YOUKAIDNS_PSK")
+	if err != nil {
+		log.Fatalf("Failed to read --psk-file: %v", err)
+	}
+	recordSecret, err := readSecret(*authSecret, *authSecretFile, "YOUKAIDNS_AUTH_SECRET")
+	if err != nil {
+		log.Fatalf("Failed to read --auth-secret-file: %v", err)
+	}
+
+	var domainConfigs []config.DomainConfig
+	if *domainConfig != "" {
+		domainConfigs, err = config.LoadDomains(*domainConfig)
+		if err != nil {
+			log.Fatalf("Failed to load --domain-config: %v", err)
+		}
+	}
+
 	cfg := config.DefaultConfig()
 
 	// Initialize statistics
 	statsCollector := stats.NewStats()
 
-	// Initialize DNS server with verbose flag, domain, and output directory
-	dnsServer := server.NewServer(cfg.DNSPort, statsCollector, *verbose, *domain, *outputDir)
+	// Initialize DNS server with verbose flag, primary domain, and output directory.
+	// Further domains save under <output-dir>/<domain> unless configured otherwise.
+	domainNames := strings.Split(*domain, ",")
+	primaryDomain := strings.TrimSpace(domainNames[0])
+	dnsServer := server.NewServer(cfg.DNSPort, statsCollector, *verbose, primaryDomain, *outputDir)
+	for _, name := range domainNames[1:] {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if err := dnsServer.AddDomain(server.DomainConfig{Name: name, OutputDir: filepath.Join(*outputDir, name)}); err != nil {
+			log.Fatalf("Failed to add domain: %v", err)
+		}
+	}
+	for _, d := range domainConfigs {
+		domainPassphrase, err := readSecret(d.PSK, d.PSKFile, "")
+		if err != nil {
+			log.Fatalf("Failed to read psk_file of domain %s: %v", d.Name, err)
+		}
+		domainOutputDir := d.OutputDir
+		if domainOutputDir == "" {
+			domainOutputDir = filepath.Join(*outputDir, d.Name)
+			if strings.EqualFold(d.Name, primaryDomain) {
+				domainOutputDir = *outputDir
+			}
+		}
+		err = dnsServer.AddDomain(server.DomainConfig{
+			Name:           d.Name,
+			OutputDir:      domainOutputDir,
+			Passphrase:     domainPassphrase,
+			MaxFileSize:    d.MaxFileSize,
+			MaxStoredBytes: d.MaxStoredBytes,
+			MaxTransfers:   d.MaxTransfers,
+		})
+		if err != nil {
+			log.Fatalf("Failed to add domain: %v", err)
+		}
+	}
+	dnsServer.SetCollisionPolicy(collisionPolicy)
+	dnsServer.SetOutboxDir(*outboxDir)
+	dnsServer.SetOutboxUploadLimit(*outboxMaxUpload)
+
+	// Built-in scripts first, so files in --payload-dir can replace them
+	dnsServer.SetScriptDefaults(server.ScriptDefaults{
+		ChunkSize:   *scriptChunkSize,
+		DNSServer:   *scriptDNSServer,
+		MaxParallel: *scriptParallel,
+	})
+	dnsServer.RegisterScript("linux", linuxScript, server.PlatformBash)
+	dnsServer.RegisterScript("windows", windowsScript, server.PlatformPowerShell)
+	if *payloadDir != "" {
+		if err := dnsServer.LoadPayloadDir(*payloadDir); err != nil {
+			log.Fatalf("Failed to load --payload-dir: %v", err)
+		}
+	}
+	for _, d := range domainConfigs {
+		if d.PayloadDir == "" {
+			continue
+		}
+		if err := dnsServer.LoadDomainPayloadDir(d.Name, d.PayloadDir); err != nil {
+			log.Fatalf("Failed to load payload_dir of domain %s: %v", d.Name, err)
+		}
+	}
+	dnsServer.SetTransferTimeout(*transferTimeout)
+	dnsServer.SetEncryptionKey(passphrase)
+	dnsServer.SetAuthSecret(recordSecret)
+	dnsServer.SetRateLimits(server.RateLimits{
+		ClientRate:     *rateLimit,
+		ClientBurst:    *rateBurst,
+		SubnetRate:     *subnetRateLimit,
+		SubnetBurst:    *subnetBurst,
+		SubnetPrefixV4: *subnetPrefix,
+		SubnetPrefixV6: *subnetPrefixV6,
+		TransferRate:   *transferRateLimit,
+		TransferBurst:  *transferBurst,
+		Action:         throttleAction,
+	})
+	dnsServer.SetRRL(server.RRLConfig{
+		ResponsesPerSecond: *rrlResponses,
+		NXDomainsPerSecond: *rrlNXDomains,
+		ErrorsPerSecond:    *rrlErrors,
+		Window:             *rrlWindow,
+		Slip:               *rrlSlip,
+		PrefixV4:           *subnetPrefix,
+		PrefixV6:           *subnetPrefixV6,
+		LogOnly:            *rrlLogOnly,
+	})
+	for feature, acl := range dnsACLs {
+		dnsServer.SetACL(feature, acl)
+	}
+	dnsServer.SetAuditLog(audit)
 
 	// Initialize web dashboard with listen IP
 	webServer := web.NewServer(cfg.WebPort, statsCollector, *webListenIP, dnsServer)
+	webServer.SetACL(webACL, audit)
+	webServer.SetAuth(webAuth)
+	webServer.SetCORS(corsOrigins)
+	if *webTLSCert != "" || *webTLSKey != "" || *webTLSSelfSigned {
+		err := webServer.SetTLS(web.TLSConfig{
+			CertFile:     *webTLSCert,
+			KeyFile:      *webTLSKey,
+			SelfSigned:   *webTLSSelfSigned,
+			RedirectPort: *webRedirectPort,
+		})
+		if err != nil {
+			log.Fatalf("Failed to set up web TLS: %v", err)
+		}
+	} else if *webRedirectPort > 0 {
+		log.Fatalf("--web-http-redirect-port needs --web-tls-cert/--web-tls-key or --web-tls-self-signed")
+	}
 
 	// Start DNS server
 	if err := dnsServer.Start(); err != nil {
@@ -59,14 +385,66 @@ func main() {
 
 	log.Println("YoukaiDNS server started")
 	log.Printf("DNS server: UDP port %d", cfg.DNSPort)
-	if *domain != "" {
-		log.Printf("Dynamic records domain: %s", *domain)
+	for _, d := range dnsServer.GetDomains() {
+		name := d.Name
+		if name == "" {
+			name = "(any)"
+		}
+		log.Printf("Domain: %s -> %s", name, d.OutputDir)
+	}
+	if *outboxDir != "" {
+		log.Printf("Outbox directory: %s", *outboxDir)
+	}
+	log.Printf("Payloads: %s", strings.Join(dnsServer.PayloadNames(), ", "))
+	if passphrase != "" {
+		log.Printf("Encrypted transfers: enabled (pre-shared key)")
+	}
+	if recordSecret != "" {
+		log.Printf("Record authentication: required (untagged records are dropped)")
+	}
+	if *rateLimit > 0 || *subnetRateLimit > 0 || *transferRateLimit > 0 {
+		log.Printf("Rate limits: %g/s per client, %g/s per subnet, %g/s per transfer (0 = none), over the limit: %s", *rateLimit, *subnetRateLimit, *transferRateLimit, throttleAction)
+	}
+	if *rrlResponses > 0 {
+		mode := "enforced"
+		if *rrlLogOnly {
+			mode = "log only"
+		}
+		log.Printf("Response rate limiting: %d responses/s per client subnet, slip %d (%s)", *rrlResponses, *rrlSlip, mode)
+	}
+	if len(dnsACLs) > 0 {
+		features := make([]string, 0, len(dnsACLs))
+		for feature := range dnsACLs {
+			features = append(features, string(feature))
+		}
+		sort.Strings(features)
+		log.Printf("DNS access control: %s", strings.Join(features, ", "))
+	}
+	if webACL != nil {
+		log.Printf("Web access control: allow %q, deny %q", *webAllow, *webDeny)
+	}
+	if *auditLog != "" {
+		log.Printf("Audit log: %s", *auditLog)
+	}
+	if webAuth != nil {
+		log.Printf("Web authentication: required (%s)", *webAuthConfig)
+	} else if *webListenIP != "localhost" && *webListenIP != "127.0.0.1" {
+		log.Printf("Warning: The web dashboard on %s has no authentication; anyone who can reach it can download received files (see --web-auth-config)", *webListenIP)
+	}
+	if webAuth != nil && !webServer.TLSEnabled() && *webListenIP != "localhost" && *webListenIP != "127.0.0.1" {
+		log.Printf("Warning: Dashboard passwords and sessions cross the network in cleartext (see --web-tls-cert or --web-tls-self-signed)")
+	}
+	if len(corsOrigins) > 0 {
+		log.Printf("Web CORS origins: %s", strings.Join(corsOrigins, ", "))
+	}
+	scheme := "http"
+	if webServer.TLSEnabled() {
+		scheme = "https"
 	}
-	log.Printf("Output directory: %s", *outputDir)
 	if *webListenIP == "localhost" || *webListenIP == "127.0.0.1" {
-		log.Printf("Web dashboard: http://localhost:%d", cfg.WebPort)
+		log.Printf("Web dashboard: %s://localhost:%d", scheme, cfg.WebPort)
 	} else {
-		log.Printf("Web dashboard: http://%s:%d", *webListenIP, cfg.WebPort)
+		log.Printf("Web dashboard: %s://%s:%d", scheme, *webListenIP, cfg.WebPort)
 	}
 
 	// Wait for interrupt signal
@@ -76,5 +454,72 @@ func main() {
 
 	log.Println("Shutting down...")
 	dnsServer.Stop()
+	if err := audit.Close(); err != nil {
+		log.Printf("Error closing audit log: %v", err)
+	}
 	log.Println("Server stopped")
 }
+
+// readSecret returns a secret from a file, a flag or an environment variable,
+// in that order of precedence (no environment variable if env is empty)
+func readSecret(value string, file string, env string) (string, error) {
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	if value != "" || env == "" {
+		return value, nil
+	}
+	return os.Getenv(env), nil
+}
+
+// listFlag is a flag that can be given more than once
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, " ") }
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// parseDNSACLs builds the per-feature DNS ACLs from --dns-allow and
+// --dns-deny entries of the form [feature=]CIDR[,CIDR...]
+func parseDNSACLs(allow []string, deny []string) (map[server.Feature]*server.ACL, error) {
+	allowed := make(map[server.Feature][]string)
+	denied := make(map[server.Feature][]string)
+	for _, list := range []struct {
+		entries []string
+		cidrs   map[server.Feature][]string
+	}{{allow, allowed}, {deny, denied}} {
+		for _, entry := range list.entries {
+			feature := server.FeatureAll
+			if name, cidrs, ok := strings.Cut(entry, "="); ok {
+				var err error
+				if feature, err = server.ParseFeature(strings.TrimSpace(name)); err != nil {
+					return nil, err
+				}
+				entry = cidrs
+			}
+			list.cidrs[feature] = append(list.cidrs[feature], strings.Split(entry, ",")...)
+		}
+	}
+
+	acls := make(map[server.Feature]*server.ACL)
+	for _, cidrs := range []map[server.Feature][]string{allowed, denied} {
+		for feature := range cidrs {
+			if acls[feature] != nil {
+				continue
+			}
+			acl, err := server.ParseACL(allowed[feature], denied[feature])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", feature, err)
+			}
+			acls[feature] = acl
+		}
+	}
+	return acls, nil
+}
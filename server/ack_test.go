@@ -0,0 +1,37 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"youkaidns/dns"
+)
+
+func TestTransferAcks(t *testing.T) {
+	s := newTestServer(t)
+	tr := testTransfer{Name: "acked.txt", File: []byte(strings.Repeat("0123456789", 12))} // 4 parts of 30 bytes
+
+	steps := []struct {
+		record string
+		want   string
+	}{
+		{tr.dataRecord(s, 2), "OK 0 -1"}, // Before the start record
+		{tr.startRecord(s), "OK 0 3"},
+		{tr.dataRecord(s, 3), "OK 0 2"},
+		{tr.dataRecord(s, 1), "OK 3 1"}, // Fills the gap up to 3
+		{tr.dataRecord(s, 3), "OK 3 1"}, // Duplicate
+		{tr.dataRecord(s, 4), "OK 4 0"},
+	}
+	for i, step := range steps {
+		w := serveQuery(s, step.record, dns.TypeTXT)
+		if len(w.answers) != 1 {
+			t.Fatalf("step %d: %d answers", i, len(w.answers))
+		}
+		if got := strings.Join(txtStrings(w.answers[0].Data), ""); got != step.want {
+			t.Errorf("step %d: ack %q, want %q", i, got, step.want)
+		}
+	}
+	if assembly := waitFinished(t, s, tr.hash8()); !assembly.Verified {
+		t.Fatalf("transfer failed: %s", assembly.FailReason)
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"youkaidns/dns"
+)
+
+// Feature is a group of DNS queries an ACL can restrict
+type Feature string
+
+// DNS features
+const (
+	FeatureAll      Feature = "all"      // Every query
+	FeatureTransfer Feature = "transfer" // Start, data, missing-chunk and probe queries
+	FeatureScripts  Feature = "scripts"  // Payload (script) queries
+	FeatureOutbox   Feature = "outbox"   // Outbox downloads
+	FeatureAgents   Feature = "agents"   // Agent polls and task chunks
+	FeatureZone     Feature = "zone"     // Zone records
+)
+
+// ParseFeature parses a DNS feature name
+func ParseFeature(name string) (Feature, error) {
+	switch feature := Feature(strings.ToLower(name)); feature {
+	case FeatureAll, FeatureTransfer, FeatureScripts, FeatureOutbox, FeatureAgents, FeatureZone:
+		return feature, nil
+	default:
+		return "", fmt.Errorf("unknown feature %q (want all, transfer, scripts, outbox, agents or zone)", name)
+	}
+}
+
+// ACL allows or denies client addresses by CIDR. Deny entries win over allow
+// entries; without allow entries every address that isn't denied is allowed.
+// A nil ACL allows everything.
+type ACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// ParseACL builds an ACL from CIDRs or single IP addresses
+func ParseACL(allow []string, deny []string) (*ACL, error) {
+	acl := &ACL{}
+	var err error
+	if acl.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if acl.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// parseCIDRs parses CIDRs, taking a single IP address as a /32 or /128
+func parseCIDRs(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", entry)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// Permits reports whether the ACL lets ip through
+func (a *ACL) Permits(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetACL restricts a DNS feature to the clients acl permits (nil removes the
+// restriction). FeatureAll applies to every feature, on top of the feature's
+// own ACL. It must be called before Start.
+func (s *Server) SetACL(feature Feature, acl *ACL) {
+	if acl == nil {
+		delete(s.acls, feature)
+		return
+	}
+	s.acls[feature] = acl
+}
+
+// permits reports whether a client may use a DNS feature
+func (s *Server) permits(feature Feature, ip net.IP) bool {
+	return s.acls[FeatureAll].Permits(ip) && s.acls[feature].Permits(ip)
+}
+
+// queryFeature returns the feature a query is for, judging by its labels the
+// way the built-in handlers match them
+func queryFeature(q *Query) Feature {
+	parts := q.Labels
+	if q.Domain == nil || len(parts) < 2 {
+		return FeatureZone
+	}
+	last := parts[len(parts)-1]
+	switch {
+	case last == "script":
+		return FeatureScripts
+	case last == "get":
+		return FeatureOutbox
+	case last == "probe":
+		return FeatureTransfer
+	case len(parts) >= 3 && (parts[len(parts)-2] == "poll" || parts[len(parts)-2] == "task"):
+		return FeatureAgents
+	}
+	if _, err := hex.DecodeString(last); err == nil && len(last) == 8 {
+		return FeatureTransfer // Start, data and missing-chunk records end in the hash8
+	}
+	return FeatureZone
+}
+
+// restrictTo limits a query handler to the clients permitted to use feature.
+// For other clients the handler is skipped; if the query is for that feature
+// and no other handler claims it, it is refused (see refuseDenied).
+func (s *Server) restrictTo(feature Feature, h Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, w ResponseWriter, q *dns.Message) {
+		query := QueryFromContext(ctx)
+		if query != nil && !s.permits(feature, query.ClientIP) {
+			if queryFeature(query) == feature {
+				query.denied = feature
+			}
+			return
+		}
+		h.ServeDNS(ctx, w, q)
+	})
+}
+
+// refuseDenied refuses a query whose feature is denied to its client and
+// records it in the audit log
+func (s *Server) refuseDenied(w ResponseWriter, query *Query) {
+	w.SetRcode(dns.RcodeRefused)
+	s.auditLog.Record(AuditEvent{
+		Source:  query.ClientIP.String(),
+		Service: "dns",
+		Feature: string(query.denied),
+		Target:  query.Name,
+		Reason:  "denied by ACL",
+	})
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"youkaidns/dns"
+)
+
+func TestACLPermits(t *testing.T) {
+	tests := []struct {
+		name        string
+		allow, deny []string
+		ip          string
+		want        bool
+	}{
+		{"no entries", nil, nil, "192.0.2.1", true},
+		{"allowed", []string{"192.0.2.0/24"}, nil, "192.0.2.1", true},
+		{"not allowed", []string{"192.0.2.0/24"}, nil, "198.51.100.1", false},
+		{"denied", nil, []string{"192.0.2.0/24"}, "192.0.2.1", false},
+		{"not denied", nil, []string{"192.0.2.0/24"}, "198.51.100.1", true},
+		{"deny wins", []string{"192.0.2.0/24"}, []string{"192.0.2.1"}, "192.0.2.1", false},
+		{"single address", []string{"192.0.2.1"}, nil, "192.0.2.2", false},
+		{"IPv6", []string{"2001:db8::/32"}, nil, "2001:db8::1", true},
+		{"IPv4 in IPv6 form", []string{"192.0.2.0/24"}, nil, "::ffff:192.0.2.1", true},
+		{"blank entries skipped", []string{" ", ""}, nil, "192.0.2.1", true},
+	}
+	for _, tt := range tests {
+		acl, err := ParseACL(tt.allow, tt.deny)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := acl.Permits(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("%s: Permits(%s) = %v, want %v", tt.name, tt.ip, got, tt.want)
+		}
+	}
+
+	if !(*ACL)(nil).Permits(net.ParseIP("192.0.2.1")) {
+		t.Error("nil ACL denies")
+	}
+	for _, bad := range []string{"192.0.2.300", "192.0.2.0/33", "example.com"} {
+		if _, err := ParseACL([]string{bad}, nil); err == nil {
+			t.Errorf("ParseACL(%q) accepted", bad)
+		}
+	}
+}
+
+func TestQueryFeature(t *testing.T) {
+	s := newTestServer(t)
+	tests := []struct {
+		name string
+		want Feature
+	}{
+		{"linux.script." + testDomain, FeatureScripts},
+		{"list.get." + testDomain, FeatureOutbox},
+		{"123.probe." + testDomain, FeatureTransfer},
+		{"1.poll.web01." + testDomain, FeatureAgents},
+		{"1.2.task.web01." + testDomain, FeatureAgents},
+		{"666f6f.1.0123abcd." + testDomain, FeatureTransfer},
+		{"www." + testDomain, FeatureZone},
+		{testDomain, FeatureZone},
+		{"linux.script.example.org", FeatureZone},
+	}
+	for _, tt := range tests {
+		q := s.newQuery(dns.Question{Name: tt.name, Type: dns.TypeTXT, Class: 1}, testClient.IP)
+		if got := queryFeature(q); got != tt.want {
+			t.Errorf("%s: feature %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := ParseFeature("Scripts"); err != nil {
+		t.Error(err)
+	}
+	if _, err := ParseFeature("files"); err == nil {
+		t.Error("unknown feature parsed")
+	}
+}
+
+func TestDNSACL(t *testing.T) {
+	s := newTestServer(t)
+	s.RegisterPayload("tool", []byte("payload"), PlatformBash)
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := OpenAuditLog(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetAuditLog(audit)
+
+	denied, _ := ParseACL(nil, []string{testClient.IP.String()})
+	s.SetACL(FeatureScripts, denied)
+	allowed := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 53}
+
+	// The denied client is refused; others are served
+	if w := serveQuery(s, "tool.script."+testDomain, dns.TypeTXT); w.rcode != dns.RcodeRefused || len(w.answers) != 0 {
+		t.Fatalf("denied client: rcode %d, %d answers", w.rcode, len(w.answers))
+	}
+	if w := serveQueryFrom(s, allowed, "tool.script."+testDomain, dns.TypeTXT); len(w.answers) == 0 {
+		t.Fatal("allowed client not served")
+	}
+
+	// Other features stay open to the denied client
+	if w := serveQuery(s, "123.probe."+testDomain, dns.TypeTXT); len(w.answers) == 0 {
+		t.Fatal("probe refused by the scripts ACL")
+	}
+
+	// FeatureAll applies on top of every feature
+	s.SetACL(FeatureAll, denied)
+	if w := serveQuery(s, "123.probe."+testDomain, dns.TypeTXT); w.rcode != dns.RcodeRefused {
+		t.Fatalf("probe rcode %d under the all ACL", w.rcode)
+	}
+	s.SetACL(FeatureAll, nil)
+	s.SetACL(FeatureScripts, nil)
+	if w := serveQuery(s, "tool.script."+testDomain, dns.TypeTXT); len(w.answers) == 0 {
+		t.Fatal("client refused after the ACL was removed")
+	}
+
+	if err := audit.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var events []AuditEvent
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	// The second denial in the interval is summed up on Close
+	if len(events) != 2 || events[0].Source != testClient.IP.String() || events[0].Service != "dns" ||
+		events[0].Feature != string(FeatureScripts) || events[0].Target != "tool.script."+testDomain || events[1].Suppressed != 1 {
+		t.Fatalf("audit events %+v", events)
+	}
+}
+
+func TestDNSACLWildcardZone(t *testing.T) {
+	s := newTestServer(t)
+	s.RegisterPayload("tool", []byte("payload"), PlatformBash)
+	s.AddRecord("*", dns.TypeTXT, []string{"wildcard"})
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := OpenAuditLog(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetAuditLog(audit)
+	denied, _ := ParseACL(nil, []string{testClient.IP.String()})
+	s.SetACL(FeatureScripts, denied)
+
+	// The wildcard record doesn't answer a question refused by the ACL
+	if w := serveQuery(s, "tool.script."+testDomain, dns.TypeTXT); w.rcode != dns.RcodeRefused || len(w.answers) != 0 {
+		t.Fatalf("denied script query: rcode %d, %d answers", w.rcode, len(w.answers))
+	}
+
+	// It still answers the client's zone queries
+	if w := serveQuery(s, "www."+testDomain, dns.TypeTXT); w.rcode == dns.RcodeRefused || len(w.answers) != 1 {
+		t.Fatalf("zone query: rcode %d, %d answers", w.rcode, len(w.answers))
+	}
+
+	if err := audit.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event AuditEvent
+	if err := json.Unmarshal(bytes.TrimSpace(data), &event); err != nil || event.Target != "tool.script."+testDomain {
+		t.Fatalf("audit log %q (%v)", data, err)
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"youkaidns/dns"
+)
+
+// Address answers carry acknowledgements and missing-chunk lists in A and
+// AAAA records, for resolvers that only forward those query types or strip
+// TXT answers. An answer is a list of 24-bit values: each A record holds one
+// value and each AAAA record five, after a leading index octet
+// (addressIndexBase + record number) that restores the order resolvers may
+// shuffle. Unused AAAA values are zero.
+//
+//	ack:     <contiguous> <outstanding>
+//	missing: <total_parts> <missing_count> <next> <first> <last> [<first> <last> ...]
+//
+// addressUnknown stands in for an unknown value (the -1 of the TXT forms).
+const (
+	addressIndexBase  = 32       // Keeps addresses clear of 0/8, 10/8 and 127/8
+	addressUnknown    = 0xFFFFFF // Largest 24-bit value
+	maxAddressRecords = 64       // Index octets stay below 100/8
+)
+
+// isAddressType reports whether a query type gets address answers
+func isAddressType(queryType uint16) bool {
+	return queryType == dns.TypeA || queryType == dns.TypeAAAA
+}
+
+// addressValuesPerRecord returns how many 24-bit values one record holds
+func addressValuesPerRecord(queryType uint16) int {
+	if queryType == dns.TypeAAAA {
+		return 5
+	}
+	return 1
+}
+
+// addressCapacity returns how many values fit in a response of
+// maxResponseSize bytes; answer names are compressed to a pointer to the
+// question
+func addressCapacity(queryDomain string, queryType uint16) int {
+	rdata := 4
+	if queryType == dns.TypeAAAA {
+		rdata = 16
+	}
+	records := (maxResponseSize - 12 - (len(queryDomain) + 2 + 4)) / (2 + 10 + rdata)
+	if records > maxAddressRecords {
+		records = maxAddressRecords
+	}
+	return records * addressValuesPerRecord(queryType)
+}
+
+// addressRecords encodes values as A or AAAA records
+func addressRecords(queryDomain string, queryType uint16, values []int) []dns.ResourceRecord {
+	perRecord := addressValuesPerRecord(queryType)
+	var rrs []dns.ResourceRecord
+
+	for i := 0; i*perRecord < len(values); i++ {
+		data := []byte{byte(addressIndexBase + i)} // 1 + 3 or 1 + 5*3 bytes
+		for j := 0; j < perRecord; j++ {
+			value := 0
+			if k := i*perRecord + j; k < len(values) {
+				value = values[k]
+			}
+			if value < 0 || value > addressUnknown {
+				value = addressUnknown
+			}
+			data = append(data, byte(value>>16), byte(value>>8), byte(value))
+		}
+
+		rrs = append(rrs, dns.ResourceRecord{
+			Name:    queryDomain,
+			Type:    queryType,
+			Class:   1, // IN
+			TTL:     0, // TTL=0 to prevent caching
+			Data:    data,
+			DataLen: uint16(len(data)),
+		})
+	}
+
+	return rrs
+}
+
+// addressAck returns the acknowledgement of a start or data record as
+// address records (see transferAck)
+func (s *Server) addressAck(q *Query) []dns.ResourceRecord {
+	contiguous, outstanding, ok := s.transferProgress(q)
+	if !ok {
+		contiguous, outstanding = addressUnknown, addressUnknown
+	}
+	return addressRecords(q.Name, q.Type, []int{contiguous, outstanding})
+}
+
+// addressMissingAnswer lists the missing parts as address records: a header
+// of total parts, missing count and the part to continue from (0 at the end
+// of the list), then first/last pairs of runs
+func addressMissingAnswer(queryDomain string, queryType uint16, totalParts int, missing missingParts) []dns.ResourceRecord {
+	pending := missing.Parts
+
+	capacity := addressCapacity(queryDomain, queryType)
+	var ranges []int
+	next := 0
+	for i := 0; i < len(pending); {
+		if 3+len(ranges)+2 > capacity {
+			next = pending[i]
+			break
+		}
+		// Extend the run while parts are consecutive
+		j := i
+		for j+1 < len(pending) && pending[j+1] == pending[j]+1 {
+			j++
+		}
+		ranges = append(ranges, pending[i], pending[j])
+		i = j + 1
+	}
+
+	if next == 0 {
+		next = missing.More
+	}
+
+	values := append([]int{totalParts, missing.Count, next}, ranges...)
+	return addressRecords(queryDomain, queryType, values)
+}
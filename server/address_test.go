@@ -0,0 +1,140 @@
+package server
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"youkaidns/dns"
+)
+
+// decodeAddressValues reads address records the way script.sh and
+// script.ps1 do: sorted by their index octet, three bytes per value
+func decodeAddressValues(t *testing.T, rrs []dns.ResourceRecord) []int {
+	t.Helper()
+	rrs = append([]dns.ResourceRecord(nil), rrs...)
+	rand.Shuffle(len(rrs), func(i, j int) { rrs[i], rrs[j] = rrs[j], rrs[i] }) // As resolvers may
+	sort.Slice(rrs, func(i, j int) bool { return rrs[i].Data[0] < rrs[j].Data[0] })
+
+	var values []int
+	for i, rr := range rrs {
+		if int(rr.Data[0]) != addressIndexBase+i {
+			t.Fatalf("record %d has index octet %d", i, rr.Data[0])
+		}
+		for b := 1; b+3 <= len(rr.Data); b += 3 {
+			values = append(values, int(rr.Data[b])<<16|int(rr.Data[b+1])<<8|int(rr.Data[b+2]))
+		}
+	}
+	return values
+}
+
+func TestAddressRecords(t *testing.T) {
+	tests := []struct {
+		name  string
+		qtype uint16
+		in    []int
+		data  [][]byte // Expected record data
+	}{
+		{"ack over A", dns.TypeA, []int{5, 0}, [][]byte{{32, 0, 0, 5}, {33, 0, 0, 0}}},
+		{"unknown over A", dns.TypeA, []int{-1, 0x1000000}, [][]byte{{32, 255, 255, 255}, {33, 255, 255, 255}}},
+		{"largest value", dns.TypeA, []int{0xFFFFFE}, [][]byte{{32, 255, 255, 254}}},
+		{"ack over AAAA", dns.TypeAAAA, []int{70000, 3}, [][]byte{{32, 0x01, 0x11, 0x70, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 0, 0}}},
+		{"two AAAA records", dns.TypeAAAA, []int{1, 2, 3, 4, 5, 6}, [][]byte{
+			{32, 0, 0, 1, 0, 0, 2, 0, 0, 3, 0, 0, 4, 0, 0, 5},
+			{33, 0, 0, 6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rrs := addressRecords("q.example.com", tt.qtype, tt.in)
+			var data [][]byte
+			for _, rr := range rrs {
+				if rr.Type != tt.qtype || int(rr.DataLen) != len(rr.Data) {
+					t.Fatalf("record type %d, length %d of %d bytes", rr.Type, rr.DataLen, len(rr.Data))
+				}
+				data = append(data, rr.Data)
+			}
+			if !reflect.DeepEqual(data, tt.data) {
+				t.Fatalf("records %v, want %v", data, tt.data)
+			}
+		})
+	}
+}
+
+func TestAddressMissingAnswer(t *testing.T) {
+	var scattered []int
+	for p := 1; p <= 2000; p += 3 {
+		scattered = append(scattered, p)
+	}
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		from    int
+		missing []int
+		want    []int // Expected values
+	}{
+		{"none", dns.TypeA, 1, nil, []int{10, 0, 0}},
+		{"runs", dns.TypeA, 1, []int{2, 3, 4, 9}, []int{10, 4, 0, 2, 4, 9, 9}},
+		{"from a later part", dns.TypeAAAA, 4, []int{2, 3, 4, 9}, []int{10, 4, 0, 4, 4, 9, 9, 0, 0, 0}},
+		{"from past the end", dns.TypeA, 11, []int{2, 3}, []int{10, 2, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := decodeAddressValues(t, addressMissingAnswer("1.v2-1.missing.0123abcd.example.com", tt.qtype, 10, missingList(tt.from, tt.missing)))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("values %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// A list too long for one response continues from next and fits the
+	// classic UDP limit with compressed answer names
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		query := "1.v2-1.missing.0123abcd." + strings.Repeat("d", 60) + ".example.com"
+		rdata := 4
+		if qtype == dns.TypeAAAA {
+			rdata = 16
+		}
+
+		var seen []int
+		from, queries := 1, 0
+		for {
+			rrs := addressMissingAnswer(query, qtype, 2000, missingList(from, scattered))
+			if size := 12 + len(query) + 2 + 4 + len(rrs)*(2+10+rdata); size > maxResponseSize {
+				t.Fatalf("type %d: response of %d bytes", qtype, size)
+			}
+			if len(rrs) > maxAddressRecords {
+				t.Fatalf("type %d: %d records", qtype, len(rrs))
+			}
+
+			values := decodeAddressValues(t, rrs)
+			if values[0] != 2000 || values[1] != len(scattered) {
+				t.Fatalf("type %d: header %v", qtype, values[:3])
+			}
+			for i := 3; i+1 < len(values); i += 2 {
+				if values[i] == 0 {
+					break // AAAA padding
+				}
+				for p := values[i]; p <= values[i+1]; p++ {
+					seen = append(seen, p)
+				}
+			}
+
+			queries++
+			if values[2] == 0 {
+				break
+			}
+			from = values[2]
+		}
+		if !reflect.DeepEqual(seen, scattered) {
+			t.Fatalf("type %d: %d queries listed %d of %d parts", qtype, queries, len(seen), len(scattered))
+		}
+		if queries < 2 {
+			t.Fatalf("type %d: %d parts fit one response", qtype, len(scattered))
+		}
+	}
+}
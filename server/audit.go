@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEvent is a denied access attempt
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	Source     string    `json:"source"`            // Client IP, "*" for a summary of several
+	Service    string    `json:"service"`           // dns or web
+	Feature    string    `json:"feature,omitempty"` // Denied DNS feature
+	Target     string    `json:"target"`            // Queried name or requested path
+	Reason     string    `json:"reason"`
+	Suppressed int       `json:"suppressed,omitempty"` // Attempts left out since the last entry (summaries only)
+}
+
+// Audit entries are sampled, so a client hammering a denied feature can't
+// flood the log: one entry per source and service per auditInterval. The
+// attempts left out are summed up in one more entry per source, written with
+// the first attempt after the interval or on Close. At most maxAuditSources
+// sources are tracked per interval; attempts from further sources are only
+// counted.
+const (
+	auditInterval   = time.Minute
+	maxAuditSources = 1000
+)
+
+// auditSample is the first attempt of a source in the current interval and
+// how many more were left out
+type auditSample struct {
+	event      AuditEvent
+	suppressed int
+}
+
+// AuditLog records denied access attempts, one JSON object per line. Events
+// are also written to the server log. A nil AuditLog only logs, without
+// sampling.
+type AuditLog struct {
+	mu       sync.Mutex
+	file     *os.File
+	window   time.Time               // Start of the current interval
+	samples  map[string]*auditSample // service|source -> sample
+	overflow int                     // Attempts from untracked sources this interval
+}
+
+// NewAuditLog returns an audit log that only writes to the server log
+func NewAuditLog() *AuditLog {
+	return &AuditLog{samples: make(map[string]*auditSample)}
+}
+
+// OpenAuditLog opens (or creates) an audit log file for appending
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	a := NewAuditLog()
+	a.file = f
+	return a, nil
+}
+
+// Record logs an event and appends it to the audit log file, unless its
+// source already has an entry in the current interval
+func (a *AuditLog) Record(event AuditEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if a == nil {
+		writeAuditEvent(nil, event)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if event.Time.Sub(a.window) >= auditInterval {
+		a.flush()
+		a.window = event.Time
+	}
+	key := event.Service + "|" + event.Source
+	if sample, exists := a.samples[key]; exists {
+		sample.suppressed++
+		return
+	}
+	if len(a.samples) >= maxAuditSources {
+		a.overflow++
+		return
+	}
+	a.samples[key] = &auditSample{event: event}
+	writeAuditEvent(a.file, event)
+}
+
+// flush writes a summary for every source with attempts left out in the
+// current interval and starts a new one. The caller must hold a.mu.
+func (a *AuditLog) flush() {
+	now := time.Now()
+	for _, sample := range a.samples {
+		if sample.suppressed == 0 {
+			continue
+		}
+		summary := sample.event
+		summary.Time = now
+		summary.Reason = fmt.Sprintf("%s (%d more since %s)", summary.Reason, sample.suppressed, sample.event.Time.Format(time.RFC3339))
+		summary.Suppressed = sample.suppressed
+		writeAuditEvent(a.file, summary)
+	}
+	if a.overflow > 0 {
+		writeAuditEvent(a.file, AuditEvent{
+			Time:       now,
+			Source:     "*",
+			Reason:     fmt.Sprintf("%d denied attempts from sources beyond the first %d since %s", a.overflow, maxAuditSources, a.window.Format(time.RFC3339)),
+			Suppressed: a.overflow,
+		})
+	}
+	a.samples = make(map[string]*auditSample)
+	a.overflow = 0
+}
+
+// Close writes the pending summaries and closes the audit log file
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.flush()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// writeAuditEvent logs an event and appends it to file if there is one
+func writeAuditEvent(file *os.File, event AuditEvent) {
+	if event.Feature != "" {
+		log.Printf("Audit: %s %s from %s (%s): %s", event.Service, event.Target, event.Source, event.Feature, event.Reason)
+	} else {
+		log.Printf("Audit: %s %s from %s: %s", event.Service, event.Target, event.Source, event.Reason)
+	}
+
+	if file == nil {
+		return
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding audit event: %v", err)
+		return
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+}
+
+// SetAuditLog sets where denied queries are recorded. It must be called
+// before Start.
+func (s *Server) SetAuditLog(audit *AuditLog) {
+	s.auditLog = audit
+}
+
+// AuditLog returns the server's audit log, for other listeners to share
+func (s *Server) AuditLog() *AuditLog {
+	return s.auditLog
+}
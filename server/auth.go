@@ -0,0 +1,92 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net"
+	"strings"
+)
+
+// tagLabelKey is the option key carrying a record's HMAC tag (m-<tag>)
+const tagLabelKey = "m"
+
+// tagSize is the length in bytes of a record tag (truncated HMAC-SHA256)
+const tagSize = 8
+
+// SetAuthSecret sets the shared secret used to authenticate start and data
+// records, agent polls and task chunk queries. When set, records without a
+// valid m-<tag> label are dropped. An empty secret turns authentication off.
+func (s *Server) SetAuthSecret(secret string) {
+	s.assemblyMu.Lock()
+	defer s.assemblyMu.Unlock()
+
+	if secret == "" {
+		s.authKey = nil
+		return
+	}
+	s.authKey = []byte(secret)
+}
+
+// RecordTag computes the tag for a record from its labels (everything before
+// the domain, without the tag label itself) and its served domain, so a tag
+// is only valid under the domain it was made for:
+// hex(HMAC-SHA256(secret, lowercase labels and domain joined with "."))[:16]
+func RecordTag(key []byte, labels []string, domain string) string {
+	name := strings.Join(labels, ".")
+	if domain = strings.Trim(domain, "."); domain != "" {
+		name += "." + domain
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.ToLower(name)))
+	return hex.EncodeToString(mac.Sum(nil)[:tagSize])
+}
+
+// splitTag removes the m-<tag> label from a record's labels, returning the
+// tag (empty if there is none) and the remaining labels
+func splitTag(parts []string) (string, []string) {
+	for i, label := range parts {
+		if !isOptionLabel(label) {
+			continue
+		}
+		if key, value := parseOptionLabel(label); key == tagLabelKey {
+			rest := make([]string, 0, len(parts)-1)
+			rest = append(rest, parts[:i]...)
+			rest = append(rest, parts[i+1:]...)
+			return value, rest
+		}
+	}
+	return "", parts
+}
+
+// authenticateRecord checks a record's tag when a secret is configured and
+// returns the labels with the tag removed. Rejections are logged and counted
+// per source, for the server and for domain d.
+func (s *Server) authenticateRecord(d *Domain, kind string, hash8 string, parts []string, clientIP net.IP) ([]string, bool) {
+	tag, rest := splitTag(parts)
+
+	s.assemblyMu.RLock()
+	key := s.authKey
+	s.assemblyMu.RUnlock()
+
+	if key == nil {
+		return rest, true
+	}
+
+	reason := ""
+	if tag == "" {
+		reason = "missing tag"
+	} else if !hmac.Equal([]byte(strings.ToLower(tag)), []byte(RecordTag(key, rest, d.Name))) {
+		reason = "bad tag"
+	}
+	if reason == "" {
+		return rest, true
+	}
+
+	source := clientIP.String()
+	log.Printf("Rejected %s record for %s from %s: %s", kind, hash8, source, reason)
+	s.stats.RecordRejection(source)
+	s.stats.Domain(d.Name).RecordRejection(source)
+	return nil, false
+}
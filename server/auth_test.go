@@ -0,0 +1,62 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"youkaidns/dns"
+)
+
+func TestRecordTagMatchesScripts(t *testing.T) {
+	// hmac.new(b"secret", b"666f6f.1.0123abcd.t.test", sha256).hexdigest()[:16],
+	// as record_tag in script.sh computes it
+	want := "5470473bea555eef"
+	if got := RecordTag([]byte("secret"), []string{"666F6F", "1", "0123abcd"}, "T.test."); got != want {
+		t.Fatalf("tag %s, want %s", got, want)
+	}
+}
+
+func TestAuthenticatedTransfer(t *testing.T) {
+	s := newTestServer(t)
+	s.SetAuthSecret("secret")
+	file := []byte("a file whose records carry HMAC tags")
+
+	tr := testTransfer{Name: "tagged.txt", File: file}
+	if assembly := waitFinished(t, s, sendTransfer(t, s, tr)); assembly.FailStatus != "" || !assembly.Verified {
+		t.Fatalf("tagged transfer %q: %s", assembly.FailStatus, assembly.FailReason)
+	}
+	if n := s.stats.GetSnapshot().RejectedRecords; n != 0 {
+		t.Fatalf("%d tagged records rejected", n)
+	}
+}
+
+func TestUnauthenticatedRecordsRejected(t *testing.T) {
+	s := newTestServer(t)
+	s.SetAuthSecret("secret")
+	tr := testTransfer{Name: "spoofed.txt", File: []byte("injected data")}
+	hash8 := tr.hash8()
+	data := encodeLabel(EncodingHex, tr.File)
+
+	records := map[string]string{
+		"untagged start":      strings.Join([]string{encodeLabel(EncodingHex, []byte(tr.Name)), "1", "30", "13", "start", hash8, testDomain}, "."),
+		"untagged data":       strings.Join([]string{data, "1", hash8, testDomain}, "."),
+		"wrong secret":        strings.Join([]string{data, "m-" + RecordTag([]byte("guess"), []string{data, "1", hash8}, testDomain), "1", hash8, testDomain}, "."),
+		"other domain":        strings.Join([]string{data, "m-" + RecordTag([]byte("secret"), []string{data, "1", hash8}, "other.test"), "1", hash8, testDomain}, "."),
+		"tag of another part": strings.Join([]string{data, "m-" + RecordTag([]byte("secret"), []string{data, "2", hash8}, testDomain), "1", hash8, testDomain}, "."),
+	}
+	for name, record := range records {
+		if w := serveQuery(s, record, dns.TypeTXT); len(w.answers) != 0 {
+			t.Errorf("%s: record acknowledged", name)
+		}
+	}
+
+	snapshot := s.stats.GetSnapshot()
+	if snapshot.RejectedRecords != int64(len(records)) || snapshot.RejectionsBySource[testClient.IP.String()] != int64(len(records)) {
+		t.Fatalf("rejections %d, by source %v; want %d from %s", snapshot.RejectedRecords, snapshot.RejectionsBySource, len(records), testClient.IP)
+	}
+	s.assemblyMu.RLock()
+	defer s.assemblyMu.RUnlock()
+	if len(s.fileAssemblies) != 0 {
+		t.Fatalf("rejected records started %d transfers", len(s.fileAssemblies))
+	}
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bundle is the archive format of a multi-file transfer, declared with the
+// start option b-<format>
+type Bundle string
+
+// Supported bundle formats
+const (
+	BundleNone Bundle = "none" // A single file
+	BundleTar  Bundle = "tar"  // A tar archive unpacked into its own directory
+)
+
+// ParseBundle parses a bundle format name
+func ParseBundle(name string) (Bundle, error) {
+	switch bundle := Bundle(strings.ToLower(name)); bundle {
+	case BundleNone, BundleTar:
+		return bundle, nil
+	default:
+		return "", fmt.Errorf("unknown bundle format %q (want none or tar)", name)
+	}
+}
+
+// bundleDirName returns the directory name for a bundle: the sanitized
+// transfer filename without its .tar extension
+func bundleDirName(filename string, hash8 string) string {
+	name := sanitizeFilename(filename)
+	if strings.EqualFold(filepath.Ext(name), ".tar") {
+		name = name[:len(name)-len(".tar")]
+	}
+	if name == "" || name == "." {
+		name = fmt.Sprintf("bundle_%s", hash8)
+	}
+	return name
+}
+
+// saveBundle unpacks a tar archive into a new directory in the output
+// directory dir, resolving name collisions like saveFile. It returns the
+// final path, the number of files written and their size.
+func (s *Server) saveBundle(dir string, name string, hash8 string, data []byte) (string, int, int64, error) {
+	// Unpack into a hidden temp directory first so readers never see a
+	// partial bundle
+	tmpDir, err := os.MkdirTemp(dir, tempPattern)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("create temp directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir) // No-op once renamed
+
+	files, err := unpackTar(tmpDir, data)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		return "", 0, 0, fmt.Errorf("chmod temp directory: %w", err)
+	}
+	size := storedBytes(tmpDir, nil)
+
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	// Only an earlier bundle's directory comes back to be replaced
+	dirPath := s.resolveCollision(dir, name, hash8, true)
+	if s.collisionPolicy == CollisionOverwrite && fileExists(dirPath) {
+		replaced := storedBytes(dirPath, nil)
+		if err := os.RemoveAll(dirPath); err != nil {
+			return "", 0, 0, fmt.Errorf("remove existing %s: %w", reasonName(filepath.Base(dirPath)), pathErr(err))
+		}
+		os.Remove(filepath.Join(dir, metaDirName, filepath.Base(dirPath)+".json"))
+		s.releaseStoredIn(dir, replaced)
+	}
+	if err := os.Rename(tmpDir, dirPath); err != nil {
+		return "", 0, 0, fmt.Errorf("rename temp directory: %w", err)
+	}
+
+	return dirPath, files, size, nil
+}
+
+// unpackTar extracts a tar archive into root and returns the number of files
+// written. Only regular files and directories are extracted; links, devices
+// and other special entries are skipped. Entry names must be local paths
+// (no absolute paths, drive letters, ".." components or backslashes) and
+// every resolved path must stay under root. Permission bits (without setuid,
+// setgid and sticky) and modification times are kept; ownership is not.
+func unpackTar(root string, data []byte) (int, error) {
+	type dirTime struct {
+		path  string
+		mtime time.Time
+	}
+	var dirTimes []dirTime
+	files := 0
+
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return files, fmt.Errorf("read tar: %w", err)
+		}
+
+		target, ok := bundlePath(root, header.Name)
+		if !ok {
+			log.Printf("Warning: Skipping unsafe bundle entry %q", header.Name)
+			continue
+		}
+		if target == root {
+			continue // The archive's "./" entry
+		}
+		mode := os.FileMode(header.Mode).Perm()
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode|0700); err != nil {
+				return files, fmt.Errorf("create %s: %w", reasonName(header.Name), pathErr(err))
+			}
+			// Directory times are set last, after their contents are written
+			dirTimes = append(dirTimes, dirTime{target, header.ModTime})
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return files, fmt.Errorf("create directory for %s: %w", reasonName(header.Name), pathErr(err))
+			}
+			if err := writeBundleFile(target, tr, mode|0600); err != nil {
+				return files, fmt.Errorf("write %s: %w", reasonName(header.Name), pathErr(err))
+			}
+			if err := os.Chtimes(target, header.ModTime, header.ModTime); err != nil {
+				log.Printf("Warning: Could not set times on %q: %v", header.Name, pathErr(err))
+			}
+			files++
+		default:
+			log.Printf("Warning: Skipping bundle entry %q of type %q", header.Name, string(header.Typeflag))
+		}
+	}
+
+	for i := len(dirTimes) - 1; i >= 0; i-- {
+		if err := os.Chtimes(dirTimes[i].path, dirTimes[i].mtime, dirTimes[i].mtime); err != nil {
+			log.Printf("Warning: Could not set times on %s: %v", dirTimes[i].path, err)
+		}
+	}
+
+	return files, nil
+}
+
+// bundlePath resolves a tar entry name under root. ok is false if the name
+// could escape root or isn't portable.
+func bundlePath(root string, name string) (string, bool) {
+	if name == "" || strings.ContainsAny(name, "\\\x00") || strings.Contains(name, ":") {
+		return "", false
+	}
+	cleaned := filepath.Clean(filepath.FromSlash(name))
+	if !filepath.IsLocal(cleaned) && cleaned != "." {
+		return "", false
+	}
+
+	target := filepath.Join(root, cleaned)
+	if target != root && !strings.HasPrefix(target, root+string(filepath.Separator)) {
+		return "", false
+	}
+	return target, true
+}
+
+// writeBundleFile writes one file from a tar stream, replacing any earlier
+// entry with the same name
+func writeBundleFile(path string, r io.Reader, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// OpenFile only applies mode to new files (and through the umask)
+	return os.Chmod(path, mode)
+}
+
+// maxReasonName caps the length of a name quoted in a failure reason
+const maxReasonName = 64
+
+// reasonName quotes a client-supplied name for a failure reason, which ends
+// up in the history and on the dashboard, shortening long names
+func reasonName(name string) string {
+	if len(name) > maxReasonName {
+		return strconv.Quote(name[:maxReasonName]) + "..."
+	}
+	return strconv.Quote(name)
+}
+
+// pathErr strips the path from a file system error, since the path is built
+// from the client's entry name
+func pathErr(err error) error {
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		return pe.Err
+	}
+	return err
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// tarEntry is one entry of a test archive
+type tarEntry struct {
+	Name     string
+	Type     byte
+	Body     string // Regular files
+	Linkname string // Links
+}
+
+// makeTar builds a tar archive of entries in order
+func makeTar(t *testing.T, entries []tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.Name, Typeflag: e.Type, Mode: 0644, Size: int64(len(e.Body)), Linkname: e.Linkname}
+		if e.Type != tar.TypeReg {
+			header.Size = 0
+			header.Mode = 0755
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.Body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// readTree returns the regular files under root by slash path, and every
+// other entry by its path with its mode type
+func readTree(t *testing.T, root string) map[string]string {
+	t.Helper()
+	tree := make(map[string]string)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		switch {
+		case info.Mode().IsRegular():
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			tree[filepath.ToSlash(rel)] = string(data)
+		case info.IsDir():
+			tree[filepath.ToSlash(rel)+"/"] = ""
+		default:
+			tree[filepath.ToSlash(rel)] = info.Mode().Type().String()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestUnpackTarPaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		files   int
+		want    map[string]string
+	}{
+		{
+			"nested files",
+			[]tarEntry{{Name: "./", Type: tar.TypeDir}, {Name: "etc/", Type: tar.TypeDir}, {Name: "etc/hosts", Type: tar.TypeReg, Body: "h"}, {Name: "logs/a.log", Type: tar.TypeReg, Body: "a"}},
+			2,
+			map[string]string{"etc/": "", "etc/hosts": "h", "logs/": "", "logs/a.log": "a"},
+		},
+		{
+			"parent components",
+			[]tarEntry{{Name: "../escape", Type: tar.TypeReg, Body: "x"}, {Name: "a/../../escape", Type: tar.TypeReg, Body: "x"}, {Name: "a/../kept", Type: tar.TypeReg, Body: "k"}},
+			1,
+			map[string]string{"kept": "k"},
+		},
+		{
+			"absolute paths",
+			[]tarEntry{{Name: "/etc/passwd", Type: tar.TypeReg, Body: "x"}, {Name: "C:/boot.ini", Type: tar.TypeReg, Body: "x"}, {Name: `dir\file`, Type: tar.TypeReg, Body: "x"}},
+			0,
+			map[string]string{},
+		},
+		{
+			"symlinks",
+			[]tarEntry{{Name: "link", Type: tar.TypeSymlink, Linkname: "/etc"}, {Name: "link/passwd", Type: tar.TypeReg, Body: "x"}},
+			1,
+			map[string]string{"link/": "", "link/passwd": "x"}, // A directory, not through the link
+		},
+		{
+			"hardlinks",
+			[]tarEntry{{Name: "hard", Type: tar.TypeLink, Linkname: "/etc/passwd"}, {Name: "sibling", Type: tar.TypeLink, Linkname: "../outside"}},
+			0,
+			map[string]string{},
+		},
+		{
+			"duplicate names",
+			[]tarEntry{{Name: "notes.txt", Type: tar.TypeReg, Body: "first"}, {Name: "./notes.txt", Type: tar.TypeReg, Body: "second"}},
+			2,
+			map[string]string{"notes.txt": "second"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outer := t.TempDir()
+			root := filepath.Join(outer, "bundle")
+			if err := os.Mkdir(root, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			files, err := unpackTar(root, makeTar(t, tt.entries))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if files != tt.files {
+				t.Errorf("%d files written, want %d", files, tt.files)
+			}
+			if got := readTree(t, root); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unpacked %v, want %v", got, tt.want)
+			}
+			if entries, _ := os.ReadDir(outer); len(entries) != 1 {
+				t.Errorf("%d entries next to the bundle", len(entries)-1)
+			}
+		})
+	}
+}
+
+func TestBundleTransfer(t *testing.T) {
+	s := newTestServer(t)
+	archive := makeTar(t, []tarEntry{{Name: "a.txt", Type: tar.TypeReg, Body: "alpha"}, {Name: "../b.txt", Type: tar.TypeReg, Body: "beta"}})
+
+	tr := testTransfer{Name: "logs.tar", File: archive, Chunk: 120, Options: []string{"b-tar"}}
+	if assembly := waitFinished(t, s, sendTransfer(t, s, tr)); assembly.FailStatus != "" {
+		t.Fatalf("bundle transfer failed: %s", assembly.FailReason)
+	}
+	if got := readTree(t, filepath.Join(s.primaryDomain().OutputDir, "logs")); !reflect.DeepEqual(got, map[string]string{"a.txt": "alpha"}) {
+		t.Fatalf("bundle directory %v", got)
+	}
+	if _, err := os.Stat(filepath.Join(s.primaryDomain().OutputDir, "b.txt")); !os.IsNotExist(err) {
+		t.Fatal("entry escaped the bundle directory")
+	}
+}
+
+func TestBundleOverwrite(t *testing.T) {
+	s := newTestServer(t)
+	s.SetCollisionPolicy(CollisionOverwrite)
+	dir := s.primaryDomain().OutputDir
+
+	var last testTransfer
+	for _, body := range []string{"a much longer first version", "second"} {
+		archive := makeTar(t, []tarEntry{{Name: "a.txt", Type: tar.TypeReg, Body: body}})
+		last = testTransfer{Name: "logs.tar", File: archive, Chunk: 120, Options: []string{"b-tar"}}
+		if assembly := waitFinished(t, s, sendTransfer(t, s, last)); assembly.FailStatus != "" {
+			t.Fatalf("bundle transfer failed: %s", assembly.FailReason)
+		}
+	}
+	if got := readTree(t, filepath.Join(dir, "logs")); !reflect.DeepEqual(got, map[string]string{"a.txt": "second"}) {
+		t.Fatalf("bundle directory %v", got)
+	}
+
+	// The old bundle's bytes are given back; the unpacked files are counted
+	if stored := s.GetDomains()[0].StoredBytes; stored != int64(len("second")) {
+		t.Fatalf("%d bytes stored after the overwrite", stored)
+	}
+	if record, err := s.readFileRecord(dir, "logs"); err != nil || record.Hash != last.hash8() {
+		t.Fatalf("record %+v (%v), want hash %s", record, err, last.hash8())
+	}
+
+	// And a deletion gives back what was counted
+	if err := s.DeleteReceivedFile("", "logs"); err != nil {
+		t.Fatal(err)
+	}
+	if stored := s.GetDomains()[0].StoredBytes; stored != 0 {
+		t.Fatalf("%d bytes stored after the deletion", stored)
+	}
+}
+
+func TestBundleOverwriteSpares(t *testing.T) {
+	s := newTestServer(t)
+	s.SetCollisionPolicy(CollisionOverwrite)
+	dir := s.primaryDomain().OutputDir
+	other := filepath.Join(dir, "u.test")
+	if err := s.AddDomain(DomainConfig{Name: "u.test", OutputDir: other}); err != nil {
+		t.Fatal(err)
+	}
+	kept := map[string]string{
+		filepath.Join(other, "report.txt"):             "other domain",
+		filepath.Join(dir, "plain", "notes.txt"):       "not a bundle",
+		filepath.Join(dir, metaDirName, "report.json"): "record",
+	}
+	for path, body := range kept {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		want string // Directory the bundle is saved as
+	}{
+		{".youkaidns.tar", "_.youkaidns"},
+		{"u.test.tar", "u_1.test"},
+		{"plain.tar", "plain_1"},
+	}
+	for _, tt := range tests {
+		archive := makeTar(t, []tarEntry{{Name: "a.txt", Type: tar.TypeReg, Body: tt.name}})
+		tr := testTransfer{Name: tt.name, File: archive, Chunk: 120, Options: []string{"b-tar"}}
+		if assembly := waitFinished(t, s, sendTransfer(t, s, tr)); assembly.FailStatus != "" {
+			t.Fatalf("%s: transfer failed: %s", tt.name, assembly.FailReason)
+		}
+		if got := readTree(t, filepath.Join(dir, tt.want)); !reflect.DeepEqual(got, map[string]string{"a.txt": tt.name}) {
+			t.Errorf("%s: %s holds %v", tt.name, tt.want, got)
+		}
+	}
+
+	for path, body := range kept {
+		if data, err := os.ReadFile(path); err != nil || string(data) != body {
+			t.Errorf("%s replaced: %q, %v", path, data, err)
+		}
+	}
+}
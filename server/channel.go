@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/base64"
+	"log"
+	"strings"
+
+	"youkaidns/dns"
+)
+
+// Downstream channels carry the answers the TXT handlers build (scripts,
+// outbox downloads, missing lists and acknowledgements) in other record
+// types, for networks that filter TXT. The payload is the TXT record data:
+// the answer's character strings, each prefixed with its length byte, in
+// answer order. Clients read each string on its own, as they do over TXT.
+//
+//	NULL:  one record whose data is the payload
+//	MX:    the payload in base32hex (lowercase, no padding) split over the
+//	       exchange names, as labels under the domain; the preference orders
+//	       the records from 0, and the labels joined in that order decode
+//	       as one string
+//	CNAME: one target name holding the whole payload like an MX exchange
+//
+// Answers that don't fit one name aren't sent over CNAME.
+
+// isChannelType reports whether a query type gets downstream channel answers
+func isChannelType(queryType uint16) bool {
+	return queryType == dns.TypeNULL || queryType == dns.TypeMX || queryType == dns.TypeCNAME
+}
+
+// maxNameLength is the longest name in text form (255 bytes on the wire)
+const maxNameLength = 253
+
+// channelRecords converts TXT answers into records of the type q asked for. It
+// returns nil if they can't be encoded.
+func (s *Server) channelRecords(q *Query, answers []dns.ResourceRecord) []dns.ResourceRecord {
+	if len(answers) == 0 {
+		return answers
+	}
+
+	var payload []byte
+	for _, rr := range answers {
+		payload = append(payload, rr.Data...)
+	}
+
+	// Names go under the served domain the query came in on
+	domain := ""
+	if q.Domain != nil {
+		domain = q.Domain.Name
+	}
+
+	var rrs []dns.ResourceRecord
+	switch q.Type {
+	case dns.TypeNULL:
+		rrs = []dns.ResourceRecord{channelRecord(q.Name, q.Type, payload)}
+	case dns.TypeCNAME:
+		name, rest := channelName(domain, payload)
+		if len(rest) > 0 {
+			if s.verbose {
+				log.Printf("Answer for %s doesn't fit a CNAME (%d bytes of data)", q.Name, len(payload))
+			}
+			return nil
+		}
+		data, err := dns.EncodeName(name)
+		if err != nil {
+			return nil
+		}
+		rrs = []dns.ResourceRecord{channelRecord(q.Name, q.Type, data)}
+	case dns.TypeMX:
+		for preference := 0; len(payload) > 0; preference++ {
+			name, rest := channelName(domain, payload)
+			if len(rest) == len(payload) {
+				return nil // The domain leaves no room for data
+			}
+			payload = rest
+			target, err := dns.EncodeName(name)
+			if err != nil {
+				return nil
+			}
+			data := append([]byte{byte(preference >> 8), byte(preference)}, target...)
+			rrs = append(rrs, channelRecord(q.Name, q.Type, data))
+		}
+	}
+
+	return rrs
+}
+
+// channelName encodes as much of payload as fits one name under domain and
+// returns the name and the bytes left over
+func channelName(domain string, payload []byte) (string, []byte) {
+	suffix := ""
+	if domain != "" {
+		suffix = "." + domain
+	}
+
+	// Largest number of bytes whose encoding, split into 63-character labels,
+	// fits next to the suffix
+	n := len(payload)
+	for n > 0 {
+		chars := base32Hex.EncodedLen(n)
+		if chars+(chars-1)/63+len(suffix) <= maxNameLength {
+			break
+		}
+		n--
+	}
+	// Cut on whole base32 blocks, so the names' labels joined in order decode
+	// in one go
+	if n < len(payload) {
+		n -= n % 5
+	}
+
+	encoded := strings.ToLower(base32Hex.EncodeToString(payload[:n]))
+	var labels []string
+	for len(encoded) > 63 {
+		labels = append(labels, encoded[:63])
+		encoded = encoded[63:]
+	}
+	labels = append(labels, encoded)
+
+	return strings.Join(labels, ".") + suffix, payload[n:]
+}
+
+// channelRecord builds one downstream channel record
+func channelRecord(name string, queryType uint16, data []byte) dns.ResourceRecord {
+	return dns.ResourceRecord{
+		Name:    name,
+		Type:    queryType,
+		Class:   1, // IN
+		TTL:     0, // TTL=0 to prevent caching
+		Data:    data,
+		DataLen: uint16(len(data)),
+	}
+}
+
+// handleProbeQuery answers channel probes
+// Format: <nonce>.probe.<domain> returns one string as long as an outbox
+// chunk: the nonce followed by "-", repeated. Clients send it over each record
+// type and keep the fastest whose answer arrives intact. Returns nil if not a
+// probe query.
+func (s *Server) handleProbeQuery(q *Query) []dns.ResourceRecord {
+	if q.Type != dns.TypeTXT {
+		return nil
+	}
+
+	parts := q.Labels
+	if q.Domain == nil || len(parts) < 2 || parts[len(parts)-1] != "probe" || parts[len(parts)-2] == "" {
+		return nil
+	}
+	nonce := parts[len(parts)-2]
+
+	size := base64.StdEncoding.EncodedLen(outboxChunkSize)
+	text := strings.Repeat(nonce+"-", size/(len(nonce)+1)+1)[:size]
+	return []dns.ResourceRecord{txtRecord(q.Name, text)}
+}
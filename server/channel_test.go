@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+
+	"youkaidns/dns"
+)
+
+// wireLabels splits an uncompressed wire-format name into its labels
+func wireLabels(t *testing.T, data []byte) []string {
+	t.Helper()
+	var labels []string
+	for len(data) > 0 && data[0] != 0 {
+		n := int(data[0])
+		if 1+n > len(data) {
+			t.Fatalf("truncated name %q", data)
+		}
+		labels = append(labels, string(data[1:1+n]))
+		data = data[1+n:]
+	}
+	return labels
+}
+
+// channelPayload decodes downstream channel answers into the TXT data they
+// carry, the way the scripts read them
+func channelPayload(t *testing.T, qtype uint16, rrs []dns.ResourceRecord) []byte {
+	t.Helper()
+	suffix := len(strings.Split(testDomain, "."))
+	decode := func(target []byte) string {
+		labels := wireLabels(t, target)
+		return strings.Join(labels[:len(labels)-suffix], "")
+	}
+
+	var encoded string
+	switch qtype {
+	case dns.TypeNULL:
+		if len(rrs) != 1 {
+			t.Fatalf("%d NULL records", len(rrs))
+		}
+		return rrs[0].Data
+	case dns.TypeCNAME:
+		if len(rrs) != 1 {
+			t.Fatalf("%d CNAME records", len(rrs))
+		}
+		encoded = decode(rrs[0].Data)
+	case dns.TypeMX:
+		sorted := append([]dns.ResourceRecord(nil), rrs...)
+		sort.Slice(sorted, func(i, j int) bool {
+			return int(sorted[i].Data[0])<<8|int(sorted[i].Data[1]) < int(sorted[j].Data[0])<<8|int(sorted[j].Data[1])
+		})
+		for _, rr := range sorted {
+			encoded += decode(rr.Data[2:])
+		}
+	}
+	payload, err := EncodingBase32.Decode(encoded)
+	if err != nil {
+		t.Fatalf("%q: %v", encoded, err)
+	}
+	return payload
+}
+
+func TestDownstreamChannels(t *testing.T) {
+	s, _ := newOutboxServer(t, map[string][]byte{"tool.bin": bytes.Repeat([]byte("payload "), 40)})
+	id := s.GetOutboxFiles()[0].ID
+	tr := testTransfer{Name: "acked.txt", File: []byte("a file of two parts, the second never sent")}
+	if w := serveQuery(s, tr.startRecord(s), dns.TypeTXT); len(w.answers) == 0 {
+		t.Fatal("start record not acknowledged")
+	}
+
+	queries := []struct {
+		name  string
+		query string
+		cname bool // Short enough for CNAME
+	}{
+		{"probe", "k3x9.probe." + testDomain, false},
+		{"outbox chunk", "1." + id + ".get." + testDomain, false},
+		{"missing list", "v2.missing." + tr.hash8() + "." + testDomain, true},
+		{"ack", tr.dataRecord(s, 1), true},
+	}
+	for _, q := range queries {
+		var want []byte
+		for _, rr := range serveQuery(s, q.query, dns.TypeTXT).answers {
+			want = append(want, rr.Data...)
+		}
+		if len(want) == 0 {
+			t.Fatalf("%s: no TXT answer", q.name)
+		}
+
+		for _, qtype := range []uint16{dns.TypeNULL, dns.TypeMX, dns.TypeCNAME} {
+			w := serveQuery(s, q.query, qtype)
+			if qtype == dns.TypeCNAME && !q.cname {
+				if len(w.answers) != 0 {
+					t.Errorf("%s: %d-byte answer sent over CNAME", q.name, len(want))
+				}
+				continue
+			}
+			if got := channelPayload(t, qtype, w.answers); !bytes.Equal(got, want) {
+				t.Errorf("%s over type %d: %q, want %q", q.name, qtype, got, want)
+			}
+			for _, rr := range w.answers {
+				if rr.Type != qtype {
+					t.Errorf("%s: answered with type %d, want %d", q.name, rr.Type, qtype)
+				}
+			}
+		}
+	}
+}
+
+func TestProbeAnswer(t *testing.T) {
+	s := newTestServer(t)
+	w := serveQuery(s, "k3x9.probe."+testDomain, dns.TypeTXT)
+	if len(w.answers) != 1 {
+		t.Fatalf("%d answers", len(w.answers))
+	}
+	text := strings.Join(txtStrings(w.answers[0].Data), "")
+	if len(text) != 240 || !strings.HasPrefix(text, "k3x9-k3x9-") {
+		t.Fatalf("probe answer %q (%d characters)", text, len(text))
+	}
+
+	for _, name := range []string{"probe." + testDomain, "k3x9.probe.other.test"} {
+		if w := serveQuery(s, name, dns.TypeTXT); len(w.answers) != 0 {
+			t.Errorf("%s answered", name)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the codec a sender applied to the file before chunking it
+type Compression string
+
+// Supported compression codecs
+const (
+	CompressionNone    Compression = "none"
+	CompressionGzip    Compression = "gzip"
+	CompressionDeflate Compression = "deflate" // Raw DEFLATE (RFC 1951)
+	CompressionZlib    Compression = "zlib"
+	CompressionZstd    Compression = "zstd"
+)
+
+// maxDecompressedBytes caps how large a decompressed file may get in a domain
+// without a file size quota, so a small compression bomb can't exhaust memory
+const maxDecompressedBytes = 1 << 30
+
+// errDecompressedTooLarge means decompression stopped at its limit
+var errDecompressedTooLarge = errors.New("decompressed size exceeds limit")
+
+// ParseCompression parses a compression codec name
+func ParseCompression(name string) (Compression, error) {
+	switch codec := Compression(strings.ToLower(name)); codec {
+	case CompressionNone, CompressionGzip, CompressionDeflate, CompressionZlib, CompressionZstd:
+		return codec, nil
+	default:
+		return "", fmt.Errorf("unknown compression %q (want none, gzip, deflate, zlib or zstd)", name)
+	}
+}
+
+// Decompress decompresses data with this codec, failing with
+// errDecompressedTooLarge once the output grows past limit bytes
+func (c Compression) Decompress(data []byte, limit int64) ([]byte, error) {
+	var r io.Reader
+	switch c {
+	case CompressionNone, "":
+		return data, nil
+	case CompressionGzip:
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	case CompressionDeflate:
+		fr := flate.NewReader(bytes.NewReader(data))
+		defer fr.Close()
+		r = fr
+	case CompressionZlib:
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	case CompressionZstd:
+		zr, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderMaxMemory(uint64(max(limit, 1))))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return nil, fmt.Errorf("unknown compression %q", string(c))
+	}
+
+	out, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		return nil, errDecompressedTooLarge
+	}
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > limit {
+		return nil, errDecompressedTooLarge
+	}
+	return out, nil
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compress compresses data with a codec as the scripts' tools do
+func compress(t *testing.T, c Compression, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch c {
+	case CompressionGzip:
+		w = gzip.NewWriter(&buf)
+	case CompressionDeflate:
+		w, err = flate.NewWriter(&buf, flate.BestCompression)
+	case CompressionZlib:
+		w = zlib.NewWriter(&buf)
+	case CompressionZstd:
+		w, err = zstd.NewWriter(&buf)
+	default:
+		return data
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompressLimit(t *testing.T) {
+	data := bytes.Repeat([]byte("youkaidns "), 10000) // Compresses to a few hundred bytes
+
+	for _, c := range []Compression{CompressionNone, CompressionGzip, CompressionDeflate, CompressionZlib, CompressionZstd} {
+		t.Run(string(c), func(t *testing.T) {
+			compressed := compress(t, c, data)
+
+			got, err := c.Decompress(compressed, int64(len(data)))
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("decompressed %d bytes, %v", len(got), err)
+			}
+			if c == CompressionNone {
+				return
+			}
+			if _, err := c.Decompress(compressed, int64(len(data))-1); !errors.Is(err, errDecompressedTooLarge) {
+				t.Fatalf("one byte over the limit: %v", err)
+			}
+		})
+	}
+}
+
+func TestCompressedTransferLimits(t *testing.T) {
+	file := []byte(strings.Repeat("a compressible line of a compressible file\n", 200))
+	wire := compress(t, CompressionGzip, file)
+
+	tests := []struct {
+		name        string
+		declared    int   // s- option, -1 to leave it out
+		maxFileSize int64 // Domain quota, 0 for none
+		fail        string
+	}{
+		{"declared size", len(file), 0, ""},
+		{"undeclared size", -1, 0, ""},
+		{"more than declared", len(file) - 1, 0, "output larger than"},
+		{"over the file size quota", -1, int64(len(file)) - 1, "output larger than"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.primaryDomain().MaxFileSize = tt.maxFileSize
+			tr := testTransfer{Name: "big.log", File: file, Wire: wire, Options: []string{"c-gzip"}}
+			if tt.declared >= 0 {
+				tr.Options = append(tr.Options, "s-"+strconv.Itoa(tt.declared))
+			}
+
+			assembly := waitFinished(t, s, sendTransfer(t, s, tr))
+			if tt.fail == "" {
+				if assembly.FailStatus != "" || !assembly.Verified {
+					t.Fatalf("transfer failed: %s", assembly.FailReason)
+				}
+				return
+			}
+			if assembly.FailStatus != HistoryFailed || !strings.Contains(assembly.FailReason, tt.fail) {
+				t.Fatalf("transfer %q: %s, want a failure containing %q", assembly.FailStatus, assembly.FailReason, tt.fail)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Cipher is the AEAD a sender used to encrypt the payload
+type Cipher string
+
+// Supported ciphers
+const (
+	CipherNone             Cipher = "none"
+	CipherAESGCM           Cipher = "aes-gcm"           // AES-256-GCM
+	CipherChaCha20Poly1305 Cipher = "chacha20-poly1305" // ChaCha20-Poly1305
+)
+
+// Key derivation parameters, shared with the transfer scripts:
+// key = PBKDF2-HMAC-SHA256(passphrase, "youkaidns", 100000 iterations, 32 bytes)
+const (
+	kdfSalt       = "youkaidns"
+	kdfIterations = 100000
+	kdfKeyLen     = 32
+)
+
+// nonceSize is the nonce length for both supported ciphers
+const nonceSize = 12
+
+// errAuthFailed means the payload didn't authenticate: wrong key, or data
+// was tampered with or corrupted on the way
+var errAuthFailed = errors.New("authentication failed")
+
+// ParseCipher parses a cipher name
+func ParseCipher(name string) (Cipher, error) {
+	switch c := Cipher(strings.ToLower(name)); c {
+	case CipherNone, CipherAESGCM, CipherChaCha20Poly1305:
+		return c, nil
+	default:
+		return "", fmt.Errorf("unknown cipher %q (want aes-gcm or chacha20-poly1305)", name)
+	}
+}
+
+// DeriveKey derives the transfer encryption key from a passphrase
+func DeriveKey(passphrase string) []byte {
+	return pbkdf2.Key([]byte(passphrase), []byte(kdfSalt), kdfIterations, kdfKeyLen, sha256.New)
+}
+
+// SetEncryptionKey sets the pre-shared passphrase used to decrypt encrypted
+// transfers. An empty passphrase disables decryption.
+func (s *Server) SetEncryptionKey(passphrase string) {
+	s.assemblyMu.Lock()
+	defer s.assemblyMu.Unlock()
+
+	if passphrase == "" {
+		s.encryptionKey = nil
+		return
+	}
+	s.encryptionKey = DeriveKey(passphrase)
+}
+
+// domainKey returns the pre-shared key of served domain d, falling back to
+// the server's; nil if neither is set
+func (s *Server) domainKey(d *Domain) []byte {
+	if d != nil && d.encryptionKey != nil {
+		return d.encryptionKey
+	}
+	s.assemblyMu.RLock()
+	defer s.assemblyMu.RUnlock()
+	return s.encryptionKey
+}
+
+// newAEAD returns the AEAD of the cipher for key, nil for CipherNone
+func (c Cipher) newAEAD(key []byte) (cipher.AEAD, error) {
+	switch c {
+	case CipherNone, "":
+		return nil, nil
+	case CipherAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CipherChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	default:
+		return nil, fmt.Errorf("unknown cipher %q", string(c))
+	}
+}
+
+// Encrypt seals plaintext with key, returning the ciphertext followed by the
+// tag. ad is bound as additional data.
+func (c Cipher) Encrypt(key []byte, nonce []byte, ad string, plaintext []byte) ([]byte, error) {
+	aead, err := c.newAEAD(key)
+	if err != nil || aead == nil {
+		return plaintext, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("nonce is %d bytes, want %d", len(nonce), aead.NonceSize())
+	}
+	return aead.Seal(nil, nonce, plaintext, []byte(ad)), nil
+}
+
+// Decrypt opens payload (ciphertext followed by the tag) with key. The
+// transfer hash is bound as additional data, so a payload can't be replayed
+// under another transfer.
+func (c Cipher) Decrypt(key []byte, nonce []byte, hash8 string, payload []byte) ([]byte, error) {
+	aead, err := c.newAEAD(key)
+	if err != nil || aead == nil {
+		return payload, err
+	}
+
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("nonce is %d bytes, want %d", len(nonce), aead.NonceSize())
+	}
+
+	plaintext, err := aead.Open(nil, nonce, payload, []byte(strings.ToLower(hash8)))
+	if err != nil {
+		return nil, errAuthFailed
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestDeriveKeyMatchesScripts(t *testing.T) {
+	// hashlib.pbkdf2_hmac("sha256", b"correct horse", b"youkaidns", 100000, 32),
+	// as the scripts derive it
+	want := "32c5b4593ebf5366172cbd0d196a40ce0dfdc2521e0af182695ef6861bc6d802"
+	if got := hex.EncodeToString(DeriveKey("correct horse")); got != want {
+		t.Fatalf("key %s, want %s", got, want)
+	}
+}
+
+func TestCipherRoundTrip(t *testing.T) {
+	key := DeriveKey("correct horse")
+	nonce := bytes.Repeat([]byte{7}, nonceSize)
+	plaintext := []byte("secret payload")
+
+	for _, c := range []Cipher{CipherAESGCM, CipherChaCha20Poly1305} {
+		t.Run(string(c), func(t *testing.T) {
+			sealed, err := c.Encrypt(key, nonce, "0123abcd", plaintext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := c.Decrypt(key, nonce, "0123ABCD", sealed)
+			if err != nil || !bytes.Equal(got, plaintext) {
+				t.Fatalf("decrypted %q, %v", got, err)
+			}
+
+			tampered := append([]byte(nil), sealed...)
+			tampered[0] ^= 1
+			for name, try := range map[string]func() ([]byte, error){
+				"wrong key":       func() ([]byte, error) { return c.Decrypt(DeriveKey("wrong"), nonce, "0123abcd", sealed) },
+				"other transfer":  func() ([]byte, error) { return c.Decrypt(key, nonce, "0123abce", sealed) },
+				"tampered":        func() ([]byte, error) { return c.Decrypt(key, nonce, "0123abcd", tampered) },
+				"truncated tag":   func() ([]byte, error) { return c.Decrypt(key, nonce, "0123abcd", sealed[:len(sealed)-1]) },
+				"different nonce": func() ([]byte, error) { return c.Decrypt(key, bytes.Repeat([]byte{8}, nonceSize), "0123abcd", sealed) },
+			} {
+				if _, err := try(); !errors.Is(err, errAuthFailed) {
+					t.Errorf("%s: %v, want authentication failure", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestEncryptedTransfer(t *testing.T) {
+	file := []byte("a file encrypted end to end with the pre-shared key")
+	nonce := bytes.Repeat([]byte{0x42}, nonceSize)
+	hash8 := testTransfer{File: file}.hash8()
+
+	tests := []struct {
+		name       string
+		serverPSK  string
+		senderPSK  string
+		wantStatus string
+	}{
+		{"matching key", "correct horse", "correct horse", ""},
+		{"wrong key", "correct horse", "battery staple", HistoryAuthFailed},
+		{"no key on the server", "", "correct horse", HistoryFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.SetEncryptionKey(tt.serverPSK)
+			wire, err := CipherChaCha20Poly1305.Encrypt(DeriveKey(tt.senderPSK), nonce, hash8, file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tr := testTransfer{Name: "secret.txt", File: file, Wire: wire, Options: []string{"x-chacha20-poly1305", "n-" + hex.EncodeToString(nonce)}}
+			assembly := waitFinished(t, s, sendTransfer(t, s, tr))
+			if assembly.FailStatus != tt.wantStatus {
+				t.Fatalf("status %q (%s), want %q", assembly.FailStatus, assembly.FailReason, tt.wantStatus)
+			}
+			if tt.wantStatus == "" && !assembly.Verified {
+				t.Fatal("decrypted file doesn't match its hash")
+			}
+		})
+	}
+}
@@ -0,0 +1,339 @@
+package server
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Domain is a served domain. Each domain saves into its own output directory
+// under its own quotas, decrypts with its own key and serves its own payloads
+// (transfer scripts come with the domain filled in). Transfers, missing-chunk
+// queries and acknowledgements only see transfers of the same domain.
+type Domain struct {
+	Name      string // Lowercase suffix; empty matches every query
+	OutputDir string
+
+	// Quotas, 0 for no limit
+	MaxFileSize    int64 // Largest transfer, declared or saved, in bytes
+	MaxStoredBytes int64 // Bytes the domain may save in its output directory
+	MaxTransfers   int   // Incomplete transfers at a time
+
+	encryptionKey []byte              // nil uses the server's pre-shared key
+	payloads      map[string]*payload // payload name -> chunks, guarded by Server.payloadMu
+	stored        *storedCounter      // Bytes in the output directory, shared by the domains saving there
+	transfers     int64               // Incomplete transfers (atomic)
+}
+
+// storedCounter counts the bytes saved in an output directory. Domains that
+// share the directory share its counter, so every save, overwrite and
+// deletion is counted once for all of them.
+type storedCounter struct {
+	bytes int64 // atomic
+}
+
+// DomainConfig configures a served domain
+type DomainConfig struct {
+	Name           string
+	OutputDir      string // Created if missing
+	Passphrase     string // Pre-shared key for this domain, empty for the server's
+	MaxFileSize    int64
+	MaxStoredBytes int64
+	MaxTransfers   int
+}
+
+// DomainInfo describes a served domain for the API
+type DomainInfo struct {
+	Name           string   `json:"name"`
+	OutputDir      string   `json:"output_dir"`
+	MaxFileSize    int64    `json:"max_file_size"`
+	MaxStoredBytes int64    `json:"max_stored_bytes"`
+	MaxTransfers   int      `json:"max_transfers"`
+	StoredBytes    int64    `json:"stored_bytes"`
+	Transfers      int      `json:"transfers"` // Incomplete transfers
+	Encrypted      bool     `json:"encrypted"` // A pre-shared key is set for the domain
+	Payloads       []string `json:"payloads"`
+}
+
+// newDomain creates a domain and its output directory. The domain is returned
+// even if the directory can't be created. Bytes already stored are counted by
+// countStored once the domain is served.
+func newDomain(cfg DomainConfig) (*Domain, error) {
+	d := &Domain{
+		Name:           normalizeDomain(cfg.Name),
+		OutputDir:      cfg.OutputDir,
+		MaxFileSize:    cfg.MaxFileSize,
+		MaxStoredBytes: cfg.MaxStoredBytes,
+		MaxTransfers:   cfg.MaxTransfers,
+		payloads:       make(map[string]*payload),
+		stored:         &storedCounter{},
+	}
+	if cfg.Passphrase != "" {
+		d.encryptionKey = DeriveKey(cfg.Passphrase)
+	}
+
+	return d, os.MkdirAll(d.OutputDir, 0755)
+}
+
+// normalizeDomain lowercases a domain and strips surrounding dots
+func normalizeDomain(name string) string {
+	return strings.Trim(strings.ToLower(name), ".")
+}
+
+// countStored sets the stored bytes of every output directory and gives the
+// domains sharing one the same counter. The output directories of other
+// domains nested inside one (such as <output-dir>/<domain>) don't count
+// against it.
+func countStored(domains []*Domain) {
+	counters := make(map[string]*storedCounter)
+	for _, d := range domains {
+		dir := filepath.Clean(d.OutputDir)
+		if counter, exists := counters[dir]; exists {
+			d.stored = counter
+			continue
+		}
+
+		skip := make(map[string]bool)
+		for _, other := range domains {
+			if filepath.Clean(other.OutputDir) != dir {
+				skip[filepath.Clean(other.OutputDir)] = true
+			}
+		}
+		d.stored = &storedCounter{bytes: storedBytes(d.OutputDir, skip)}
+		counters[dir] = d.stored
+	}
+}
+
+// storedBytes sums the sizes of the received files under dir, skipping the
+// metadata directory, in-progress temp files and the directories in skip
+func storedBytes(dir string, skip map[string]bool) int64 {
+	var total int64
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if entry.IsDir() && skip[filepath.Clean(path)] {
+			return filepath.SkipDir
+		}
+		if path != dir && isInternalFile(entry.Name()) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.Type().IsRegular() {
+			if info, err := entry.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+// AddDomain adds a served domain, or reconfigures it if it is already served.
+// Domains must be added before payloads are registered and before Start.
+func (s *Server) AddDomain(cfg DomainConfig) error {
+	d, err := newDomain(cfg)
+	if err != nil {
+		return fmt.Errorf("domain %s: %w", cfg.Name, err)
+	}
+
+	s.domainMu.Lock()
+	defer s.domainMu.Unlock()
+
+	replaced := false
+	for i, existing := range s.domains {
+		if existing.Name == d.Name {
+			s.domains[i] = d
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		s.domains = append(s.domains, d)
+	}
+	countStored(s.domains)
+	return nil
+}
+
+// matchDomain returns the served domain a query falls under (the longest
+// matching suffix), or nil if it is outside all of them
+func (s *Server) matchDomain(queryDomain string) *Domain {
+	queryDomainLower := strings.ToLower(queryDomain)
+
+	s.domainMu.RLock()
+	defer s.domainMu.RUnlock()
+
+	var match *Domain
+	for _, d := range s.domains {
+		if d.Name != "" && !strings.HasSuffix(queryDomainLower, "."+d.Name) {
+			continue
+		}
+		if match == nil || len(d.Name) > len(match.Name) {
+			match = d
+		}
+	}
+	return match
+}
+
+// queryLabels returns the served domain of a query and the query's labels
+// before it (all labels for the catch-all domain). ok is false if the query
+// is outside every served domain.
+func (s *Server) queryLabels(queryDomain string) (*Domain, []string, bool) {
+	d := s.matchDomain(queryDomain)
+	if d == nil {
+		return nil, nil, false
+	}
+
+	queryDomainLower := strings.ToLower(queryDomain)
+	if d.Name == "" {
+		return d, strings.Split(queryDomainLower, "."), true
+	}
+	prefix := queryDomainLower[:len(queryDomainLower)-len("."+d.Name)]
+	return d, strings.Split(prefix, "."), true
+}
+
+// primaryDomain returns the domain given to NewServer
+func (s *Server) primaryDomain() *Domain {
+	s.domainMu.RLock()
+	defer s.domainMu.RUnlock()
+	return s.domains[0]
+}
+
+// allDomains returns the served domains, the primary one first
+func (s *Server) allDomains() []*Domain {
+	s.domainMu.RLock()
+	defer s.domainMu.RUnlock()
+	return append([]*Domain(nil), s.domains...)
+}
+
+// findDomain returns the served domain with the given name, or the primary
+// domain if name is empty
+func (s *Server) findDomain(name string) (*Domain, bool) {
+	name = normalizeDomain(name)
+	if name == "" {
+		return s.primaryDomain(), true
+	}
+	for _, d := range s.allDomains() {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+// transferKey identifies a transfer among all domains' transfers
+func transferKey(d *Domain, hash8 string) string {
+	return d.Name + "/" + hash8
+}
+
+// key returns the transfer key of the assembly
+func (a *FileAssembly) key() string {
+	return transferKey(a.Domain, a.Hash)
+}
+
+// checkTransferQuota reports why a transfer of the given declared sizes
+// (wire bytes and original file bytes, -1 if unknown) can't start in d, or
+// nil if it can
+func (d *Domain) checkTransferQuota(totalBytes int64, fileBytes int64) error {
+	if d.MaxFileSize > 0 && (totalBytes > d.MaxFileSize || fileBytes > d.MaxFileSize) {
+		return fmt.Errorf("transfer is larger than the %d byte limit", d.MaxFileSize)
+	}
+	return d.checkStoredQuota(totalBytes)
+}
+
+// checkStoredQuota reports whether saving size more bytes would exceed the
+// domain's storage quota
+func (d *Domain) checkStoredQuota(size int64) error {
+	if d.MaxStoredBytes > 0 && atomic.LoadInt64(&d.stored.bytes)+size > d.MaxStoredBytes {
+		return fmt.Errorf("storage quota of %d bytes reached", d.MaxStoredBytes)
+	}
+	return nil
+}
+
+// reserveStored counts size bytes against the domain's storage quota before
+// they are saved, failing if the quota would be exceeded
+func (d *Domain) reserveStored(size int64) error {
+	for {
+		stored := atomic.LoadInt64(&d.stored.bytes)
+		if d.MaxStoredBytes > 0 && stored+size > d.MaxStoredBytes {
+			return fmt.Errorf("storage quota of %d bytes reached", d.MaxStoredBytes)
+		}
+		if atomic.CompareAndSwapInt64(&d.stored.bytes, stored, stored+size) {
+			return nil
+		}
+	}
+}
+
+// releaseStored returns bytes to the storage quota: those reserved for a save
+// that failed, or those of a file that was deleted or overwritten
+func (d *Domain) releaseStored(size int64) {
+	atomic.AddInt64(&d.stored.bytes, -size)
+}
+
+// releaseStoredIn returns the bytes of a file removed from the output
+// directory dir to the storage quota of the domains saving there
+func (s *Server) releaseStoredIn(dir string, size int64) {
+	for _, d := range s.allDomains() {
+		if filepath.Clean(d.OutputDir) == filepath.Clean(dir) {
+			d.releaseStored(size) // The counter is shared, so once is enough
+			return
+		}
+	}
+}
+
+// startTransfer counts a new incomplete transfer against the domain's quota,
+// failing if MaxTransfers are already in progress. The caller must hold
+// s.assemblyMu, so checks and counts of new transfers don't interleave.
+func (d *Domain) startTransfer() bool {
+	if d.MaxTransfers > 0 && atomic.LoadInt64(&d.transfers) >= int64(d.MaxTransfers) {
+		return false
+	}
+	atomic.AddInt64(&d.transfers, 1)
+	return true
+}
+
+// endTransfer uncounts a transfer that was saved, failed or timed out. The
+// caller must hold the assembly's mu and call it only once per transfer.
+func (d *Domain) endTransfer() {
+	atomic.AddInt64(&d.transfers, -1)
+}
+
+// GetDomains returns the served domains, the primary one first
+func (s *Server) GetDomains() []DomainInfo {
+	domains := s.allDomains()
+
+	s.assemblyMu.RLock()
+	serverKey := s.encryptionKey
+	s.assemblyMu.RUnlock()
+
+	s.payloadMu.RLock()
+	defer s.payloadMu.RUnlock()
+
+	infos := make([]DomainInfo, 0, len(domains))
+	for _, d := range domains {
+		names := make([]string, 0, len(d.payloads))
+		for name := range d.payloads {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		infos = append(infos, DomainInfo{
+			Name:           d.Name,
+			OutputDir:      d.OutputDir,
+			MaxFileSize:    d.MaxFileSize,
+			MaxStoredBytes: d.MaxStoredBytes,
+			MaxTransfers:   d.MaxTransfers,
+			StoredBytes:    atomic.LoadInt64(&d.stored.bytes),
+			Transfers:      int(atomic.LoadInt64(&d.transfers)),
+			Encrypted:      d.encryptionKey != nil || serverKey != nil,
+			Payloads:       names,
+		})
+	}
+	return infos
+}
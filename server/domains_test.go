@@ -0,0 +1,140 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"youkaidns/dns"
+)
+
+func TestMaxTransfers(t *testing.T) {
+	s := newTestServer(t)
+	if err := s.AddDomain(DomainConfig{Name: testDomain, OutputDir: t.TempDir(), MaxTransfers: 1}); err != nil {
+		t.Fatal(err)
+	}
+	active := func() int {
+		t.Helper()
+		return s.GetDomains()[0].Transfers
+	}
+	start := func(tr testTransfer) bool {
+		t.Helper()
+		return len(serveQuery(s, tr.startRecord(s), dns.TypeTXT).answers) > 0
+	}
+
+	saved := testTransfer{Name: "saved.txt", File: make([]byte, 45)}
+	if !start(saved) || active() != 1 {
+		t.Fatalf("first transfer not started (%d active)", active())
+	}
+	waiting := testTransfer{Name: "waiting.txt", File: []byte("waiting")}
+	if start(waiting) {
+		t.Fatal("start record over the limit acknowledged")
+	}
+	if w := serveQuery(s, waiting.dataRecord(s, 1), dns.TypeTXT); len(w.answers) != 0 {
+		t.Fatal("data record of a new transfer over the limit acknowledged")
+	}
+
+	// A saved transfer frees its slot
+	waitFinished(t, s, sendTransfer(t, s, saved))
+	if active() != 0 {
+		t.Fatalf("%d active after a save", active())
+	}
+
+	// So does a failed one
+	failed := testTransfer{Name: "failed.txt", File: []byte("not gzip"), Options: []string{"c-gzip"}}
+	if assembly := waitFinished(t, s, sendTransfer(t, s, failed)); assembly.FailStatus == "" || active() != 0 {
+		t.Fatalf("failed transfer: status %q, %d active", assembly.FailStatus, active())
+	}
+
+	// And one that times out
+	if !start(waiting) {
+		t.Fatal("transfer not started after the others finished")
+	}
+	s.SetTransferTimeout(time.Second)
+	s.assemblyMu.Lock()
+	assembly := s.fileAssemblies[transferKey(s.primaryDomain(), waiting.hash8())]
+	s.assemblyMu.Unlock()
+	assembly.mu.Lock()
+	assembly.LastActivity = time.Now().Add(-time.Minute)
+	assembly.mu.Unlock()
+	s.expireStaleAssemblies()
+	if active() != 0 {
+		t.Fatalf("%d active after a timeout", active())
+	}
+	if !start(testTransfer{Name: "next.txt", File: []byte("next")}) {
+		t.Fatal("transfer not started after a timeout")
+	}
+}
+
+func TestExpireSkipsBusyAssemblies(t *testing.T) {
+	s := newTestServer(t)
+	s.SetTransferTimeout(time.Second)
+	tr := testTransfer{Name: "busy.txt", File: []byte("busy")}
+	serveQuery(s, tr.startRecord(s), dns.TypeTXT)
+
+	s.assemblyMu.Lock()
+	assembly := s.fileAssemblies[transferKey(s.primaryDomain(), tr.hash8())]
+	s.assemblyMu.Unlock()
+
+	// A transfer being saved holds its lock; the sweep must not wait on it
+	assembly.mu.Lock()
+	assembly.LastActivity = time.Now().Add(-time.Minute)
+	done := make(chan struct{})
+	go func() {
+		s.expireStaleAssemblies()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sweep blocked on a busy transfer")
+	}
+	assembly.mu.Unlock()
+
+	if s.GetDomains()[0].Transfers != 1 {
+		t.Fatal("busy transfer expired")
+	}
+}
+
+func TestSharedOutputDirQuota(t *testing.T) {
+	s := newTestServer(t)
+	dir := s.primaryDomain().OutputDir
+	if err := s.AddDomain(DomainConfig{Name: "u.test", OutputDir: dir + "/"}); err != nil {
+		t.Fatal(err)
+	}
+	s.SetCollisionPolicy(CollisionOverwrite)
+	stored := func() []int64 {
+		t.Helper()
+		var bytes []int64
+		for _, info := range s.GetDomains() {
+			bytes = append(bytes, info.StoredBytes)
+		}
+		return bytes
+	}
+	check := func(step string, want int64) {
+		t.Helper()
+		for i, got := range stored() {
+			if got != want {
+				t.Fatalf("%s: domain %d stores %d bytes, want %d", step, i, got, want)
+			}
+		}
+	}
+
+	save := func(tr testTransfer) {
+		t.Helper()
+		if assembly := waitFinished(t, s, sendTransfer(t, s, tr)); assembly.FailStatus != "" {
+			t.Fatalf("%s failed: %s", tr.Name, assembly.FailReason)
+		}
+	}
+	save(testTransfer{Name: "report.txt", File: make([]byte, 100)})
+	check("saved", 100)
+
+	// An overwrite replaces the old bytes rather than adding to them
+	save(testTransfer{Name: "report.txt", File: make([]byte, 40)})
+	check("overwritten", 40)
+
+	// A deletion through the other domain is seen by both
+	if err := s.DeleteReceivedFile("u.test", "report.txt"); err != nil {
+		t.Fatal(err)
+	}
+	check("deleted", 0)
+}
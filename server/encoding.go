@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Encoding is the text encoding used for filename and chunk data labels
+type Encoding string
+
+// Supported label encodings. All of them survive resolvers that change the
+// case of query names (DNS 0x20), since names are case-insensitive.
+const (
+	EncodingHex    Encoding = "hex" // 2 chars per byte (default)
+	EncodingBase32 Encoding = "b32" // RFC 4648 base32hex without padding, 1.6 chars per byte
+	EncodingBase36 Encoding = "b36" // 7-byte blocks as 11 base36 digits, ~1.57 chars per byte
+)
+
+// base32Hex is the extended hex alphabet (0-9A-V), which keeps encoded labels
+// free of characters that look like protocol markers
+var base32Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// base36Digits is the base36 alphabet
+const base36Digits = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+// base36BlockBytes is the number of bytes per full base36 block
+const base36BlockBytes = 7
+
+// base36BlockChars maps an encoded base36 block length to the number of bytes
+// it holds. Each length is the fewest digits that can represent n bytes.
+var base36BlockChars = map[int]int{2: 1, 4: 2, 5: 3, 7: 4, 8: 5, 10: 6, 11: 7}
+
+// ParseEncoding parses a label encoding name
+func ParseEncoding(name string) (Encoding, error) {
+	switch enc := Encoding(strings.ToLower(name)); enc {
+	case EncodingHex, EncodingBase32, EncodingBase36:
+		return enc, nil
+	default:
+		return "", fmt.Errorf("unknown encoding %q (want hex, b32 or b36)", name)
+	}
+}
+
+// Decode decodes label text in this encoding
+func (e Encoding) Decode(text string) ([]byte, error) {
+	switch e {
+	case EncodingHex, "":
+		return hex.DecodeString(text)
+	case EncodingBase32:
+		return base32Hex.DecodeString(strings.ToUpper(text))
+	case EncodingBase36:
+		return decodeBase36(strings.ToLower(text))
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", string(e))
+	}
+}
+
+// decodeBase36 decodes fixed-width base36 blocks. Every 11 digits carry 7
+// bytes (big-endian). A shorter final block carries fewer bytes.
+func decodeBase36(text string) ([]byte, error) {
+	fullChars := 11
+	out := make([]byte, 0, len(text)*base36BlockBytes/fullChars+base36BlockBytes)
+
+	for len(text) > 0 {
+		blockLen := fullChars
+		if len(text) < blockLen {
+			blockLen = len(text)
+		}
+		numBytes, ok := base36BlockChars[blockLen]
+		if !ok {
+			return nil, fmt.Errorf("invalid base36 block length %d", blockLen)
+		}
+
+		var value uint64
+		for _, c := range text[:blockLen] {
+			digit := strings.IndexRune(base36Digits, c)
+			if digit < 0 {
+				return nil, fmt.Errorf("invalid base36 digit %q", c)
+			}
+			value = value*36 + uint64(digit)
+		}
+		if numBytes < 8 && value>>(8*numBytes) != 0 {
+			return nil, errors.New("base36 block overflows its byte count")
+		}
+
+		for i := numBytes - 1; i >= 0; i-- {
+			out = append(out, byte(value>>(8*i)))
+		}
+		text = text[blockLen:]
+	}
+
+	return out, nil
+}
+
+// isOptionLabel reports whether a label is a key-value protocol option
+// (e.g. e-b32). Encoded data and hash labels never contain a dash.
+func isOptionLabel(label string) bool {
+	return strings.Contains(label, "-")
+}
+
+// parseOptionLabel splits an option label into its key and value
+func parseOptionLabel(label string) (string, string) {
+	key, value, _ := strings.Cut(label, "-")
+	return key, value
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"youkaidns/dns"
+)
+
+// encodeLabel encodes data as label text the way script.sh does
+func encodeLabel(e Encoding, data []byte) string {
+	switch e {
+	case EncodingBase32:
+		return strings.ToLower(base32Hex.EncodeToString(data))
+	case EncodingBase36:
+		return encodeBase36(data)
+	default:
+		return hex.EncodeToString(data)
+	}
+}
+
+// encodeBase36 is encode_base36 from script.sh: 7-byte blocks as 11 digits,
+// a shorter final block as the fewest digits that hold it
+func encodeBase36(data []byte) string {
+	widths := map[int]int{}
+	for chars, n := range base36BlockChars {
+		widths[n] = chars
+	}
+
+	var out strings.Builder
+	for len(data) > 0 {
+		block := data[:min(base36BlockBytes, len(data))]
+		data = data[len(block):]
+
+		var value uint64
+		for _, b := range block {
+			value = value<<8 | uint64(b)
+		}
+		digits := make([]byte, widths[len(block)])
+		for i := len(digits) - 1; i >= 0; i-- {
+			digits[i] = base36Digits[value%36]
+			value /= 36
+		}
+		out.Write(digits)
+	}
+	return out.String()
+}
+
+func TestEncodingsRoundTrip(t *testing.T) {
+	data := make([]byte, 64)
+	for i := range data {
+		data[i] = byte(255 - i*13)
+	}
+
+	for _, e := range []Encoding{EncodingHex, EncodingBase32, EncodingBase36} {
+		for n := 0; n <= len(data); n++ {
+			text := encodeLabel(e, data[:n])
+			// Resolvers may change the case of query names (DNS 0x20)
+			for _, variant := range []string{text, strings.ToUpper(text)} {
+				got, err := e.Decode(variant)
+				if err != nil {
+					t.Fatalf("%s: decoding %d bytes: %v", e, n, err)
+				}
+				if !bytes.Equal(got, data[:n]) {
+					t.Fatalf("%s: %d bytes decoded as %x", e, n, got)
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeBase36Rejects(t *testing.T) {
+	for _, text := range []string{
+		"abc",         // 3 digits is no block length
+		"zzzzzzzzzzz", // Overflows 7 bytes
+		"zz",          // Overflows 1 byte
+		"0000000000_", // Not a digit
+	} {
+		if _, err := EncodingBase36.Decode(text); err == nil {
+			t.Errorf("decoded %q", text)
+		}
+	}
+}
+
+func TestParseEncoding(t *testing.T) {
+	for _, name := range []string{"hex", "b32", "B36"} {
+		if _, err := ParseEncoding(name); err != nil {
+			t.Errorf("ParseEncoding(%q): %v", name, err)
+		}
+	}
+	if _, err := ParseEncoding("base64"); err == nil {
+		t.Error("ParseEncoding accepted base64")
+	}
+}
+
+func TestTransferInEachEncoding(t *testing.T) {
+	file := []byte("a file sent with labels in each of the supported encodings")
+	for _, e := range []Encoding{EncodingHex, EncodingBase32, EncodingBase36} {
+		t.Run(string(e), func(t *testing.T) {
+			s := newTestServer(t)
+			tr := testTransfer{Name: "enc.txt", File: file, Encoding: e}
+
+			// A data record ahead of the start record is kept until the
+			// start record names its encoding
+			if w := serveQuery(s, tr.dataRecord(s, 2), dns.TypeTXT); len(w.answers) == 0 {
+				t.Fatal("early data record not acknowledged")
+			}
+			hash8 := sendTransfer(t, s, tr)
+
+			assembly := waitFinished(t, s, hash8)
+			if assembly.FailStatus != "" || !assembly.Verified {
+				t.Fatalf("transfer %s, verified %v: %s", assembly.FailStatus, assembly.Verified, assembly.FailReason)
+			}
+		})
+	}
+}
+
+func TestEarlyPartsCapped(t *testing.T) {
+	s := newTestServer(t)
+	tr := testTransfer{Name: "early.bin", File: make([]byte, 30*(maxPendingParts+2))}
+	for i := range tr.File {
+		tr.File[i] = byte(i)
+	}
+
+	for part := 1; part <= maxPendingParts; part++ {
+		if w := serveQuery(s, tr.dataRecord(s, part), dns.TypeTXT); len(w.answers) == 0 {
+			t.Fatalf("early part %d not acknowledged", part)
+		}
+	}
+	if w := serveQuery(s, tr.dataRecord(s, maxPendingParts+1), dns.TypeTXT); len(w.answers) != 0 {
+		t.Fatal("early part over the cap acknowledged")
+	}
+	if w := serveQuery(s, tr.dataRecord(s, 1), dns.TypeTXT); len(w.answers) == 0 {
+		t.Fatal("repeated early part not acknowledged")
+	}
+
+	// Once the start record arrives the rest are taken as usual
+	if assembly := waitFinished(t, s, sendTransfer(t, s, tr)); assembly.FailStatus != "" || !assembly.Verified {
+		t.Fatalf("transfer %s, verified %v: %s", assembly.FailStatus, assembly.Verified, assembly.FailReason)
+	}
+}
+
+func TestStartRecordDuringParts(t *testing.T) {
+	s := newTestServer(t)
+	tr := testTransfer{Name: "racy.bin", File: make([]byte, 30*40)}
+
+	// Repeated start records update the assembly while parts arrive; run
+	// with -race to check the parts are logged from a consistent copy
+	serveQuery(s, tr.startRecord(s), dns.TypeTXT) // Builds the handler chain
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			serveQuery(s, tr.startRecord(s), dns.TypeTXT)
+		}
+	}()
+	for part := 1; part <= tr.totalParts(); part++ {
+		serveQuery(s, tr.dataRecord(s, part), dns.TypeTXT)
+	}
+	<-done
+
+	if assembly := waitFinished(t, s, sendTransfer(t, s, tr)); assembly.FailStatus != "" {
+		t.Fatalf("transfer failed: %s", assembly.FailReason)
+	}
+}
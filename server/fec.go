@@ -0,0 +1,290 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// FEC is the forward error correction a sender declared with the start
+// option f-<data>-<parity>: every group of Data data parts gets Parity parity
+// parts, so up to Parity lost parts of a group can be rebuilt without a retry.
+//
+// Parity parts are numbered after the data parts: parity j (0-based) of
+// group g (0-based) is part total_parts + g*Parity + j + 1. Group g holds data
+// parts g*Data+1 to (g+1)*Data; the last group may be shorter. Data parts are
+// zero-padded to the chunk size and parity j is
+//
+//	p_j = sum over i of coef(j, i) * d_i   in GF(256) (polynomial 0x11d)
+//	coef(j, i) = (255 ^ i) / ((255 - j) ^ i)
+//
+// where i is the part's index within its group. This is a Cauchy matrix with
+// its columns scaled so the first parity part is the plain XOR of the group.
+type FEC struct {
+	Data   int // Data parts per group
+	Parity int // Parity parts per group
+}
+
+// maxFECShards is the largest group (data plus parity parts) the GF(256)
+// code supports
+const maxFECShards = 256
+
+// ParseFEC parses an FEC option value ("<data>-<parity>")
+func ParseFEC(value string) (FEC, error) {
+	dataStr, parityStr, ok := strings.Cut(value, "-")
+	if !ok {
+		return FEC{}, fmt.Errorf("invalid FEC %q (want <data>-<parity>)", value)
+	}
+	data, err := strconv.Atoi(dataStr)
+	if err != nil || data < 1 {
+		return FEC{}, fmt.Errorf("invalid FEC data parts %q", dataStr)
+	}
+	parity, err := strconv.Atoi(parityStr)
+	if err != nil || parity < 1 {
+		return FEC{}, fmt.Errorf("invalid FEC parity parts %q", parityStr)
+	}
+	if data+parity > maxFECShards {
+		return FEC{}, fmt.Errorf("FEC group %d+%d is larger than %d parts", data, parity, maxFECShards)
+	}
+	return FEC{Data: data, Parity: parity}, nil
+}
+
+// Enabled reports whether the sender sends parity parts
+func (f FEC) Enabled() bool {
+	return f.Data > 0 && f.Parity > 0
+}
+
+// String returns the option value, or "none" without FEC
+func (f FEC) String() string {
+	if !f.Enabled() {
+		return "none"
+	}
+	return fmt.Sprintf("%d-%d", f.Data, f.Parity)
+}
+
+// ParityParts returns the number of parity parts sent for totalParts data parts
+func (f FEC) ParityParts(totalParts int) int {
+	if !f.Enabled() || totalParts <= 0 {
+		return 0
+	}
+	return (totalParts + f.Data - 1) / f.Data * f.Parity
+}
+
+// isParityPart reports whether partNum is a parity part of the assembly
+func (a *FileAssembly) isParityPart(partNum int) bool {
+	return a.FEC.Enabled() && a.TotalParts > 0 &&
+		partNum > a.TotalParts && partNum <= a.TotalParts+a.FEC.ParityParts(a.TotalParts)
+}
+
+// errPartOutOfRange is returned for part numbers past the data and parity
+// parts the start record declared
+var errPartOutOfRange = errors.New("part number out of range")
+
+// addPart stores a received data or parity part, rebuilds any data parts of
+// its group that FEC makes recoverable and advances the contiguous mark. It
+// returns true if the part had already been received. Parts outside 1 to
+// TotalParts plus the parity parts are dropped with errPartOutOfRange. The
+// caller must hold a.mu.
+func (a *FileAssembly) addPart(partNum int, data []byte) (bool, error) {
+	if partNum < 1 || a.TotalParts > 0 && partNum > a.TotalParts+a.FEC.ParityParts(a.TotalParts) {
+		return false, errPartOutOfRange
+	}
+
+	var duplicate bool
+	if a.isParityPart(partNum) {
+		if a.Parity == nil {
+			a.Parity = make(map[int][]byte)
+		}
+		_, duplicate = a.Parity[partNum]
+		a.Parity[partNum] = data
+		a.recoverGroup((partNum - a.TotalParts - 1) / a.FEC.Parity)
+	} else {
+		_, duplicate = a.Parts[partNum]
+		a.Parts[partNum] = data
+		if a.FEC.Enabled() && a.TotalParts > 0 {
+			a.recoverGroup((partNum - 1) / a.FEC.Data)
+		}
+	}
+
+	a.advanceContiguous()
+	return duplicate, nil
+}
+
+// recoverGroup rebuilds the missing data parts of an FEC group once as many
+// of its parity parts have arrived as data parts are missing. The caller must
+// hold a.mu.
+func (a *FileAssembly) recoverGroup(group int) {
+	first := group*a.FEC.Data + 1
+	if first > a.TotalParts || a.ChunkSize <= 0 {
+		return
+	}
+	count := a.FEC.Data
+	if first+count-1 > a.TotalParts {
+		count = a.TotalParts - first + 1
+	}
+
+	var missing []int // Indexes within the group
+	for i := 0; i < count; i++ {
+		if _, exists := a.Parts[first+i]; !exists {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+
+	var rows []int // Parity indexes that arrived
+	parityBase := a.TotalParts + group*a.FEC.Parity + 1
+	for j := 0; j < a.FEC.Parity && len(rows) < len(missing); j++ {
+		if _, exists := a.Parity[parityBase+j]; exists {
+			rows = append(rows, j)
+		}
+	}
+	if len(rows) < len(missing) {
+		return
+	}
+
+	// Syndromes: each parity part minus the contribution of the data parts
+	// that did arrive leaves a combination of the missing ones
+	size := a.ChunkSize
+	syndromes := make([][]byte, len(rows))
+	for r, j := range rows {
+		syndrome := make([]byte, size)
+		copy(syndrome, a.Parity[parityBase+j])
+		for i := 0; i < count; i++ {
+			part, exists := a.Parts[first+i]
+			if !exists {
+				continue
+			}
+			c := fecCoefficient(j, i)
+			for b := 0; b < len(part) && b < size; b++ {
+				syndrome[b] ^= gfMul(c, part[b])
+			}
+		}
+		syndromes[r] = syndrome
+	}
+
+	// Solve coef(rows, missing) * missing parts = syndromes
+	matrix := make([][]byte, len(rows))
+	for r, j := range rows {
+		matrix[r] = make([]byte, len(missing))
+		for c, i := range missing {
+			matrix[r][c] = fecCoefficient(j, i)
+		}
+	}
+	inverse, ok := gfInvert(matrix)
+	if !ok {
+		log.Printf("FEC: singular matrix for group %d of %s", group, a.Hash)
+		return
+	}
+
+	lastSize := int(a.TotalBytes - int64(a.TotalParts-1)*int64(a.ChunkSize))
+	for c, i := range missing {
+		part := make([]byte, size)
+		for r := range rows {
+			coef := inverse[c][r]
+			for b := 0; b < size; b++ {
+				part[b] ^= gfMul(coef, syndromes[r][b])
+			}
+		}
+
+		partNum := first + i
+		if partNum == a.TotalParts && lastSize > 0 && lastSize < size {
+			part = part[:lastSize]
+		}
+		a.Parts[partNum] = part
+		a.RecoveredParts++
+		log.Printf("FEC: recovered part %d/%d for file %s (hash: %s)", partNum, a.TotalParts, a.Filename, a.Hash)
+	}
+}
+
+// fecCoefficient returns the coefficient of data index i in parity row j
+func fecCoefficient(j int, i int) byte {
+	return gfDiv(byte(255^i), byte((255-j)^i))
+}
+
+// GF(256) arithmetic with the polynomial x^8 + x^4 + x^3 + x^2 + 1 (0x11d)
+var gfExp, gfLog = gfTables()
+
+// gfTables builds the exponent and logarithm tables for generator 2
+func gfTables() ([512]byte, [256]byte) {
+	var exp [512]byte
+	var logs [256]byte
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		logs[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(exp); i++ {
+		exp[i] = exp[i-255]
+	}
+	return exp, logs
+}
+
+// gfMul multiplies in GF(256)
+func gfMul(a byte, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// gfDiv divides in GF(256); b must not be 0
+func gfDiv(a byte, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// gfInvert inverts a square matrix over GF(256) by Gauss-Jordan elimination.
+// ok is false if the matrix is singular.
+func gfInvert(matrix [][]byte) ([][]byte, bool) {
+	n := len(matrix)
+	work := make([][]byte, n)
+	for r := range matrix {
+		work[r] = make([]byte, 2*n)
+		copy(work[r], matrix[r])
+		work[r][n+r] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for r := col; r < n; r++ {
+			if work[r][col] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot == -1 {
+			return nil, false
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		scale := gfDiv(1, work[col][col])
+		for c := range work[col] {
+			work[col][c] = gfMul(work[col][c], scale)
+		}
+		for r := 0; r < n; r++ {
+			if r == col || work[r][col] == 0 {
+				continue
+			}
+			factor := work[r][col]
+			for c := range work[r] {
+				work[r][c] ^= gfMul(factor, work[col][c])
+			}
+		}
+	}
+
+	inverse := make([][]byte, n)
+	for r := range work {
+		inverse[r] = work[r][n:]
+	}
+	return inverse, true
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"youkaidns/dns"
+)
+
+// encodeParity computes the parity parts of data the way script.sh and
+// script.ps1 do, in part order
+func encodeParity(data []byte, size int, fec FEC) [][]byte {
+	total := (len(data) + size - 1) / size
+	var parity [][]byte
+	for first := 0; first < total; first += fec.Data {
+		for j := 0; j < fec.Parity; j++ {
+			p := make([]byte, size)
+			for i := 0; i < fec.Data && first+i < total; i++ {
+				shard := make([]byte, size) // Zero-padded
+				copy(shard, data[(first+i)*size:min((first+i+1)*size, len(data))])
+				c := fecCoefficient(j, i)
+				for b := range shard {
+					p[b] ^= gfMul(c, shard[b])
+				}
+			}
+			parity = append(parity, p)
+		}
+	}
+	return parity
+}
+
+func TestParityMatchesScripts(t *testing.T) {
+	// Parity of "youkaidns fec!" in 4-byte parts with FEC 3-2, from the
+	// encoder in script.sh
+	want := "6b267760a9619423632100006c240000"
+
+	got := bytes.Join(encodeParity([]byte("youkaidns fec!"), 4, FEC{Data: 3, Parity: 2}), nil)
+	if hex.EncodeToString(got) != want {
+		t.Fatalf("parity %x, want %s", got, want)
+	}
+
+	// The first parity part of a group is the plain XOR of its data parts
+	for i := 0; i < 10; i++ {
+		if c := fecCoefficient(0, i); c != 1 {
+			t.Errorf("coef(0, %d) = %d, want 1", i, c)
+		}
+	}
+}
+
+func TestFECRecovery(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int // Payload bytes
+		chunk     int
+		fec       FEC
+		lost      []int // Data and parity part numbers never delivered
+		recovered bool
+	}{
+		{"one lost, one parity", 100, 10, FEC{Data: 5, Parity: 1}, []int{3}, true},
+		{"exactly parity lost in each group", 100, 10, FEC{Data: 5, Parity: 2}, []int{1, 2, 6, 10}, true},
+		{"three lost, three parity", 95, 10, FEC{Data: 4, Parity: 3}, []int{5, 6, 8}, true},
+		{"short last part lost", 95, 10, FEC{Data: 4, Parity: 2}, []int{9, 10}, true},
+		{"short last group", 95, 10, FEC{Data: 4, Parity: 2}, []int{10}, true},
+		{"data and parity lost", 100, 10, FEC{Data: 5, Parity: 2}, []int{2, 11}, true},
+		{"all parity of a group lost", 100, 10, FEC{Data: 5, Parity: 2}, []int{3, 11, 12}, false},
+		{"one more than parity", 100, 10, FEC{Data: 5, Parity: 2}, []int{1, 2, 3}, false},
+		{"largest group", 2000, 8, FEC{Data: 250, Parity: 6}, []int{1, 50, 100, 150, 200, 250}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := make([]byte, tt.size)
+			for i := range data {
+				data[i] = byte(i*31 + 7)
+			}
+			totalParts := (tt.size + tt.chunk - 1) / tt.chunk
+			parity := encodeParity(data, tt.chunk, tt.fec)
+			if len(parity) != tt.fec.ParityParts(totalParts) {
+				t.Fatalf("%d parity parts, ParityParts says %d", len(parity), tt.fec.ParityParts(totalParts))
+			}
+
+			a := &FileAssembly{
+				TotalParts: totalParts,
+				ChunkSize:  tt.chunk,
+				TotalBytes: int64(tt.size),
+				FEC:        tt.fec,
+				Parts:      make(map[int][]byte),
+			}
+			lost := make(map[int]bool)
+			for _, p := range tt.lost {
+				lost[p] = true
+			}
+			for p := 1; p <= totalParts; p++ {
+				if !lost[p] {
+					a.addPart(p, data[(p-1)*tt.chunk:min(p*tt.chunk, tt.size)])
+				}
+			}
+			for i, part := range parity {
+				if p := totalParts + i + 1; !lost[p] {
+					a.addPart(p, part)
+				}
+			}
+
+			lostData := 0
+			for _, p := range tt.lost {
+				if p <= totalParts {
+					lostData++
+				}
+			}
+			if !tt.recovered {
+				if a.RecoveredParts == lostData {
+					t.Fatalf("recovered all %d lost parts with too little parity", lostData)
+				}
+				return
+			}
+
+			if a.RecoveredParts != lostData {
+				t.Fatalf("recovered %d parts, want %d", a.RecoveredParts, lostData)
+			}
+			if a.Contiguous != totalParts {
+				t.Fatalf("contiguous mark %d, want %d", a.Contiguous, totalParts)
+			}
+			var got []byte
+			for p := 1; p <= totalParts; p++ {
+				got = append(got, a.Parts[p]...)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("recovered payload differs")
+			}
+		})
+	}
+}
+
+func TestParseFEC(t *testing.T) {
+	tests := []struct {
+		value string
+		want  FEC
+		err   bool
+	}{
+		{"10-2", FEC{Data: 10, Parity: 2}, false},
+		{"1-1", FEC{Data: 1, Parity: 1}, false},
+		{"250-6", FEC{Data: 250, Parity: 6}, false},
+		{"250-7", FEC{}, true},
+		{"10", FEC{}, true},
+		{"0-2", FEC{}, true},
+		{"10-0", FEC{}, true},
+		{"a-b", FEC{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseFEC(tt.value)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ParseFEC(%q) = %v, %v; want %v, error %v", tt.value, got, err, tt.want, tt.err)
+		}
+	}
+	if s := fmt.Sprint(FEC{}); s != "none" {
+		t.Errorf("FEC{} prints as %q, want none", s)
+	}
+}
+
+func TestPartsOutOfRangeDropped(t *testing.T) {
+	file := []byte("ninety bytes of file split into three thirty byte parts, plus parity when FEC is on.......")
+
+	tests := []struct {
+		name     string
+		options  []string
+		accepted []int // Parts acknowledged besides 1 to 3
+		dropped  []int
+	}{
+		{"no FEC", nil, nil, []int{0, 4, 100}},
+		{"FEC", []string{"f-2-1"}, []int{4, 5}, []int{6, 100}}, // Two groups, one parity part each
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			tr := testTransfer{Name: "ranged.txt", File: file, Options: tt.options}
+			if w := serveQuery(s, tr.startRecord(s), dns.TypeTXT); len(w.answers) == 0 {
+				t.Fatal("start record not acknowledged")
+			}
+
+			parity := encodeParity(file, tr.chunk(), FEC{Data: 2, Parity: 1})
+			for _, part := range tt.accepted {
+				record := recordName(s, []string{hex.EncodeToString(parity[part-tr.totalParts()-1]), strconv.Itoa(part)}, 1, tr.hash8())
+				if w := serveQuery(s, record, dns.TypeTXT); len(w.answers) == 0 {
+					t.Errorf("part %d dropped", part)
+				}
+			}
+			for _, part := range tt.dropped {
+				record := recordName(s, []string{hex.EncodeToString(file[:tr.chunk()]), strconv.Itoa(part)}, 1, tr.hash8())
+				if w := serveQuery(s, record, dns.TypeTXT); len(w.answers) != 0 {
+					t.Errorf("part %d acknowledged", part)
+				}
+			}
+
+			for part := 1; part <= tr.totalParts(); part++ {
+				serveQuery(s, tr.dataRecord(s, part), dns.TypeTXT)
+			}
+			if assembly := waitFinished(t, s, tr.hash8()); !assembly.Verified || len(assembly.Parts) != tr.totalParts() {
+				t.Fatalf("transfer %q with %d parts", assembly.FailReason, len(assembly.Parts))
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"youkaidns/dns"
+)
+
+// Handler answers DNS requests. Middleware sees each request whole; query
+// handlers registered with Handle see one question at a time, with its Query
+// in the context (see QueryFromContext).
+type Handler interface {
+	ServeDNS(ctx context.Context, w ResponseWriter, q *dns.Message)
+}
+
+// HandlerFunc adapts a function to a Handler
+type HandlerFunc func(ctx context.Context, w ResponseWriter, q *dns.Message)
+
+// ServeDNS calls f(ctx, w, q)
+func (f HandlerFunc) ServeDNS(ctx context.Context, w ResponseWriter, q *dns.Message) {
+	f(ctx, w, q)
+}
+
+// Middleware wraps the handling of every request, for logging, access
+// control, rate limiting and the like. It can answer or drop a request itself
+// by not calling next.
+type Middleware func(next Handler) Handler
+
+// ResponseWriter builds the response to a request
+type ResponseWriter interface {
+	// RemoteAddr returns the address the request came from
+	RemoteAddr() *net.UDPAddr
+
+	// Answer adds answer records. A query handler claims its question by
+	// calling Answer, even with no records; later handlers don't see it.
+	Answer(rrs ...dns.ResourceRecord)
+
+	// Answers returns the answer records added so far
+	Answers() []dns.ResourceRecord
+
+	// SetRcode sets the response code. Without it the response is NOERROR
+	// if it has answers and NXDOMAIN otherwise.
+	SetRcode(rcode int)
+
+	// Truncate sets TC on the response, asking the client to retry over TCP.
+	// A truncated response without answers is NOERROR by default.
+	Truncate()
+
+	// Drop discards the request: no response is sent
+	Drop()
+}
+
+// Query is a question of a request as the query handlers see it
+type Query struct {
+	Name     string   // Queried name as received
+	Type     uint16   // Queried type
+	ClientIP net.IP   // Resolver the request came from
+	Domain   *Domain  // Served domain the name falls under, nil if none
+	Labels   []string // Lowercased labels before Domain (all labels for the catch-all domain)
+
+	claimed bool    // A query handler answered the question
+	denied  Feature // The query's feature, if an ACL denies it to the client
+}
+
+// contextKey keys the values the server puts in handler contexts
+type contextKey int
+
+const (
+	queryKey   contextKey = iota // *Query of the question being handled
+	queriesKey                   // []*Query of all questions in the request
+)
+
+// QueryFromContext returns the Query a handler is called for. Middleware gets
+// the request's first question. It returns nil outside a request.
+func QueryFromContext(ctx context.Context) *Query {
+	q, _ := ctx.Value(queryKey).(*Query)
+	return q
+}
+
+// newQuery matches a question to its served domain
+func (s *Server) newQuery(question dns.Question, clientIP net.IP) *Query {
+	q := &Query{Name: question.Name, Type: question.Type, ClientIP: clientIP}
+	if d, labels, ok := s.queryLabels(question.Name); ok {
+		q.Domain = d
+		q.Labels = labels
+	}
+	return q
+}
+
+// Handle registers a query handler. Query handlers are tried in the order
+// they were registered, the built-in ones first, until one claims the
+// question. Handlers must be registered before Start.
+func (s *Server) Handle(h Handler) {
+	s.handlers = append(s.handlers, h)
+}
+
+// Use adds middleware around the handling of every request. The first one
+// added runs first. Middleware must be added before Start.
+func (s *Server) Use(mw ...Middleware) {
+	s.middleware = append(s.middleware, mw...)
+}
+
+// chain returns the request handler: the middleware around serveQuestions
+func (s *Server) chain() Handler {
+	var h Handler = HandlerFunc(s.serveQuestions)
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		h = s.middleware[i](h)
+	}
+	return h
+}
+
+// serveQuestions passes each question of a request to the query handlers in
+// turn, as a single-question message
+func (s *Server) serveQuestions(ctx context.Context, w ResponseWriter, q *dns.Message) {
+	queries, _ := ctx.Value(queriesKey).([]*Query)
+
+	for i, question := range q.Questions {
+		query := s.newQuery(question, w.RemoteAddr().IP)
+		if i < len(queries) {
+			query = queries[i]
+		}
+		questionCtx := context.WithValue(ctx, queryKey, query)
+		single := &dns.Message{Header: q.Header, Questions: []dns.Question{question}}
+		single.Header.QdCount = 1
+
+		for _, h := range s.handlers {
+			qw := &questionWriter{ResponseWriter: w}
+			h.ServeDNS(questionCtx, qw, single)
+			if qw.claimed {
+				query.claimed = true
+				w.Answer(qw.answers...)
+				break
+			}
+			// A question denied its feature is refused, not left for later
+			// handlers such as wildcard zone records to answer
+			if query.denied != "" {
+				break
+			}
+		}
+		if !query.claimed && query.denied != "" {
+			s.refuseDenied(w, query)
+		}
+	}
+}
+
+// responseWriter collects the response to a request
+type responseWriter struct {
+	addr      *net.UDPAddr
+	answers   []dns.ResourceRecord
+	rcode     int  // -1 until set
+	truncated bool // Set TC
+	dropped   bool // Send no response
+}
+
+func (w *responseWriter) RemoteAddr() *net.UDPAddr { return w.addr }
+
+func (w *responseWriter) Answer(rrs ...dns.ResourceRecord) {
+	w.answers = append(w.answers, rrs...)
+}
+
+func (w *responseWriter) Answers() []dns.ResourceRecord { return w.answers }
+
+func (w *responseWriter) SetRcode(rcode int) { w.rcode = rcode }
+
+func (w *responseWriter) Truncate() { w.truncated = true }
+
+func (w *responseWriter) Drop() { w.dropped = true }
+
+// questionWriter collects a query handler's answers to one question, so the
+// question only counts as claimed once the handler answers
+type questionWriter struct {
+	ResponseWriter
+	answers []dns.ResourceRecord
+	claimed bool
+}
+
+func (w *questionWriter) Answer(rrs ...dns.ResourceRecord) {
+	w.answers = append(w.answers, rrs...)
+	w.claimed = true
+}
+
+func (w *questionWriter) Answers() []dns.ResourceRecord { return w.answers }
+
+// answerer is a built-in query handler: it returns the answers to q, or nil
+// if the question isn't for it
+type answerer func(q *Query) []dns.ResourceRecord
+
+// builtinHandler adapts a built-in query handler. Downstream channel types
+// (NULL, MX, CNAME) are answered as TXT and the answers re-encoded (see
+// channelRecords).
+func (s *Server) builtinHandler(answer answerer) Handler {
+	return HandlerFunc(func(ctx context.Context, w ResponseWriter, _ *dns.Message) {
+		q := QueryFromContext(ctx)
+		if q == nil {
+			return
+		}
+
+		handled := *q
+		if isChannelType(q.Type) {
+			handled.Type = dns.TypeTXT
+		}
+		answers := answer(&handled)
+		if answers == nil {
+			return
+		}
+		if handled.Type != q.Type {
+			answers = s.channelRecords(q, answers)
+		}
+		w.Answer(answers...)
+	})
+}
+
+// registerBuiltinHandlers registers the script, probe, missing, outbox,
+// session and dynamic record handlers, then the zone lookup, each restricted
+// by its feature's ACL
+func (s *Server) registerBuiltinHandlers() {
+	s.Handle(s.restrictTo(FeatureScripts, s.builtinHandler(s.handleScriptQuery)))
+	s.Handle(s.restrictTo(FeatureTransfer, s.builtinHandler(s.handleProbeQuery)))
+	s.Handle(s.restrictTo(FeatureTransfer, s.builtinHandler(s.handleMissingQuery)))
+	s.Handle(s.restrictTo(FeatureOutbox, s.builtinHandler(s.handleGetQuery)))
+	s.Handle(s.restrictTo(FeatureAgents, s.builtinHandler(s.handleSessionQuery)))
+	s.Handle(s.restrictTo(FeatureTransfer, s.builtinHandler(s.handleDynamicQuery)))
+	s.Handle(s.restrictTo(FeatureZone, HandlerFunc(s.serveZone)))
+}
+
+// serveZone answers from the zone records
+func (s *Server) serveZone(ctx context.Context, w ResponseWriter, _ *dns.Message) {
+	q := QueryFromContext(ctx)
+	if q == nil {
+		return
+	}
+	if records := s.lookup(strings.ToLower(q.Name), q.Type); len(records) > 0 {
+		w.Answer(s.convertToResourceRecords(q.Name, records)...)
+	}
+}
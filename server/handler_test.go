@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"youkaidns/dns"
+)
+
+// recordingHandler records the questions it sees and claims those named
+// claim, answering with records
+type recordingHandler struct {
+	name    string
+	claim   string
+	records []dns.ResourceRecord
+	seen    *[]string
+}
+
+func (h recordingHandler) ServeDNS(ctx context.Context, w ResponseWriter, q *dns.Message) {
+	query := QueryFromContext(ctx)
+	if len(q.Questions) != 1 || query == nil || query.Name != q.Questions[0].Name {
+		*h.seen = append(*h.seen, h.name+": bad question")
+		return
+	}
+	*h.seen = append(*h.seen, h.name+" "+query.Name)
+	if query.Name == h.claim {
+		w.Answer(h.records...)
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	s := newTestServer(t)
+	var seen []string
+	mark := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(ctx context.Context, w ResponseWriter, q *dns.Message) {
+				seen = append(seen, name+" "+QueryFromContext(ctx).Name)
+				next.ServeDNS(ctx, w, q)
+			})
+		}
+	}
+	s.Use(mark("first"), mark("second"))
+	s.Handle(recordingHandler{name: "handler", seen: &seen})
+
+	serveQuery(s, "custom."+testDomain, dns.TypeA)
+	want := []string{"first custom.t.test", "second custom.t.test", "handler custom.t.test"}
+	if !reflect.DeepEqual(seen, want) {
+		t.Fatalf("ran %q, want %q", seen, want)
+	}
+}
+
+func TestMiddlewareDrop(t *testing.T) {
+	s := newTestServer(t)
+	var seen []string
+	s.Use(func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, w ResponseWriter, q *dns.Message) {
+			w.Drop()
+		})
+	})
+	s.Handle(recordingHandler{name: "handler", seen: &seen})
+
+	if w := serveQuery(s, "custom."+testDomain, dns.TypeA); !w.dropped {
+		t.Fatal("request not dropped")
+	}
+	if len(seen) != 0 {
+		t.Fatalf("handlers ran after a drop: %q", seen)
+	}
+}
+
+func TestQueryHandlers(t *testing.T) {
+	s := newTestServer(t)
+	var seen []string
+	answer := dns.ResourceRecord{Name: "second." + testDomain, Type: dns.TypeA, Class: 1, TTL: 60, Data: []byte{192, 0, 2, 9}}
+	s.Handle(recordingHandler{name: "declines", seen: &seen})
+	s.Handle(recordingHandler{name: "claims", claim: "empty." + testDomain, seen: &seen})
+	s.Handle(recordingHandler{name: "answers", claim: "second." + testDomain, records: []dns.ResourceRecord{answer}, seen: &seen})
+
+	tests := []struct {
+		name    string
+		seen    []string
+		claimed bool
+		answers int
+	}{
+		// Claiming without records stops the chain
+		{"empty." + testDomain, []string{"declines empty.t.test", "claims empty.t.test"}, true, 0},
+		{"second." + testDomain, []string{"declines second.t.test", "claims second.t.test", "answers second.t.test"}, true, 1},
+		{"nobody." + testDomain, []string{"declines nobody.t.test", "claims nobody.t.test", "answers nobody.t.test"}, false, 0},
+		// Built-in handlers claim their questions before registered ones
+		{"1.probe." + testDomain, nil, true, 1},
+	}
+	for _, tt := range tests {
+		seen = nil
+		query := s.newQuery(dns.Question{Name: tt.name, Type: dns.TypeTXT, Class: 1}, testClient.IP)
+		ctx := context.WithValue(context.Background(), queriesKey, []*Query{query})
+		w := &responseWriter{addr: testClient, rcode: -1}
+		s.chain().ServeDNS(ctx, w, &dns.Message{Questions: []dns.Question{{Name: tt.name, Type: dns.TypeTXT, Class: 1}}})
+
+		if !reflect.DeepEqual(seen, tt.seen) || query.claimed != tt.claimed || len(w.answers) != tt.answers {
+			t.Errorf("%s: ran %q, claimed %v, %d answers; want %q, %v, %d", tt.name, seen, query.claimed, len(w.answers), tt.seen, tt.claimed, tt.answers)
+		}
+	}
+}
+
+func TestQuestionsServedSeparately(t *testing.T) {
+	s := newTestServer(t)
+	var seen []string
+	var labels [][]string
+	s.Handle(HandlerFunc(func(ctx context.Context, w ResponseWriter, q *dns.Message) {
+		query := QueryFromContext(ctx)
+		if q.Header.QdCount != 1 || len(q.Questions) != 1 {
+			t.Errorf("handler got %d questions", len(q.Questions))
+		}
+		seen = append(seen, query.Name)
+		labels = append(labels, query.Labels)
+		if query.Domain != s.primaryDomain() {
+			t.Errorf("%s: domain %v", query.Name, query.Domain)
+		}
+		w.Answer()
+	}))
+
+	// Without queries in the context, as from middleware that rewrites the
+	// request, the questions are matched to their domains afresh
+	msg := &dns.Message{
+		Header: dns.MessageHeader{QdCount: 2},
+		Questions: []dns.Question{
+			{Name: "One.A." + testDomain, Type: dns.TypeA, Class: 1},
+			{Name: "two." + testDomain, Type: dns.TypeAAAA, Class: 1},
+		},
+	}
+	w := &responseWriter{addr: testClient, rcode: -1}
+	s.chain().ServeDNS(context.Background(), w, msg)
+
+	if want := []string{"One.A.t.test", "two.t.test"}; !reflect.DeepEqual(seen, want) {
+		t.Fatalf("served %q, want %q", seen, want)
+	}
+	if want := [][]string{{"one", "a"}, {"two"}}; !reflect.DeepEqual(labels, want) {
+		t.Fatalf("labels %q, want %q", labels, want)
+	}
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// historyFileName is the transfer catalog inside the metadata directory
+const historyFileName = "history.jsonl"
+
+// Transfer outcomes recorded in the history catalog
+const (
+	HistoryComplete   = "complete"
+	HistoryFailed     = "failed"
+	HistoryAuthFailed = "auth_failed" // Encrypted payload didn't authenticate
+)
+
+// HistoryEntry is one finished (completed or failed) transfer in the catalog
+type HistoryEntry struct {
+	Hash             string    `json:"hash"`
+	OriginalFilename string    `json:"original_filename"`
+	File             string    `json:"file,omitempty"` // Saved file name, empty on failure
+	SourceIP         string    `json:"source_ip"`
+	Host             string    `json:"host,omitempty"`   // Host ID from the h- option
+	Domain           string    `json:"domain,omitempty"` // Served domain the transfer arrived under
+	Status           string    `json:"status"`           // complete, failed or auth_failed
+	Error            string    `json:"error,omitempty"`  // Failure reason
+	TotalParts       int       `json:"total_parts"`
+	ReceivedParts    int       `json:"received_parts"`
+	ChunkSize        int       `json:"chunk_size"`
+	TotalBytes       int64     `json:"total_bytes"` // Bytes on the wire
+	FileBytes        int64     `json:"file_bytes"`  // Bytes after decompression, -1 if unknown
+	Compression      string    `json:"compression"`
+	Cipher           string    `json:"cipher"`
+	Bundle           string    `json:"bundle"`
+	Verified         bool      `json:"verified"`
+	Retries          int       `json:"retries"`         // Missing-chunk rounds that reported gaps
+	DuplicateParts   int       `json:"duplicate_parts"` // Parts received more than once
+	RecoveredParts   int       `json:"recovered_parts"` // Data parts rebuilt from FEC parity
+	StartedAt        time.Time `json:"started_at"`
+	FinishedAt       time.Time `json:"finished_at"`
+	DurationMs       int64     `json:"duration_ms"`
+}
+
+// HistoryFilter selects entries from the history catalog
+type HistoryFilter struct {
+	Hash     string    // Exact hash8 match
+	Domain   string    // Served domain, exact match
+	Filename string    // Case-insensitive substring of the original or saved filename
+	SourceIP string    // Exact source IP match
+	Status   string    // complete, failed or auth_failed
+	Since    time.Time // Finished at or after
+	Until    time.Time // Finished before
+	Limit    int       // Maximum entries to return (0 = no limit)
+}
+
+// Match reports whether an entry passes the filter
+func (f HistoryFilter) Match(entry HistoryEntry) bool {
+	if f.Hash != "" && !strings.EqualFold(entry.Hash, f.Hash) {
+		return false
+	}
+	if f.Filename != "" {
+		needle := strings.ToLower(f.Filename)
+		if !strings.Contains(strings.ToLower(entry.OriginalFilename), needle) &&
+			!strings.Contains(strings.ToLower(entry.File), needle) {
+			return false
+		}
+	}
+	if f.Domain != "" && !strings.EqualFold(entry.Domain, f.Domain) {
+		return false
+	}
+	if f.SourceIP != "" && entry.SourceIP != f.SourceIP {
+		return false
+	}
+	if f.Status != "" && entry.Status != f.Status {
+		return false
+	}
+	if !f.Since.IsZero() && entry.FinishedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !entry.FinishedAt.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// recordHistory appends a finished transfer to the catalog and counts it for
+// its host. The caller must hold assembly.mu.
+func (s *Server) recordHistory(assembly *FileAssembly, status string, savedFile string, reason string) {
+	s.recordHostTransfer(assembly.Host, status, assembly.FileBytes)
+
+	finishedAt := time.Now()
+	entry := HistoryEntry{
+		Hash:             assembly.Hash,
+		OriginalFilename: assembly.Filename,
+		File:             savedFile,
+		SourceIP:         assembly.SourceIP,
+		Host:             assembly.Host,
+		Domain:           assembly.Domain.Name,
+		Status:           status,
+		Error:            reason,
+		TotalParts:       assembly.TotalParts,
+		ReceivedParts:    len(assembly.Parts),
+		ChunkSize:        assembly.ChunkSize,
+		TotalBytes:       assembly.TotalBytes,
+		FileBytes:        assembly.FileBytes,
+		Compression:      string(assembly.Compression),
+		Cipher:           string(assembly.Cipher),
+		Bundle:           string(assembly.Bundle),
+		Verified:         assembly.Verified,
+		Retries:          assembly.Retries,
+		DuplicateParts:   assembly.DuplicateParts,
+		RecoveredParts:   assembly.RecoveredParts,
+		StartedAt:        assembly.StartedAt,
+		FinishedAt:       finishedAt,
+		DurationMs:       finishedAt.Sub(assembly.StartedAt).Milliseconds(),
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error encoding history entry for %s: %v", assembly.Hash, err)
+		return
+	}
+
+	metaDir := filepath.Join(assembly.Domain.OutputDir, metaDirName)
+	if err := os.MkdirAll(metaDir, 0755); err != nil {
+		log.Printf("Error creating metadata directory %s: %v", metaDir, err)
+		return
+	}
+
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+
+	f, err := os.OpenFile(filepath.Join(metaDir, historyFileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Error opening transfer history: %v", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		log.Printf("Error writing transfer history: %v", err)
+	}
+}
+
+// GetHistory returns catalog entries matching the filter, newest first.
+// Every output directory keeps its own catalog, so the entries of all
+// domains are merged.
+func (s *Server) GetHistory(filter HistoryFilter) ([]HistoryEntry, error) {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+
+	var entries []HistoryEntry
+	read := make(map[string]bool)
+	for _, d := range s.allDomains() {
+		if read[d.OutputDir] {
+			continue
+		}
+		read[d.OutputDir] = true
+
+		dirEntries, err := readHistory(d, filter)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, dirEntries...)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].FinishedAt.After(entries[j].FinishedAt)
+	})
+
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[:filter.Limit]
+	}
+	if entries == nil {
+		entries = []HistoryEntry{}
+	}
+
+	return entries, nil
+}
+
+// readHistory returns the entries of d's catalog that match the filter.
+// Entries recorded without a domain belong to d. The caller must hold
+// s.historyMu.
+func readHistory(d *Domain, filter HistoryFilter) ([]HistoryEntry, error) {
+	f, err := os.Open(filepath.Join(d.OutputDir, metaDirName, historyFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []HistoryEntry
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var entry HistoryEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			log.Printf("Skipping malformed history line %d in %s: %v", lineNum, d.OutputDir, err)
+			continue
+		}
+		if entry.Domain == "" {
+			entry.Domain = d.Name
+		}
+		if filter.Match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read transfer history: %w", err)
+	}
+
+	return entries, nil
+}
+
+// expireStaleAssemblies fails and removes transfers that have had no activity
+// for longer than the transfer timeout. Transfers that already finished, saved
+// or failed, are recorded and cleaned up elsewhere.
+func (s *Server) expireStaleAssemblies() {
+	s.assemblyMu.Lock()
+	timeout := s.transferTimeout
+	var stale []*FileAssembly
+	for hash8, assembly := range s.fileAssemblies {
+		// A transfer whose lock is held is busy (receiving or being saved),
+		// so it isn't idle; don't wait on it with assemblyMu held
+		if !assembly.mu.TryLock() {
+			continue
+		}
+		idle := time.Since(assembly.LastActivity)
+		finished := !assembly.CompletedAt.IsZero() || assembly.FailStatus != ""
+		assembly.mu.Unlock()
+
+		if !finished && idle > timeout {
+			stale = append(stale, assembly)
+			delete(s.fileAssemblies, hash8)
+		}
+	}
+	s.assemblyMu.Unlock()
+
+	for _, assembly := range stale {
+		assembly.mu.Lock()
+		// A save already under way when it was removed wins
+		if !assembly.CompletedAt.IsZero() || assembly.FailStatus != "" {
+			assembly.mu.Unlock()
+			continue
+		}
+		reason := fmt.Sprintf("no activity for %s", timeout)
+		log.Printf("Transfer timed out: %s (hash: %s, %d/%d parts)", assembly.Filename, assembly.Hash, len(assembly.Parts), assembly.TotalParts)
+		assembly.FailStatus = HistoryFailed
+		assembly.FailReason = reason
+		assembly.Domain.endTransfer()
+		s.recordHistory(assembly, HistoryFailed, "", reason)
+		assembly.mu.Unlock()
+	}
+}
+
+// expireLoop periodically expires stale transfers, idle agent sessions, old
+// tasks and idle hosts until the server shuts down
+func (s *Server) expireLoop() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case <-ticker.C:
+			s.expireStaleAssemblies()
+			s.expireSessions()
+			s.expireTasks()
+			s.expireHosts()
+		}
+	}
+}
+
+// SetTransferTimeout sets how long an incomplete transfer may sit idle before
+// it is recorded as failed and discarded
+func (s *Server) SetTransferTimeout(timeout time.Duration) {
+	s.assemblyMu.Lock()
+	defer s.assemblyMu.Unlock()
+	s.transferTimeout = timeout
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpireStaleAssemblies(t *testing.T) {
+	s := newTestServer(t)
+	s.SetTransferTimeout(time.Second)
+	d := s.primaryDomain()
+	idle := time.Now().Add(-time.Minute)
+
+	assemblies := map[string]*FileAssembly{
+		"stale":     {Hash: "00000001", TotalParts: 4, LastActivity: idle},
+		"active":    {Hash: "00000002", TotalParts: 4, LastActivity: time.Now()},
+		"completed": {Hash: "00000003", TotalParts: 4, LastActivity: idle, CompletedAt: idle},
+		// Already failed and recorded, waiting for its cleanup
+		"failed": {Hash: "00000004", TotalParts: 4, LastActivity: idle, FailStatus: HistoryFailed},
+	}
+	for _, a := range assemblies {
+		a.Domain = d
+		a.Parts = make(map[int][]byte)
+		s.fileAssemblies[a.key()] = a
+	}
+	d.transfers = 2 // The stale and active ones
+
+	// Sweeps more often than the timeout must not record a transfer twice
+	s.expireStaleAssemblies()
+	s.expireStaleAssemblies()
+
+	history, err := s.GetHistory(HistoryFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Hash != "00000001" || history[0].Status != HistoryFailed {
+		t.Fatalf("history %+v, want only the stale transfer as failed", history)
+	}
+	if d.transfers != 1 {
+		t.Errorf("%d transfers counted, want 1", d.transfers)
+	}
+	for name, a := range assemblies {
+		_, kept := s.fileAssemblies[a.key()]
+		if kept == (name == "stale") {
+			t.Errorf("%s transfer kept: %v", name, kept)
+		}
+	}
+}
+
+func TestHistoryFilter(t *testing.T) {
+	finished := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	entry := HistoryEntry{Hash: "0123abcd", OriginalFilename: "Report.pdf", File: "report_1.pdf", SourceIP: "192.0.2.1", Status: HistoryComplete, FinishedAt: finished}
+
+	tests := []struct {
+		name   string
+		filter HistoryFilter
+		want   bool
+	}{
+		{"empty", HistoryFilter{}, true},
+		{"hash in another case", HistoryFilter{Hash: "0123ABCD"}, true},
+		{"saved name substring", HistoryFilter{Filename: "PORT_1"}, true},
+		{"other source", HistoryFilter{SourceIP: "192.0.2.2"}, false},
+		{"other status", HistoryFilter{Status: HistoryFailed}, false},
+		{"since finish", HistoryFilter{Since: finished}, true},
+		{"until finish", HistoryFilter{Until: finished}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.Match(entry); got != tt.want {
+			t.Errorf("%s: Match = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"log"
+	"net"
+	"sort"
+	"time"
+)
+
+// maxHostIDLength caps host IDs (one DNS label)
+const maxHostIDLength = 63
+
+// maxHostResolvers caps how many resolvers are remembered per host; the least
+// recently used one makes room for a new one
+const maxHostResolvers = 16
+
+// At most maxHosts hosts are kept; the least recently seen one makes room for
+// a new one. A host is forgotten after hostIdleTimeout without a check-in.
+const (
+	maxHosts        = 1000
+	hostIdleTimeout = 24 * time.Hour
+)
+
+// Host is a sending host, identified by the h-<host_id> start option of its
+// transfers or by the agent ID it polls with
+type Host struct {
+	ID        string         `json:"id"`
+	FirstSeen time.Time      `json:"first_seen"`
+	LastSeen  time.Time      `json:"last_seen"` // Last record or poll from the host
+	CheckIns  int64          `json:"check_ins"` // Start records, data records and polls
+	Transfers int            `json:"transfers"` // Completed transfers
+	Failed    int            `json:"failed"`    // Failed transfers
+	Bytes     int64          `json:"bytes"`     // File bytes of completed transfers
+	Resolvers []HostResolver `json:"resolvers"` // Most recently used first
+}
+
+// HostResolver is a resolver a host's queries arrived from
+type HostResolver struct {
+	IP       string    `json:"ip"`
+	CheckIns int64     `json:"check_ins"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// validHostID reports whether id is a usable host ID: lowercase letters,
+// digits and dashes
+func validHostID(id string) bool {
+	if id == "" || len(id) > maxHostIDLength {
+		return false
+	}
+	for _, r := range id {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// checkInHost records a query from host through the resolver clientIP. It does
+// nothing if host is empty.
+func (s *Server) checkInHost(host string, clientIP net.IP) {
+	if host == "" {
+		return
+	}
+
+	s.hostMu.Lock()
+	defer s.hostMu.Unlock()
+
+	now := time.Now()
+	h, exists := s.hosts[host]
+	if !exists {
+		if len(s.hosts) >= maxHosts {
+			s.evictHost()
+		}
+		h = &Host{ID: host, FirstSeen: now}
+		s.hosts[host] = h
+		log.Printf("New host: %s via %s", host, clientIP)
+	}
+	h.LastSeen = now
+	h.CheckIns++
+
+	ip := clientIP.String()
+	found := -1
+	for i := range h.Resolvers {
+		if h.Resolvers[i].IP == ip {
+			found = i
+			break
+		}
+	}
+	if found < 0 {
+		if len(h.Resolvers) >= maxHostResolvers {
+			h.Resolvers = h.Resolvers[:maxHostResolvers-1]
+		}
+		h.Resolvers = append(h.Resolvers, HostResolver{IP: ip})
+		found = len(h.Resolvers) - 1
+	}
+	resolver := h.Resolvers[found]
+	resolver.CheckIns++
+	resolver.LastSeen = now
+
+	// Keep the most recently used resolver first
+	copy(h.Resolvers[1:found+1], h.Resolvers[:found])
+	h.Resolvers[0] = resolver
+}
+
+// evictHost forgets the least recently seen host. The caller must hold
+// hostMu.
+func (s *Server) evictHost() {
+	var oldest *Host
+	for _, h := range s.hosts {
+		if oldest == nil || h.LastSeen.Before(oldest.LastSeen) {
+			oldest = h
+		}
+	}
+	if oldest != nil {
+		delete(s.hosts, oldest.ID)
+		log.Printf("Host registry full: forgot %s (last seen %s)", oldest.ID, oldest.LastSeen.Format(time.RFC3339))
+	}
+}
+
+// expireHosts forgets hosts that haven't checked in for hostIdleTimeout
+func (s *Server) expireHosts() {
+	s.hostMu.Lock()
+	defer s.hostMu.Unlock()
+
+	cutoff := time.Now().Add(-hostIdleTimeout)
+	for id, h := range s.hosts {
+		if h.LastSeen.Before(cutoff) {
+			delete(s.hosts, id)
+			if s.verbose {
+				log.Printf("Forgot idle host %s", id)
+			}
+		}
+	}
+}
+
+// recordHostTransfer counts a finished transfer (history status) for its host
+func (s *Server) recordHostTransfer(host string, status string, fileBytes int64) {
+	if host == "" {
+		return
+	}
+
+	s.hostMu.Lock()
+	defer s.hostMu.Unlock()
+
+	h, exists := s.hosts[host]
+	if !exists {
+		return
+	}
+	if status != HistoryComplete {
+		h.Failed++
+		return
+	}
+	h.Transfers++
+	if fileBytes > 0 {
+		h.Bytes += fileBytes
+	}
+}
+
+// GetHosts returns the known hosts, most recently seen first
+func (s *Server) GetHosts() []Host {
+	s.hostMu.Lock()
+	defer s.hostMu.Unlock()
+
+	hosts := make([]Host, 0, len(s.hosts))
+	for _, h := range s.hosts {
+		info := *h
+		info.Resolvers = append([]HostResolver(nil), h.Resolvers...)
+		hosts = append(hosts, info)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].LastSeen.After(hosts[j].LastSeen)
+	})
+	return hosts
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"youkaidns/dns"
+)
+
+func TestHostRegistry(t *testing.T) {
+	s := newTestServer(t)
+	other := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 53}
+
+	// Hosts are counted per transfer; IDs are lowercased
+	file := make([]byte, 45)
+	sent := testTransfer{Name: "a.txt", File: file, Options: []string{"h-WEB01"}}
+	waitFinished(t, s, sendTransfer(t, s, sent))
+
+	failed := testTransfer{Name: "b.txt", File: []byte("not gzip"), Options: []string{"c-gzip", "h-web01"}}
+	waitFinished(t, s, sendTransfer(t, s, failed))
+
+	// Untagged transfers and invalid IDs register no host
+	waitFinished(t, s, sendTransfer(t, s, testTransfer{Name: "c.txt", File: []byte("anonymous")}))
+	bad := testTransfer{Name: "d.txt", File: []byte("bad id"), Options: []string{"h-bad_id"}}
+	if w := serveQuery(s, bad.startRecord(s), dns.TypeTXT); len(w.answers) != 0 {
+		t.Fatal("start record with an invalid host acknowledged")
+	}
+
+	// A poll from another resolver checks the host in too
+	serveQueryFrom(s, other, "1.poll.web01."+testDomain, dns.TypeTXT)
+
+	hosts := s.GetHosts()
+	if len(hosts) != 1 {
+		t.Fatalf("hosts %+v, want only web01", hosts)
+	}
+	h := hosts[0]
+	if h.ID != "web01" || h.Transfers != 1 || h.Failed != 1 || h.Bytes != int64(len(file)) {
+		t.Fatalf("host %+v", h)
+	}
+	// Start and two parts, start and one part, and the poll
+	if h.CheckIns != 6 {
+		t.Fatalf("%d check-ins, want 6", h.CheckIns)
+	}
+	if len(h.Resolvers) != 2 || h.Resolvers[0].IP != other.IP.String() || h.Resolvers[1].IP != testClient.IP.String() ||
+		h.Resolvers[0].CheckIns != 1 || h.Resolvers[1].CheckIns != 5 {
+		t.Fatalf("resolvers %+v", h.Resolvers)
+	}
+	if h.FirstSeen.After(h.LastSeen) {
+		t.Fatalf("first seen %s after last seen %s", h.FirstSeen, h.LastSeen)
+	}
+}
+
+func TestHostResolversCapped(t *testing.T) {
+	s := newTestServer(t)
+	for i := 0; i <= maxHostResolvers; i++ {
+		s.checkInHost("web01", net.IPv4(10, 0, 0, byte(i)))
+	}
+	// Reusing a resolver moves it to the front
+	s.checkInHost("web01", net.IPv4(10, 0, 0, 5))
+
+	resolvers := s.GetHosts()[0].Resolvers
+	if len(resolvers) != maxHostResolvers {
+		t.Fatalf("%d resolvers, want %d", len(resolvers), maxHostResolvers)
+	}
+	if resolvers[0].IP != "10.0.0.5" || resolvers[0].CheckIns != 2 || resolvers[1].IP != "10.0.0."+strconv.Itoa(maxHostResolvers) {
+		t.Fatalf("resolvers %+v", resolvers)
+	}
+	for _, r := range resolvers {
+		if r.IP == "10.0.0.0" {
+			t.Fatal("least recently used resolver kept")
+		}
+	}
+}
+
+func TestExpireHosts(t *testing.T) {
+	s := newTestServer(t)
+	for i := 0; i < maxHosts; i++ {
+		s.checkInHost("host"+strconv.Itoa(i), testClient.IP)
+	}
+	s.hostMu.Lock()
+	s.hosts["host0"].LastSeen = time.Now().Add(-time.Minute)
+	s.hosts["host1"].LastSeen = time.Now().Add(-hostIdleTimeout - time.Minute)
+	s.hostMu.Unlock()
+
+	// A full registry forgets the least recently seen host
+	s.checkInHost("newhost", testClient.IP)
+	if len(s.GetHosts()) != maxHosts {
+		t.Fatalf("%d hosts, want %d", len(s.GetHosts()), maxHosts)
+	}
+	s.hostMu.Lock()
+	_, kept := s.hosts["host1"]
+	s.hostMu.Unlock()
+	if kept {
+		t.Fatal("least recently seen host kept")
+	}
+
+	// Idle hosts expire
+	s.hostMu.Lock()
+	s.hosts["host0"].LastSeen = time.Now().Add(-hostIdleTimeout - time.Minute)
+	s.hostMu.Unlock()
+	s.expireHosts()
+	for _, h := range s.GetHosts() {
+		if h.ID == "host0" {
+			t.Fatal("idle host kept")
+		}
+	}
+	if len(s.GetHosts()) != maxHosts-1 {
+		t.Fatalf("%d hosts after expiry, want %d", len(s.GetHosts()), maxHosts-1)
+	}
+}
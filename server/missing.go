@@ -0,0 +1,213 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"youkaidns/dns"
+)
+
+// Missing-chunk response formats, selected by the label before "missing":
+// [counter.]missing.<hash8> (v1), [counter.]v2[-<from>].missing.<hash8> and
+// [counter.]v3[-<from>].missing.<hash8>
+const (
+	MissingFormatList   = "v1" // One TXT record per missing part number
+	MissingFormatRanges = "v2" // Run-length ranges: 120-180,300
+	MissingFormatBitmap = "v3" // Base64 bitmap windows: <start>:<bitmap>
+)
+
+// maxMissingList caps how many part numbers a v1 response lists
+const maxMissingList = 8
+
+// maxMissingWalk caps how many missing parts one missing-chunk query
+// collects; responses carry fewer, and their next field continues past it
+const maxMissingWalk = 4096
+
+// maxResponseSize is the classic DNS-over-UDP message limit that compact
+// missing-chunk responses are sized to fit
+const maxResponseSize = 512
+
+// parseMissingFormat parses the label before "missing" into a format and the
+// first part number to report. Labels that aren't a known format (such as a
+// bare counter) select v1.
+func parseMissingFormat(label string) (string, int) {
+	format, fromStr, _ := strings.Cut(label, "-")
+	if format != MissingFormatRanges && format != MissingFormatBitmap {
+		return MissingFormatList, 1
+	}
+
+	from := 1
+	if fromStr != "" {
+		if n, err := strconv.Atoi(fromStr); err == nil && n >= 1 {
+			from = n
+		}
+	}
+	return format, from
+}
+
+// missingParts is a window of the parts a transfer is missing
+type missingParts struct {
+	Parts []int // Missing parts from the requested one onwards, sorted
+	Count int   // Parts missing in all
+	More  int   // First missing part after Parts, 0 if none
+}
+
+// missingFrom returns up to limit missing data parts of a from part from
+// onwards. It walks the received parts rather than every part number, so a
+// query costs the same however many parts the start record declared. The
+// caller holds a.mu.
+func (a *FileAssembly) missingFrom(from, limit int) missingParts {
+	received := make([]int, 0, len(a.Parts))
+	for part := range a.Parts {
+		if part >= 1 && part <= a.TotalParts {
+			received = append(received, part)
+		}
+	}
+	sort.Ints(received)
+
+	m := missingParts{Count: a.TotalParts - len(received)}
+	i := sort.SearchInts(received, from)
+	for part := max(from, 1); part <= a.TotalParts; part++ {
+		if i < len(received) && received[i] == part {
+			i++
+			continue
+		}
+		if len(m.Parts) == limit {
+			m.More = part
+			break
+		}
+		m.Parts = append(m.Parts, part)
+	}
+	return m
+}
+
+// compactMissingAnswer builds a single TXT record listing the missing parts
+// in the ranges or bitmap format. The first string is
+// a header "<format> <total_parts> <missing_count> <next>"; next is the part
+// to ask from for the rest of the list, or 0 if the response reaches the end.
+// Each following string is self-contained: comma-separated ranges, or one
+// "<start>:<base64>" bitmap window where the most significant bit of the
+// first byte is part start and a set bit means missing.
+func compactMissingAnswer(queryDomain string, format string, totalParts int, missing missingParts) dns.ResourceRecord {
+	// Header, question and one answer, each carrying the query name
+	budget := maxResponseSize - 12 - (len(queryDomain) + 2 + 4) - (len(queryDomain) + 2 + 10)
+
+	var strs []string
+	var next int
+	budget -= 1 + len(fmt.Sprintf("%s %d %d %d", format, totalParts, missing.Count, totalParts)) // Header at its largest
+
+	if format == MissingFormatRanges {
+		strs, next = missingRanges(missing.Parts, budget)
+	} else {
+		strs, next = missingBitmaps(missing.Parts, budget)
+	}
+	if next == 0 {
+		next = missing.More
+	}
+
+	header := fmt.Sprintf("%s %d %d %d", format, totalParts, missing.Count, next)
+
+	var data []byte
+	for _, str := range append([]string{header}, strs...) {
+		data = append(data, byte(len(str)))
+		data = append(data, str...)
+	}
+
+	return dns.ResourceRecord{
+		Name:    queryDomain,
+		Type:    dns.TypeTXT,
+		Class:   1, // IN
+		TTL:     0, // TTL=0 to prevent caching
+		Data:    data,
+		DataLen: uint16(len(data)),
+	}
+}
+
+// missingRanges packs sorted part numbers into comma-separated ranges, using
+// at most budget bytes of TXT data. It returns the strings and the first
+// part left out (0 if none).
+func missingRanges(missing []int, budget int) ([]string, int) {
+	var strs []string
+	current := ""
+
+	for i := 0; i < len(missing); {
+		// Extend the run while parts are consecutive
+		j := i
+		for j+1 < len(missing) && missing[j+1] == missing[j]+1 {
+			j++
+		}
+		item := strconv.Itoa(missing[i])
+		if j > i {
+			item = fmt.Sprintf("%d-%d", missing[i], missing[j])
+		}
+
+		switch {
+		case current != "" && len(current)+1+len(item) <= 255 && 1+len(item) <= budget:
+			current += "," + item
+			budget -= 1 + len(item)
+		case current != "" && 1+len(item) <= budget:
+			// Start a new string (a length byte instead of a comma)
+			strs = append(strs, current)
+			current = item
+			budget -= 1 + len(item)
+		case current == "" && 1+len(item) <= budget:
+			current = item
+			budget -= 1 + len(item)
+		default:
+			if current != "" {
+				strs = append(strs, current)
+			}
+			return strs, missing[i]
+		}
+		i = j + 1
+	}
+
+	if current != "" {
+		strs = append(strs, current)
+	}
+	return strs, 0
+}
+
+// missingBitmaps packs sorted part numbers into bitmap windows, each starting
+// at a missing part, using at most budget bytes of TXT data. It returns the
+// strings and the first part left out (0 if none).
+func missingBitmaps(missing []int, budget int) ([]string, int) {
+	var strs []string
+
+	i := 0
+	for i < len(missing) {
+		prefix := strconv.Itoa(missing[i]) + ":"
+		room := 255 - len(prefix)
+		if budget-1-len(prefix) < room {
+			room = budget - 1 - len(prefix)
+		}
+		// Whole base64 quanta only, so each window decodes on its own
+		nbytes := room / 4 * 3
+		if nbytes <= 0 {
+			return strs, missing[i]
+		}
+
+		windowStart := missing[i]
+		bitmap := make([]byte, nbytes)
+		for i < len(missing) && missing[i] < windowStart+nbytes*8 {
+			bit := missing[i] - windowStart
+			bitmap[bit/8] |= 0x80 >> (bit % 8)
+			i++
+		}
+
+		// Drop trailing zero bytes beyond the last missing part
+		last := (missing[i-1] - windowStart) / 8
+		used := (last/3 + 1) * 3
+		if used > nbytes {
+			used = nbytes
+		}
+		str := prefix + base64.StdEncoding.EncodeToString(bitmap[:used])
+		strs = append(strs, str)
+		budget -= 1 + len(str)
+	}
+
+	return strs, 0
+}
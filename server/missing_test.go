@@ -0,0 +1,283 @@
+package server
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"youkaidns/dns"
+)
+
+// decodeRanges parses ranges strings the way script.sh and script.ps1 do
+func decodeRanges(t *testing.T, strs []string) []int {
+	t.Helper()
+	var parts []int
+	for _, str := range strs {
+		for _, item := range strings.Split(str, ",") {
+			first, last, isRange := strings.Cut(item, "-")
+			a, err := strconv.Atoi(first)
+			if err != nil {
+				t.Fatalf("bad range item %q", item)
+			}
+			b := a
+			if isRange {
+				if b, err = strconv.Atoi(last); err != nil || b <= a {
+					t.Fatalf("bad range item %q", item)
+				}
+			}
+			for p := a; p <= b; p++ {
+				parts = append(parts, p)
+			}
+		}
+	}
+	return parts
+}
+
+// decodeBitmaps parses bitmap windows the way script.sh and script.ps1 do
+func decodeBitmaps(t *testing.T, strs []string) []int {
+	t.Helper()
+	var parts []int
+	for _, str := range strs {
+		startStr, encoded, ok := strings.Cut(str, ":")
+		start, err := strconv.Atoi(startStr)
+		if !ok || err != nil {
+			t.Fatalf("bad bitmap window %q", str)
+		}
+		bitmap, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			t.Fatalf("bad bitmap window %q: %v", str, err)
+		}
+		for bit := 0; bit < len(bitmap)*8; bit++ {
+			if bitmap[bit/8]&(0x80>>(bit%8)) != 0 {
+				parts = append(parts, start+bit)
+			}
+		}
+	}
+	return parts
+}
+
+// missingList returns the window of missing from part from onwards, as
+// FileAssembly.missingFrom would without a limit
+func missingList(from int, missing []int) missingParts {
+	m := missingParts{Count: len(missing)}
+	for _, part := range missing {
+		if part >= from {
+			m.Parts = append(m.Parts, part)
+		}
+	}
+	return m
+}
+
+// txtSize is the TXT data size of strs: a length byte plus each string
+func txtSize(strs []string) int {
+	size := 0
+	for _, str := range strs {
+		size += 1 + len(str)
+	}
+	return size
+}
+
+// partRange returns the parts from first to last
+func partRange(first, last int) []int {
+	var parts []int
+	for p := first; p <= last; p++ {
+		parts = append(parts, p)
+	}
+	return parts
+}
+
+// everyOther returns every second part from first, count parts in all
+func everyOther(first, count int) []int {
+	var parts []int
+	for i := 0; i < count; i++ {
+		parts = append(parts, first+2*i)
+	}
+	return parts
+}
+
+func TestMissingEncodingsRoundTrip(t *testing.T) {
+	encodings := []struct {
+		name   string
+		encode func([]int, int) ([]string, int)
+		decode func(*testing.T, []string) []int
+		// The layout doesn't depend on the budget, so any budget short of
+		// the full size leaves parts out. Bitmap windows shrink to fit.
+		fixedLayout bool
+	}{
+		{"ranges", missingRanges, decodeRanges, true},
+		{"bitmaps", missingBitmaps, decodeBitmaps, false},
+	}
+	tests := []struct {
+		name    string
+		missing []int
+	}{
+		{"single", []int{7}},
+		{"one run", partRange(120, 180)},
+		{"runs and singles", []int{1, 2, 3, 10, 300, 301, 5000}},
+		{"scattered", everyOther(1, 400)},
+		{"far apart", []int{1, 100000, 200000}},
+	}
+
+	for _, enc := range encodings {
+		for _, tt := range tests {
+			full, next := enc.encode(tt.missing, 1<<16)
+			if next != 0 {
+				t.Fatalf("%s/%s: unlimited budget left out part %d", enc.name, tt.name, next)
+			}
+			need := txtSize(full)
+
+			// At the exact budget everything fits; smaller budgets leave the rest
+			// for the next query
+			for _, budget := range []int{need, need - 1, need / 2, 8} {
+				t.Run(enc.name+"/"+tt.name+"/"+strconv.Itoa(budget), func(t *testing.T) {
+					strs, next := enc.encode(tt.missing, budget)
+					if size := txtSize(strs); size > budget {
+						t.Fatalf("used %d bytes, budget %d", size, budget)
+					}
+					for _, str := range strs {
+						if len(str) > 255 {
+							t.Fatalf("string of %d bytes", len(str))
+						}
+					}
+
+					want := tt.missing
+					if next != 0 {
+						i := 0
+						for i < len(tt.missing) && tt.missing[i] < next {
+							i++
+						}
+						if i == len(tt.missing) || tt.missing[i] != next {
+							t.Fatalf("next %d isn't a missing part", next)
+						}
+						want = tt.missing[:i]
+					}
+					if got := enc.decode(t, strs); !reflect.DeepEqual(got, want) && !(len(got) == 0 && len(want) == 0) {
+						t.Fatalf("decoded %v, want %v", got, want)
+					}
+
+					if budget >= need && next != 0 {
+						t.Errorf("budget %d fits everything but left out part %d", budget, next)
+					}
+					if enc.fixedLayout && budget < need && next == 0 {
+						t.Errorf("budget %d is short of %d but nothing was left out", budget, need)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestCompactMissingAnswerFitsResponse(t *testing.T) {
+	domain := strings.Repeat("a", 60) + "." + strings.Repeat("b", 60) + ".example.com"
+	query := "12.v3-1.missing.0123abcd." + domain
+	missing := everyOther(1, 5000)
+
+	for _, format := range []string{MissingFormatRanges, MissingFormatBitmap} {
+		t.Run(format, func(t *testing.T) {
+			rr := compactMissingAnswer(query, format, 10000, missingList(1, missing))
+			size := 12 + (len(query) + 2 + 4) + (len(query) + 2 + 10) + len(rr.Data)
+			if size > maxResponseSize {
+				t.Fatalf("response of %d bytes, limit %d", size, maxResponseSize)
+			}
+
+			strs := txtStrings(rr.Data)
+			fields := strings.Fields(strs[0])
+			if len(fields) != 4 || fields[0] != format || fields[1] != "10000" || fields[2] != "5000" {
+				t.Fatalf("header %q", strs[0])
+			}
+			next, _ := strconv.Atoi(fields[3])
+			if next == 0 {
+				t.Fatal("5000 scattered parts fit one response")
+			}
+
+			// Asking from next continues where the first response stopped
+			rest := txtStrings(compactMissingAnswer(query, format, 10000, missingList(next, missing)).Data)[1:]
+			decode := decodeRanges
+			if format == MissingFormatBitmap {
+				decode = decodeBitmaps
+			}
+			if got := decode(t, rest); len(got) == 0 || got[0] != next {
+				t.Fatalf("continuation decoded %v, want it to start at %d", got, next)
+			}
+		})
+	}
+}
+
+func TestParseMissingFormat(t *testing.T) {
+	tests := []struct {
+		label  string
+		format string
+		from   int
+	}{
+		{"3", MissingFormatList, 1},
+		{"v1", MissingFormatList, 1},
+		{"v2", MissingFormatRanges, 1},
+		{"v2-250", MissingFormatRanges, 250},
+		{"v3-7", MissingFormatBitmap, 7},
+		{"v3-0", MissingFormatBitmap, 1},
+		{"v3-x", MissingFormatBitmap, 1},
+		{"v4-9", MissingFormatList, 1},
+	}
+	for _, tt := range tests {
+		format, from := parseMissingFormat(tt.label)
+		if format != tt.format || from != tt.from {
+			t.Errorf("parseMissingFormat(%q) = %s, %d; want %s, %d", tt.label, format, from, tt.format, tt.from)
+		}
+	}
+}
+
+func TestMissingFrom(t *testing.T) {
+	a := &FileAssembly{TotalParts: 10, Parts: map[int][]byte{2: nil, 3: nil, 7: nil, 12: nil}}
+
+	tests := []struct {
+		from, limit int
+		want        missingParts
+	}{
+		{1, 100, missingParts{[]int{1, 4, 5, 6, 8, 9, 10}, 7, 0}},
+		{3, 100, missingParts{[]int{4, 5, 6, 8, 9, 10}, 7, 0}},
+		{1, 3, missingParts{[]int{1, 4, 5}, 7, 6}},
+		{11, 100, missingParts{nil, 7, 0}},
+	}
+	for _, tt := range tests {
+		if got := a.missingFrom(tt.from, tt.limit); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("missingFrom(%d, %d) = %+v, want %+v", tt.from, tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestTotalPartsCapped(t *testing.T) {
+	s := newTestServer(t)
+	name := encodeLabel(EncodingHex, []byte("huge.bin"))
+	hash8 := "0123abcd"
+
+	tests := []struct {
+		name   string
+		labels []string // total_parts, chunk_size, total_bytes
+		ok     bool
+	}{
+		{"parts for the bytes", []string{"4", "30", "100"}, true},
+		{"one part for no bytes", []string{"1", "30", "0"}, true},
+		{"more parts than the bytes fill", []string{"5", "30", "100"}, false},
+		{"over the part limit", []string{strconv.Itoa(maxTotalParts + 1), "1", strconv.Itoa(maxTotalParts + 1)}, false},
+	}
+	for _, tt := range tests {
+		record := strings.Join(append(append([]string{name}, tt.labels...), "start", hash8, testDomain), ".")
+		if w := serveQuery(s, record, dns.TypeTXT); (len(w.answers) > 0) != tt.ok {
+			t.Errorf("%s: acknowledged %v, want %v", tt.name, len(w.answers) > 0, tt.ok)
+		}
+	}
+
+	// A transfer at the part limit answers missing queries from its
+	// received parts, a page at a time
+	record := strings.Join([]string{name, strconv.Itoa(maxTotalParts), "1", strconv.Itoa(maxTotalParts), "start", "0123abce", testDomain}, ".")
+	if w := serveQuery(s, record, dns.TypeTXT); len(w.answers) == 0 {
+		t.Fatal("start record at the part limit rejected")
+	}
+	strs := txtStrings(serveQuery(s, "v2.missing.0123abce."+testDomain, dns.TypeTXT).answers[0].Data)
+	want := "v2 " + strconv.Itoa(maxTotalParts) + " " + strconv.Itoa(maxTotalParts) + " " + strconv.Itoa(maxMissingWalk+1)
+	if strs[0] != want || strs[1] != "1-"+strconv.Itoa(maxMissingWalk) {
+		t.Fatalf("missing list %q, want header %q and the first %d parts", strs, want, maxMissingWalk)
+	}
+}
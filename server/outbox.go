@@ -0,0 +1,447 @@
+package server
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"youkaidns/dns"
+)
+
+// outboxChunkSize is the number of file bytes per download chunk. Base64
+// turns 180 bytes into 240 characters, which fits a single TXT string.
+const outboxChunkSize = 180
+
+// maxOutboxPageLabel is the longest page label manifest pages are sized for
+const maxOutboxPageLabel = len("99999")
+
+// DefaultOutboxUploadLimit is the largest file SaveOutboxFile accepts unless
+// SetOutboxUploadLimit sets another limit
+const DefaultOutboxUploadLimit = 64 << 20
+
+// ErrOutboxFileTooLarge is returned when an outbox upload is over the limit
+var ErrOutboxFileTooLarge = errors.New("file is larger than the outbox upload limit")
+
+// OutboxFile is a file offered for download from the outbox directory
+type OutboxFile struct {
+	ID      string    `json:"id"`     // Short id of the name and content (see outboxID), used in chunk queries
+	Name    string    `json:"name"`   // File name in the outbox directory
+	Size    int64     `json:"size"`   // Size in bytes
+	MD5     string    `json:"md5"`    // Full MD5 of the file
+	Chunks  int       `json:"chunks"` // Number of chunks of outboxChunkSize bytes
+	ModTime time.Time `json:"mod_time"`
+}
+
+// SetOutboxDir sets the directory whose files are served over DNS. An empty
+// directory disables downloads.
+func (s *Server) SetOutboxDir(dir string) {
+	s.outboxMu.Lock()
+	defer s.outboxMu.Unlock()
+
+	s.outboxDir = dir
+	s.outboxFiles = make(map[string]*OutboxFile)
+	s.outboxScanned = time.Time{}
+	if dir != "" {
+		os.MkdirAll(dir, 0755)
+	}
+}
+
+// SetOutboxUploadLimit sets the largest file SaveOutboxFile accepts, in
+// bytes; 0 restores DefaultOutboxUploadLimit
+func (s *Server) SetOutboxUploadLimit(limit int64) {
+	s.outboxMu.Lock()
+	defer s.outboxMu.Unlock()
+	s.outboxLimit = max(limit, 0)
+}
+
+// OutboxUploadLimit returns the largest file SaveOutboxFile accepts
+func (s *Server) OutboxUploadLimit() int64 {
+	s.outboxMu.Lock()
+	defer s.outboxMu.Unlock()
+	return s.uploadLimit()
+}
+
+// uploadLimit returns the outbox upload limit. The caller must hold
+// outboxMu.
+func (s *Server) uploadLimit() int64 {
+	if s.outboxLimit == 0 {
+		return DefaultOutboxUploadLimit
+	}
+	return s.outboxLimit
+}
+
+// GetOutboxFiles rescans the outbox directory and returns its files sorted by name
+func (s *Server) GetOutboxFiles() []OutboxFile {
+	s.scanOutbox(0)
+
+	s.outboxMu.Lock()
+	defer s.outboxMu.Unlock()
+	return s.sortedOutbox()
+}
+
+// SaveOutboxFile writes the data read from r to the outbox directory under
+// name, replacing a file of that name, and returns the rescanned entry. Data
+// over the upload limit fails with ErrOutboxFileTooLarge.
+func (s *Server) SaveOutboxFile(name string, r io.Reader) (OutboxFile, error) {
+	if !validOutboxName(name) {
+		return OutboxFile{}, fmt.Errorf("invalid file name %q", name)
+	}
+	s.outboxMu.Lock()
+	dir := s.outboxDir
+	limit := s.uploadLimit()
+	s.outboxMu.Unlock()
+	if dir == "" {
+		return OutboxFile{}, fmt.Errorf("outbox is disabled")
+	}
+
+	// Written under a hidden name the scanner skips, then renamed, so clients
+	// never see a partial file
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return OutboxFile{}, err
+	}
+	// Read one byte past the limit to tell a file of exactly the limit from
+	// a larger one
+	n, err := io.Copy(tmp, io.LimitReader(r, limit+1))
+	if err == nil && n > limit {
+		err = ErrOutboxFileTooLarge
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return OutboxFile{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return OutboxFile{}, err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		os.Remove(tmp.Name())
+		return OutboxFile{}, err
+	}
+	log.Printf("Added outbox file %s", name)
+
+	s.scanOutbox(0)
+	s.outboxMu.Lock()
+	defer s.outboxMu.Unlock()
+	for _, f := range s.outboxFiles {
+		if f.Name == name {
+			return *f, nil
+		}
+	}
+	return OutboxFile{}, fmt.Errorf("outbox file %s was not indexed", name)
+}
+
+// DeleteOutboxFile removes a file from the outbox directory
+func (s *Server) DeleteOutboxFile(name string) error {
+	if !validOutboxName(name) {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	s.outboxMu.Lock()
+	dir := s.outboxDir
+	s.outboxMu.Unlock()
+	if dir == "" {
+		return ErrFileNotFound
+	}
+
+	filePath := filepath.Join(dir, name)
+	if info, err := os.Lstat(filePath); err != nil || info.IsDir() {
+		return ErrFileNotFound
+	}
+	if err := os.Remove(filePath); err != nil {
+		return err
+	}
+	log.Printf("Deleted outbox file %s", name)
+
+	s.scanOutbox(0)
+	return nil
+}
+
+// validOutboxName reports whether name can be an outbox file: a plain file
+// name that isn't hidden, since the scanner skips hidden files
+func validOutboxName(name string) bool {
+	return name != "" && name == filepath.Base(name) && !strings.HasPrefix(name, ".") &&
+		!strings.ContainsAny(name, "/\\")
+}
+
+// outboxRescanInterval is how often DNS queries may rescan the outbox
+// directory, so a flood of manifest or unknown-id queries can't keep the
+// scanner busy
+const outboxRescanInterval = time.Second
+
+// scanOutbox refreshes the outbox index unless it was refreshed less than
+// minAge ago. Hashes are reused for files whose size and modification time
+// are unchanged. Files are listed and hashed without holding outboxMu, so
+// chunk queries for indexed files are answered during a scan.
+func (s *Server) scanOutbox(minAge time.Duration) {
+	s.outboxScanMu.Lock()
+	defer s.outboxScanMu.Unlock()
+
+	s.outboxMu.Lock()
+	dir := s.outboxDir
+	fresh := time.Since(s.outboxScanned) < minAge
+	byName := make(map[string]*OutboxFile, len(s.outboxFiles))
+	for _, f := range s.outboxFiles {
+		byName[f.Name] = f
+	}
+	s.outboxMu.Unlock()
+	if dir == "" || fresh {
+		return
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Error reading outbox directory %s: %v", dir, err)
+		return
+	}
+
+	files := make(map[string]*OutboxFile, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		f, ok := byName[entry.Name()]
+		if !ok || f.Size != info.Size() || !f.ModTime.Equal(info.ModTime()) {
+			sum, err := md5File(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				log.Printf("Error hashing outbox file %s: %v", entry.Name(), err)
+				continue
+			}
+			f = &OutboxFile{
+				ID:      outboxID(entry.Name(), sum),
+				Name:    entry.Name(),
+				Size:    info.Size(),
+				MD5:     sum,
+				Chunks:  int((info.Size() + outboxChunkSize - 1) / outboxChunkSize),
+				ModTime: info.ModTime(),
+			}
+		}
+		if other, exists := files[f.ID]; exists {
+			log.Printf("Warning: Outbox files %s and %s have the same id %s; skipping %s", other.Name, f.Name, f.ID, f.Name)
+			continue
+		}
+		files[f.ID] = f
+	}
+
+	s.outboxMu.Lock()
+	defer s.outboxMu.Unlock()
+	if s.outboxDir == dir { // Not changed by SetOutboxDir meanwhile
+		s.outboxFiles = files
+		s.outboxScanned = time.Now()
+	}
+}
+
+// outboxID returns the id of an outbox file: the first 8 hex characters of
+// the MD5 of its name and content MD5, so copies of a file under different
+// names get different ids
+func outboxID(name string, sum string) string {
+	id := md5.Sum([]byte(name + "/" + sum))
+	return hex.EncodeToString(id[:4])
+}
+
+// sortedOutbox returns the indexed outbox files sorted by name. The caller
+// must hold outboxMu.
+func (s *Server) sortedOutbox() []OutboxFile {
+	files := make([]OutboxFile, 0, len(s.outboxFiles))
+	for _, f := range s.outboxFiles {
+		files = append(files, *f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	return files
+}
+
+// handleGetQuery serves the outbox over DNS
+// Format: [page.]list.get.<domain> returns the manifest, one TXT record per
+// file ("<id> <size> <chunks> <md5> <name>"), as many files per page as fit
+// one response (see outboxPages) and no files past the last page;
+// <chunk_num>.<id>.get.<domain> returns chunk chunk_num (1-based) as base64.
+// Returns nil if not a get query.
+func (s *Server) handleGetQuery(q *Query) []dns.ResourceRecord {
+	// Only handle TXT queries
+	if q.Type != dns.TypeTXT {
+		return nil
+	}
+
+	parts := q.Labels
+	if q.Domain == nil || len(parts) < 2 || parts[len(parts)-1] != "get" {
+		return nil
+	}
+
+	s.outboxMu.Lock()
+	dir := s.outboxDir
+	s.outboxMu.Unlock()
+	if dir == "" {
+		return nil
+	}
+
+	// Manifest: [page.]list.get
+	if parts[len(parts)-2] == "list" {
+		page := 1
+		if len(parts) >= 3 {
+			if n, err := strconv.Atoi(parts[len(parts)-3]); err == nil && n >= 1 {
+				page = n
+			}
+		}
+
+		s.scanOutbox(outboxRescanInterval)
+		s.outboxMu.Lock()
+		files := s.sortedOutbox()
+		s.outboxMu.Unlock()
+
+		answers := []dns.ResourceRecord{}
+		if pages := outboxPages(strings.TrimSuffix("list.get."+q.Domain.Name, "."), files); page <= len(pages) {
+			for _, entry := range pages[page-1] {
+				answers = append(answers, txtRecord(q.Name, entry))
+			}
+		}
+
+		if s.verbose {
+			log.Printf("Outbox manifest query (page %d): returning %d of %d files", page, len(answers), len(files))
+		}
+		return answers
+	}
+
+	// Chunk: <chunk_num>.<id>.get
+	if len(parts) < 3 {
+		return nil
+	}
+	id := parts[len(parts)-2]
+	chunkNum, err := strconv.Atoi(parts[len(parts)-3])
+	if err != nil || chunkNum < 1 {
+		return nil
+	}
+
+	f, exists := s.outboxFile(id)
+	if !exists {
+		// The file may have been added since the last scan
+		s.scanOutbox(outboxRescanInterval)
+		if f, exists = s.outboxFile(id); !exists {
+			return nil
+		}
+	}
+	if chunkNum > f.Chunks {
+		return nil
+	}
+
+	chunk, err := readChunk(filepath.Join(dir, f.Name), int64(chunkNum-1)*outboxChunkSize, outboxChunkSize)
+	if err != nil {
+		log.Printf("Error reading outbox file %s: %v", f.Name, err)
+		return nil
+	}
+
+	if s.verbose {
+		log.Printf("Outbox chunk query for %s: chunk %d/%d", f.Name, chunkNum, f.Chunks)
+	}
+
+	return []dns.ResourceRecord{txtRecord(q.Name, base64.StdEncoding.EncodeToString(chunk))}
+}
+
+// outboxFile looks up an indexed outbox file by id
+func (s *Server) outboxFile(id string) (*OutboxFile, bool) {
+	s.outboxMu.Lock()
+	defer s.outboxMu.Unlock()
+	f, exists := s.outboxFiles[id]
+	return f, exists
+}
+
+// outboxPages splits the manifest into pages of entries, each holding as many
+// files as fit one response of maxResponseSize bytes (at least one). Pages
+// are sized for the longest page label in front of listName, so the
+// boundaries don't depend on how a page is asked for.
+func outboxPages(listName string, files []OutboxFile) [][]string {
+	// Header, question and answers whose names point to the question
+	budget := maxResponseSize - 12 - (maxOutboxPageLabel + 1 + len(listName) + 2 + 4)
+
+	var pages [][]string
+	var page []string
+	used := 0
+	for _, f := range files {
+		entry := fmt.Sprintf("%s %d %d %s %s", f.ID, f.Size, f.Chunks, f.MD5, f.Name)
+		size := 2 + 10 + len(txtRecord("", entry).Data)
+		if len(page) > 0 && used+size > budget {
+			pages = append(pages, page)
+			page, used = nil, 0
+		}
+		page = append(page, entry)
+		used += size
+	}
+	if len(page) > 0 {
+		pages = append(pages, page)
+	}
+	return pages
+}
+
+// txtRecord builds a TXT answer for text, split into as many 255-byte
+// character strings as needed
+func txtRecord(name string, text string) dns.ResourceRecord {
+	var data []byte
+	for {
+		n := len(text)
+		if n > 255 {
+			n = 255
+		}
+		data = append(data, byte(n))
+		data = append(data, text[:n]...)
+		text = text[n:]
+		if text == "" {
+			break
+		}
+	}
+
+	return dns.ResourceRecord{
+		Name:    name,
+		Type:    dns.TypeTXT,
+		Class:   1, // IN
+		TTL:     0, // TTL=0 to prevent caching
+		Data:    data,
+		DataLen: uint16(len(data)),
+	}
+}
+
+// readChunk reads up to size bytes from path at offset
+func readChunk(path string, offset int64, size int) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, size)
+	n, err := f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// md5File returns the hex MD5 of a file
+func md5File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
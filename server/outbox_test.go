@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"youkaidns/dns"
+)
+
+// newOutboxServer returns a test server whose outbox holds files
+func newOutboxServer(t *testing.T, files map[string][]byte) (*Server, string) {
+	t.Helper()
+	s := newTestServer(t)
+	dir := filepath.Join(t.TempDir(), "outbox")
+	s.SetOutboxDir(dir)
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s, dir
+}
+
+// manifest fetches every page of the outbox manifest over DNS, keyed by name,
+// checking each page fits a UDP response
+func manifest(t *testing.T, s *Server) map[string][]string {
+	t.Helper()
+	entries := make(map[string][]string)
+	for page := 1; ; page++ {
+		name := strconv.Itoa(page) + ".list.get." + testDomain
+		w := serveQuery(s, name, dns.TypeTXT)
+		if len(w.answers) == 0 {
+			return entries
+		}
+		question := dns.Question{Name: name, Type: dns.TypeTXT, Class: 1}
+		response := &dns.Message{Header: dns.MessageHeader{QdCount: 1}, Questions: []dns.Question{question}, Answers: w.answers}
+		if data, err := response.ToBytes(); err != nil || len(data) > maxResponseSize {
+			t.Fatalf("page %d: %d bytes (%v)", page, len(data), err)
+		}
+		for _, rr := range w.answers {
+			fields := strings.SplitN(strings.Join(txtStrings(rr.Data), ""), " ", 5)
+			if len(fields) != 5 {
+				t.Fatalf("manifest entry %q", fields)
+			}
+			if _, listed := entries[fields[4]]; listed {
+				t.Fatalf("%s listed on two pages", fields[4])
+			}
+			entries[fields[4]] = fields
+		}
+	}
+}
+
+func TestOutboxDownload(t *testing.T) {
+	data := make([]byte, 2*outboxChunkSize+7)
+	for i := range data {
+		data[i] = byte(i * 11)
+	}
+	files := map[string][]byte{"tool.bin": data, ".hidden": []byte("not served")}
+	// Enough files with long names to need several pages
+	const listed = 20
+	for i := 1; i < listed; i++ {
+		files[fmt.Sprintf("%02d-%s.txt", i, strings.Repeat("long-name", i))] = []byte{byte(i)}
+	}
+	s, _ := newOutboxServer(t, files)
+
+	entries := manifest(t, s)
+	if len(entries) != listed {
+		t.Fatalf("manifest lists %d files, want %d", len(entries), listed)
+	}
+	if _, listed := entries[".hidden"]; listed {
+		t.Fatal("hidden file listed")
+	}
+
+	fields := entries["tool.bin"]
+	sum := md5.Sum(data)
+	if fields[0] != outboxID("tool.bin", hex.EncodeToString(sum[:])) || fields[1] != strconv.Itoa(len(data)) ||
+		fields[2] != "3" || fields[3] != hex.EncodeToString(sum[:]) {
+		t.Fatalf("manifest entry %q", fields)
+	}
+
+	var got []byte
+	for chunk := 1; chunk <= 3; chunk++ {
+		w := serveQuery(s, fmt.Sprintf("%d.%s.get.%s", chunk, fields[0], testDomain), dns.TypeTXT)
+		if len(w.answers) != 1 {
+			t.Fatalf("chunk %d: %d answers", chunk, len(w.answers))
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.Join(txtStrings(w.answers[0].Data), ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, decoded...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded chunks differ from the file")
+	}
+
+	// No chunk past the end
+	if w := serveQuery(s, "4."+fields[0]+".get."+testDomain, dns.TypeTXT); len(w.answers) != 0 {
+		t.Fatal("chunk past the end answered")
+	}
+}
+
+func TestOutboxIDs(t *testing.T) {
+	// Copies under different names get different ids; the id follows a file
+	// whose content changes
+	s, dir := newOutboxServer(t, map[string][]byte{"a.txt": []byte("same"), "b.txt": []byte("same")})
+	first := s.GetOutboxFiles()
+	if len(first) != 2 || first[0].ID == first[1].ID {
+		t.Fatalf("outbox %+v", first)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("changed content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "c.txt"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	second := s.GetOutboxFiles()
+	if len(second) != 3 || second[0].ID == first[0].ID || second[1].ID != first[1].ID {
+		t.Fatalf("after changes: %+v", second)
+	}
+}
+
+func TestOutboxDisabled(t *testing.T) {
+	s := newTestServer(t)
+	if w := serveQuery(s, "list.get."+testDomain, dns.TypeTXT); len(w.answers) != 0 || w.rcode >= 0 {
+		t.Fatal("manifest answered without an outbox directory")
+	}
+}
+
+func TestOutboxUploadLimit(t *testing.T) {
+	s, dir := newOutboxServer(t, nil)
+	if s.OutboxUploadLimit() != DefaultOutboxUploadLimit {
+		t.Fatalf("default limit %d", s.OutboxUploadLimit())
+	}
+	s.SetOutboxUploadLimit(4)
+
+	if _, err := s.SaveOutboxFile("fits.txt", strings.NewReader("1234")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SaveOutboxFile("big.txt", strings.NewReader("12345")); err != ErrOutboxFileTooLarge {
+		t.Fatalf("upload over the limit: %v", err)
+	}
+
+	// Nothing of the rejected upload is left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "fits.txt" {
+		t.Fatalf("outbox holds %v", entries)
+	}
+}
+
+func TestOutboxPages(t *testing.T) {
+	files := make(map[string][]byte)
+	for i := 0; i < 12; i++ {
+		files[fmt.Sprintf("%02d-%s.txt", i, strings.Repeat("x", 40))] = []byte{byte(i)}
+	}
+	s, _ := newOutboxServer(t, files)
+
+	// Page boundaries don't depend on how the page is asked for
+	first := serveQuery(s, "list.get."+testDomain, dns.TypeTXT)
+	if len(first.answers) == 0 || len(first.answers) == len(files) {
+		t.Fatalf("first page lists %d of %d files", len(first.answers), len(files))
+	}
+	for _, name := range []string{"1.list.get." + testDomain, "00001.list.get." + testDomain} {
+		if w := serveQuery(s, name, dns.TypeTXT); len(w.answers) != len(first.answers) {
+			t.Errorf("%s lists %d files, want %d", name, len(w.answers), len(first.answers))
+		}
+	}
+
+	// A file too long for the budget still gets a page of its own
+	pages := outboxPages("list.get."+testDomain, []OutboxFile{{ID: "0123abcd", Name: strings.Repeat("y", 500)}, {ID: "4567cdef", Name: "next"}})
+	if len(pages) != 2 || len(pages[0]) != 1 || len(pages[1]) != 1 {
+		t.Fatalf("pages %d", len(pages))
+	}
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CollisionPolicy controls how a received file is named when a file with
+// the same name already exists in the output directory
+type CollisionPolicy string
+
+// Supported collision policies
+const (
+	CollisionOverwrite  CollisionPolicy = "overwrite"   // Replace the existing file
+	CollisionSuffix     CollisionPolicy = "suffix"      // name_1.ext, name_2.ext, ...
+	CollisionTimestamp  CollisionPolicy = "timestamp"   // name_20060102-150405.ext
+	CollisionHashPrefix CollisionPolicy = "hash-prefix" // hash8_name.ext
+)
+
+// metaDirName is the hidden directory inside the output directory that holds
+// sidecar records for saved files
+const metaDirName = ".youkaidns"
+
+// tempPattern names the temp files and directories saves are written to
+// before being renamed into place
+const tempPattern = ".youkaidns-*.tmp"
+
+// isInternalFile reports whether a name in an output directory is the
+// server's own (sidecar records or an in-progress save) rather than a
+// received file
+func isInternalFile(name string) bool {
+	if name == metaDirName {
+		return true
+	}
+	return strings.HasPrefix(name, ".youkaidns-") && strings.HasSuffix(name, ".tmp")
+}
+
+// ParseCollisionPolicy parses a collision policy name
+func ParseCollisionPolicy(name string) (CollisionPolicy, error) {
+	switch policy := CollisionPolicy(strings.ToLower(name)); policy {
+	case CollisionOverwrite, CollisionSuffix, CollisionTimestamp, CollisionHashPrefix:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown collision policy %q (want overwrite, suffix, timestamp or hash-prefix)", name)
+	}
+}
+
+// FileRecord is the sidecar record tying a saved file to its transfer
+type FileRecord struct {
+	File             string    `json:"file"`              // Name of the saved file in the output directory
+	OriginalFilename string    `json:"original_filename"` // Filename announced by the sender
+	Hash             string    `json:"hash"`              // Transfer hash8
+	SourceIP         string    `json:"source_ip"`         // Resolver IP that sent the start record
+	Size             int64     `json:"size"`              // Saved file size in bytes (archive size for a bundle)
+	Verified         bool      `json:"verified"`          // File matched its transfer hash
+	Bundle           bool      `json:"bundle,omitempty"`  // File is a directory unpacked from a bundle
+	Files            int       `json:"files,omitempty"`   // Files unpacked from the bundle
+	StartedAt        time.Time `json:"started_at"`        // When the transfer was first seen
+	SavedAt          time.Time `json:"saved_at"`          // When the file was written
+}
+
+// SetCollisionPolicy sets the policy used when a received file name is already taken
+func (s *Server) SetCollisionPolicy(policy CollisionPolicy) {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	s.collisionPolicy = policy
+}
+
+// saveFile writes data atomically into the output directory dir, resolving
+// name collisions according to the configured policy. It returns the final
+// path.
+func (s *Server) saveFile(dir string, name string, hash8 string, data []byte) (string, error) {
+	// Write to a temp file first so readers never see a partial file
+	tmp, err := os.CreateTemp(dir, tempPattern)
+	if err != nil {
+		return "", fmt.Errorf("create temp file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // No-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("write temp file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("close temp file: %w", err)
+	}
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		return "", fmt.Errorf("chmod temp file: %w", err)
+	}
+
+	// Pick the final name and rename under the lock so two transfers
+	// finishing together can't claim the same name
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	filePath := s.resolveCollision(dir, name, hash8, false)
+	var replaced int64
+	if info, err := os.Lstat(filePath); err == nil && info.Mode().IsRegular() {
+		replaced = info.Size()
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return "", fmt.Errorf("rename temp file: %w", err)
+	}
+
+	// An overwritten file's bytes are no longer stored
+	s.releaseStoredIn(dir, replaced)
+
+	return filePath, nil
+}
+
+// resolveCollision returns a path in the output directory dir for name that
+// doesn't clash with an existing file, unless the policy is overwrite. A
+// name the server uses for itself is renamed, since the file would otherwise
+// be hidden from listings and uncounted by the quota. Overwriting replaces
+// only a received file of the same kind (a regular file, or the directory of
+// a bundle when bundle is set), and never a path holding another domain's
+// output directory.
+func (s *Server) resolveCollision(dir string, name string, hash8 string, bundle bool) string {
+	if isInternalFile(name) {
+		name = "_" + name
+	}
+	filePath := filepath.Join(dir, name)
+	if !s.reservedPath(filePath) && (!fileExists(filePath) ||
+		s.collisionPolicy == CollisionOverwrite && s.replaceable(dir, name, bundle)) {
+		return filePath
+	}
+
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	switch s.collisionPolicy {
+	case CollisionTimestamp:
+		name = fmt.Sprintf("%s_%s%s", base, time.Now().Format("20060102-150405"), ext)
+	case CollisionHashPrefix:
+		name = fmt.Sprintf("%s_%s", hash8, name)
+	}
+
+	// Fall back to a numeric suffix (also used by the suffix policy itself)
+	filePath = filepath.Join(dir, name)
+	ext = filepath.Ext(name)
+	base = strings.TrimSuffix(name, ext)
+	for i := 1; fileExists(filePath) || s.reservedPath(filePath); i++ {
+		filePath = filepath.Join(dir, fmt.Sprintf("%s_%d%s", base, i, ext))
+	}
+
+	return filePath
+}
+
+// reservedPath reports whether path is, or holds, the output directory of a
+// served domain, such as <output-dir>/<domain> for a secondary domain
+func (s *Server) reservedPath(path string) bool {
+	for _, d := range s.allDomains() {
+		rel, err := filepath.Rel(filepath.Clean(path), filepath.Clean(d.OutputDir))
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceable reports whether the overwrite policy may replace the existing
+// entry name in dir: a regular file with a file, or with a bundle a directory
+// whose record shows it was unpacked from one
+func (s *Server) replaceable(dir string, name string, bundle bool) bool {
+	info, err := os.Lstat(filepath.Join(dir, name))
+	if err != nil {
+		return false
+	}
+	if !bundle {
+		return info.Mode().IsRegular()
+	}
+	if !info.IsDir() {
+		return false
+	}
+	record, err := s.readFileRecord(dir, name)
+	return err == nil && record.Bundle
+}
+
+// writeFileRecord writes the sidecar record for a file saved in dir
+func (s *Server) writeFileRecord(dir string, record FileRecord) {
+	metaDir := filepath.Join(dir, metaDirName)
+	if err := os.MkdirAll(metaDir, 0755); err != nil {
+		log.Printf("Error creating metadata directory %s: %v", metaDir, err)
+		return
+	}
+
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		log.Printf("Error encoding file record for %s: %v", record.File, err)
+		return
+	}
+
+	recordPath := filepath.Join(metaDir, record.File+".json")
+	if err := os.WriteFile(recordPath, data, 0644); err != nil {
+		log.Printf("Error writing file record %s: %v", recordPath, err)
+	}
+}
+
+// readFileRecord reads the sidecar record for a file saved in dir, if any
+func (s *Server) readFileRecord(dir string, name string) (*FileRecord, error) {
+	data, err := os.ReadFile(filepath.Join(dir, metaDirName, name+".json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var record FileRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// fileExists reports whether a path exists
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
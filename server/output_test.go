@@ -0,0 +1,124 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveFileCollisionPolicies(t *testing.T) {
+	tests := []struct {
+		policy CollisionPolicy
+		want   []string // Names of three saves of report.txt, in order
+	}{
+		{CollisionOverwrite, []string{"report.txt", "report.txt", "report.txt"}},
+		{CollisionSuffix, []string{"report.txt", "report_1.txt", "report_2.txt"}},
+		{CollisionHashPrefix, []string{"report.txt", "0123abcd_report.txt", "0123abcd_report_1.txt"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			s := newTestServer(t)
+			s.SetCollisionPolicy(tt.policy)
+			dir := s.primaryDomain().OutputDir
+
+			for i, want := range tt.want {
+				path, err := s.saveFile(dir, "report.txt", "0123abcd", []byte{byte(i)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if filepath.Base(path) != want {
+					t.Fatalf("save %d named %s, want %s", i+1, filepath.Base(path), want)
+				}
+			}
+
+			// Saves go through temp files that must not be left behind
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range entries {
+				if isInternalFile(entry.Name()) && entry.Name() != metaDirName {
+					t.Errorf("temp file %s left in the output directory", entry.Name())
+				}
+			}
+		})
+	}
+
+	// The timestamp policy falls back to a numeric suffix within a second
+	s := newTestServer(t)
+	s.SetCollisionPolicy(CollisionTimestamp)
+	dir := s.primaryDomain().OutputDir
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		path, err := s.saveFile(dir, "report.txt", "0123abcd", []byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[path] {
+			t.Fatalf("timestamp policy reused %s", filepath.Base(path))
+		}
+		seen[path] = true
+	}
+}
+
+func TestParseCollisionPolicy(t *testing.T) {
+	for _, name := range []string{"overwrite", "suffix", "timestamp", "HASH-PREFIX"} {
+		if _, err := ParseCollisionPolicy(name); err != nil {
+			t.Errorf("ParseCollisionPolicy(%q): %v", name, err)
+		}
+	}
+	if _, err := ParseCollisionPolicy("rename"); err == nil {
+		t.Error("ParseCollisionPolicy accepted an unknown policy")
+	}
+}
+
+func TestTransferWritesSidecarRecord(t *testing.T) {
+	s := newTestServer(t)
+	dir := s.primaryDomain().OutputDir
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("older file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := testTransfer{Name: "notes.txt", File: []byte("the notes a sender transferred over DNS")}
+	hash8 := sendTransfer(t, s, tr)
+	if assembly := waitFinished(t, s, hash8); assembly.FailStatus != "" {
+		t.Fatalf("transfer failed: %s", assembly.FailReason)
+	}
+
+	// The existing file is kept and the transfer saved next to it
+	data, err := os.ReadFile(filepath.Join(dir, "notes_1.txt"))
+	if err != nil || string(data) != string(tr.File) {
+		t.Fatalf("saved file %q, %v", data, err)
+	}
+	record, err := s.readFileRecord(dir, "notes_1.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.OriginalFilename != "notes.txt" || record.Hash != hash8 || record.SourceIP != testClient.IP.String() ||
+		record.Size != int64(len(tr.File)) || !record.Verified {
+		t.Fatalf("sidecar record %+v", record)
+	}
+}
+
+func TestSaveFileInternalNames(t *testing.T) {
+	for _, policy := range []CollisionPolicy{CollisionOverwrite, CollisionSuffix} {
+		s := newTestServer(t)
+		s.SetCollisionPolicy(policy)
+		dir := s.primaryDomain().OutputDir
+		s.writeFileRecord(dir, FileRecord{File: "kept.txt"})
+
+		for _, name := range []string{metaDirName, ".youkaidns-1.tmp"} {
+			path, err := s.saveFile(dir, name, "0123abcd", []byte("received"))
+			if err != nil {
+				t.Fatalf("%s: save as %s: %v", policy, name, err)
+			}
+			if isInternalFile(filepath.Base(path)) {
+				t.Errorf("%s: saved under the internal name %s", policy, filepath.Base(path))
+			}
+		}
+		if _, err := s.readFileRecord(dir, "kept.txt"); err != nil {
+			t.Errorf("%s: records lost: %v", policy, err)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"youkaidns/dns"
+)
+
+// payloadChunkSize is the number of base64 characters per payload chunk
+// (safe for a single TXT string)
+const payloadChunkSize = 200
+
+// Platform selects the one-liner a client runs to fetch a payload
+type Platform string
+
+// Supported one-liner platforms
+const (
+	PlatformBash       Platform = "bash"       // bash with dig
+	PlatformPowerShell Platform = "powershell" // PowerShell with Resolve-DnsName
+	PlatformPython     Platform = "python"     // python3 with nslookup (POSIX shell)
+	PlatformBusybox    Platform = "busybox"    // busybox sh with nslookup
+)
+
+// onelinerTemplates are the fetch commands per platform. Templates get
+// .Chunks (number of chunks) and .Base (<name>.script[.<domain>]); chunk i
+// (1-based) is served at i.<Base>.
+var onelinerTemplates = map[Platform]*template.Template{
+	PlatformBash: template.Must(template.New("bash").Parse(
+		`echo $(for i in $(seq 1 {{.Chunks}}); do dig +short $i.{{.Base}} TXT | grep -oE '"[^"]+"' | tr -d '"'; done) | tr -d ' ' | base64 -d`)),
+	PlatformPowerShell: template.Must(template.New("powershell").Parse(
+		`[System.Text.Encoding]::UTF8.GetString([System.Convert]::FromBase64String((1..{{.Chunks}}|%{Resolve-DnsName -ty TXT -na "$_.{{.Base}}"|? Section -eq Answer|% Strings})))`)),
+	PlatformPython: template.Must(template.New("python").Parse(
+		`python3 -c "import subprocess as s,base64 as b,re,sys;sys.stdout.buffer.write(b.b64decode(''.join(re.findall(r'text = \"([\w+/=]+)\"',s.getoutput(';'.join('nslookup -type=txt %d.{{.Base}}'%i for i in range(1,{{.Chunks}}+1)))))))"`)),
+	PlatformBusybox: template.Must(template.New("busybox").Parse(
+		`for i in $(seq 1 {{.Chunks}}); do nslookup -type=txt $i.{{.Base}} | sed -n 's/.*text = "\(.*\)"/\1/p'; done | tr -d '\n' | base64 -d`)),
+}
+
+// ParsePlatform parses a one-liner platform name
+func ParsePlatform(name string) (Platform, error) {
+	platform := Platform(strings.ToLower(name))
+	if _, ok := onelinerTemplates[platform]; !ok {
+		return "", fmt.Errorf("unknown platform %q (want bash, powershell, python or busybox)", name)
+	}
+	return platform, nil
+}
+
+// ScriptDefaults are the settings baked into served transfer scripts, along
+// with the domain they are served under
+type ScriptDefaults struct {
+	ChunkSize   int    // Bytes per chunk
+	DNSServer   string // Resolver to send queries to, empty for the system default
+	MaxParallel int    // Concurrent queries
+}
+
+// scriptDefaultRule rewrites one default setting line of a transfer script
+type scriptDefaultRule struct {
+	re *regexp.Regexp // Group 1 is the text kept before the value
+	// value returns the new value, or false to leave the line alone
+	value func(domain string, d ScriptDefaults) (string, bool)
+}
+
+// scriptDefaultRules match the default lines of script.sh and the parameter
+// defaults of script.ps1
+var scriptDefaultRules = []scriptDefaultRule{
+	{regexp.MustCompile(`(?m)^(DEFAULT_DOMAIN=)[^\r\n]*`), func(domain string, d ScriptDefaults) (string, bool) {
+		return shellQuote(domain), domain != ""
+	}},
+	{regexp.MustCompile(`(?m)^(DEFAULT_CHUNK_SIZE=)[^\r\n]*`), func(domain string, d ScriptDefaults) (string, bool) {
+		return strconv.Itoa(d.ChunkSize), d.ChunkSize > 0
+	}},
+	{regexp.MustCompile(`(?m)^(DEFAULT_DNS_SERVER=)[^\r\n]*`), func(domain string, d ScriptDefaults) (string, bool) {
+		return shellQuote(d.DNSServer), true
+	}},
+	{regexp.MustCompile(`(?m)^(DEFAULT_MAX_PARALLEL=)[^\r\n]*`), func(domain string, d ScriptDefaults) (string, bool) {
+		return strconv.Itoa(d.MaxParallel), d.MaxParallel > 0
+	}},
+	{regexp.MustCompile(`(?m)^(\s*\[string\]\$Domain = )"[^"\r\n]*"`), func(domain string, d ScriptDefaults) (string, bool) {
+		return powershellQuote(domain), domain != ""
+	}},
+	{regexp.MustCompile(`(?m)^(\s*\[int\]\$ChunkSize = )\d+`), func(domain string, d ScriptDefaults) (string, bool) {
+		return strconv.Itoa(d.ChunkSize), d.ChunkSize > 0
+	}},
+	{regexp.MustCompile(`(?m)^(\s*\[string\]\$DnsServer = )"[^"\r\n]*"`), func(domain string, d ScriptDefaults) (string, bool) {
+		return powershellQuote(d.DNSServer), true
+	}},
+	{regexp.MustCompile(`(?m)^(\s*\[int\]\$MaxParallel = )\d+`), func(domain string, d ScriptDefaults) (string, bool) {
+		return strconv.Itoa(d.MaxParallel), d.MaxParallel > 0
+	}},
+}
+
+// SetScriptDefaults sets the settings baked into transfer scripts registered
+// after this call
+func (s *Server) SetScriptDefaults(d ScriptDefaults) {
+	s.payloadMu.Lock()
+	defer s.payloadMu.Unlock()
+	s.scriptDefaults = d
+}
+
+// renderScript fills domain and the script defaults into the default lines
+// of a transfer script
+func (s *Server) renderScript(domain string, data []byte) []byte {
+	s.payloadMu.RLock()
+	d := s.scriptDefaults
+	s.payloadMu.RUnlock()
+
+	for _, rule := range scriptDefaultRules {
+		value, ok := rule.value(domain, d)
+		if !ok {
+			continue
+		}
+		re := rule.re
+		data = re.ReplaceAllFunc(data, func(match []byte) []byte {
+			prefix := re.FindSubmatch(match)[1]
+			return append(append([]byte{}, prefix...), value...)
+		})
+	}
+	return data
+}
+
+// shellQuote quotes a value for a POSIX shell
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// powershellQuote quotes a value as a PowerShell literal string
+func powershellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// payload is a file served in chunks via [chunk_num.]<name>.script queries
+type payload struct {
+	chunks   []string // base64 chunks of payloadChunkSize characters
+	platform Platform // Platform used when the query doesn't name one
+}
+
+// RegisterPayload makes data available as a named payload under every served
+// domain, replacing any payload with the same name. platform is the default
+// one-liner platform. The payload is served byte for byte.
+func (s *Server) RegisterPayload(name string, data []byte, platform Platform) {
+	for _, d := range s.allDomains() {
+		s.registerPayload(d, name, data, platform, false)
+	}
+}
+
+// RegisterScript registers a built-in transfer script like RegisterPayload,
+// with each domain and the script defaults filled into its default lines
+func (s *Server) RegisterScript(name string, data []byte, platform Platform) {
+	for _, d := range s.allDomains() {
+		s.registerPayload(d, name, data, platform, true)
+	}
+}
+
+// registerPayload makes data available as a named payload under domain d,
+// rendered as a transfer script if script is set
+func (s *Server) registerPayload(d *Domain, name string, data []byte, platform Platform, script bool) {
+	if script {
+		data = s.renderScript(d.Name, data)
+	}
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	var chunks []string
+	for i := 0; i < len(encoded); i += payloadChunkSize {
+		end := i + payloadChunkSize
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		chunks = append(chunks, encoded[i:end])
+	}
+
+	s.payloadMu.Lock()
+	d.payloads[name] = &payload{chunks: chunks, platform: platform}
+	s.payloadMu.Unlock()
+
+	if s.verbose {
+		log.Printf("Registered payload %s for %s: %d chunks (%s)", name, d.Name, len(chunks), platform)
+	}
+}
+
+// LoadPayloadDir registers every file in dir as a payload under every served
+// domain. The payload name is the file name without its extension, lowercased
+// and reduced to characters valid in a DNS label; .ps1 files default to
+// PowerShell, the rest to bash. Files in dir replace payloads with the same
+// name.
+func (s *Server) LoadPayloadDir(dir string) error {
+	return s.loadPayloadDir(dir, s.allDomains())
+}
+
+// LoadDomainPayloadDir registers every file in dir as a payload under one
+// served domain, like LoadPayloadDir
+func (s *Server) LoadDomainPayloadDir(domain string, dir string) error {
+	d, exists := s.findDomain(domain)
+	if !exists {
+		return fmt.Errorf("unknown domain %q", domain)
+	}
+	return s.loadPayloadDir(dir, []*Domain{d})
+}
+
+// loadPayloadDir registers every file in dir as a payload under domains
+func (s *Server) loadPayloadDir(dir string, domains []*Domain) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		name := payloadName(entry.Name())
+		if name == "" {
+			log.Printf("Warning: Skipping payload %s: no usable name", entry.Name())
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+
+		platform := PlatformBash
+		if strings.EqualFold(filepath.Ext(entry.Name()), ".ps1") {
+			platform = PlatformPowerShell
+		}
+		for _, d := range domains {
+			s.registerPayload(d, name, data, platform, false)
+		}
+		log.Printf("Loaded payload %s from %s", name, entry.Name())
+	}
+
+	return nil
+}
+
+// PayloadNames returns the payload names registered under the primary domain,
+// sorted
+func (s *Server) PayloadNames() []string {
+	d := s.primaryDomain()
+
+	s.payloadMu.RLock()
+	defer s.payloadMu.RUnlock()
+
+	names := make([]string, 0, len(d.payloads))
+	for name := range d.payloads {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// payloadName turns a file name into a payload name usable as a DNS label
+func payloadName(filename string) string {
+	base := strings.ToLower(strings.TrimSuffix(filename, filepath.Ext(filename)))
+
+	var b strings.Builder
+	for _, r := range base {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == '-' || r == '_' || r == ' ' || r == '.':
+			b.WriteByte('-')
+		}
+	}
+
+	name := strings.Trim(b.String(), "-")
+	if len(name) > 63 {
+		name = name[:63]
+	}
+	return name
+}
+
+// handleScriptQuery handles queries for payloads
+// Format: <name>.script.<domain> returns a one-liner for the payload's
+// default platform, <platform>.<name>.script.<domain> a one-liner for that
+// platform, and <chunk_num>.<name>.script.<domain> one chunk (1-based).
+// Returns TXT records, or nil if not a payload query.
+func (s *Server) handleScriptQuery(q *Query) []dns.ResourceRecord {
+	// Only handle TXT queries
+	if q.Type != dns.TypeTXT {
+		return nil
+	}
+
+	d, parts := q.Domain, q.Labels
+	if d == nil || len(parts) < 2 || parts[len(parts)-1] != "script" {
+		return nil
+	}
+	name := parts[len(parts)-2]
+
+	s.payloadMu.RLock()
+	p, exists := d.payloads[name]
+	s.payloadMu.RUnlock()
+
+	if !exists || len(p.chunks) == 0 {
+		return nil
+	}
+
+	platform := p.platform
+	if len(parts) >= 3 {
+		selector := parts[len(parts)-3]
+
+		// Chunk query: return that chunk only
+		if chunkNum, err := strconv.Atoi(selector); err == nil {
+			if chunkNum < 1 || chunkNum > len(p.chunks) {
+				return nil
+			}
+			return []dns.ResourceRecord{txtRecord(q.Name, p.chunks[chunkNum-1])}
+		}
+
+		// Platform query: return the one-liner for that platform
+		parsed, err := ParsePlatform(selector)
+		if err != nil {
+			return nil
+		}
+		platform = parsed
+	}
+
+	return s.onelinerAnswer(q.Name, d.Name, name, platform, len(p.chunks))
+}
+
+// onelinerAnswer returns a one-liner command that retrieves the full payload
+// from domain. This avoids DNS resolver limits on large responses.
+func (s *Server) onelinerAnswer(queryDomain string, domain string, name string, platform Platform, chunks int) []dns.ResourceRecord {
+	base := name + ".script"
+	if domain != "" {
+		base = base + "." + domain
+	}
+
+	var buf bytes.Buffer
+	err := onelinerTemplates[platform].Execute(&buf, struct {
+		Chunks int
+		Base   string
+	}{chunks, base})
+	if err != nil {
+		log.Printf("Error rendering %s one-liner for %s: %v", platform, name, err)
+		return nil
+	}
+
+	if s.verbose {
+		log.Printf("Script query for %s: returning %s one-liner command (%d chunks total)", name, platform, chunks)
+	}
+
+	return []dns.ResourceRecord{txtRecord(queryDomain, buf.String())}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeNslookup answers "nslookup -type=txt <name>" from files named after the
+// queried name, in the output format of BIND's nslookup
+const fakeNslookup = `#!/bin/sh
+name="$2"
+echo "Server:		127.0.0.1"
+echo "Address:	127.0.0.1#53"
+echo
+if [ -f "$ANSWERS/$name" ]; then
+	printf '%s\ttext = "%s"\n' "$name" "$(cat "$ANSWERS/$name")"
+else
+	echo "** server can't find $name: NXDOMAIN"
+fi
+`
+
+func TestPythonOnelinerDecodesPayload(t *testing.T) {
+	for _, tool := range []string{"sh", "python3"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available", tool)
+		}
+	}
+
+	tests := []struct {
+		name string
+		size int // Payload bytes
+	}{
+		{"single short chunk", 3},         // 4 base64 characters
+		{"short final chunk", 153},        // 204 characters: 200 + 4
+		{"final chunk of eight", 156},     // 208 characters: 200 + 8
+		{"exact chunks", 300},             // 400 characters: 200 + 200
+		{"padded short final chunk", 301}, // 404 characters, ending in "=="
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := newTestServer(t)
+
+			data := make([]byte, tt.size)
+			for i := range data {
+				data[i] = byte(i*7 + 1)
+			}
+			s.RegisterPayload("tool", data, PlatformPython)
+
+			chunks := s.primaryDomain().payloads["tool"].chunks
+			answers := filepath.Join(dir, "answers")
+			bin := filepath.Join(dir, "bin")
+			for _, d := range []string{answers, bin} {
+				if err := os.Mkdir(d, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i, chunk := range chunks {
+				name := filepath.Join(answers, strconv.Itoa(i+1)+".tool.script.t.test")
+				if err := os.WriteFile(name, []byte(chunk), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(filepath.Join(bin, "nslookup"), []byte(fakeNslookup), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			answer := s.onelinerAnswer("tool.script.t.test", "t.test", "tool", PlatformPython, len(chunks))
+			if len(answer) != 1 {
+				t.Fatalf("got %d answers, want 1", len(answer))
+			}
+			oneliner := strings.Join(txtStrings(answer[0].Data), "")
+
+			cmd := exec.Command("sh", "-c", oneliner)
+			cmd.Env = append(os.Environ(), "PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"), "ANSWERS="+answers)
+			var stderr bytes.Buffer
+			cmd.Stderr = &stderr
+			out, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("one-liner failed: %v\n%s", err, stderr.String())
+			}
+			if !bytes.Equal(out, data) {
+				t.Errorf("decoded %d bytes, want the %d payload bytes", len(out), len(data))
+			}
+		})
+	}
+}
+
+func TestOnlyScriptsRendered(t *testing.T) {
+	script := []byte("#!/bin/bash\nDEFAULT_DOMAIN=''\nDEFAULT_CHUNK_SIZE=30\n")
+	s := newTestServer(t)
+	s.SetScriptDefaults(ScriptDefaults{ChunkSize: 60})
+	s.RegisterScript("linux", script, PlatformBash)
+	s.RegisterPayload("tool", script, PlatformBash)
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "extra.sh"), script, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.LoadPayloadDir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"linux", "#!/bin/bash\nDEFAULT_DOMAIN='t.test'\nDEFAULT_CHUNK_SIZE=60\n"},
+		{"tool", string(script)},
+		{"extra", string(script)},
+	}
+	for _, tt := range tests {
+		chunks := s.primaryDomain().payloads[tt.name].chunks
+		got, err := base64.StdEncoding.DecodeString(strings.Join(chunks, ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s served as %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// txtStrings splits TXT record data into its character strings
+func txtStrings(data []byte) []string {
+	var out []string
+	for len(data) > 0 {
+		n := int(data[0])
+		out = append(out, string(data[1:1+n]))
+		data = data[1+n:]
+	}
+	return out
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"youkaidns/dns"
+)
+
+// RateLimitAction is what happens to a query over its rate limit
+type RateLimitAction string
+
+// Supported rate limit actions
+const (
+	RateLimitDrop     RateLimitAction = "drop"     // Send no response
+	RateLimitRefuse   RateLimitAction = "refuse"   // Answer REFUSED
+	RateLimitTruncate RateLimitAction = "truncate" // Answer empty with TC set
+)
+
+// ParseRateLimitAction parses a rate limit action name
+func ParseRateLimitAction(name string) (RateLimitAction, error) {
+	switch action := RateLimitAction(strings.ToLower(name)); action {
+	case RateLimitDrop, RateLimitRefuse, RateLimitTruncate:
+		return action, nil
+	default:
+		return "", fmt.Errorf("unknown rate limit action %q (want drop, refuse or truncate)", name)
+	}
+}
+
+// RateLimits configures token-bucket query rate limits. Rates are queries
+// per second, 0 for no limit. A burst of 0 allows one second's worth of
+// queries.
+type RateLimits struct {
+	ClientRate  float64 // Per client (resolver) IP
+	ClientBurst int
+
+	SubnetRate     float64 // Per client subnet
+	SubnetBurst    int
+	SubnetPrefixV4 int // Subnet size for IPv4 clients, default /24
+	SubnetPrefixV6 int // Subnet size for IPv6 clients, default /56
+
+	TransferRate  float64 // Per transfer (start and data records of one hash)
+	TransferBurst int
+
+	Action RateLimitAction // Default drop
+}
+
+// Default client subnet sizes for subnet rate limits
+const (
+	defaultSubnetPrefixV4 = 24
+	defaultSubnetPrefixV6 = 56
+)
+
+// bucketSweepInterval is how often buckets that have refilled are forgotten
+const bucketSweepInterval = time.Minute
+
+// tokenBucket holds the tokens of one key; a query takes one
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// bucketSet is a token bucket per key, all with the same rate and burst
+type bucketSet struct {
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// newBucketSet returns a bucket set, or nil if rate is 0
+func newBucketSet(rate float64, burst int) *bucketSet {
+	if rate <= 0 {
+		return nil
+	}
+	b := float64(burst)
+	if burst <= 0 {
+		b = rate
+	}
+	if b < 1 {
+		b = 1
+	}
+	return &bucketSet{rate: rate, burst: b, buckets: make(map[string]*tokenBucket), lastSweep: time.Now()}
+}
+
+// bucket returns key's bucket, refilled up to now
+func (b *bucketSet) bucket(key string, now time.Time) *tokenBucket {
+	if now.Sub(b.lastSweep) >= bucketSweepInterval {
+		b.sweep(now)
+	}
+
+	bucket, exists := b.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: b.burst, last: now}
+		b.buckets[key] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * b.rate
+	if bucket.tokens > b.burst {
+		bucket.tokens = b.burst
+	}
+	bucket.last = now
+	return bucket
+}
+
+// sweep forgets buckets that have refilled, since a new bucket starts full
+func (b *bucketSet) sweep(now time.Time) {
+	for key, bucket := range b.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*b.rate >= b.burst {
+			delete(b.buckets, key)
+		}
+	}
+	b.lastSweep = now
+}
+
+// rateLimiter applies RateLimits to queries
+type rateLimiter struct {
+	mu       sync.Mutex
+	limits   RateLimits
+	client   *bucketSet
+	subnet   *bucketSet
+	transfer *bucketSet
+}
+
+// newRateLimiter returns a rate limiter, or nil if no limit is set
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	if limits.SubnetPrefixV4 <= 0 || limits.SubnetPrefixV4 > 32 {
+		limits.SubnetPrefixV4 = defaultSubnetPrefixV4
+	}
+	if limits.SubnetPrefixV6 <= 0 || limits.SubnetPrefixV6 > 128 {
+		limits.SubnetPrefixV6 = defaultSubnetPrefixV6
+	}
+	if limits.Action == "" {
+		limits.Action = RateLimitDrop
+	}
+
+	r := &rateLimiter{
+		limits:   limits,
+		client:   newBucketSet(limits.ClientRate, limits.ClientBurst),
+		subnet:   newBucketSet(limits.SubnetRate, limits.SubnetBurst),
+		transfer: newBucketSet(limits.TransferRate, limits.TransferBurst),
+	}
+	if r.client == nil && r.subnet == nil && r.transfer == nil {
+		return nil
+	}
+	return r
+}
+
+// allow reports whether a query from clientIP (for transfer, empty if none)
+// is within the limits, and which limit it broke if not. A token is taken
+// from every bucket only once all of them have one, so a query rejected by
+// one limit doesn't use up the others.
+func (r *rateLimiter) allow(clientIP net.IP, transfer string, now time.Time) (bool, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var taken []*tokenBucket
+	check := func(set *bucketSet, key string) bool {
+		if set == nil || key == "" {
+			return true
+		}
+		bucket := set.bucket(key, now)
+		taken = append(taken, bucket)
+		return bucket.tokens >= 1
+	}
+	if !check(r.client, clientIP.String()) {
+		return false, "client"
+	}
+	if r.subnet != nil && !check(r.subnet, clientSubnet(clientIP, r.limits.SubnetPrefixV4, r.limits.SubnetPrefixV6)) {
+		return false, "subnet"
+	}
+	if !check(r.transfer, transfer) {
+		return false, "transfer"
+	}
+	for _, bucket := range taken {
+		bucket.tokens--
+	}
+	return true, ""
+}
+
+// clientSubnet returns the subnet of ip in CIDR notation
+func clientSubnet(ip net.IP, prefixV4 int, prefixV6 int) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(prefixV4, 32)), Mask: net.CIDRMask(prefixV4, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(prefixV6, 128)), Mask: net.CIDRMask(prefixV6, 128)}).String()
+}
+
+// queryTransfer returns the transfer key of a start or data record (its last
+// label is the hash8), or "" for other queries
+func queryTransfer(q *Query) string {
+	if q == nil || q.Domain == nil || len(q.Labels) < 3 {
+		return ""
+	}
+	hash8 := q.Labels[len(q.Labels)-1]
+	if len(hash8) != 8 {
+		return ""
+	}
+	if _, err := hex.DecodeString(hash8); err != nil {
+		return ""
+	}
+	return transferKey(q.Domain, hash8)
+}
+
+// SetRateLimits sets the query rate limits. Limits of 0 are not enforced. It
+// must be called before Start.
+func (s *Server) SetRateLimits(limits RateLimits) {
+	s.rateLimiter = newRateLimiter(limits)
+}
+
+// rateLimit is the middleware that throttles queries over their rate limits
+// and counts them per client. It runs right after RRL, before any other
+// middleware.
+func (s *Server) rateLimit(next Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, w ResponseWriter, q *dns.Message) {
+		limiter := s.rateLimiter
+		if limiter == nil {
+			next.ServeDNS(ctx, w, q)
+			return
+		}
+
+		query := QueryFromContext(ctx)
+		clientIP := w.RemoteAddr().IP
+		allowed, limit := limiter.allow(clientIP, queryTransfer(query), time.Now())
+		if allowed {
+			next.ServeDNS(ctx, w, q)
+			return
+		}
+
+		s.stats.RecordThrottled(clientIP.String())
+		if query != nil && query.Domain != nil {
+			s.stats.Domain(query.Domain.Name).RecordThrottled(clientIP.String())
+		}
+		if s.verbose {
+			log.Printf("Throttled query from %s (%s rate limit, %s)", clientIP, limit, limiter.limits.Action)
+		}
+
+		switch limiter.limits.Action {
+		case RateLimitRefuse:
+			w.SetRcode(dns.RcodeRefused)
+		case RateLimitTruncate:
+			w.Truncate()
+		default:
+			w.Drop()
+		}
+	})
+}
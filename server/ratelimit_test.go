@@ -0,0 +1,208 @@
+package server
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"youkaidns/dns"
+)
+
+func TestBucketSet(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		at    []time.Duration // When each query is made
+		want  []bool
+	}{
+		{"burst then empty", 1, 3, []time.Duration{0, 0, 0, 0}, []bool{true, true, true, false}},
+		{"burst defaults to the rate", 2, 0, []time.Duration{0, 0, 0}, []bool{true, true, false}},
+		{"burst at least one", 0.5, 0, []time.Duration{0, 0}, []bool{true, false}},
+		{"refills at the rate", 2, 1, []time.Duration{0, 0, 250 * time.Millisecond, 500 * time.Millisecond}, []bool{true, false, false, true}},
+		{"refill capped at the burst", 10, 2, []time.Duration{0, 0, time.Hour, time.Hour, time.Hour}, []bool{true, true, true, true, false}},
+	}
+	for _, tt := range tests {
+		set := newBucketSet(tt.rate, tt.burst)
+		for i, at := range tt.at {
+			bucket := set.bucket("192.0.2.1", start.Add(at))
+			got := bucket.tokens >= 1
+			if got {
+				bucket.tokens--
+			}
+			if got != tt.want[i] {
+				t.Errorf("%s: query %d allowed %v, want %v", tt.name, i+1, got, tt.want[i])
+			}
+		}
+	}
+
+	if newBucketSet(0, 10) != nil {
+		t.Error("bucket set without a rate")
+	}
+
+	// Refilled buckets are forgotten on the next sweep; others are kept
+	set := newBucketSet(0.02, 2) // 1.2 tokens a sweep interval
+	set.lastSweep = start
+	set.bucket("refilled", start).tokens = 1
+	set.bucket("empty", start).tokens = 0
+	set.bucket("other", start.Add(bucketSweepInterval))
+	if _, kept := set.buckets["refilled"]; kept {
+		t.Error("refilled bucket kept")
+	}
+	if _, kept := set.buckets["empty"]; !kept {
+		t.Error("empty bucket forgotten")
+	}
+}
+
+func TestClientSubnet(t *testing.T) {
+	tests := []struct {
+		ip                 string
+		prefixV4, prefixV6 int
+		want               string
+	}{
+		{"192.0.2.77", 24, 56, "192.0.2.0/24"},
+		{"192.0.2.77", 32, 56, "192.0.2.77/32"},
+		{"198.51.100.200", 16, 56, "198.51.0.0/16"},
+		{"::ffff:192.0.2.77", 24, 56, "192.0.2.0/24"},
+		{"2001:db8:1:2ff::1", 24, 56, "2001:db8:1:200::/56"},
+		{"2001:db8:1:2ff::1", 24, 128, "2001:db8:1:2ff::1/128"},
+	}
+	for _, tt := range tests {
+		if got := clientSubnet(net.ParseIP(tt.ip), tt.prefixV4, tt.prefixV6); got != tt.want {
+			t.Errorf("clientSubnet(%s, /%d, /%d) = %s, want %s", tt.ip, tt.prefixV4, tt.prefixV6, got, tt.want)
+		}
+	}
+}
+
+func TestQueryTransfer(t *testing.T) {
+	s := newTestServer(t)
+	tr := testTransfer{Name: "report.txt", File: []byte("report")}
+	key := transferKey(s.primaryDomain(), tr.hash8())
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{tr.startRecord(s), key},
+		{tr.dataRecord(s, 1), key},
+		{"123.probe." + testDomain, ""},
+		{"linux.script." + testDomain, ""},
+		{"1.poll.web01." + testDomain, ""},
+		{"aa.1.zzzzzzzz." + testDomain, ""},
+		{"666f6f.1.0123abcd.example.org", ""},
+	}
+	for _, tt := range tests {
+		q := s.newQuery(dns.Question{Name: tt.name, Type: dns.TypeTXT, Class: 1}, testClient.IP)
+		if got := queryTransfer(q); got != tt.want {
+			t.Errorf("%s: transfer %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if queryTransfer(nil) != "" {
+		t.Error("transfer of no query")
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	now := time.Now()
+	client := net.ParseIP("192.0.2.1")
+	neighbour := net.ParseIP("192.0.2.2")
+
+	tests := []struct {
+		name   string
+		limits RateLimits
+		ip     net.IP
+		want   string // Limit broken, "" if allowed
+	}{
+		{"client", RateLimits{ClientRate: 1, ClientBurst: 1}, client, "client"},
+		{"other client", RateLimits{ClientRate: 1, ClientBurst: 1}, neighbour, ""},
+		{"subnet", RateLimits{SubnetRate: 1, SubnetBurst: 1}, neighbour, "subnet"},
+		{"other subnet", RateLimits{SubnetRate: 1, SubnetBurst: 1}, net.ParseIP("198.51.100.1"), ""},
+		{"transfer", RateLimits{TransferRate: 1, TransferBurst: 1}, neighbour, "transfer"},
+	}
+	for _, tt := range tests {
+		limiter := newRateLimiter(tt.limits)
+		if allowed, _ := limiter.allow(client, "t.test|0123abcd", now); !allowed {
+			t.Fatalf("%s: first query rejected", tt.name)
+		}
+		allowed, limit := limiter.allow(tt.ip, "t.test|0123abcd", now)
+		if allowed != (tt.want == "") || limit != tt.want {
+			t.Errorf("%s: allowed %v by the %q limit, want %q", tt.name, allowed, limit, tt.want)
+		}
+	}
+
+	if newRateLimiter(RateLimits{Action: RateLimitRefuse}) != nil {
+		t.Error("rate limiter without limits")
+	}
+
+	// A query rejected by the subnet or transfer limit leaves the client's
+	// tokens alone
+	limiter := newRateLimiter(RateLimits{ClientRate: 1, ClientBurst: 2, SubnetRate: 1, SubnetBurst: 1, TransferRate: 1, TransferBurst: 1})
+	steps := []struct {
+		ip       net.IP
+		transfer string
+		want     string
+	}{
+		{client, "", ""},
+		{client, "", "subnet"},
+		{client, "", "subnet"},
+		{neighbour, "", "subnet"},
+	}
+	for i, step := range steps {
+		if _, limit := limiter.allow(step.ip, step.transfer, now); limit != step.want {
+			t.Fatalf("step %d: limit %q, want %q", i+1, limit, step.want)
+		}
+	}
+	if tokens := limiter.client.buckets[client.String()].tokens; tokens != 1 {
+		t.Fatalf("client has %v tokens after the subnet rejections, want 1", tokens)
+	}
+
+	limiter = newRateLimiter(RateLimits{ClientRate: 1, ClientBurst: 2, TransferRate: 1, TransferBurst: 1})
+	limiter.allow(client, "t.test|0123abcd", now)
+	if _, limit := limiter.allow(client, "t.test|0123abcd", now); limit != "transfer" {
+		t.Fatalf("second record of the transfer: limit %q", limit)
+	}
+	if allowed, _ := limiter.allow(client, "", now); !allowed {
+		t.Fatal("transfer rejection used up the client's tokens")
+	}
+}
+
+func TestRateLimitActions(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		action RateLimitAction
+		check  func(w *responseWriter) bool
+	}{
+		{"", func(w *responseWriter) bool { return w.dropped }},
+		{RateLimitDrop, func(w *responseWriter) bool { return w.dropped }},
+		{RateLimitRefuse, func(w *responseWriter) bool { return w.rcode == dns.RcodeRefused && !w.dropped }},
+		{RateLimitTruncate, func(w *responseWriter) bool { return w.truncated && !w.dropped }},
+	}
+	for _, tt := range tests {
+		s := newTestServer(t)
+		s.verbose = true
+		s.SetRateLimits(RateLimits{ClientRate: 1, ClientBurst: 1, Action: tt.action})
+		logged.Reset()
+
+		if w := serveQuery(s, "123.probe."+testDomain, dns.TypeTXT); len(w.answers) == 0 {
+			t.Fatalf("%q: first query not answered", tt.action)
+		}
+		w := serveQuery(s, "123.probe."+testDomain, dns.TypeTXT)
+		if len(w.answers) != 0 || !tt.check(w) {
+			t.Errorf("%q: throttled response %+v", tt.action, w)
+		}
+		if s.stats.ThrottledQueries != 1 || s.stats.ThrottledBySource[testClient.IP.String()] != 1 {
+			t.Errorf("%q: %d throttled queries recorded", tt.action, s.stats.ThrottledQueries)
+		}
+		if !strings.Contains(logged.String(), "Throttled query from "+testClient.IP.String()+" (client rate limit") {
+			t.Errorf("%q: logged %q", tt.action, logged.String())
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+	"youkaidns/dns"
+)
+
+// RRLConfig configures response rate limiting (RRL) in the style of BIND. It
+// limits identical responses sent to one client prefix, so the server can't be
+// used to flood a spoofed source address with answers larger than the
+// queries.
+//
+// Transfer queries all have unique names, so unlike BIND, responses are
+// accounted per client prefix, response kind and served domain, not per
+// queried name. Names outside the served domains share one account per
+// client prefix and kind.
+type RRLConfig struct {
+	ResponsesPerSecond int // Answers per second, 0 disables RRL
+	NXDomainsPerSecond int // NXDOMAIN responses per second (default ResponsesPerSecond)
+	ErrorsPerSecond    int // Other error and truncated responses per second (default ResponsesPerSecond)
+
+	Window int // Seconds of excess a bucket remembers, default 15
+	Slip   int // Every Slip-th limited response is sent truncated instead of dropped (0 never, negative for 2)
+
+	PrefixV4 int // Client prefix for IPv4, default /24
+	PrefixV6 int // Client prefix for IPv6, default /56
+
+	LogOnly bool // Count and log responses that would be limited, but send them
+}
+
+// rrlOtherZone accounts responses to names outside the served domains. It
+// can't be a served domain's name.
+const rrlOtherZone = "(other)"
+
+// Default RRL settings, as in BIND
+const (
+	defaultRRLWindow = 15
+	defaultRRLSlip   = 2
+)
+
+// Response kinds accounted separately by RRL
+const (
+	rrlAnswer   = "answer"
+	rrlNXDomain = "nxdomain"
+	rrlError    = "error"
+)
+
+// rrlBucket is the account of one client prefix, response kind and domain.
+// The balance is refilled at the kind's rate up to one second's worth, goes
+// down by one per response and can't go below -Window seconds' worth.
+type rrlBucket struct {
+	rate    float64 // Responses per second of the bucket's kind
+	balance float64
+	last    time.Time
+	limited int64 // Responses limited since the balance went negative
+}
+
+// responseRateLimiter accounts responses per bucket
+type responseRateLimiter struct {
+	mu        sync.Mutex
+	config    RRLConfig
+	buckets   map[string]*rrlBucket
+	lastSweep time.Time
+}
+
+// newResponseRateLimiter returns a response rate limiter, or nil if RRL is
+// disabled
+func newResponseRateLimiter(config RRLConfig) *responseRateLimiter {
+	if config.ResponsesPerSecond <= 0 {
+		return nil
+	}
+	if config.NXDomainsPerSecond <= 0 {
+		config.NXDomainsPerSecond = config.ResponsesPerSecond
+	}
+	if config.ErrorsPerSecond <= 0 {
+		config.ErrorsPerSecond = config.ResponsesPerSecond
+	}
+	if config.Window <= 0 {
+		config.Window = defaultRRLWindow
+	}
+	if config.Slip < 0 {
+		config.Slip = defaultRRLSlip
+	}
+	if config.PrefixV4 <= 0 || config.PrefixV4 > 32 {
+		config.PrefixV4 = defaultSubnetPrefixV4
+	}
+	if config.PrefixV6 <= 0 || config.PrefixV6 > 128 {
+		config.PrefixV6 = defaultSubnetPrefixV6
+	}
+	return &responseRateLimiter{config: config, buckets: make(map[string]*rrlBucket), lastSweep: time.Now()}
+}
+
+// rate returns the responses per second allowed for a response kind
+func (r *responseRateLimiter) rate(kind string) float64 {
+	switch kind {
+	case rrlNXDomain:
+		return float64(r.config.NXDomainsPerSecond)
+	case rrlError:
+		return float64(r.config.ErrorsPerSecond)
+	default:
+		return float64(r.config.ResponsesPerSecond)
+	}
+}
+
+// account charges a response to its bucket. It reports whether the response
+// is over the limit and, if so, whether it should slip through truncated.
+// first is true for the first limited response after the bucket was in
+// credit.
+func (r *responseRateLimiter) account(key string, kind string) (limited bool, slip bool, first bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.lastSweep) >= bucketSweepInterval {
+		r.sweep(now)
+	}
+
+	rate := r.rate(kind)
+	bucket, exists := r.buckets[key]
+	if !exists {
+		bucket = &rrlBucket{rate: rate, balance: rate, last: now}
+		r.buckets[key] = bucket
+	}
+	bucket.balance += now.Sub(bucket.last).Seconds() * rate
+	if bucket.balance > rate {
+		bucket.balance = rate
+	}
+	bucket.last = now
+
+	bucket.balance--
+	if floor := -rate * float64(r.config.Window); bucket.balance < floor {
+		bucket.balance = floor
+	}
+	if bucket.balance >= 0 {
+		bucket.limited = 0
+		return false, false, false
+	}
+
+	bucket.limited++
+	slip = r.config.Slip > 0 && bucket.limited%int64(r.config.Slip) == 0
+	return true, slip, bucket.limited == 1
+}
+
+// sweep forgets buckets that are back in full credit
+func (r *responseRateLimiter) sweep(now time.Time) {
+	for key, bucket := range r.buckets {
+		if bucket.balance+now.Sub(bucket.last).Seconds()*bucket.rate >= bucket.rate {
+			delete(r.buckets, key)
+		}
+	}
+	r.lastSweep = now
+}
+
+// SetRRL sets response rate limiting. A ResponsesPerSecond of 0 disables it.
+// It must be called before Start.
+func (s *Server) SetRRL(config RRLConfig) {
+	s.responseLimiter = newResponseRateLimiter(config)
+}
+
+// rrlWriter holds back a response until RRL has accounted for it
+type rrlWriter struct {
+	ResponseWriter
+	answers   []dns.ResourceRecord
+	rcode     int
+	truncated bool
+	dropped   bool
+}
+
+func (w *rrlWriter) Answer(rrs ...dns.ResourceRecord) { w.answers = append(w.answers, rrs...) }
+
+func (w *rrlWriter) Answers() []dns.ResourceRecord { return w.answers }
+
+func (w *rrlWriter) SetRcode(rcode int) { w.rcode = rcode }
+
+func (w *rrlWriter) Truncate() { w.truncated = true }
+
+func (w *rrlWriter) Drop() { w.dropped = true }
+
+// kind returns the RRL response kind of the held response
+func (w *rrlWriter) kind() string {
+	switch {
+	case w.truncated && len(w.answers) == 0:
+		return rrlError
+	case w.rcode == dns.RcodeNXDomain || (w.rcode < 0 && len(w.answers) == 0):
+		return rrlNXDomain
+	case w.rcode >= 0 && w.rcode != dns.RcodeNoError:
+		return rrlError
+	default:
+		return rrlAnswer
+	}
+}
+
+// send passes the held response on
+func (w *rrlWriter) send() {
+	if w.dropped {
+		w.ResponseWriter.Drop()
+		return
+	}
+	if len(w.answers) > 0 {
+		w.ResponseWriter.Answer(w.answers...)
+	}
+	if w.rcode >= 0 {
+		w.ResponseWriter.SetRcode(w.rcode)
+	}
+	if w.truncated {
+		w.ResponseWriter.Truncate()
+	}
+}
+
+// responseRateLimit is the middleware that applies RRL to every response. It
+// runs first, so it also sees responses refused or truncated by rate limits.
+func (s *Server) responseRateLimit(next Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, w ResponseWriter, q *dns.Message) {
+		limiter := s.responseLimiter
+		if limiter == nil {
+			next.ServeDNS(ctx, w, q)
+			return
+		}
+
+		held := &rrlWriter{ResponseWriter: w, rcode: -1}
+		next.ServeDNS(ctx, held, q)
+		if held.dropped {
+			w.Drop()
+			return
+		}
+
+		clientIP := w.RemoteAddr().IP
+		prefix := clientSubnet(clientIP, limiter.config.PrefixV4, limiter.config.PrefixV6)
+		name := rrlOtherZone
+		if query := QueryFromContext(ctx); query != nil && query.Domain != nil {
+			name = query.Domain.Name
+		}
+		kind := held.kind()
+
+		limited, slip, first := limiter.account(prefix+"|"+kind+"|"+name, kind)
+		if !limited {
+			held.send()
+			return
+		}
+
+		s.stats.RecordRRL(prefix, slip)
+		if first {
+			mode := "limiting"
+			if limiter.config.LogOnly {
+				mode = "would limit"
+			}
+			log.Printf("RRL: %s %s responses to %s for %s", mode, kind, prefix, rrlName(name))
+		}
+		if limiter.config.LogOnly {
+			held.send()
+			return
+		}
+		if slip {
+			w.Truncate()
+			return
+		}
+		w.Drop()
+	})
+}
+
+// rrlName returns a domain for logging, "." for the catch-all domain
+func rrlName(name string) string {
+	switch name {
+	case "":
+		return "."
+	case rrlOtherZone:
+		return "names outside the served domains"
+	}
+	return name
+}
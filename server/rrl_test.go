@@ -0,0 +1,154 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"youkaidns/dns"
+)
+
+// rrlOutcome is what happened to one response
+type rrlOutcome struct {
+	limited, slip, first bool
+}
+
+func TestRRLSlipAtLimit(t *testing.T) {
+	sent := rrlOutcome{}
+	dropped := rrlOutcome{limited: true}
+	slipped := rrlOutcome{limited: true, slip: true}
+	firstDropped := rrlOutcome{limited: true, first: true}
+	firstSlipped := rrlOutcome{limited: true, slip: true, first: true}
+
+	tests := []struct {
+		name   string
+		config RRLConfig
+		want   []rrlOutcome // One burst of responses, faster than the refill
+	}{
+		{"default slip", RRLConfig{ResponsesPerSecond: 3, Slip: -1},
+			[]rrlOutcome{sent, sent, sent, firstDropped, slipped, dropped, slipped, dropped}},
+		{"slip every response", RRLConfig{ResponsesPerSecond: 2, Slip: 1},
+			[]rrlOutcome{sent, sent, firstSlipped, slipped, slipped}},
+		{"slip every third", RRLConfig{ResponsesPerSecond: 1, Slip: 3},
+			[]rrlOutcome{sent, firstDropped, dropped, slipped, dropped, dropped, slipped}},
+		{"never slip", RRLConfig{ResponsesPerSecond: 2, Slip: 0},
+			[]rrlOutcome{sent, sent, firstDropped, dropped, dropped}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := newResponseRateLimiter(tt.config)
+			for i, want := range tt.want {
+				limited, slip, first := limiter.account("192.0.2.0/24|answer|example.com", rrlAnswer)
+				if got := (rrlOutcome{limited, slip, first}); got != want {
+					t.Fatalf("response %d: got %+v, want %+v", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRRLBuckets(t *testing.T) {
+	limiter := newResponseRateLimiter(RRLConfig{ResponsesPerSecond: 2, NXDomainsPerSecond: 1, Window: 2})
+	answer := "192.0.2.0/24|answer|example.com"
+	nxdomain := "192.0.2.0/24|nxdomain|example.com"
+
+	// Each kind has its own rate and bucket
+	for i := 0; i < 2; i++ {
+		if limited, _, _ := limiter.account(answer, rrlAnswer); limited {
+			t.Fatalf("answer %d limited", i+1)
+		}
+	}
+	if limited, _, _ := limiter.account(nxdomain, rrlNXDomain); limited {
+		t.Fatal("first NXDOMAIN limited")
+	}
+	if limited, _, _ := limiter.account(nxdomain, rrlNXDomain); !limited {
+		t.Fatal("second NXDOMAIN not limited at 1 per second")
+	}
+	if limited, _, _ := limiter.account("198.51.100.0/24|answer|example.com", rrlAnswer); limited {
+		t.Fatal("another prefix limited")
+	}
+
+	// The debt is capped at Window seconds, so a flood is forgiven after that
+	for i := 0; i < 100; i++ {
+		limiter.account(answer, rrlAnswer)
+	}
+	if floor := -2.0 * 2; limiter.buckets[answer].balance < floor {
+		t.Fatalf("balance %.1f below the window floor %.1f", limiter.buckets[answer].balance, floor)
+	}
+	limiter.buckets[answer].last = time.Now().Add(-3 * time.Second)
+	limited, _, first := limiter.account(answer, rrlAnswer)
+	if limited || first {
+		t.Fatal("still limited after the window refilled")
+	}
+	if limited, _, first := limiter.account(answer, rrlAnswer); limited || first {
+		t.Fatal("second answer after refill limited")
+	}
+	if _, _, first := limiter.account(answer, rrlAnswer); !first {
+		t.Fatal("first limited response after refill not reported as first")
+	}
+}
+
+func TestNewResponseRateLimiterDefaults(t *testing.T) {
+	if newResponseRateLimiter(RRLConfig{}) != nil {
+		t.Fatal("RRL enabled without a rate")
+	}
+
+	limiter := newResponseRateLimiter(RRLConfig{ResponsesPerSecond: 5, Slip: -1, PrefixV4: 33, PrefixV6: 0})
+	want := RRLConfig{
+		ResponsesPerSecond: 5,
+		NXDomainsPerSecond: 5,
+		ErrorsPerSecond:    5,
+		Window:             defaultRRLWindow,
+		Slip:               defaultRRLSlip,
+		PrefixV4:           defaultSubnetPrefixV4,
+		PrefixV6:           defaultSubnetPrefixV6,
+	}
+	if limiter.config != want {
+		t.Fatalf("config %+v, want %+v", limiter.config, want)
+	}
+}
+
+func TestRRLWriterKind(t *testing.T) {
+	answer := dns.ResourceRecord{Name: "a.example.com", Type: dns.TypeTXT}
+	tests := []struct {
+		name string
+		w    rrlWriter
+		want string
+	}{
+		{"answer", rrlWriter{rcode: -1, answers: []dns.ResourceRecord{answer}}, rrlAnswer},
+		{"empty NOERROR", rrlWriter{rcode: dns.RcodeNoError}, rrlAnswer},
+		{"no answer", rrlWriter{rcode: -1}, rrlNXDomain},
+		{"NXDOMAIN", rrlWriter{rcode: dns.RcodeNXDomain}, rrlNXDomain},
+		{"REFUSED", rrlWriter{rcode: dns.RcodeRefused}, rrlError},
+		{"truncated", rrlWriter{rcode: -1, truncated: true}, rrlError},
+		{"truncated answer", rrlWriter{rcode: -1, truncated: true, answers: []dns.ResourceRecord{answer}}, rrlAnswer},
+	}
+	for _, tt := range tests {
+		if got := tt.w.kind(); got != tt.want {
+			t.Errorf("%s: kind %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRRLOutOfZoneNames(t *testing.T) {
+	s := newTestServer(t)
+	s.SetRRL(RRLConfig{ResponsesPerSecond: 2, Slip: 0})
+
+	// Distinct names outside the served domains share one account, so a
+	// flood can't escape RRL by varying the name
+	for i, name := range []string{"a.example.org", "b.example.org", "c.example.net"} {
+		w := serveQuery(s, name, dns.TypeA)
+		if dropped := i == 2; w.dropped != dropped {
+			t.Fatalf("%s: dropped %v, want %v", name, w.dropped, dropped)
+		}
+	}
+	if w := serveQuery(s, "missing."+testDomain, dns.TypeA); w.dropped {
+		t.Fatal("served domain limited by out-of-zone responses")
+	}
+
+	s.responseLimiter.mu.Lock()
+	defer s.responseLimiter.mu.Unlock()
+	if _, exists := s.responseLimiter.buckets["192.0.2.0/24|"+rrlNXDomain+"|"+rrlOtherZone]; !exists || len(s.responseLimiter.buckets) != 2 {
+		t.Fatalf("buckets %v", s.responseLimiter.buckets)
+	}
+}
@@ -1,8 +1,10 @@
 package server
 
 import (
-	"encoding/base64"
+	"context"
+	"crypto/md5"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -17,6 +19,14 @@ import (
 	"youkaidns/stats"
 )
 
+// maxTotalParts caps the data parts a start record can declare
+const maxTotalParts = 1 << 24
+
+// maxPendingParts caps the data records a transfer keeps while it waits for
+// its start record. Senders send the start record first, so only the
+// parallel queries racing it arrive early.
+const maxPendingParts = 256
+
 // Record represents a DNS record
 type Record struct {
 	Type  uint16
@@ -29,10 +39,34 @@ type FileAssembly struct {
 	Hash        string
 	TotalParts  int
 	ChunkSize   int
-	TotalBytes  int64          // Total file size in bytes
+	TotalBytes  int64          // Total size in bytes on the wire (after compression)
+	FileBytes   int64          // Original file size, -1 until declared or decompressed
+	Encoding    Encoding       // Label encoding, empty until the start record arrives
+	Compression Compression    // Codec applied by the sender before chunking
+	Cipher      Cipher         // AEAD applied by the sender after compression
+	Nonce       []byte         // Per-transfer nonce for Cipher
+	FEC         FEC            // Parity layout declared by the sender
+	Bundle      Bundle         // Archive format of a multi-file transfer
+	Task        int            // Task whose result this is, 0 for none
+	Host        string         // Sending host from the h- option, empty if not declared
+	Domain      *Domain        // Served domain the transfer arrived under
 	Parts       map[int][]byte // part number -> data
+	Parity      map[int][]byte // part number -> FEC parity data
+	pending     map[int]string // part number -> encoded data received before the start record
+	SourceIP    string         // Resolver IP the transfer was first seen from
+	StartedAt   time.Time      // When the transfer was first seen
 	CompletedAt time.Time      // When file was completed
-	mu          sync.Mutex
+	Verified    bool           // Saved data matched the transfer hash
+	FailStatus  string         // failed or auth_failed, empty unless failed
+	FailReason  string         // Why assembly failed
+
+	LastActivity   time.Time // Last start/data record for this transfer
+	Retries        int       // Missing-chunk queries that reported gaps
+	Contiguous     int       // Parts 1 to Contiguous have all arrived
+	RecoveredParts int       // Data parts rebuilt from FEC parity
+	DuplicateParts int       // Data records for parts already received
+
+	mu sync.Mutex
 }
 
 // Server represents a DNS server
@@ -42,97 +76,105 @@ type Server struct {
 	conn     *net.UDPConn
 	shutdown chan struct{}
 	verbose  bool
-	domain   string // Domain suffix for dynamic records
+
+	// Served domains, the primary one (from NewServer) first
+	domains  []*Domain
+	domainMu sync.RWMutex
+
+	// Query handlers, tried in order, and the middleware around them; handler
+	// is the whole chain, built by Start
+	handlers   []Handler
+	middleware []Middleware
+	handler    Handler
+
+	// Query rate limits and response rate limiting, nil for none
+	rateLimiter     *rateLimiter
+	responseLimiter *responseRateLimiter
+
+	// Client ACLs per feature, and where denied queries are recorded
+	acls     map[Feature]*ACL
+	auditLog *AuditLog
 
 	// Zone data (dynamically generated)
 	mu      sync.RWMutex
 	records map[string]map[uint16][]Record // domain -> type -> records
 
 	// File assembly tracking
-	fileAssemblies map[string]*FileAssembly // hash -> assembly
+	fileAssemblies map[string]*FileAssembly // transfer key (domain/hash) -> assembly
 	assemblyMu     sync.RWMutex
-	outputDir      string
 
-	// Script chunks for serving via DNS
-	scriptChunks map[string][]string // script name -> base64 chunks
-	scriptMu     sync.RWMutex
-}
+	// Incomplete transfers idle for longer than this are failed and dropped
+	transferTimeout time.Duration
 
-// NewServer creates a new DNS server
-func NewServer(port int, s *stats.Stats, verbose bool, domain string, outputDir string) *Server {
-	// Create output directory if it doesn't exist
-	os.MkdirAll(outputDir, 0755)
+	// Key for encrypted transfers, derived from the pre-shared passphrase;
+	// domains with their own passphrase use theirs
+	encryptionKey []byte
 
-	server := &Server{
-		port:           port,
-		stats:          s,
-		shutdown:       make(chan struct{}),
-		verbose:        verbose,
-		domain:         domain,
-		records:        make(map[string]map[uint16][]Record),
-		fileAssemblies: make(map[string]*FileAssembly),
-		outputDir:      outputDir,
-		scriptChunks:   make(map[string][]string),
-	}
+	// Shared secret for record tags; nil accepts untagged records
+	authKey []byte
 
-	// Load and prepare script files
-	server.loadScripts()
+	// Transfer history catalog
+	historyMu sync.Mutex
 
-	return server
-}
+	// Saving received files
+	collisionPolicy CollisionPolicy
+	saveMu          sync.Mutex
 
-// loadScripts loads script files and prepares them for DNS serving
-func (s *Server) loadScripts() {
-	scripts := map[string]string{
-		"linux":   "script.sh",
-		"windows": "script.ps1",
-	}
+	// Scripts and other payloads served via DNS (kept per domain)
+	payloadMu sync.RWMutex
 
-	for name, filename := range scripts {
-		var data []byte
-		var err error
+	// Settings baked into served transfer scripts
+	scriptDefaults ScriptDefaults
 
-		// Try different paths to find the script
-		paths := []string{
-			filename,
-			"./" + filename,
-			"../" + filename,
-		}
+	// Files offered for download over DNS, keyed by ID, and the largest
+	// upload accepted (0 for DefaultOutboxUploadLimit). outboxScanMu
+	// serializes directory scans, which run without holding outboxMu.
+	outboxDir     string
+	outboxFiles   map[string]*OutboxFile
+	outboxScanned time.Time
+	outboxLimit   int64
+	outboxMu      sync.Mutex
+	outboxScanMu  sync.Mutex
 
-		for _, path := range paths {
-			data, err = os.ReadFile(path)
-			if err == nil {
-				break
-			}
-		}
+	// Agent sessions polling for tasks
+	sessions   map[string]*Session // agent ID -> session
+	tasks      map[int]*Task       // task ID -> task
+	nextTaskID int
+	sessionMu  sync.Mutex
 
-		if err != nil {
-			log.Printf("Warning: Could not load script %s: %v", filename, err)
-			continue
-		}
-
-		// Encode as base64
-		encoded := base64.StdEncoding.EncodeToString(data)
+	// Sending hosts, keyed by host ID
+	hosts  map[string]*Host
+	hostMu sync.Mutex
+}
 
-		// Split into chunks of ~200 characters (safe for DNS TXT records)
-		chunkSize := 200
-		var chunks []string
-		for i := 0; i < len(encoded); i += chunkSize {
-			end := i + chunkSize
-			if end > len(encoded) {
-				end = len(encoded)
-			}
-			chunks = append(chunks, encoded[i:end])
-		}
+// NewServer creates a new DNS server
+func NewServer(port int, s *stats.Stats, verbose bool, domain string, outputDir string) *Server {
+	// Create output directory if it doesn't exist
+	primary, err := newDomain(DomainConfig{Name: domain, OutputDir: outputDir})
+	if err != nil {
+		log.Printf("Warning: Creating output directory %s: %v", outputDir, err)
+	}
 
-		s.scriptMu.Lock()
-		s.scriptChunks[name] = chunks
-		s.scriptMu.Unlock()
+	server := &Server{
+		port:            port,
+		stats:           s,
+		shutdown:        make(chan struct{}),
+		verbose:         verbose,
+		domains:         []*Domain{primary},
+		records:         make(map[string]map[uint16][]Record),
+		fileAssemblies:  make(map[string]*FileAssembly),
+		collisionPolicy: CollisionSuffix,
+		transferTimeout: 10 * time.Minute,
+		sessions:        make(map[string]*Session),
+		tasks:           make(map[int]*Task),
+		hosts:           make(map[string]*Host),
+		acls:            make(map[Feature]*ACL),
+	}
+	countStored(server.domains)
+	server.Use(server.responseRateLimit, server.rateLimit)
+	server.registerBuiltinHandlers()
 
-		if s.verbose {
-			log.Printf("Loaded script %s: %d chunks", filename, len(chunks))
-		}
-	}
+	return server
 }
 
 // AddRecord adds a record to the zone
@@ -242,7 +284,9 @@ func (s *Server) Start() error {
 	s.conn = conn
 	log.Printf("DNS server listening on UDP port %d", s.port)
 
+	s.handler = s.chain()
 	go s.handleRequests()
+	go s.expireLoop()
 
 	return nil
 }
@@ -275,8 +319,11 @@ func (s *Server) handleRequests() {
 				continue
 			}
 
-			// Handle request in a goroutine for better concurrency
-			go s.handleRequest(buffer[:n], clientAddr)
+			// Handle request in a goroutine for better concurrency, on its
+			// own copy since the next read reuses the buffer
+			packet := make([]byte, n)
+			copy(packet, buffer[:n])
+			go s.handleRequest(packet, clientAddr)
 		}
 	}
 }
@@ -292,75 +339,62 @@ func (s *Server) handleRequest(data []byte, clientAddr *net.UDPAddr) {
 		return
 	}
 
-	// Process each question
-	var allAnswers []dns.ResourceRecord
-	success := false
-
-	for _, question := range query.Questions {
-		// Record the query
+	// Record each question, for the server and its domain
+	queries := make([]*Query, len(query.Questions))
+	var served *Domain // Domain of the first question under a served domain
+	for i, question := range query.Questions {
+		queries[i] = s.newQuery(question, clientAddr.IP)
 		s.stats.RecordQuery(question.Name, question.Type)
+		if d := queries[i].Domain; d != nil {
+			s.stats.Domain(d.Name).RecordQuery(question.Name, question.Type)
+			if served == nil {
+				served = d
+			}
+		}
 
 		// Verbose logging
 		if s.verbose {
 			typeName := s.getTypeName(question.Type)
 			log.Printf("DNS Query: %s -> %s from %s", question.Name, typeName, clientAddr.IP)
 		}
+	}
 
-		// Check if this is a script query
-		if scriptAnswers := s.handleScriptQuery(question.Name, question.Type); scriptAnswers != nil {
-			allAnswers = append(allAnswers, scriptAnswers...)
-			success = true
-			continue
-		}
-
-		// Check if this is a missing chunks query
-		if missingAnswers := s.handleMissingQuery(question.Name, question.Type); missingAnswers != nil {
-			allAnswers = append(allAnswers, missingAnswers...)
-			success = true
-			continue
-		}
-
-		// Check if this is a dynamic file transfer query
-		if s.handleDynamicRecord(question.Name) {
-			// Dynamic record handled, respond with "OK" TXT record
-			if question.Type == dns.TypeTXT {
-				okData := []byte{byte(len("OK"))}
-				okData = append(okData, []byte("OK")...)
-				rr := dns.ResourceRecord{
-					Name:    question.Name,
-					Type:    dns.TypeTXT,
-					Class:   1, // IN
-					TTL:     0, // TTL=0 to prevent caching
-					Data:    okData,
-					DataLen: uint16(len(okData)),
-				}
-				allAnswers = append(allAnswers, rr)
-			}
-			success = true
-			continue
+	// Run the middleware and query handlers
+	ctx := context.WithValue(context.Background(), queriesKey, queries)
+	if len(queries) > 0 {
+		ctx = context.WithValue(ctx, queryKey, queries[0])
+	}
+	w := &responseWriter{addr: clientAddr, rcode: -1}
+	s.handler.ServeDNS(ctx, w, query)
+	if w.dropped {
+		if s.verbose {
+			log.Printf("DNS Response: dropped")
 		}
+		return
+	}
 
-		// Lookup in zone
-		records := s.lookup(question.Name, question.Type)
-		if len(records) > 0 {
-			answers := s.convertToResourceRecords(question.Name, records)
-			allAnswers = append(allAnswers, answers...)
-			success = true
-		}
+	allAnswers := w.answers
+	success := len(allAnswers) > 0
+	for _, q := range queries {
+		success = success || q.claimed
 	}
 
 	// Build response
-	var response *dns.Message
-	if len(allAnswers) > 0 {
-		response, err = dns.BuildResponse(query, allAnswers, dns.RcodeNoError)
-	} else {
-		response, err = dns.BuildResponse(query, nil, dns.RcodeNXDomain)
+	rcode := w.rcode
+	if rcode < 0 {
+		rcode = dns.RcodeNXDomain
+		if len(allAnswers) > 0 || w.truncated {
+			rcode = dns.RcodeNoError
+		}
 	}
-
+	response, err := dns.BuildResponse(query, allAnswers, rcode)
 	if err != nil {
 		log.Printf("Error building response: %v", err)
 		return
 	}
+	if w.truncated {
+		response.Header.Flags |= dns.FlagTC
+	}
 
 	// Convert to bytes
 	responseBytes, err := response.ToBytes()
@@ -379,258 +413,104 @@ func (s *Server) handleRequest(data []byte, clientAddr *net.UDPAddr) {
 	// Record statistics
 	duration := time.Since(startTime)
 	s.stats.RecordResponse(success, duration)
+	if served != nil {
+		s.stats.Domain(served.Name).RecordResponse(success, duration)
+	}
 
 	// Verbose logging for response
 	if s.verbose {
 		status := "SUCCESS"
-		if !success {
+		if rcode == dns.RcodeNXDomain {
 			status = "NXDOMAIN"
+		} else if rcode != dns.RcodeNoError {
+			status = fmt.Sprintf("RCODE%d", rcode)
+		}
+		if w.truncated {
+			status += " (truncated)"
 		}
 		log.Printf("DNS Response: %s (%d answers) in %v", status, len(allAnswers), duration)
 	}
 }
 
+// handleDynamicQuery acknowledges start and data records, in TXT or address
+// records. Other types get no answers. Returns nil if not a dynamic record.
+func (s *Server) handleDynamicQuery(q *Query) []dns.ResourceRecord {
+	if !s.handleDynamicRecord(q) {
+		return nil
+	}
+	if q.Type == dns.TypeTXT {
+		return []dns.ResourceRecord{txtRecord(q.Name, s.transferAck(q))}
+	} else if isAddressType(q.Type) {
+		return s.addressAck(q)
+	}
+	return []dns.ResourceRecord{}
+}
+
 // getTypeName returns a string representation of DNS record type
 func (s *Server) getTypeName(recordType uint16) string {
 	switch recordType {
 	case dns.TypeA:
 		return "A"
+	case dns.TypeCNAME:
+		return "CNAME"
+	case dns.TypeNULL:
+		return "NULL"
+	case dns.TypeMX:
+		return "MX"
 	case dns.TypeTXT:
 		return "TXT"
+	case dns.TypeAAAA:
+		return "AAAA"
 	default:
 		return fmt.Sprintf("TYPE%d", recordType)
 	}
 }
 
-// handleScriptQuery handles queries for script files
-// Format: [chunk_num.]linux.script.<domain> or [chunk_num.]windows.script.<domain>
-// Returns TXT records with script chunks, or nil if not a script query
-func (s *Server) handleScriptQuery(queryDomain string, queryType uint16) []dns.ResourceRecord {
-	// Only handle TXT queries
-	if queryType != dns.TypeTXT {
+// handleMissingQuery handles queries for missing chunks
+// Format: [counter.]missing.<hash8>.<domain> or missing.<hash8>.<domain>
+// returns one TXT record per missing chunk number (up to maxMissingList);
+// [counter.]v2[-<from>].missing.<hash8> and v3[-<from>] return the gap list as
+// ranges or bitmaps (see compactMissingAnswer). A and AAAA queries always get
+// the ranges as address records (see addressMissingAnswer). Returns nil if not
+// a missing query.
+func (s *Server) handleMissingQuery(q *Query) []dns.ResourceRecord {
+	// Only handle TXT, A and AAAA queries
+	if q.Type != dns.TypeTXT && !isAddressType(q.Type) {
 		return nil
 	}
 
-	// Check if query matches script format
-	var scriptName string
-	var chunkNum int = -1
-
-	if s.domain != "" {
-		// Normalize domains for comparison (lowercase)
-		queryDomainLower := strings.ToLower(queryDomain)
-		domainLower := strings.ToLower(s.domain)
-
-		// Check if query ends with the configured domain
-		if !strings.HasSuffix(queryDomainLower, "."+domainLower) {
-			return nil
-		}
-
-		// Extract the part before the domain
-		prefix := queryDomainLower[:len(queryDomainLower)-len("."+domainLower)]
-		parts := strings.Split(prefix, ".")
-
-		// Should be: [chunk_num.]linux.script or [chunk_num.]windows.script
-		if len(parts) < 2 {
-			return nil
-		}
-
-		// Check if last part is "script"
-		if parts[len(parts)-1] != "script" {
-			return nil
-		}
-
-		// Get script name (should be before "script")
-		if len(parts) < 2 {
-			return nil
-		}
-		scriptName = parts[len(parts)-2]
-		if scriptName != "windows" && scriptName != "linux" {
-			return nil
-		}
-
-		// Check if there's a chunk number prefix
-		// Format: chunk_num.linux.script.<domain>
-		if len(parts) >= 3 {
-			if num, err := strconv.Atoi(parts[0]); err == nil {
-				chunkNum = num
-			}
-		}
-	} else {
-		// No domain configured - check format: [chunk_num.]linux.script or [chunk_num.]windows.script
-		parts := strings.Split(queryDomain, ".")
-		if len(parts) < 2 {
-			return nil
-		}
-
-		// Check if last part is "script"
-		if parts[len(parts)-1] != "script" {
-			return nil
-		}
-
-		// Get script name
-		if len(parts) < 2 {
-			return nil
-		}
-		scriptName = parts[len(parts)-2]
-		if scriptName != "windows" && scriptName != "linux" {
-			return nil
-		}
-
-		// Check if there's a chunk number prefix
-		// Format: chunk_num.linux.script
-		if len(parts) >= 3 {
-			if num, err := strconv.Atoi(parts[0]); err == nil {
-				chunkNum = num
-			}
-		}
-	}
-
-	// Get script chunks
-	s.scriptMu.RLock()
-	chunks, exists := s.scriptChunks[scriptName]
-	s.scriptMu.RUnlock()
-
-	if !exists || len(chunks) == 0 {
+	// Check if query matches [counter.][<format>.]missing.<hash8>.<domain> format
+	d, parts := q.Domain, q.Labels
+	if d == nil {
 		return nil
 	}
 
-	// If chunk number specified, return that chunk only
-	// Note: chunk numbers in one-liner are 1-based, but array is 0-based
-	if chunkNum >= 1 {
-		chunkIdx := chunkNum - 1 // Convert to 0-based index
-		if chunkIdx < len(chunks) {
-			chunkData := []byte{byte(len(chunks[chunkIdx]))}
-			chunkData = append(chunkData, []byte(chunks[chunkIdx])...)
-
-			rr := dns.ResourceRecord{
-				Name:    queryDomain,
-				Type:    dns.TypeTXT,
-				Class:   1, // IN
-				TTL:     0, // TTL=0 to prevent caching
-				Data:    chunkData,
-				DataLen: uint16(len(chunkData)),
-			}
-			return []dns.ResourceRecord{rr}
+	// Find "missing" in the parts; hash8 follows it
+	missingIdx := -1
+	for i, part := range parts {
+		if part == "missing" {
+			missingIdx = i
+			break
 		}
-		return nil
-	}
-
-	// Return a one-liner command to retrieve the full script
-	// This avoids DNS resolver limits on large responses
-	var oneliner string
-	baseDomain := scriptName + ".script"
-	if s.domain != "" {
-		baseDomain = baseDomain + "." + s.domain
-	}
-
-	if scriptName == "windows" {
-		// PowerShell one-liner to retrieve and decode the script
-		// Format: $i.windows.script.<domain>
-		// Shortened version to fit in DNS TXT record
-		oneliner = fmt.Sprintf("[System.Text.Encoding]::UTF8.GetString([System.Convert]::FromBase64String((1..%d|%%{Resolve-DnsName -ty TXT -na \"$_.%s\"|? Section -eq Answer|%% Strings})))", len(chunks), baseDomain)
-	} else {
-		// Bash one-liner to retrieve and decode the script
-		// Format: $i.linux.script.<domain>
-		// Use tr -d ' ' to remove spaces between base64 chunks
-		oneliner = fmt.Sprintf("echo $(for i in $(seq 1 %d); do dig +short $i.%s TXT | grep -oE '\"[^\"]+\"' | tr -d '\"'; done) | tr -d ' ' | base64 -d", len(chunks), baseDomain)
-	}
-
-	// Return the one-liner as a single TXT record
-	onelinerData := []byte{byte(len(oneliner))}
-	onelinerData = append(onelinerData, []byte(oneliner)...)
-
-	rr := dns.ResourceRecord{
-		Name:    queryDomain,
-		Type:    dns.TypeTXT,
-		Class:   1, // IN
-		TTL:     0, // TTL=0 to prevent caching
-		Data:    onelinerData,
-		DataLen: uint16(len(onelinerData)),
-	}
-
-	if s.verbose {
-		log.Printf("Script query for %s: returning one-liner command (%d chunks total)", scriptName, len(chunks))
 	}
-
-	return []dns.ResourceRecord{rr}
-}
-
-// handleMissingQuery handles queries for missing chunks
-// Format: [counter.]missing.<hash8>.<domain> or missing.<hash8>.<domain>
-// Returns TXT records with all missing chunk numbers, or nil if not a missing query
-func (s *Server) handleMissingQuery(queryDomain string, queryType uint16) []dns.ResourceRecord {
-	// Only handle TXT queries
-	if queryType != dns.TypeTXT {
+	if missingIdx == -1 || missingIdx+1 >= len(parts) {
 		return nil
 	}
-
-	// Check if query matches [counter.]missing.<hash8>.<domain> format
-	var hash8 string
-	if s.domain != "" {
-		// Normalize domains for comparison (lowercase)
-		queryDomainLower := strings.ToLower(queryDomain)
-		domainLower := strings.ToLower(s.domain)
-
-		// Check if query ends with the configured domain
-		if !strings.HasSuffix(queryDomainLower, "."+domainLower) {
-			return nil
-		}
-
-		// Extract the part before the domain
-		prefix := queryDomainLower[:len(queryDomainLower)-len("."+domainLower)]
-		parts := strings.Split(prefix, ".")
-
-		// Should be: [counter.]missing.<hash8> or missing.<hash8>
-		// Find "missing" in the parts
-		missingIdx := -1
-		for i, part := range parts {
-			if part == "missing" {
-				missingIdx = i
-				break
-			}
-		}
-
-		if missingIdx == -1 {
-			return nil
-		}
-
-		// After "missing" should be hash8
-		if missingIdx+1 >= len(parts) {
-			return nil
-		}
-		hash8 = parts[missingIdx+1]
-	} else {
-		// No domain configured - check format: [counter.]missing.<hash8>
-		parts := strings.Split(queryDomain, ".")
-
-		// Find "missing" in the parts
-		missingIdx := -1
-		for i, part := range parts {
-			if part == "missing" {
-				missingIdx = i
-				break
-			}
-		}
-
-		if missingIdx == -1 {
-			return nil
-		}
-
-		// After "missing" should be hash8
-		if missingIdx+1 >= len(parts) {
-			return nil
-		}
-		hash8 = parts[missingIdx+1]
+	hash8 := parts[missingIdx+1]
+	formatLabel := ""
+	if missingIdx > 0 {
+		formatLabel = parts[missingIdx-1]
 	}
 
 	// Validate hash8 is 8 hex characters
 	if len(hash8) != 8 {
 		return nil
 	}
+	format, from := parseMissingFormat(formatLabel)
 
 	// Get file assembly
 	s.assemblyMu.RLock()
-	assembly, exists := s.fileAssemblies[hash8]
+	assembly, exists := s.fileAssemblies[transferKey(d, hash8)]
 	s.assemblyMu.RUnlock()
 
 	if !exists {
@@ -638,44 +518,62 @@ func (s *Server) handleMissingQuery(queryDomain string, queryType uint16) []dns.
 		return nil
 	}
 
-	// Check if we have total parts info
-	if assembly.TotalParts <= 0 {
-		return nil
+	// Find missing chunks (1-based: parts from to TotalParts)
+	limit := maxMissingWalk
+	if format == MissingFormatList && !isAddressType(q.Type) {
+		limit = maxMissingList
 	}
-
-	// Find missing chunks (1-based: parts 1 to TotalParts)
 	assembly.mu.Lock()
-	var missingChunks []int
+	totalParts := assembly.TotalParts
+	if totalParts <= 0 {
+		// No start record yet, so no total parts to list against
+		assembly.mu.Unlock()
+		return nil
+	}
+	missing := assembly.missingFrom(from, limit)
 	isCompleted := !assembly.CompletedAt.IsZero()
-	if assembly.TotalParts > 0 {
-		for i := 1; i <= assembly.TotalParts; i++ {
-			if _, exists := assembly.Parts[i]; !exists {
-				missingChunks = append(missingChunks, i)
-			}
-		}
+	// Follow-up pages of a compact listing belong to the same retry round
+	if missing.Count > 0 && from == 1 {
+		assembly.Retries++
 	}
 	assembly.mu.Unlock()
 
+	if isAddressType(q.Type) {
+		if s.verbose {
+			log.Printf("Missing chunks query for hash %s (%s from part %d): %d missing chunks", hash8, s.getTypeName(q.Type), from, missing.Count)
+		}
+		return addressMissingAnswer(q.Name, q.Type, totalParts, missing)
+	}
+
+	// Compact formats answer with a single record, even when nothing is missing
+	if format != MissingFormatList {
+		rr := compactMissingAnswer(q.Name, format, totalParts, missing)
+		if s.verbose {
+			log.Printf("Missing chunks query for hash %s (%s from part %d): %d missing chunks", hash8, format, from, missing.Count)
+		}
+		return []dns.ResourceRecord{rr}
+	}
+
 	// If file is completed, return empty response (no missing chunks)
-	if isCompleted && len(missingChunks) == 0 {
+	if isCompleted && missing.Count == 0 {
 		// File is complete, return empty response (not NXDOMAIN)
 		return []dns.ResourceRecord{}
 	}
 
-	if len(missingChunks) == 0 {
+	if missing.Count == 0 {
 		// All chunks received but not yet marked complete, return empty
 		return []dns.ResourceRecord{}
 	}
 
-	// Build TXT records
+	// Build TXT records, listing at most maxMissingList parts
 	var answers []dns.ResourceRecord
-	for _, chunkNum := range missingChunks {
+	for _, chunkNum := range missing.Parts {
 		chunkNumStr := fmt.Sprintf("%d", chunkNum)
 		txtData := []byte{byte(len(chunkNumStr))}
 		txtData = append(txtData, []byte(chunkNumStr)...)
 
 		rr := dns.ResourceRecord{
-			Name:    queryDomain,
+			Name:    q.Name,
 			Type:    dns.TypeTXT,
 			Class:   1, // IN
 			TTL:     0, // TTL=0 to prevent caching
@@ -695,86 +593,39 @@ func (s *Server) handleMissingQuery(queryDomain string, queryType uint16) []dns.
 // handleDynamicRecord processes dynamic file transfer records
 // Returns true if the query matches the dynamic record format
 // Format: xxx.start.<hex>.<domain> or xxx.<part_num>.<hex>.<domain>
-func (s *Server) handleDynamicRecord(queryDomain string) bool {
-	// If domain is configured, check if query ends with it
-	if s.domain != "" {
-		// Normalize domains for comparison (lowercase)
-		queryDomainLower := strings.ToLower(queryDomain)
-		domainLower := strings.ToLower(s.domain)
-
-		// Check if query ends with the configured domain
-		if !strings.HasSuffix(queryDomainLower, "."+domainLower) && queryDomainLower != domainLower {
-			return false
-		}
-
-		// Extract the part before the domain
-		// Remove the domain suffix (including the dot)
-		prefix := queryDomainLower
-		if strings.HasSuffix(prefix, "."+domainLower) {
-			prefix = prefix[:len(prefix)-len("."+domainLower)]
-		} else if prefix == domainLower {
-			// Query is exactly the domain, not a dynamic record
-			return false
-		}
-
-		// Split the prefix part
-		parts := strings.Split(prefix, ".")
-		if len(parts) < 3 {
-			return false
-		}
-
-		// Check for start record: filename.total_parts.chunk_size.total_bytes.start.hash8
-		if len(parts) >= 6 {
-			// Find "start" marker
-			startIdx := -1
-			for i, part := range parts {
-				if part == "start" {
-					startIdx = i
-					break
-				}
-			}
-			if startIdx != -1 && startIdx >= 3 {
-				return s.handleStartRecord(parts)
-			}
-		}
-
-		// Check for data record: data_hex.part_num.hash8
-		// Need at least 3 parts: data, part_num, hash8
-		if len(parts) >= 3 {
-			return s.handleDataRecord(parts)
-		}
-
-		return false
-	}
-
-	// If no domain configured, use original behavior (backward compatibility)
-	parts := strings.Split(queryDomain, ".")
-	if len(parts) < 4 {
+func (s *Server) handleDynamicRecord(q *Query) bool {
+	// The labels before the served domain (all labels without one)
+	d, parts := q.Domain, q.Labels
+	if d == nil || len(parts) < 3 {
 		return false
 	}
 
 	// Check for start record: filename.total_parts.chunk_size.total_bytes.start.hash8
-	// Find "start" marker to check if it's a start record
-	for i, part := range parts {
-		if part == "start" && i >= 3 && i < len(parts)-1 {
-			return s.handleStartRecord(parts)
+	if len(parts) >= 6 {
+		// Find "start" marker
+		startIdx := -1
+		for i, part := range parts {
+			if part == "start" {
+				startIdx = i
+				break
+			}
+		}
+		if startIdx != -1 && startIdx >= 3 {
+			return s.handleStartRecord(d, parts, q.ClientIP)
 		}
 	}
 
 	// Check for data record: data_hex.part_num.hash8
-	// The pattern is: data_hex.part_num.hash8
-	// We need at least 3 parts: data, part_num, hash8
-	if len(parts) >= 3 {
-		// Try to parse as data record
-		return s.handleDataRecord(parts)
-	}
-
-	return false
+	return s.handleDataRecord(d, parts, q.ClientIP)
 }
 
 // handleStartRecord processes a start record
-// Format: filename_hex.total_parts.chunk_size.total_bytes.start.hash8
-func (s *Server) handleStartRecord(parts []string) bool {
+// Format: filename_enc.total_parts.chunk_size.total_bytes.start[.key-value...].hash8
+// Options: e-<hex|b32|b36> selects the label encoding (default hex),
+// c-<codec> declares the compression codec and s-<bytes> the original file size,
+// x-<cipher> and n-<nonce_hex> declare encryption with the pre-shared key,
+// m-<tag> authenticates the record when an auth secret is configured
+func (s *Server) handleStartRecord(d *Domain, parts []string, clientIP net.IP) bool {
 	// Find "start" marker
 	startIdx := -1
 	for i, part := range parts {
@@ -791,24 +642,120 @@ func (s *Server) handleStartRecord(parts []string) bool {
 	}
 
 	// Parse components
-	// Before start: filename_hex (may span multiple labels), total_parts, chunk_size, total_bytes
+	// Before start: filename (may span multiple labels), total_parts, chunk_size, total_bytes
 	totalBytesStr := parts[startIdx-1]
 	chunkSizeStr := parts[startIdx-2]
 	totalPartsStr := parts[startIdx-3]
-	filenameHexParts := parts[:startIdx-3]
-	filenameHex := strings.Join(filenameHexParts, "")
+	filenameParts := parts[:startIdx-3]
+	filenameText := strings.Join(filenameParts, "")
 
-	// After start: hash8
-	if startIdx+1 >= len(parts) {
+	// After start: option labels, then hash8
+	hashIdx := startIdx + 1
+	for hashIdx < len(parts) && isOptionLabel(parts[hashIdx]) {
+		hashIdx++
+	}
+	if hashIdx >= len(parts) {
+		return false
+	}
+	hash8 := parts[hashIdx]
+
+	encoding := EncodingHex
+	compression := CompressionNone
+	fileBytes := int64(-1)
+	cipherName := CipherNone
+	var nonce []byte
+	var fec FEC
+	bundle := BundleNone
+	taskID := 0
+	host := ""
+	for _, label := range parts[startIdx+1 : hashIdx] {
+		key, value := parseOptionLabel(label)
+		switch key {
+		case "e":
+			enc, err := ParseEncoding(value)
+			if err != nil {
+				log.Printf("Rejecting start record for %s: %v", hash8, err)
+				return false
+			}
+			encoding = enc
+		case "c":
+			codec, err := ParseCompression(value)
+			if err != nil {
+				log.Printf("Rejecting start record for %s: %v", hash8, err)
+				return false
+			}
+			compression = codec
+		case "s":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				log.Printf("Rejecting start record for %s: invalid original size %q", hash8, value)
+				return false
+			}
+			fileBytes = size
+		case "x":
+			c, err := ParseCipher(value)
+			if err != nil {
+				log.Printf("Rejecting start record for %s: %v", hash8, err)
+				return false
+			}
+			cipherName = c
+		case "n":
+			n, err := hex.DecodeString(value)
+			if err != nil || len(n) != nonceSize {
+				log.Printf("Rejecting start record for %s: invalid nonce %q", hash8, value)
+				return false
+			}
+			nonce = n
+		case "f":
+			f, err := ParseFEC(value)
+			if err != nil {
+				log.Printf("Rejecting start record for %s: %v", hash8, err)
+				return false
+			}
+			fec = f
+		case "b":
+			b, err := ParseBundle(value)
+			if err != nil {
+				log.Printf("Rejecting start record for %s: %v", hash8, err)
+				return false
+			}
+			bundle = b
+		case "t":
+			id, err := strconv.Atoi(value)
+			if err != nil || id < 1 {
+				log.Printf("Rejecting start record for %s: invalid task %q", hash8, value)
+				return false
+			}
+			taskID = id
+		case "h":
+			id := strings.ToLower(value)
+			if !validHostID(id) {
+				log.Printf("Rejecting start record for %s: invalid host %q", hash8, value)
+				return false
+			}
+			host = id
+		case tagLabelKey:
+			// Checked by authenticateRecord below
+		default:
+			if s.verbose {
+				log.Printf("Ignoring unknown start option %q for %s", label, hash8)
+			}
+		}
+	}
+	if cipherName != CipherNone && nonce == nil {
+		log.Printf("Rejecting start record for %s: cipher %s without a nonce", hash8, cipherName)
 		return false
 	}
-	hash8 := parts[startIdx+1]
 
 	// Validate hash8 is 8 hex characters
 	if len(hash8) != 8 {
 		return false
 	}
 
+	if _, ok := s.authenticateRecord(d, "start", hash8, parts, clientIP); !ok {
+		return false
+	}
+
 	// Parse total parts
 	totalParts, err := strconv.Atoi(totalPartsStr)
 	if err != nil || totalParts <= 0 {
@@ -827,44 +774,107 @@ func (s *Server) handleStartRecord(parts []string) bool {
 		return false
 	}
 
-	// Decode filename from hex
-	filenameBytes, err := hex.DecodeString(filenameHex)
+	// Decode filename
+	filenameBytes, err := encoding.Decode(filenameText)
 	if err != nil {
-		log.Printf("Error decoding filename hex '%s': %v", filenameHex, err)
+		log.Printf("Error decoding filename %s '%s': %v", encoding, filenameText, err)
 		return false
 	}
 	filename := string(filenameBytes)
 
+	if err := d.checkTransferQuota(totalBytes, fileBytes); err != nil {
+		log.Printf("Rejecting start record for %s (%s): %v", hash8, filename, err)
+		return false
+	}
+
+	// Parts beyond those total_bytes fills would never arrive
+	needed := totalBytes / int64(chunkSize)
+	if totalBytes%int64(chunkSize) != 0 || needed == 0 {
+		needed++
+	}
+	if int64(totalParts) > needed || totalParts > maxTotalParts {
+		log.Printf("Rejecting start record for %s (%s): %d parts for %d bytes in %d byte chunks", hash8, filename, totalParts, totalBytes, chunkSize)
+		return false
+	}
+
 	// Create or update file assembly
 	s.assemblyMu.Lock()
-	assembly, exists := s.fileAssemblies[hash8]
+	assembly, exists := s.fileAssemblies[transferKey(d, hash8)]
 	if !exists {
+		if !d.startTransfer() {
+			s.assemblyMu.Unlock()
+			log.Printf("Rejecting start record for %s (%s): %d transfers already in progress", hash8, filename, d.MaxTransfers)
+			return false
+		}
 		assembly = &FileAssembly{
-			Filename:   filename,
-			Hash:       hash8,
-			TotalParts: totalParts,
-			ChunkSize:  chunkSize,
-			TotalBytes: totalBytes,
-			Parts:      make(map[int][]byte),
+			Filename:     filename,
+			Hash:         hash8,
+			TotalParts:   totalParts,
+			ChunkSize:    chunkSize,
+			TotalBytes:   totalBytes,
+			FileBytes:    fileBytes,
+			Encoding:     encoding,
+			Compression:  compression,
+			Cipher:       cipherName,
+			Nonce:        nonce,
+			FEC:          fec,
+			Bundle:       bundle,
+			Task:         taskID,
+			Host:         host,
+			Domain:       d,
+			Parts:        make(map[int][]byte),
+			SourceIP:     clientIP.String(),
+			StartedAt:    time.Now(),
+			LastActivity: time.Now(),
 		}
-		s.fileAssemblies[hash8] = assembly
-		log.Printf("Started file assembly: %s (hash: %s, parts: %d, chunk_size: %d, total_bytes: %d)", filename, hash8, totalParts, chunkSize, totalBytes)
+		s.fileAssemblies[assembly.key()] = assembly
+		log.Printf("Started file assembly: %s (hash: %s, parts: %d, chunk_size: %d, total_bytes: %d, encoding: %s, compression: %s, cipher: %s, fec: %s)", filename, hash8, totalParts, chunkSize, totalBytes, encoding, compression, cipherName, fec)
 	} else {
 		// Update if needed
+		assembly.mu.Lock()
 		assembly.Filename = filename
 		assembly.TotalParts = totalParts
 		assembly.ChunkSize = chunkSize
 		assembly.TotalBytes = totalBytes
+		assembly.FileBytes = fileBytes
+		assembly.Encoding = encoding
+		assembly.Compression = compression
+		assembly.Cipher = cipherName
+		assembly.Nonce = nonce
+		assembly.FEC = fec
+		assembly.Bundle = bundle
+		assembly.Task = taskID
+		assembly.Host = host
+		assembly.LastActivity = time.Now()
+
+		// Decode data records that arrived before the start record
+		for partNum, text := range assembly.pending {
+			dataBytes, err := encoding.Decode(text)
+			if err != nil {
+				log.Printf("Dropping early part %d for %s: %v", partNum, hash8, err)
+				continue
+			}
+			if _, err := assembly.addPart(partNum, dataBytes); err != nil {
+				log.Printf("Dropping early part %d for %s: %v", partNum, hash8, err)
+			}
+		}
+		assembly.pending = nil
+		assembly.mu.Unlock()
 	}
 	s.assemblyMu.Unlock()
 
+	s.checkInHost(host, clientIP)
+
+	// All data may already have arrived ahead of the start record
+	s.checkComplete(assembly)
+
 	return true
 }
 
 // handleDataRecord processes a data record
-// Format: data_hex.part_num.hash8
-func (s *Server) handleDataRecord(parts []string) bool {
-	// Need at least 3 parts: data_hex, part_num, hash8
+// Format: data_enc[.m-<tag>].part_num.hash8 (data in the encoding from the start record)
+func (s *Server) handleDataRecord(d *Domain, parts []string, clientIP net.IP) bool {
+	// Need at least 3 parts: data, part_num, hash8
 	if len(parts) < 3 {
 		return false
 	}
@@ -873,10 +883,6 @@ func (s *Server) handleDataRecord(parts []string) bool {
 	hash8 := parts[len(parts)-1]
 	partNumStr := parts[len(parts)-2]
 
-	// Everything before that is data_hex (may span multiple labels)
-	dataHexParts := parts[:len(parts)-2]
-	dataHex := strings.Join(dataHexParts, "")
-
 	// Validate hash8 is 8 hex characters
 	if len(hash8) != 8 {
 		return false
@@ -888,81 +894,241 @@ func (s *Server) handleDataRecord(parts []string) bool {
 		return false
 	}
 
-	// Decode data from hex
-	dataBytes, err := hex.DecodeString(dataHex)
-	if err != nil {
-		log.Printf("Error decoding data hex '%s': %v", dataHex, err)
+	// Check and strip the m-<tag> label
+	parts, ok := s.authenticateRecord(d, "data", hash8, parts, clientIP)
+	if !ok {
 		return false
 	}
 
+	// Everything before part_num is encoded data (may span multiple labels)
+	dataParts := parts[:len(parts)-2]
+	dataText := strings.Join(dataParts, "")
+
 	// Get or create file assembly
 	s.assemblyMu.Lock()
-	assembly, exists := s.fileAssemblies[hash8]
+	assembly, exists := s.fileAssemblies[transferKey(d, hash8)]
 	if !exists {
+		if !d.startTransfer() {
+			s.assemblyMu.Unlock()
+			log.Printf("Dropping part %d for %s: %d transfers already in progress", partNum, hash8, d.MaxTransfers)
+			return false
+		}
 		// Create assembly if it doesn't exist (maybe start record was missed)
 		assembly = &FileAssembly{
 			Filename:   fmt.Sprintf("unknown_%s", hash8),
 			Hash:       hash8,
 			TotalParts: -1, // Unknown
 			TotalBytes: -1, // Unknown
+			FileBytes:  -1, // Unknown
+			Domain:     d,
 			Parts:      make(map[int][]byte),
+			SourceIP:   clientIP.String(),
+			StartedAt:  time.Now(),
 		}
-		s.fileAssemblies[hash8] = assembly
+		s.fileAssemblies[assembly.key()] = assembly
 		log.Printf("Created file assembly from data record: hash %s", hash8)
 	}
 	s.assemblyMu.Unlock()
 
 	// Add part to assembly
 	assembly.mu.Lock()
-	assembly.Parts[partNum] = dataBytes
-	receivedParts := len(assembly.Parts)
-	assembly.mu.Unlock()
+	if assembly.Encoding == "" {
+		// Start record not seen yet, so the encoding is unknown; keep the
+		// raw text until it arrives
+		if _, exists := assembly.pending[partNum]; !exists && len(assembly.pending) >= maxPendingParts {
+			assembly.mu.Unlock()
+			log.Printf("Dropping part %d for %s: %d parts already waiting for the start record", partNum, hash8, maxPendingParts)
+			return false
+		}
+		if assembly.pending == nil {
+			assembly.pending = make(map[int]string)
+		}
+		assembly.pending[partNum] = dataText
+		assembly.LastActivity = time.Now()
+		host := assembly.Host
+		assembly.mu.Unlock()
 
-	log.Printf("Received part %d/%d for file %s (hash: %s)", partNum, assembly.TotalParts, assembly.Filename, hash8)
+		s.checkInHost(host, clientIP)
 
-	// Check if file is complete
-	if assembly.TotalParts > 0 && receivedParts >= assembly.TotalParts {
-		// Check if we have all parts (1-based: parts 1 to TotalParts)
-		assembly.mu.Lock()
-		allParts := true
-		for i := 1; i <= assembly.TotalParts; i++ {
-			if _, exists := assembly.Parts[i]; !exists {
-				allParts = false
-				break
-			}
-		}
+		log.Printf("Received part %d (before start record) for hash %s", partNum, hash8)
+		return true
+	}
+
+	dataBytes, err := assembly.Encoding.Decode(dataText)
+	if err != nil {
 		assembly.mu.Unlock()
+		log.Printf("Error decoding data %s '%s': %v", assembly.Encoding, dataText, err)
+		return false
+	}
 
-		if allParts {
-			go s.assembleAndSaveFile(hash8)
-		}
+	duplicate, err := assembly.addPart(partNum, dataBytes)
+	if err != nil {
+		total := assembly.TotalParts + assembly.FEC.ParityParts(assembly.TotalParts)
+		assembly.mu.Unlock()
+		log.Printf("Dropping part %d for %s: %v (%d parts)", partNum, hash8, err, total)
+		return false
 	}
+	if duplicate {
+		assembly.DuplicateParts++
+	}
+	assembly.LastActivity = time.Now()
+	host := assembly.Host
+	totalParts, filename := assembly.TotalParts, assembly.Filename
+	assembly.mu.Unlock()
+
+	s.checkInHost(host, clientIP)
+
+	log.Printf("Received part %d/%d for file %s (hash: %s)", partNum, totalParts, filename, hash8)
+
+	s.checkComplete(assembly)
 
 	return true
 }
 
+// checkComplete starts saving the file once every part has arrived
+func (s *Server) checkComplete(assembly *FileAssembly) {
+	assembly.mu.Lock()
+	defer assembly.mu.Unlock()
+
+	if assembly.TotalParts <= 0 || len(assembly.Parts) < assembly.TotalParts {
+		return
+	}
+
+	// Check if we have all parts (1-based: parts 1 to TotalParts)
+	for i := 1; i <= assembly.TotalParts; i++ {
+		if _, exists := assembly.Parts[i]; !exists {
+			return
+		}
+	}
+
+	go s.assembleAndSaveFile(assembly.key())
+}
+
 // assembleAndSaveFile assembles all parts and saves the file
-func (s *Server) assembleAndSaveFile(hash8 string) {
+func (s *Server) assembleAndSaveFile(key string) {
 	s.assemblyMu.RLock()
-	assembly, exists := s.fileAssemblies[hash8]
+	assembly, exists := s.fileAssemblies[key]
 	if !exists {
 		s.assemblyMu.RUnlock()
 		return
 	}
 	s.assemblyMu.RUnlock()
 
+	hash8 := assembly.Hash
+	d := assembly.Domain
+	encryptionKey := s.domainKey(d)
+
 	assembly.mu.Lock()
 	defer assembly.mu.Unlock()
 
+	// Several data records can complete the file at once; only save it once
+	if !assembly.CompletedAt.IsZero() || assembly.FailStatus != "" {
+		return
+	}
+
 	// Assemble parts in order (1-based: parts 1 to TotalParts)
-	var fileData []byte
+	var wireData []byte
 	for i := 1; i <= assembly.TotalParts; i++ {
 		part, exists := assembly.Parts[i]
 		if !exists {
 			log.Printf("Warning: Missing part %d for file %s (hash: %s)", i, assembly.Filename, hash8)
 			return
 		}
-		fileData = append(fileData, part...)
+		wireData = append(wireData, part...)
+	}
+
+	// Undo the sender's transformations: decrypt, then decompress
+	payload := wireData
+	if assembly.Cipher != CipherNone && assembly.Cipher != "" {
+		if encryptionKey == nil {
+			s.failAssembly(assembly, HistoryFailed, "transfer is encrypted but no pre-shared key is configured")
+			return
+		}
+		plaintext, err := assembly.Cipher.Decrypt(encryptionKey, assembly.Nonce, hash8, wireData)
+		if errors.Is(err, errAuthFailed) {
+			s.failAssembly(assembly, HistoryAuthFailed, fmt.Sprintf("%s: %v (wrong key or tampered data)", assembly.Cipher, err))
+			return
+		}
+		if err != nil {
+			s.failAssembly(assembly, HistoryFailed, fmt.Sprintf("decrypt %s: %v", assembly.Cipher, err))
+			return
+		}
+		payload = plaintext
+	}
+
+	// Decompress no further than the domain's file size quota, or the
+	// original size the sender declared
+	limit := int64(maxDecompressedBytes)
+	if d.MaxFileSize > 0 {
+		limit = d.MaxFileSize
+	}
+	if assembly.Compression != CompressionNone && assembly.FileBytes >= 0 {
+		limit = min(limit, assembly.FileBytes)
+	}
+	fileData, err := assembly.Compression.Decompress(payload, limit)
+	if errors.Is(err, errDecompressedTooLarge) {
+		s.failAssembly(assembly, HistoryFailed, fmt.Sprintf("decompress %s: output larger than %d bytes", assembly.Compression, limit))
+		return
+	}
+	if err != nil {
+		s.failAssembly(assembly, HistoryFailed, fmt.Sprintf("decompress %s: %v", assembly.Compression, err))
+		return
+	}
+	if assembly.FileBytes >= 0 && int64(len(fileData)) != assembly.FileBytes {
+		log.Printf("Warning: File %s (hash: %s) is %d bytes, sender declared %d", assembly.Filename, hash8, len(fileData), assembly.FileBytes)
+	}
+	assembly.FileBytes = int64(len(fileData))
+
+	// Verify against the transfer hash (first 8 hex chars of the file's MD5)
+	assembly.Verified = verifyHash(fileData, hash8)
+	if !assembly.Verified {
+		log.Printf("Warning: File %s does not match its hash %s", assembly.Filename, hash8)
+	}
+
+	// Quotas apply to the saved size too, since compressed transfers
+	// declare less than they save
+	if d.MaxFileSize > 0 && int64(len(fileData)) > d.MaxFileSize {
+		s.failAssembly(assembly, HistoryFailed, fmt.Sprintf("file is larger than the %d byte limit", d.MaxFileSize))
+		return
+	}
+	if err := d.reserveStored(int64(len(fileData))); err != nil {
+		s.failAssembly(assembly, HistoryFailed, err.Error())
+		return
+	}
+
+	// A bundle is unpacked into its own directory
+	if assembly.Bundle == BundleTar {
+		dirPath, files, size, err := s.saveBundle(d.OutputDir, bundleDirName(assembly.Filename, hash8), hash8, fileData)
+		if err != nil {
+			d.releaseStored(int64(len(fileData)))
+			s.failAssembly(assembly, HistoryFailed, fmt.Sprintf("unpack bundle: %v", err))
+			return
+		}
+		// The archive was reserved; the unpacked files are what is stored,
+		// and what a deletion or overwrite gives back
+		d.releaseStored(int64(len(fileData)) - size)
+		log.Printf("Successfully unpacked bundle: %s (%d files, %d bytes, hash: %s)", dirPath, files, len(fileData), hash8)
+
+		assembly.CompletedAt = time.Now()
+		d.endTransfer()
+		s.writeFileRecord(d.OutputDir, FileRecord{
+			File:             filepath.Base(dirPath),
+			OriginalFilename: assembly.Filename,
+			Hash:             hash8,
+			SourceIP:         assembly.SourceIP,
+			Size:             int64(len(fileData)),
+			Verified:         assembly.Verified,
+			Bundle:           true,
+			Files:            files,
+			StartedAt:        assembly.StartedAt,
+			SavedAt:          assembly.CompletedAt,
+		})
+		s.recordHistory(assembly, HistoryComplete, filepath.Base(dirPath), "")
+		if assembly.Task > 0 {
+			s.completeTask(assembly.Task, assembly.Host, d.Name, filepath.Base(dirPath), int64(len(fileData)), hash8)
+		}
+		s.scheduleCleanup(assembly)
+		return
 	}
 
 	// Create safe filename
@@ -971,32 +1137,77 @@ func (s *Server) assembleAndSaveFile(hash8 string) {
 		safeFilename = fmt.Sprintf("file_%s", hash8)
 	}
 
-	// Save file
-	filePath := filepath.Join(s.outputDir, safeFilename)
-	err := os.WriteFile(filePath, fileData, 0644)
+	// Save file (atomically, honouring the collision policy)
+	filePath, err := s.saveFile(d.OutputDir, safeFilename, hash8, fileData)
 	if err != nil {
-		log.Printf("Error saving file %s: %v", filePath, err)
+		d.releaseStored(int64(len(fileData)))
+		s.failAssembly(assembly, HistoryFailed, err.Error())
 		return
 	}
 
-	log.Printf("Successfully saved file: %s (size: %d bytes, hash: %s)", filePath, len(fileData), hash8)
+	if assembly.Compression != CompressionNone {
+		log.Printf("Successfully saved file: %s (size: %d bytes, %d on the wire, hash: %s)", filePath, len(fileData), len(wireData), hash8)
+	} else {
+		log.Printf("Successfully saved file: %s (size: %d bytes, hash: %s)", filePath, len(fileData), hash8)
+	}
 
 	// Mark as completed but keep assembly for a short time to allow missing chunk queries
 	assembly.CompletedAt = time.Now()
+	d.endTransfer()
+
+	s.writeFileRecord(d.OutputDir, FileRecord{
+		File:             filepath.Base(filePath),
+		OriginalFilename: assembly.Filename,
+		Hash:             hash8,
+		SourceIP:         assembly.SourceIP,
+		Size:             int64(len(fileData)),
+		Verified:         assembly.Verified,
+		StartedAt:        assembly.StartedAt,
+		SavedAt:          assembly.CompletedAt,
+	})
+	s.recordHistory(assembly, HistoryComplete, filepath.Base(filePath), "")
+	if assembly.Task > 0 {
+		s.completeTask(assembly.Task, assembly.Host, d.Name, filepath.Base(filePath), int64(len(fileData)), hash8)
+	}
 
-	// Clean up assembly after 30 seconds (allows time for final missing chunk queries)
+	s.scheduleCleanup(assembly)
+}
+
+// failAssembly marks an assembly as failed with the given history status
+// (failed or auth_failed) and records it. The caller must hold assembly.mu.
+func (s *Server) failAssembly(assembly *FileAssembly, status string, reason string) {
+	log.Printf("Error: Transfer %s (hash: %s) %s: %s", assembly.Filename, assembly.Hash, status, reason)
+	assembly.FailStatus = status
+	assembly.FailReason = reason
+	assembly.Domain.endTransfer()
+	s.recordHistory(assembly, status, "", reason)
+	s.scheduleCleanup(assembly)
+}
+
+// scheduleCleanup removes a finished assembly after 30 seconds (allows time
+// for final missing chunk queries and for the dashboard to show the outcome).
+// The caller must hold assembly.mu.
+func (s *Server) scheduleCleanup(assembly *FileAssembly) {
+	key, filename := assembly.key(), assembly.Filename
 	go func() {
 		time.Sleep(30 * time.Second)
 		s.assemblyMu.Lock()
 		defer s.assemblyMu.Unlock()
-		// Double-check it's still the same assembly and completed
-		if existing, exists := s.fileAssemblies[hash8]; exists && existing == assembly {
-			delete(s.fileAssemblies, hash8)
-			log.Printf("Cleaned up completed file assembly: %s (hash: %s)", assembly.Filename, hash8)
+		// Double-check it's still the same assembly
+		if existing, exists := s.fileAssemblies[key]; exists && existing == assembly {
+			delete(s.fileAssemblies, key)
+			log.Printf("Cleaned up finished file assembly: %s (hash: %s)", filename, assembly.Hash)
 		}
 	}()
 }
 
+// verifyHash reports whether data matches a transfer hash (the first 8 hex
+// characters of its MD5, as computed by the transfer scripts)
+func verifyHash(data []byte, hash8 string) bool {
+	sum := md5.Sum(data)
+	return strings.EqualFold(hex.EncodeToString(sum[:4]), hash8)
+}
+
 // sanitizeFilename creates a safe filename from the original
 func sanitizeFilename(filename string) string {
 	// Remove path separators and other dangerous characters
@@ -1015,44 +1226,73 @@ func sanitizeFilename(filename string) string {
 	return filename
 }
 
-// GetFileTransfers returns information about all active file transfers
-func (s *Server) GetFileTransfers() []map[string]interface{} {
+// GetFileTransfers returns information about the active file transfers of a
+// served domain, or of all domains if domain is empty
+func (s *Server) GetFileTransfers(domain string) []map[string]interface{} {
+	domain = normalizeDomain(domain)
+
 	s.assemblyMu.RLock()
 	defer s.assemblyMu.RUnlock()
 
 	var transfers []map[string]interface{}
-	for hash8, assembly := range s.fileAssemblies {
+	for _, assembly := range s.fileAssemblies {
+		if domain != "" && assembly.Domain.Name != domain {
+			continue
+		}
+		hash8 := assembly.Hash
 		assembly.mu.Lock()
 		receivedParts := len(assembly.Parts)
-		var missingChunks []int
+		parityParts := assembly.FEC.ParityParts(assembly.TotalParts)
+		receivedParity := len(assembly.Parity)
+		recoveredParts := assembly.RecoveredParts
 		// Find missing chunks (1-based: parts 1 to TotalParts)
-		if assembly.TotalParts > 0 {
-			for i := 1; i <= assembly.TotalParts; i++ {
-				if _, exists := assembly.Parts[i]; !exists {
-					missingChunks = append(missingChunks, i)
-				}
-			}
-		}
+		missing := assembly.missingFrom(1, maxMissingWalk)
 		progress := 0.0
 		if assembly.TotalParts > 0 {
 			progress = float64(receivedParts) / float64(assembly.TotalParts) * 100.0
 		}
 		status := "in_progress"
-		if assembly.TotalParts > 0 && receivedParts >= assembly.TotalParts && len(missingChunks) == 0 {
+		if assembly.FailStatus != "" {
+			status = assembly.FailStatus
+		} else if assembly.TotalParts > 0 && receivedParts >= assembly.TotalParts && missing.Count == 0 {
 			status = "complete"
 		}
+		fileBytes := assembly.FileBytes
+		if fileBytes < 0 && assembly.Compression == CompressionNone {
+			fileBytes = assembly.TotalBytes
+		}
+		compressionRatio := 0.0
+		if fileBytes > 0 && assembly.TotalBytes > 0 {
+			compressionRatio = float64(fileBytes) / float64(assembly.TotalBytes)
+		}
 		assembly.mu.Unlock()
 
 		transfer := map[string]interface{}{
-			"hash":           hash8,
-			"filename":       assembly.Filename,
-			"total_parts":    assembly.TotalParts,
-			"received_parts": receivedParts,
-			"chunk_size":     assembly.ChunkSize,
-			"total_bytes":    assembly.TotalBytes,
-			"progress":       progress,
-			"status":         status,
-			"missing_chunks": missingChunks,
+			"hash":              hash8,
+			"filename":          assembly.Filename,
+			"total_parts":       assembly.TotalParts,
+			"received_parts":    receivedParts,
+			"chunk_size":        assembly.ChunkSize,
+			"total_bytes":       assembly.TotalBytes,
+			"wire_bytes":        assembly.TotalBytes,
+			"file_bytes":        fileBytes,
+			"compression":       assembly.Compression,
+			"compression_ratio": compressionRatio,
+			"encoding":          assembly.Encoding,
+			"cipher":            assembly.Cipher,
+			"fec":               assembly.FEC.String(),
+			"bundle":            assembly.Bundle,
+			"host":              assembly.Host,
+			"domain":            assembly.Domain.Name,
+			"parity_parts":      parityParts,
+			"received_parity":   receivedParity,
+			"recovered_parts":   recoveredParts,
+			"verified":          assembly.Verified,
+			"error":             assembly.FailReason,
+			"progress":          progress,
+			"status":            status,
+			"missing_count":     missing.Count,
+			"missing_chunks":    missing.Parts,
 		}
 		transfers = append(transfers, transfer)
 	}
@@ -1070,16 +1310,49 @@ func (s *Server) GetFileTransfers() []map[string]interface{} {
 	return transfers
 }
 
-// GetReceivedFiles returns a list of files in the output directory
-func (s *Server) GetReceivedFiles() ([]map[string]interface{}, error) {
-	files, err := os.ReadDir(s.outputDir)
+// GetReceivedFiles returns a list of files in the output directory of a
+// served domain, or in those of all domains if domain is empty
+func (s *Server) GetReceivedFiles(domain string) ([]map[string]interface{}, error) {
+	domain = normalizeDomain(domain)
+
+	var fileList []map[string]interface{}
+	listed := make(map[string]bool)
+	for _, d := range s.allDomains() {
+		if (domain != "" && d.Name != domain) || listed[d.OutputDir] {
+			continue
+		}
+		listed[d.OutputDir] = true
+
+		entries, err := s.receivedFiles(d)
+		if err != nil {
+			return nil, err
+		}
+		fileList = append(fileList, entries...)
+	}
+
+	// Sort by modification time (newest first)
+	for i := 0; i < len(fileList); i++ {
+		for j := i + 1; j < len(fileList); j++ {
+			if fileList[i]["mod_time"].(string) < fileList[j]["mod_time"].(string) {
+				fileList[i], fileList[j] = fileList[j], fileList[i]
+			}
+		}
+	}
+
+	return fileList, nil
+}
+
+// receivedFiles lists the files in the output directory of d
+func (s *Server) receivedFiles(d *Domain) ([]map[string]interface{}, error) {
+	files, err := os.ReadDir(d.OutputDir)
 	if err != nil {
 		return nil, err
 	}
 
 	var fileList []map[string]interface{}
 	for _, file := range files {
-		if file.IsDir() {
+		// Skip the server's metadata and in-progress temp files
+		if isInternalFile(file.Name()) {
 			continue
 		}
 
@@ -1088,26 +1361,91 @@ func (s *Server) GetReceivedFiles() ([]map[string]interface{}, error) {
 			continue
 		}
 
-		fileList = append(fileList, map[string]interface{}{
+		record, recordErr := s.readFileRecord(d.OutputDir, file.Name())
+		// Directories are only listed if they are unpacked bundles
+		if file.IsDir() && (recordErr != nil || !record.Bundle) {
+			continue
+		}
+
+		entry := map[string]interface{}{
 			"name":     file.Name(),
+			"domain":   d.Name,
 			"size":     info.Size(),
 			"mod_time": info.ModTime().Format(time.RFC3339),
-		})
-	}
-
-	// Sort by modification time (newest first)
-	for i := 0; i < len(fileList); i++ {
-		for j := i + 1; j < len(fileList); j++ {
-			if fileList[i]["mod_time"].(string) < fileList[j]["mod_time"].(string) {
-				fileList[i], fileList[j] = fileList[j], fileList[i]
+		}
+		if recordErr == nil {
+			entry["hash"] = record.Hash
+			entry["source_ip"] = record.SourceIP
+			entry["original_filename"] = record.OriginalFilename
+			if record.Bundle {
+				entry["size"] = record.Size
+				entry["bundle"] = true
+				entry["files"] = record.Files
 			}
 		}
+		fileList = append(fileList, entry)
 	}
 
 	return fileList, nil
 }
 
-// GetOutputDir returns the output directory path
-func (s *Server) GetOutputDir() string {
-	return s.outputDir
+// ErrFileNotFound is returned when deleting a received or outbox file that
+// doesn't exist
+var ErrFileNotFound = errors.New("file not found")
+
+// DeleteReceivedFile removes a received file (or unpacked bundle) and its
+// sidecar record from the output directory of a served domain, or of the
+// primary domain if domain is empty, and returns its bytes to the storage
+// quota
+func (s *Server) DeleteReceivedFile(domain string, name string) error {
+	if name == "" || name != filepath.Base(name) || strings.Contains(name, "..") || isInternalFile(name) {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	d, exists := s.findDomain(domain)
+	if !exists {
+		return fmt.Errorf("unknown domain %q", domain)
+	}
+
+	// Under the save lock so a transfer finishing meanwhile can't be saved
+	// under the name being removed
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	filePath := filepath.Join(d.OutputDir, name)
+	info, err := os.Lstat(filePath)
+	if err != nil {
+		return ErrFileNotFound
+	}
+
+	size := info.Size()
+	if info.IsDir() {
+		record, err := s.readFileRecord(d.OutputDir, name)
+		if err != nil || !record.Bundle {
+			return ErrFileNotFound // Only bundles are listed as directories
+		}
+		size = storedBytes(filePath, nil)
+		err = os.RemoveAll(filePath)
+	} else {
+		err = os.Remove(filePath)
+	}
+	if err != nil {
+		return err
+	}
+	os.Remove(filepath.Join(d.OutputDir, metaDirName, name+".json"))
+
+	// Domains sharing the output directory share its counter
+	d.releaseStored(size)
+
+	log.Printf("Deleted received file %s from %s", name, d.OutputDir)
+	return nil
+}
+
+// GetOutputDir returns the output directory of a served domain, or of the
+// primary domain if domain is empty. ok is false for an unknown domain.
+func (s *Server) GetOutputDir(domain string) (string, bool) {
+	d, exists := s.findDomain(domain)
+	if !exists {
+		return "", false
+	}
+	return d.OutputDir, true
 }
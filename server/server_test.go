@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"youkaidns/dns"
+	"youkaidns/stats"
+)
+
+// testDomain is the primary domain of test servers
+const testDomain = "t.test"
+
+// testClient is the resolver test queries come from
+var testClient = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}
+
+// newTestServer returns a server for testDomain saving into a temp directory
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	return NewServer(0, stats.NewStats(), false, testDomain, filepath.Join(t.TempDir(), "out"))
+}
+
+// serveQuery runs one question from testClient through the middleware and
+// query handlers, as handleRequest does, and returns the response
+func serveQuery(s *Server, name string, qtype uint16) *responseWriter {
+	return serveQueryFrom(s, testClient, name, qtype)
+}
+
+// serveQueryFrom runs one question from addr through the middleware and query
+// handlers
+func serveQueryFrom(s *Server, addr *net.UDPAddr, name string, qtype uint16) *responseWriter {
+	question := dns.Question{Name: name, Type: qtype, Class: 1}
+	q := s.newQuery(question, addr.IP)
+	ctx := context.WithValue(context.Background(), queriesKey, []*Query{q})
+	ctx = context.WithValue(ctx, queryKey, q)
+
+	if s.handler == nil {
+		s.handler = s.chain()
+	}
+	w := &responseWriter{addr: addr, rcode: -1}
+	s.handler.ServeDNS(ctx, w, &dns.Message{Header: dns.MessageHeader{QdCount: 1}, Questions: []dns.Question{question}})
+	return w
+}
+
+// testTransfer is a transfer sent the way the scripts send one
+type testTransfer struct {
+	Name     string
+	File     []byte   // Original file; its MD5 gives the transfer hash
+	Wire     []byte   // Bytes sent (compressed or encrypted), nil to send File
+	Chunk    int      // Bytes per part, 0 for 30
+	Encoding Encoding // Label encoding, empty for hex
+	Options  []string // Start record options, such as c-gzip
+}
+
+// hash8 returns the transfer hash: the first 8 hex characters of the file's MD5
+func (tr testTransfer) hash8() string {
+	sum := md5.Sum(tr.File)
+	return hex.EncodeToString(sum[:4])
+}
+
+// wire returns the bytes sent
+func (tr testTransfer) wire() []byte {
+	if tr.Wire != nil {
+		return tr.Wire
+	}
+	return tr.File
+}
+
+// chunk returns the bytes per part
+func (tr testTransfer) chunk() int {
+	if tr.Chunk > 0 {
+		return tr.Chunk
+	}
+	return 30
+}
+
+// totalParts returns the number of data parts
+func (tr testTransfer) totalParts() int {
+	return max(1, (len(tr.wire())+tr.chunk()-1)/tr.chunk())
+}
+
+// encode encodes label text in the transfer's encoding
+func (tr testTransfer) encode(data []byte) string {
+	return encodeLabel(tr.Encoding, data)
+}
+
+// startRecord returns the start record name for s's secret, if any
+func (tr testTransfer) startRecord(s *Server) string {
+	labels := splitLabels(tr.encode([]byte(tr.Name)))
+	labels = append(labels, strconv.Itoa(tr.totalParts()), strconv.Itoa(tr.chunk()), strconv.Itoa(len(tr.wire())), "start")
+	if tr.Encoding != "" {
+		labels = append(labels, "e-"+string(tr.Encoding))
+	}
+	labels = append(labels, tr.Options...)
+	return recordName(s, labels, len(labels), tr.hash8())
+}
+
+// dataRecord returns the data record name of part (1-based)
+func (tr testTransfer) dataRecord(s *Server, part int) string {
+	data := tr.wire()
+	chunk := data[min((part-1)*tr.chunk(), len(data)):min(part*tr.chunk(), len(data))]
+	labels := append(splitLabels(tr.encode(chunk)), strconv.Itoa(part))
+	return recordName(s, labels, len(labels)-1, tr.hash8())
+}
+
+// splitLabels splits encoded text into labels of at most 63 characters
+func splitLabels(text string) []string {
+	var labels []string
+	for len(text) > 63 {
+		labels = append(labels, text[:63])
+		text = text[63:]
+	}
+	return append(labels, text)
+}
+
+// recordName returns the query name of a record's labels and hash under
+// testDomain. If s has an auth secret, the tag label goes before labels[tagAt].
+func recordName(s *Server, labels []string, tagAt int, hash8 string) string {
+	labels = append(append([]string(nil), labels...), hash8)
+	if s.authKey != nil {
+		tag := "m-" + RecordTag(s.authKey, labels, testDomain)
+		labels = append(labels[:tagAt], append([]string{tag}, labels[tagAt:]...)...)
+	}
+	return strings.Join(labels, ".") + "." + testDomain
+}
+
+// sendTransfer sends the start record and every data part over TXT and
+// returns the transfer hash
+func sendTransfer(t *testing.T, s *Server, tr testTransfer) string {
+	t.Helper()
+	if w := serveQuery(s, tr.startRecord(s), dns.TypeTXT); len(w.answers) == 0 {
+		t.Fatalf("start record of %s not acknowledged", tr.Name)
+	}
+	for part := 1; part <= tr.totalParts(); part++ {
+		if w := serveQuery(s, tr.dataRecord(s, part), dns.TypeTXT); len(w.answers) == 0 {
+			t.Fatalf("part %d of %s not acknowledged", part, tr.Name)
+		}
+	}
+	return tr.hash8()
+}
+
+// waitFinished waits until the transfer hash8 of the primary domain is saved
+// or has failed, and returns its assembly
+func waitFinished(t *testing.T, s *Server, hash8 string) *FileAssembly {
+	t.Helper()
+	key := transferKey(s.primaryDomain(), hash8)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		s.assemblyMu.RLock()
+		assembly, exists := s.fileAssemblies[key]
+		s.assemblyMu.RUnlock()
+		if !exists {
+			continue
+		}
+		assembly.mu.Lock()
+		finished := !assembly.CompletedAt.IsZero() || assembly.FailStatus != ""
+		assembly.mu.Unlock()
+		if finished {
+			return assembly
+		}
+	}
+	t.Fatalf("transfer %s didn't finish", hash8)
+	return nil
+}
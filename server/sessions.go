@@ -0,0 +1,462 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"youkaidns/dns"
+)
+
+// Task states
+const (
+	TaskQueued    = "queued"    // Waiting for the agent's next poll
+	TaskSent      = "sent"      // The agent fetched every chunk
+	TaskCompleted = "completed" // The result upload arrived
+)
+
+// maxTaskSize caps the size of a queued task
+const maxTaskSize = 64 * 1024
+
+// maxAgentIDLength caps agent IDs (lowercase letters and digits)
+const maxAgentIDLength = 32
+
+// At most maxAgentSessions agents are kept; a new agent replaces the least
+// recently seen one without queued tasks. An agent without queued tasks is
+// forgotten after agentIdleTimeout without a poll; its tasks are kept.
+const (
+	maxAgentSessions = 1000
+	agentIdleTimeout = 24 * time.Hour
+)
+
+// At most maxTasks tasks are kept; queueing a new one forgets the oldest
+// task that isn't queued. A completed task, or a sent task whose result never
+// arrived, is forgotten taskRetention after it completed or was sent.
+const (
+	maxTasks      = 10000
+	taskRetention = 24 * time.Hour
+)
+
+// Session is an agent that polls for tasks
+type Session struct {
+	ID        string    `json:"id"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	LastIP    string    `json:"last_ip"` // Resolver IP of the last poll
+	Polls     int64     `json:"polls"`
+	Queued    int       `json:"queued"`
+	Sent      int       `json:"sent"`
+	Completed int       `json:"completed"`
+
+	tasks []*Task // In queue order
+}
+
+// Task is a command queued for an agent. Its result comes back as an
+// ordinary transfer whose start record carries t-<task_id>.
+type Task struct {
+	ID          int        `json:"id"`
+	Agent       string     `json:"agent"`
+	Command     string     `json:"command"`
+	Status      string     `json:"status"` // queued, sent or completed
+	Chunks      int        `json:"chunks"` // Base64 chunks of outboxChunkSize bytes of the payload sent
+	QueuedAt    time.Time  `json:"queued_at"`
+	SentAt      *time.Time `json:"sent_at,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ResultFile  string     `json:"result_file,omitempty"` // Saved result in the domain's output directory
+	Domain      string     `json:"domain,omitempty"`      // Domain the result arrived under
+	ResultSize  int64      `json:"result_size,omitempty"`
+	ResultHash  string     `json:"result_hash,omitempty"` // Transfer hash of the result
+
+	payload   []byte // Command as sent, encrypted if sealedFor has a pre-shared key
+	nonce     []byte // Nonce of an encrypted payload, nil if sent in the clear
+	sealedFor string // Domain the payload was prepared for at the last poll
+}
+
+// ErrUnknownAgent is returned when queueing a task for an agent that has
+// never polled
+var ErrUnknownAgent = errors.New("unknown agent")
+
+// ErrTooManyTasks is returned when queueing a task while maxTasks tasks are
+// all still queued
+var ErrTooManyTasks = errors.New("too many queued tasks")
+
+// validAgentID reports whether id is a usable agent ID
+func validAgentID(id string) bool {
+	if id == "" || len(id) > maxAgentIDLength {
+		return false
+	}
+	for _, r := range id {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// QueueTask queues command for agent and returns the new task
+func (s *Server) QueueTask(agent string, command string) (Task, error) {
+	agent = strings.ToLower(agent)
+	if command == "" {
+		return Task{}, errors.New("empty command")
+	}
+	if len(command) > maxTaskSize {
+		return Task{}, fmt.Errorf("command is larger than %d bytes", maxTaskSize)
+	}
+
+	s.sessionMu.Lock()
+	defer s.sessionMu.Unlock()
+
+	session, exists := s.sessions[agent]
+	if !exists {
+		return Task{}, ErrUnknownAgent
+	}
+	if len(s.tasks) >= maxTasks && !s.evictTask() {
+		return Task{}, ErrTooManyTasks
+	}
+
+	s.nextTaskID++
+	task := &Task{
+		ID:       s.nextTaskID,
+		Agent:    agent,
+		Command:  command,
+		Status:   TaskQueued,
+		Chunks:   (len(command) + outboxChunkSize - 1) / outboxChunkSize,
+		QueuedAt: time.Now(),
+	}
+	session.tasks = append(session.tasks, task)
+	s.tasks[task.ID] = task
+
+	log.Printf("Queued task %d for agent %s (%d bytes)", task.ID, agent, len(command))
+	return *task, nil
+}
+
+// GetSessions returns the agents that have polled, most recently seen first
+func (s *Server) GetSessions() []Session {
+	s.sessionMu.Lock()
+	defer s.sessionMu.Unlock()
+
+	sessions := make([]Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		info := *session
+		info.tasks = nil
+		for _, task := range session.tasks {
+			switch task.Status {
+			case TaskQueued:
+				info.Queued++
+			case TaskSent:
+				info.Sent++
+			case TaskCompleted:
+				info.Completed++
+			}
+		}
+		sessions = append(sessions, info)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeen.After(sessions[j].LastSeen)
+	})
+	return sessions
+}
+
+// GetTasks returns the tasks of an agent (all agents if agent is empty) in
+// queue order
+func (s *Server) GetTasks(agent string) []Task {
+	agent = strings.ToLower(agent)
+
+	s.sessionMu.Lock()
+	defer s.sessionMu.Unlock()
+
+	tasks := []Task{}
+	for _, task := range s.tasks {
+		if agent == "" || task.Agent == agent {
+			tasks = append(tasks, *task)
+		}
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].ID < tasks[j].ID
+	})
+	return tasks
+}
+
+// GetTask returns a task by ID
+func (s *Server) GetTask(id int) (Task, bool) {
+	s.sessionMu.Lock()
+	defer s.sessionMu.Unlock()
+
+	task, exists := s.tasks[id]
+	if !exists {
+		return Task{}, false
+	}
+	return *task, true
+}
+
+// completeTask attaches a saved result to its task. The result must come
+// from the task's agent (the h- option of the transfer) after the agent
+// fetched the task; other results are left as ordinary files.
+func (s *Server) completeTask(id int, host string, domain string, file string, size int64, hash8 string) {
+	s.sessionMu.Lock()
+	defer s.sessionMu.Unlock()
+
+	task, exists := s.tasks[id]
+	if !exists {
+		log.Printf("Warning: Result %s is for unknown task %d", file, id)
+		return
+	}
+	if host != task.Agent {
+		log.Printf("Warning: Rejecting result %s for task %d: sent by host %q, not agent %s", file, id, host, task.Agent)
+		return
+	}
+	if task.Status != TaskSent {
+		log.Printf("Warning: Rejecting result %s for task %d: task is %s", file, id, task.Status)
+		return
+	}
+
+	now := time.Now()
+	task.Status = TaskCompleted
+	task.CompletedAt = &now
+	task.ResultFile = file
+	task.Domain = domain
+	task.ResultSize = size
+	task.ResultHash = hash8
+	log.Printf("Task %d for agent %s completed: %s (%d bytes)", id, task.Agent, file, size)
+}
+
+// handleSessionQuery serves task polling
+// Format: <seq>.poll.<agentid>.<domain> registers the agent, checks in the
+// host of the same ID and returns "task <id> <chunks>" for its oldest queued
+// task ("task <id> <chunks> aes-gcm <nonce>" if the domain has a pre-shared
+// key), or "idle";
+// <chunk_num>.<id>.task.<agentid>.<domain> returns chunk chunk_num (1-based)
+// of the task's payload as base64. Fetching the last chunk marks the task
+// sent. With a record secret both need an m-<tag> label like start and data
+// records. Returns nil if not a session query.
+func (s *Server) handleSessionQuery(q *Query) []dns.ResourceRecord {
+	if q.Type != dns.TypeTXT {
+		return nil
+	}
+
+	parts := q.Labels
+	if q.Domain == nil || len(parts) < 3 {
+		return nil
+	}
+	agent := parts[len(parts)-1]
+	kind := parts[len(parts)-2]
+	if (kind != "poll" && kind != "task") || !validAgentID(agent) {
+		return nil
+	}
+
+	// Without this, anyone could register agents and hosts or fetch tasks
+	parts, ok := s.authenticateRecord(q.Domain, kind, agent, parts, q.ClientIP)
+	if !ok || len(parts) < 3 {
+		return nil
+	}
+	key := s.domainKey(q.Domain)
+
+	s.sessionMu.Lock()
+	defer s.sessionMu.Unlock()
+
+	// Poll: <seq>.poll.<agentid>; the sequence number only defeats caching
+	if kind == "poll" {
+		now := time.Now()
+		session, exists := s.sessions[agent]
+		if !exists {
+			if len(s.sessions) >= maxAgentSessions && !s.evictSession() {
+				log.Printf("Warning: Ignoring poll from new agent %s: %d agents have queued tasks", agent, len(s.sessions))
+				return nil
+			}
+			session = &Session{ID: agent, FirstSeen: now}
+			s.sessions[agent] = session
+			log.Printf("New agent session: %s from %s", agent, q.ClientIP)
+		}
+		session.LastSeen = now
+		session.LastIP = q.ClientIP.String()
+		session.Polls++
+		s.checkInHost(agent, q.ClientIP)
+
+		for _, task := range session.tasks {
+			if task.Status == TaskQueued {
+				if err := sealTask(task, q.Domain.Name, key); err != nil {
+					log.Printf("Error encrypting task %d: %v", task.ID, err)
+					return nil
+				}
+				answer := fmt.Sprintf("task %d %d", task.ID, task.Chunks)
+				if task.nonce != nil {
+					answer += fmt.Sprintf(" %s %x", CipherAESGCM, task.nonce)
+				}
+				if s.verbose {
+					log.Printf("Agent %s poll: task %d (%d chunks)", agent, task.ID, task.Chunks)
+				}
+				return []dns.ResourceRecord{txtRecord(q.Name, answer)}
+			}
+		}
+		return []dns.ResourceRecord{txtRecord(q.Name, "idle")}
+	}
+
+	// Chunk: <chunk_num>.<id>.task.<agentid>
+	if len(parts) < 4 {
+		return nil
+	}
+	id, err := strconv.Atoi(parts[len(parts)-3])
+	if err != nil {
+		return nil
+	}
+	chunkNum, err := strconv.Atoi(parts[len(parts)-4])
+	if err != nil {
+		return nil
+	}
+	task, exists := s.tasks[id]
+	// The payload is only prepared by a poll under the same domain
+	if !exists || task.Agent != agent || task.sealedFor != q.Domain.Name || chunkNum < 1 || chunkNum > task.Chunks {
+		return nil
+	}
+
+	start := (chunkNum - 1) * outboxChunkSize
+	end := start + outboxChunkSize
+	if end > len(task.payload) {
+		end = len(task.payload)
+	}
+	if chunkNum == task.Chunks && task.Status == TaskQueued {
+		now := time.Now()
+		task.Status = TaskSent
+		task.SentAt = &now
+		log.Printf("Task %d sent to agent %s", task.ID, agent)
+	}
+
+	return []dns.ResourceRecord{txtRecord(q.Name, base64.StdEncoding.EncodeToString(task.payload[start:end]))}
+}
+
+// taskAD is the additional data of an encrypted task, so a payload can't be
+// replayed as another task or to another agent
+func taskAD(task *Task) string {
+	return fmt.Sprintf("%s/%d", task.Agent, task.ID)
+}
+
+// sealTask prepares the payload of a task for polls under domain: the
+// command encrypted with AES-256-GCM under a fresh nonce if key is set, the
+// plain command otherwise. A payload already prepared for domain is kept, so
+// the chunks don't change while the agent fetches them. The caller must hold
+// sessionMu.
+func sealTask(task *Task, domain string, key []byte) error {
+	if task.sealedFor == domain && task.payload != nil {
+		return nil
+	}
+
+	task.payload, task.nonce = []byte(task.Command), nil
+	if key != nil {
+		nonce := make([]byte, nonceSize)
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		payload, err := CipherAESGCM.Encrypt(key, nonce, taskAD(task), []byte(task.Command))
+		if err != nil {
+			return err
+		}
+		task.payload, task.nonce = payload, nonce
+	}
+	task.sealedFor = domain
+	task.Chunks = (len(task.payload) + outboxChunkSize - 1) / outboxChunkSize
+	return nil
+}
+
+// evictSession forgets the least recently seen agent without queued tasks to
+// make room for a new one. It returns false if every agent has queued tasks.
+// The caller must hold sessionMu.
+func (s *Server) evictSession() bool {
+	var oldest *Session
+	for _, session := range s.sessions {
+		if !session.hasQueued() && (oldest == nil || session.LastSeen.Before(oldest.LastSeen)) {
+			oldest = session
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	delete(s.sessions, oldest.ID)
+	log.Printf("Agent sessions full: forgot %s (last seen %s)", oldest.ID, oldest.LastSeen.Format(time.RFC3339))
+	return true
+}
+
+// expireSessions forgets agents without queued tasks that haven't polled for
+// agentIdleTimeout
+func (s *Server) expireSessions() {
+	s.sessionMu.Lock()
+	defer s.sessionMu.Unlock()
+
+	cutoff := time.Now().Add(-agentIdleTimeout)
+	for id, session := range s.sessions {
+		if session.LastSeen.Before(cutoff) && !session.hasQueued() {
+			delete(s.sessions, id)
+			if s.verbose {
+				log.Printf("Forgot idle agent %s", id)
+			}
+		}
+	}
+}
+
+// hasQueued reports whether the agent has tasks waiting for it
+func (session *Session) hasQueued() bool {
+	for _, task := range session.tasks {
+		if task.Status == TaskQueued {
+			return true
+		}
+	}
+	return false
+}
+
+// forgetTask removes a task from the task list and its agent's queue. The
+// caller must hold sessionMu.
+func (s *Server) forgetTask(task *Task) {
+	delete(s.tasks, task.ID)
+	if session, exists := s.sessions[task.Agent]; exists {
+		for i, t := range session.tasks {
+			if t == task {
+				session.tasks = append(session.tasks[:i], session.tasks[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// evictTask forgets the oldest task that isn't queued to make room for a new
+// one. It returns false if every task is queued. The caller must hold
+// sessionMu.
+func (s *Server) evictTask() bool {
+	var oldest *Task
+	for _, task := range s.tasks {
+		if task.Status != TaskQueued && (oldest == nil || task.ID < oldest.ID) {
+			oldest = task
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	s.forgetTask(oldest)
+	log.Printf("Task list full: forgot task %d (%s)", oldest.ID, oldest.Status)
+	return true
+}
+
+// expireTasks forgets completed tasks and sent tasks without a result once
+// taskRetention has passed since they completed or were sent
+func (s *Server) expireTasks() {
+	s.sessionMu.Lock()
+	defer s.sessionMu.Unlock()
+
+	cutoff := time.Now().Add(-taskRetention)
+	for _, task := range s.tasks {
+		finished := task.CompletedAt
+		if finished == nil {
+			finished = task.SentAt
+		}
+		if task.Status != TaskQueued && finished != nil && finished.Before(cutoff) {
+			s.forgetTask(task)
+			if s.verbose {
+				log.Printf("Forgot %s task %d", task.Status, task.ID)
+			}
+		}
+	}
+}
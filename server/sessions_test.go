@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"youkaidns/dns"
+)
+
+// pollAgent polls as agent and fetches every chunk of the task it is given,
+// returning the poll answer and the command
+func pollAgent(t *testing.T, s *Server, agent string) (string, string) {
+	t.Helper()
+	w := serveQuery(s, "1.poll."+agent+"."+testDomain, dns.TypeTXT)
+	if len(w.answers) != 1 {
+		t.Fatalf("poll: %d answers", len(w.answers))
+	}
+	answer := strings.Join(txtStrings(w.answers[0].Data), "")
+	fields := strings.Fields(answer)
+	if fields[0] != "task" {
+		return answer, ""
+	}
+
+	chunks, err := strconv.Atoi(fields[2])
+	if err != nil {
+		t.Fatalf("poll answer %q", answer)
+	}
+	var encoded string
+	for chunk := 1; chunk <= chunks; chunk++ {
+		w := serveQuery(s, strconv.Itoa(chunk)+"."+fields[1]+".task."+agent+"."+testDomain, dns.TypeTXT)
+		if len(w.answers) != 1 {
+			t.Fatalf("chunk %d: %d answers", chunk, len(w.answers))
+		}
+		encoded += strings.Join(txtStrings(w.answers[0].Data), "")
+	}
+	command, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return answer, string(command)
+}
+
+func TestTaskRoundTrip(t *testing.T) {
+	s := newTestServer(t)
+	if answer, _ := pollAgent(t, s, "web01"); answer != "idle" {
+		t.Fatalf("first poll %q, want idle", answer)
+	}
+	task, err := s.QueueTask("web01", "uname -a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A result before the task is sent leaves it queued
+	early := testTransfer{Name: "early.txt", File: []byte("too early"), Options: []string{"t-1", "h-web01"}}
+	waitFinished(t, s, sendTransfer(t, s, early))
+	if got, _ := s.GetTask(task.ID); got.Status != TaskQueued {
+		t.Fatalf("task %s after an early result", got.Status)
+	}
+
+	if answer, command := pollAgent(t, s, "web01"); answer != "task 1 1" || command != "uname -a" {
+		t.Fatalf("poll %q with command %q", answer, command)
+	}
+	if got, _ := s.GetTask(task.ID); got.Status != TaskSent {
+		t.Fatalf("task %s after its chunks were fetched", got.Status)
+	}
+
+	results := []struct {
+		name   string
+		file   string
+		host   string
+		status string
+	}{
+		{"other host", "spoofed.txt", "h-db01", TaskSent},
+		{"no host", "anonymous.txt", "", TaskSent},
+		{"the agent", "task-1.txt", "h-web01", TaskCompleted},
+	}
+	for _, r := range results {
+		tr := testTransfer{Name: r.file, File: []byte("Linux web01 from " + r.name), Options: []string{"t-1"}}
+		if r.host != "" {
+			tr.Options = append(tr.Options, r.host)
+		}
+		if assembly := waitFinished(t, s, sendTransfer(t, s, tr)); !assembly.Verified {
+			t.Fatalf("%s: transfer failed: %s", r.name, assembly.FailReason)
+		}
+		if got, _ := s.GetTask(task.ID); got.Status != r.status {
+			t.Errorf("%s: task %s, want %s", r.name, got.Status, r.status)
+		}
+	}
+	if got, _ := s.GetTask(task.ID); got.ResultFile != "task-1.txt" {
+		t.Fatalf("result file %q", got.ResultFile)
+	}
+}
+
+func TestExpireTasks(t *testing.T) {
+	s := newTestServer(t)
+	pollAgent(t, s, "web01")
+	old := time.Now().Add(-taskRetention - time.Minute)
+	recent := time.Now()
+
+	tasks := []struct {
+		status string
+		at     time.Time
+		kept   bool
+	}{
+		{TaskQueued, old, true},
+		{TaskSent, old, false},
+		{TaskSent, recent, true},
+		{TaskCompleted, old, false},
+		{TaskCompleted, recent, true},
+	}
+	for _, tt := range tasks {
+		task, err := s.QueueTask("web01", "true")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.sessionMu.Lock()
+		queued := s.tasks[task.ID]
+		queued.Status = tt.status
+		at := tt.at
+		switch tt.status {
+		case TaskSent:
+			queued.SentAt = &at
+		case TaskCompleted:
+			queued.SentAt, queued.CompletedAt = &at, &at
+		}
+		s.sessionMu.Unlock()
+	}
+
+	s.expireTasks()
+	for i, tt := range tasks {
+		if _, kept := s.GetTask(i + 1); kept != tt.kept {
+			t.Errorf("%s task from %s: kept %v, want %v", tt.status, tt.at.Format(time.TimeOnly), kept, tt.kept)
+		}
+	}
+	if n := len(s.sessions["web01"].tasks); n != 3 {
+		t.Fatalf("agent queue holds %d tasks, want 3", n)
+	}
+
+	// A full task list makes room by forgetting the oldest task that isn't
+	// queued, and refuses new tasks once every task is queued
+	s.sessionMu.Lock()
+	if !s.evictTask() {
+		t.Fatal("nothing evicted")
+	}
+	_, sentKept := s.tasks[3]
+	s.sessionMu.Unlock()
+	if sentKept {
+		t.Fatal("oldest sent task kept")
+	}
+	s.sessionMu.Lock()
+	s.evictTask()
+	evicted := s.evictTask()
+	s.sessionMu.Unlock()
+	if evicted {
+		t.Fatal("queued task evicted")
+	}
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+
+	"youkaidns/dns"
+)
+
+// maxZoneTXT is the longest TXT value a zone record may hold, split into
+// 255-byte character strings
+const maxZoneTXT = 1024
+
+// ErrRecordNotFound is returned when removing a zone record that doesn't exist
+var ErrRecordNotFound = errors.New("record not found")
+
+// ZoneRecord is a zone record as listed and changed through the API
+type ZoneRecord struct {
+	Name  string `json:"name"`  // Owner name, or "*" for every name without records of the type
+	Type  string `json:"type"`  // A or TXT
+	Value string `json:"value"` // IPv4 address, or the text of a TXT record
+}
+
+// parseZoneRecord checks a zone record and returns it in the form AddRecord
+// takes: the lowercased name, the record type and its value
+func parseZoneRecord(record ZoneRecord) (string, uint16, interface{}, error) {
+	name, err := parseZoneName(record.Name)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	recordType, err := parseZoneType(record.Type)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	switch recordType {
+	case dns.TypeA:
+		ip := net.ParseIP(strings.TrimSpace(record.Value)).To4()
+		if ip == nil {
+			return "", 0, nil, fmt.Errorf("invalid IPv4 address %q", record.Value)
+		}
+		return name, recordType, ip.String(), nil
+	default:
+		if record.Value == "" || len(record.Value) > maxZoneTXT {
+			return "", 0, nil, fmt.Errorf("TXT value must be 1 to %d bytes", maxZoneTXT)
+		}
+		var strs []string
+		for text := record.Value; text != ""; {
+			n := min(len(text), 255)
+			strs = append(strs, text[:n])
+			text = text[n:]
+		}
+		return name, recordType, strs, nil
+	}
+}
+
+// parseZoneName checks a zone record name and returns it lowercased, without
+// a trailing dot
+func parseZoneName(value string) (string, error) {
+	name := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(value)), ".")
+	if name == "*" {
+		return name, nil
+	}
+	if name == "" || len(name) > 253 {
+		return "", fmt.Errorf("invalid name %q", value)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return "", fmt.Errorf("invalid name %q", value)
+		}
+	}
+	return name, nil
+}
+
+// parseZoneType parses the type of a zone record
+func parseZoneType(value string) (uint16, error) {
+	switch strings.ToUpper(value) {
+	case "A":
+		return dns.TypeA, nil
+	case "TXT":
+		return dns.TypeTXT, nil
+	default:
+		return 0, fmt.Errorf("unsupported record type %q (want A or TXT)", value)
+	}
+}
+
+// zoneValue returns the value of a zone record as ZoneRecord shows it
+func zoneValue(record Record) string {
+	switch value := record.Value.(type) {
+	case string:
+		return value
+	case []string:
+		return strings.Join(value, "")
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// zoneTypeName returns the name of a zone record type
+func zoneTypeName(recordType uint16) string {
+	switch recordType {
+	case dns.TypeA:
+		return "A"
+	case dns.TypeTXT:
+		return "TXT"
+	default:
+		return fmt.Sprintf("TYPE%d", recordType)
+	}
+}
+
+// GetZoneRecords returns the zone records sorted by name and type
+func (s *Server) GetZoneRecords() []ZoneRecord {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	records := []ZoneRecord{}
+	for name, types := range s.records {
+		for recordType, list := range types {
+			for _, record := range list {
+				records = append(records, ZoneRecord{Name: name, Type: zoneTypeName(recordType), Value: zoneValue(record)})
+			}
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Name != records[j].Name {
+			return records[i].Name < records[j].Name
+		}
+		return records[i].Type < records[j].Type
+	})
+	return records
+}
+
+// AddZoneRecord checks a zone record and adds it to the zone, returning it as
+// stored
+func (s *Server) AddZoneRecord(record ZoneRecord) (ZoneRecord, error) {
+	name, recordType, value, err := parseZoneRecord(record)
+	if err != nil {
+		return ZoneRecord{}, err
+	}
+
+	s.AddRecord(name, recordType, value)
+	stored := ZoneRecord{Name: name, Type: zoneTypeName(recordType), Value: zoneValue(Record{Value: value})}
+	log.Printf("Added zone record %s %s %s", stored.Name, stored.Type, stored.Value)
+	return stored, nil
+}
+
+// RemoveZoneRecord removes the zone records with record's name and type,
+// only those with its value unless the value is empty. It returns how many
+// were removed.
+func (s *Server) RemoveZoneRecord(record ZoneRecord) (int, error) {
+	name, err := parseZoneName(record.Name)
+	if err != nil {
+		return 0, err
+	}
+	recordType, err := parseZoneType(record.Type)
+	if err != nil {
+		return 0, err
+	}
+	anyValue := record.Value == ""
+	var want string
+	if !anyValue {
+		_, _, value, err := parseZoneRecord(record)
+		if err != nil {
+			return 0, err
+		}
+		want = zoneValue(Record{Value: value})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var kept []Record
+	removed := 0
+	for _, r := range s.records[name][recordType] {
+		if anyValue || zoneValue(r) == want {
+			removed++
+			continue
+		}
+		kept = append(kept, r)
+	}
+	if removed == 0 {
+		return 0, ErrRecordNotFound
+	}
+
+	if len(kept) > 0 {
+		s.records[name][recordType] = kept
+	} else {
+		delete(s.records[name], recordType)
+		if len(s.records[name]) == 0 {
+			delete(s.records, name)
+		}
+	}
+	log.Printf("Removed %d zone record(s) %s %s", removed, name, zoneTypeName(recordType))
+	return removed, nil
+}
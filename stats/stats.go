@@ -1,6 +1,7 @@
 package stats
 
 import (
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -17,19 +18,68 @@ type Stats struct {
 	SuccessfulResps int64
 	FailedResps     int64
 
+	// Transfer records dropped for failing authentication
+	RejectedRecords    int64
+	RejectionsBySource map[string]int64 // Source IP -> count
+
+	// Queries over a rate limit
+	ThrottledQueries  int64
+	ThrottledBySource map[string]int64 // Source IP -> count
+
+	// Responses held back by response rate limiting (dropped or slipped)
+	RRLDropped  int64
+	RRLSlipped  int64            // Sent truncated instead
+	RRLByPrefix map[string]int64 // Client prefix -> count
+
 	// Response time tracking
 	responseTimes []time.Duration
 	maxTimes      int // Maximum number of times to keep
+
+	// Statistics per served domain, created on first use
+	domains map[string]*Stats
 }
 
 // NewStats creates a new stats collector
 func NewStats() *Stats {
 	return &Stats{
-		QueriesByType:   make(map[uint16]int64),
-		QueriesByDomain: make(map[string]int64),
-		responseTimes:   make([]time.Duration, 0, 1000),
-		maxTimes:        1000,
+		QueriesByType:      make(map[uint16]int64),
+		QueriesByDomain:    make(map[string]int64),
+		RejectionsBySource: make(map[string]int64),
+		ThrottledBySource:  make(map[string]int64),
+		RRLByPrefix:        make(map[string]int64),
+		responseTimes:      make([]time.Duration, 0, 1000),
+		maxTimes:           1000,
+	}
+}
+
+// Domain returns the statistics of a served domain, creating them on first
+// use. The server records queries under a served domain both here and in s.
+func (s *Stats) Domain(name string) *Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.domains == nil {
+		s.domains = make(map[string]*Stats)
+	}
+	domain, exists := s.domains[name]
+	if !exists {
+		domain = NewStats()
+		s.domains[name] = domain
+	}
+	return domain
+}
+
+// DomainSnapshot returns a snapshot of a served domain's statistics, or an
+// empty snapshot if the domain has seen no queries
+func (s *Stats) DomainSnapshot(name string) Snapshot {
+	s.mu.RLock()
+	domain, exists := s.domains[name]
+	s.mu.RUnlock()
+
+	if !exists {
+		domain = NewStats()
 	}
+	return domain.GetSnapshot()
 }
 
 // RecordQuery records a DNS query
@@ -61,6 +111,40 @@ func (s *Stats) RecordResponse(success bool, duration time.Duration) {
 	}
 }
 
+// RecordRejection records a transfer record dropped because it failed
+// authentication
+func (s *Stats) RecordRejection(source string) {
+	atomic.AddInt64(&s.RejectedRecords, 1)
+
+	s.mu.Lock()
+	countSource(s.RejectionsBySource, source)
+	s.mu.Unlock()
+}
+
+// RecordThrottled records a query dropped, refused or truncated for going
+// over a rate limit
+func (s *Stats) RecordThrottled(source string) {
+	atomic.AddInt64(&s.ThrottledQueries, 1)
+
+	s.mu.Lock()
+	countSource(s.ThrottledBySource, source)
+	s.mu.Unlock()
+}
+
+// RecordRRL records a response limited by response rate limiting: sent
+// truncated if slipped, dropped otherwise
+func (s *Stats) RecordRRL(prefix string, slipped bool) {
+	if slipped {
+		atomic.AddInt64(&s.RRLSlipped, 1)
+	} else {
+		atomic.AddInt64(&s.RRLDropped, 1)
+	}
+
+	s.mu.Lock()
+	countSource(s.RRLByPrefix, prefix)
+	s.mu.Unlock()
+}
+
 // Snapshot returns a snapshot of current statistics
 type Snapshot struct {
 	TotalQueries    int64              `json:"total_queries"`
@@ -69,6 +153,16 @@ type Snapshot struct {
 	SuccessfulResps int64              `json:"successful_responses"`
 	FailedResps     int64              `json:"failed_responses"`
 	ResponseTime    ResponseTimeStats  `json:"response_time"`
+
+	RejectedRecords    int64            `json:"rejected_records"`
+	RejectionsBySource map[string]int64 `json:"rejections_by_source"` // Top 10 sources
+
+	ThrottledQueries  int64            `json:"throttled_queries"`
+	ThrottledBySource map[string]int64 `json:"throttled_by_source"` // Top 10 sources
+
+	RRLDropped  int64            `json:"rrl_dropped"`
+	RRLSlipped  int64            `json:"rrl_slipped"`
+	RRLByPrefix map[string]int64 `json:"rrl_by_prefix"` // Top 10 client prefixes
 }
 
 // ResponseTimeStats holds response time statistics
@@ -90,6 +184,16 @@ func (s *Stats) GetSnapshot() Snapshot {
 		QueriesByDomain: make(map[string]int64),
 		SuccessfulResps: atomic.LoadInt64(&s.SuccessfulResps),
 		FailedResps:     atomic.LoadInt64(&s.FailedResps),
+
+		RejectedRecords:    atomic.LoadInt64(&s.RejectedRecords),
+		RejectionsBySource: topCounts(s.RejectionsBySource, 10),
+
+		ThrottledQueries:  atomic.LoadInt64(&s.ThrottledQueries),
+		ThrottledBySource: topCounts(s.ThrottledBySource, 10),
+
+		RRLDropped:  atomic.LoadInt64(&s.RRLDropped),
+		RRLSlipped:  atomic.LoadInt64(&s.RRLSlipped),
+		RRLByPrefix: topCounts(s.RRLByPrefix, 10),
 	}
 
 	// Copy queries by type
@@ -150,13 +254,56 @@ func (s *Stats) GetSnapshot() Snapshot {
 	return snapshot
 }
 
+// maxSourceCounts caps the sources a per-source counter keeps. When a new
+// source arrives at the cap, all but the top half are forgotten, so a flood
+// of one-off addresses can't grow memory and the top sources survive.
+const maxSourceCounts = 1000
+
+// countSource counts one event for source
+func countSource(counts map[string]int64, source string) {
+	if _, exists := counts[source]; !exists && len(counts) >= maxSourceCounts {
+		keep := topCounts(counts, maxSourceCounts/2)
+		for k := range counts {
+			if _, kept := keep[k]; !kept {
+				delete(counts, k)
+			}
+		}
+	}
+	counts[source]++
+}
+
+// topCounts returns the n largest entries of counts
+func topCounts(counts map[string]int64, n int) map[string]int64 {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return counts[keys[i]] > counts[keys[j]]
+	})
+
+	top := make(map[string]int64)
+	for i := 0; i < len(keys) && i < n; i++ {
+		top[keys[i]] = counts[keys[i]]
+	}
+	return top
+}
+
 // getTypeName returns a string representation of a DNS type
 func getTypeName(t uint16) string {
 	switch t {
 	case 1:
 		return "A"
+	case 5:
+		return "CNAME"
+	case 10:
+		return "NULL"
+	case 15:
+		return "MX"
 	case 16:
 		return "TXT"
+	case 28:
+		return "AAAA"
 	default:
 		return "UNKNOWN"
 	}
@@ -2,11 +2,14 @@ package web
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 	"youkaidns/server"
 	"youkaidns/stats"
 )
@@ -15,6 +18,7 @@ import (
 type API struct {
 	stats     *stats.Stats
 	dnsServer *server.Server
+	audit     *server.AuditLog // Where requests denied for their role are recorded
 }
 
 // NewAPI creates a new API handler
@@ -25,17 +29,41 @@ func NewAPI(s *stats.Stats, dnsServer *server.Server) *API {
 	}
 }
 
-// HandleStats returns statistics as JSON
+// require reports whether the request's role allows what a handler needs,
+// answering 403 Forbidden and recording the attempt if not
+func (a *API) require(w http.ResponseWriter, r *http.Request, required Role) bool {
+	name, role := requestRole(r)
+	if role.allows(required) {
+		return true
+	}
+
+	a.audit.Record(server.AuditEvent{
+		Source:  clientHost(r),
+		Service: "web",
+		Target:  r.Method + " " + r.URL.Path,
+		Reason:  fmt.Sprintf("%s (%s) needs the %s role", name, role, required),
+	})
+	http.Error(w, "Forbidden: needs the "+string(required)+" role", http.StatusForbidden)
+	return false
+}
+
+// HandleStats returns statistics as JSON, for one served domain if the
+// domain parameter is set
 func (a *API) HandleStats(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if !a.require(w, r, RoleViewer) {
+		return
+	}
 
 	snapshot := a.stats.GetSnapshot()
+	if domain := r.URL.Query().Get("domain"); domain != "" {
+		snapshot = a.stats.DomainSnapshot(strings.ToLower(domain))
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 
 	if err := json.NewEncoder(w).Encode(snapshot); err != nil {
 		http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
@@ -43,22 +71,25 @@ func (a *API) HandleStats(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// HandleTransfers returns file transfer progress as JSON
+// HandleTransfers returns file transfer progress as JSON (optional domain
+// parameter)
 func (a *API) HandleTransfers(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if !a.require(w, r, RoleViewer) {
+		return
+	}
 
 	if a.dnsServer == nil {
 		http.Error(w, "DNS server not available", http.StatusInternalServerError)
 		return
 	}
 
-	transfers := a.dnsServer.GetFileTransfers()
+	transfers := a.dnsServer.GetFileTransfers(r.URL.Query().Get("domain"))
 
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 
 	if err := json.NewEncoder(w).Encode(transfers); err != nil {
 		http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
@@ -66,26 +97,52 @@ func (a *API) HandleTransfers(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// HandleFiles returns list of received files as JSON
+// HandleFiles returns list of received files as JSON (GET, optional domain
+// parameter) or deletes one (DELETE with file and optional domain parameters)
 func (a *API) HandleFiles(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	required := RoleViewer
+	if r.Method == http.MethodDelete {
+		required = RoleOperator
+	}
+	if !a.require(w, r, required) {
+		return
+	}
 
 	if a.dnsServer == nil {
 		http.Error(w, "DNS server not available", http.StatusInternalServerError)
 		return
 	}
 
-	files, err := a.dnsServer.GetReceivedFiles()
+	if r.Method == http.MethodDelete {
+		domain := r.URL.Query().Get("domain")
+		if _, exists := a.dnsServer.GetOutputDir(domain); !exists {
+			http.Error(w, "Unknown domain", http.StatusNotFound)
+			return
+		}
+		err := a.dnsServer.DeleteReceivedFile(domain, r.URL.Query().Get("file"))
+		if errors.Is(err, server.ErrFileNotFound) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Error deleting file: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	files, err := a.dnsServer.GetReceivedFiles(r.URL.Query().Get("domain"))
 	if err != nil {
 		http.Error(w, "Error reading files: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 
 	if err := json.NewEncoder(w).Encode(files); err != nil {
 		http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
@@ -93,12 +150,139 @@ func (a *API) HandleFiles(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// HandleDownload serves a file for download
+// HandleOutbox lists the files offered for download over DNS as JSON (GET),
+// adds one (POST with the file as the body and a name parameter) or removes
+// one (DELETE with a name parameter)
+func (a *API) HandleOutbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	required := RoleViewer
+	if r.Method != http.MethodGet {
+		required = RoleOperator
+	}
+	if !a.require(w, r, required) {
+		return
+	}
+
+	if a.dnsServer == nil {
+		http.Error(w, "DNS server not available", http.StatusInternalServerError)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	var result interface{}
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodPost:
+		limit := a.dnsServer.OutboxUploadLimit()
+		file, err := a.dnsServer.SaveOutboxFile(name, http.MaxBytesReader(w, r.Body, limit))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) || errors.Is(err, server.ErrOutboxFileTooLarge) {
+			http.Error(w, fmt.Sprintf("File larger than %d bytes", limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Error saving file: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		result = file
+		status = http.StatusCreated
+	case http.MethodDelete:
+		err := a.dnsServer.DeleteOutboxFile(name)
+		if errors.Is(err, server.ErrFileNotFound) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Error deleting file: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		result = a.dnsServer.GetOutboxFiles()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+// HandleHistory returns the transfer history catalog as JSON
+// Query parameters: hash, domain, filename, source, status, since, until (RFC3339), limit
+func (a *API) HandleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.require(w, r, RoleViewer) {
+		return
+	}
+
+	if a.dnsServer == nil {
+		http.Error(w, "DNS server not available", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := server.HistoryFilter{
+		Hash:     query.Get("hash"),
+		Domain:   query.Get("domain"),
+		Filename: query.Get("filename"),
+		SourceIP: query.Get("source"),
+		Status:   query.Get("status"),
+	}
+
+	var err error
+	if since := query.Get("since"); since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			http.Error(w, "Invalid since parameter (want RFC3339)", http.StatusBadRequest)
+			return
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			http.Error(w, "Invalid until parameter (want RFC3339)", http.StatusBadRequest)
+			return
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit < 0 {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	history, err := a.dnsServer.GetHistory(filter)
+	if err != nil {
+		http.Error(w, "Error reading history: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(history); err != nil {
+		http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+// HandleDownload serves a file for download from the output directory of
+// the domain parameter (the primary domain if not set)
 func (a *API) HandleDownload(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if !a.require(w, r, RoleOperator) {
+		return
+	}
 
 	if a.dnsServer == nil {
 		http.Error(w, "DNS server not available", http.StatusInternalServerError)
@@ -118,7 +302,11 @@ func (a *API) HandleDownload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	outputDir := a.dnsServer.GetOutputDir()
+	outputDir, exists := a.dnsServer.GetOutputDir(r.URL.Query().Get("domain"))
+	if !exists {
+		http.Error(w, "Unknown domain", http.StatusNotFound)
+		return
+	}
 	filePath := filepath.Join(outputDir, filename)
 
 	// Check if file exists
@@ -127,6 +315,10 @@ func (a *API) HandleDownload(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
+	if info.IsDir() {
+		http.Error(w, "Bundles are unpacked on the server and can't be downloaded", http.StatusBadRequest)
+		return
+	}
 
 	// Set headers for file download
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
@@ -137,3 +329,257 @@ func (a *API) HandleDownload(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, filePath)
 }
 
+// HandleDomains returns the served domains as JSON
+func (a *API) HandleDomains(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.require(w, r, RoleViewer) {
+		return
+	}
+
+	if a.dnsServer == nil {
+		http.Error(w, "DNS server not available", http.StatusInternalServerError)
+		return
+	}
+
+	domains := a.dnsServer.GetDomains()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(domains); err != nil {
+		http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+// HandleHosts returns the sending hosts as JSON
+func (a *API) HandleHosts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.require(w, r, RoleViewer) {
+		return
+	}
+
+	if a.dnsServer == nil {
+		http.Error(w, "DNS server not available", http.StatusInternalServerError)
+		return
+	}
+
+	hosts := a.dnsServer.GetHosts()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(hosts); err != nil {
+		http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+// HandleSessions returns the agent sessions as JSON
+func (a *API) HandleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.require(w, r, RoleViewer) {
+		return
+	}
+
+	if a.dnsServer == nil {
+		http.Error(w, "DNS server not available", http.StatusInternalServerError)
+		return
+	}
+
+	sessions := a.dnsServer.GetSessions()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(sessions); err != nil {
+		http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+// HandleTasks lists tasks (GET, optional agent parameter) or queues one
+// (POST with a JSON body {"agent": "<id>", "command": "<text>"})
+func (a *API) HandleTasks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	required := RoleViewer
+	if r.Method == http.MethodPost {
+		required = RoleOperator
+	}
+	if !a.require(w, r, required) {
+		return
+	}
+
+	if a.dnsServer == nil {
+		http.Error(w, "DNS server not available", http.StatusInternalServerError)
+		return
+	}
+
+	var result interface{}
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		var req struct {
+			Agent   string `json:"agent"`
+			Command string `json:"command"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+
+		task, err := a.dnsServer.QueueTask(req.Agent, req.Command)
+		if errors.Is(err, server.ErrUnknownAgent) {
+			http.Error(w, "Unknown agent", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, server.ErrTooManyTasks) {
+			http.Error(w, "Too many queued tasks", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Invalid task: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		result = task
+		status = http.StatusCreated
+	} else {
+		result = a.dnsServer.GetTasks(r.URL.Query().Get("agent"))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+// HandleTaskResult serves the result file of a completed task
+func (a *API) HandleTaskResult(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.require(w, r, RoleOperator) {
+		return
+	}
+
+	if a.dnsServer == nil {
+		http.Error(w, "DNS server not available", http.StatusInternalServerError)
+		return
+	}
+
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Missing or invalid id parameter", http.StatusBadRequest)
+		return
+	}
+	task, exists := a.dnsServer.GetTask(id)
+	if !exists {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+	if task.ResultFile == "" {
+		http.Error(w, "Task has no result yet", http.StatusNotFound)
+		return
+	}
+
+	outputDir, exists := a.dnsServer.GetOutputDir(task.Domain)
+	if !exists {
+		http.Error(w, "Result file not found", http.StatusNotFound)
+		return
+	}
+	filePath := filepath.Join(outputDir, task.ResultFile)
+	info, err := os.Stat(filePath)
+	if err != nil {
+		http.Error(w, "Result file not found", http.StatusNotFound)
+		return
+	}
+	if info.IsDir() {
+		http.Error(w, "Bundles are unpacked on the server and can't be downloaded", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", task.ResultFile))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", info.Size()))
+
+	http.ServeFile(w, r, filePath)
+}
+
+// HandleZone lists the zone records as JSON (GET), adds one (POST with a JSON
+// body {"name": "www", "type": "A", "value": "192.0.2.1"}) or removes those
+// with a name and type (DELETE with name, type and optional value parameters)
+func (a *API) HandleZone(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	required := RoleViewer
+	if r.Method != http.MethodGet {
+		required = RoleOperator
+	}
+	if !a.require(w, r, required) {
+		return
+	}
+
+	if a.dnsServer == nil {
+		http.Error(w, "DNS server not available", http.StatusInternalServerError)
+		return
+	}
+
+	var result interface{}
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodPost:
+		var req server.ZoneRecord
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		record, err := a.dnsServer.AddZoneRecord(req)
+		if err != nil {
+			http.Error(w, "Invalid record: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		result = record
+		status = http.StatusCreated
+	case http.MethodDelete:
+		query := r.URL.Query()
+		_, err := a.dnsServer.RemoveZoneRecord(server.ZoneRecord{
+			Name:  query.Get("name"),
+			Type:  query.Get("type"),
+			Value: query.Get("value"),
+		})
+		if errors.Is(err, server.ErrRecordNotFound) {
+			http.Error(w, "Record not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Invalid record: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		result = a.dnsServer.GetZoneRecords()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,149 @@
+package web
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"youkaidns/server"
+)
+
+// request builds a dashboard request with a session cookie and CSRF token
+func request(cookie *http.Cookie, csrf string, method string, target string, body io.Reader) *http.Request {
+	r := httptest.NewRequest(method, target, body)
+	r.AddCookie(cookie)
+	if csrf != "" {
+		r.Header.Set(csrfHeader, csrf)
+	}
+	return r
+}
+
+// outboxNames lists the outbox through the API
+func outboxNames(t *testing.T, s *Server, cookie *http.Cookie) []string {
+	t.Helper()
+	w := serve(s, request(cookie, "", http.MethodGet, "/api/outbox", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET outbox: status %d", w.Code)
+	}
+	var files []server.OutboxFile
+	if err := json.NewDecoder(w.Body).Decode(&files); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	return names
+}
+
+func TestOutboxAPI(t *testing.T) {
+	s := newAuthServer(t)
+	dir := filepath.Join(t.TempDir(), "outbox")
+	s.dnsServer.SetOutboxDir(dir)
+	cookie, csrf := login(t, s, "admin")
+
+	if w := serve(s, request(cookie, csrf, http.MethodPost, "/api/outbox?name=notes.txt", strings.NewReader("notes"))); w.Code != http.StatusCreated {
+		t.Fatalf("upload: status %d", w.Code)
+	}
+
+	// Files dropped into the directory are listed without a restart
+	if err := os.WriteFile(filepath.Join(dir, "dropped.txt"), []byte("dropped"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if names := outboxNames(t, s, cookie); strings.Join(names, ",") != "dropped.txt,notes.txt" {
+		t.Fatalf("outbox lists %v", names)
+	}
+
+	if w := serve(s, request(cookie, csrf, http.MethodDelete, "/api/outbox?name=dropped.txt", nil)); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: status %d", w.Code)
+	}
+	if w := serve(s, request(cookie, csrf, http.MethodDelete, "/api/outbox?name=dropped.txt", nil)); w.Code != http.StatusNotFound {
+		t.Fatalf("second delete: status %d", w.Code)
+	}
+	if names := outboxNames(t, s, cookie); strings.Join(names, ",") != "notes.txt" {
+		t.Fatalf("outbox lists %v after the delete", names)
+	}
+
+	// Uploads are capped at the configured limit
+	s.dnsServer.SetOutboxUploadLimit(4)
+	if w := serve(s, request(cookie, csrf, http.MethodPost, "/api/outbox?name=big.txt", strings.NewReader("12345"))); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("upload over the limit: status %d", w.Code)
+	}
+	if w := serve(s, request(cookie, csrf, http.MethodPost, "/api/outbox?name=small.txt", strings.NewReader("1234"))); w.Code != http.StatusCreated {
+		t.Fatalf("upload at the limit: status %d", w.Code)
+	}
+	if names := outboxNames(t, s, cookie); strings.Join(names, ",") != "notes.txt,small.txt" {
+		t.Fatalf("outbox lists %v after the capped uploads", names)
+	}
+}
+
+func TestOperatorEndpoints(t *testing.T) {
+	s := newAuthServer(t)
+	s.dnsServer.SetOutboxDir(filepath.Join(t.TempDir(), "outbox"))
+	operator, operatorCSRF := login(t, s, "admin")
+	viewer, viewerCSRF := login(t, s, "watcher")
+
+	targets := []struct {
+		method string
+		target string
+	}{
+		{http.MethodPost, "/api/outbox?name=notes.txt"},
+		{http.MethodDelete, "/api/outbox?name=notes.txt"},
+		{http.MethodDelete, "/api/files?file=report.txt"},
+	}
+	for _, tt := range targets {
+		name := tt.method + " " + tt.target
+		if w := serve(s, request(viewer, viewerCSRF, tt.method, tt.target, strings.NewReader("x"))); w.Code != http.StatusForbidden {
+			t.Errorf("%s as a viewer: status %d", name, w.Code)
+		}
+		if w := serve(s, request(operator, "not-the-token", tt.method, tt.target, strings.NewReader("x"))); w.Code != http.StatusForbidden {
+			t.Errorf("%s with a bad CSRF token: status %d", name, w.Code)
+		}
+		if w := serve(s, request(operator, operatorCSRF, tt.method, tt.target, strings.NewReader("x"))); w.Code == http.StatusForbidden {
+			t.Errorf("%s as an operator: forbidden", name)
+		}
+	}
+}
+
+func TestRejectsPathNames(t *testing.T) {
+	s := newAuthServer(t)
+	root := t.TempDir()
+	outbox := filepath.Join(root, "outbox")
+	s.dnsServer.SetOutboxDir(outbox)
+	outputDir, _ := s.dnsServer.GetOutputDir("")
+	if err := os.MkdirAll(filepath.Join(outputDir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{filepath.Join(root, "kept.txt"), filepath.Join(outputDir, "sub", "kept.txt")} {
+		if err := os.WriteFile(path, []byte("kept"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cookie, csrf := login(t, s, "admin")
+
+	for _, name := range []string{"../kept.txt", "sub/kept.txt", `..\kept.txt`, "/etc/passwd"} {
+		target := "/api/outbox?name=" + url.QueryEscape(name)
+		if w := serve(s, request(cookie, csrf, http.MethodPost, target, strings.NewReader("overwritten"))); w.Code != http.StatusBadRequest {
+			t.Errorf("upload as %q: status %d", name, w.Code)
+		}
+		if w := serve(s, request(cookie, csrf, http.MethodDelete, target, nil)); w.Code != http.StatusBadRequest {
+			t.Errorf("outbox delete of %q: status %d", name, w.Code)
+		}
+		target = "/api/files?file=" + url.QueryEscape(name)
+		if w := serve(s, request(cookie, csrf, http.MethodDelete, target, nil)); w.Code != http.StatusBadRequest {
+			t.Errorf("file delete of %q: status %d", name, w.Code)
+		}
+	}
+
+	for _, path := range []string{filepath.Join(root, "kept.txt"), filepath.Join(outputDir, "sub", "kept.txt")} {
+		if data, err := os.ReadFile(path); err != nil || string(data) != "kept" {
+			t.Errorf("%s changed: %q, %v", path, data, err)
+		}
+	}
+}
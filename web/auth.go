@@ -0,0 +1,388 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"youkaidns/config"
+	"youkaidns/server"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Session cookie and CSRF header names
+const (
+	sessionCookie = "youkaidns_session"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+// DefaultSessionTTL is how long a dashboard login lasts by default
+const DefaultSessionTTL = 12 * time.Hour
+
+// Role is what a user or token may do
+type Role string
+
+// Roles, each allowed everything the one before is
+const (
+	RoleViewer   Role = "viewer"   // Watch stats, transfers, hosts and history
+	RoleOperator Role = "operator" // Also download files and results, queue tasks and change what the server sends
+)
+
+// ParseRole parses a role name, viewer if empty
+func ParseRole(name string) (Role, error) {
+	switch role := Role(strings.ToLower(name)); role {
+	case "":
+		return RoleViewer, nil
+	case RoleViewer, RoleOperator:
+		return role, nil
+	default:
+		return "", fmt.Errorf("unknown role %q (want viewer or operator)", name)
+	}
+}
+
+// allows reports whether role may do what required needs
+func (role Role) allows(required Role) bool {
+	return role == RoleOperator || required == RoleViewer
+}
+
+// account is a user's or token's credential and role
+type account struct {
+	name   string
+	secret []byte // bcrypt hash for users
+	role   Role
+}
+
+// Auth holds the dashboard users, API tokens and login sessions
+type Auth struct {
+	users  map[string]account // username -> user
+	tokens map[string]account // hex SHA-256 of a token -> token
+	ttl    time.Duration
+
+	sessions  map[string]*session // session ID -> session
+	sessionMu sync.Mutex
+}
+
+// session is a dashboard login. Its CSRF token must accompany every request
+// that changes something.
+type session struct {
+	user    string
+	role    Role
+	csrf    string
+	expires time.Time
+}
+
+// identity is who made an authenticated request
+type identity struct {
+	name    string
+	role    Role
+	session *session // nil for API tokens
+}
+
+// identityKey keys the identity in request contexts
+type identityKey struct{}
+
+// dummyHash is compared against for unknown users, so a login takes as long
+// whether or not the user exists
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("youkaidns"), bcrypt.DefaultCost)
+	return hash
+})
+
+// NewAuth returns the authentication for the configured users and tokens.
+// Logins last ttl (DefaultSessionTTL if 0).
+func NewAuth(cfg *config.AuthConfig, ttl time.Duration) (*Auth, error) {
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+	a := &Auth{
+		users:    make(map[string]account),
+		tokens:   make(map[string]account),
+		ttl:      ttl,
+		sessions: make(map[string]*session),
+	}
+	for _, u := range cfg.Users {
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("user %s: invalid bcrypt hash: %v", u.Username, err)
+		}
+		if _, exists := a.users[u.Username]; exists {
+			return nil, fmt.Errorf("user %s is listed twice", u.Username)
+		}
+		role, err := ParseRole(u.Role)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %v", u.Username, err)
+		}
+		a.users[u.Username] = account{name: u.Username, secret: []byte(u.PasswordHash), role: role}
+	}
+	for _, t := range cfg.Tokens {
+		sum := strings.ToLower(t.SHA256)
+		if _, err := hex.DecodeString(sum); err != nil {
+			return nil, fmt.Errorf("token %s: invalid sha256", t.Name)
+		}
+		role, err := ParseRole(t.Role)
+		if err != nil {
+			return nil, fmt.Errorf("token %s: %v", t.Name, err)
+		}
+		a.tokens[sum] = account{name: t.Name, role: role}
+	}
+	return a, nil
+}
+
+// HashPassword returns the bcrypt hash of a password for the auth config
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// login checks a username and password and starts a session
+func (a *Auth) login(username string, password string) (string, *session, bool) {
+	user, exists := a.users[username]
+	if !exists {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return "", nil, false
+	}
+	if bcrypt.CompareHashAndPassword(user.secret, []byte(password)) != nil {
+		return "", nil, false
+	}
+
+	id, csrf := randomToken(), randomToken()
+	now := time.Now()
+	s := &session{user: username, role: user.role, csrf: csrf, expires: now.Add(a.ttl)}
+
+	a.sessionMu.Lock()
+	defer a.sessionMu.Unlock()
+	for sid, old := range a.sessions {
+		if now.After(old.expires) {
+			delete(a.sessions, sid)
+		}
+	}
+	a.sessions[id] = s
+	return id, s, true
+}
+
+// logout ends a session
+func (a *Auth) logout(id string) {
+	a.sessionMu.Lock()
+	defer a.sessionMu.Unlock()
+	delete(a.sessions, id)
+}
+
+// session returns the live session of a request's cookie
+func (a *Auth) session(r *http.Request) (string, *session) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return "", nil
+	}
+
+	a.sessionMu.Lock()
+	defer a.sessionMu.Unlock()
+	s, exists := a.sessions[cookie.Value]
+	if !exists {
+		return "", nil
+	}
+	if time.Now().After(s.expires) {
+		delete(a.sessions, cookie.Value)
+		return "", nil
+	}
+	return cookie.Value, s
+}
+
+// authenticate identifies a request by its bearer token or session cookie
+func (a *Auth) authenticate(r *http.Request) (identity, bool) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		token, found := strings.CutPrefix(header, "Bearer ")
+		if !found {
+			return identity{}, false
+		}
+		sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+		t, exists := a.tokens[hex.EncodeToString(sum[:])]
+		if !exists {
+			return identity{}, false
+		}
+		return identity{name: "token:" + t.name, role: t.role}, true
+	}
+
+	if _, s := a.session(r); s != nil {
+		return identity{name: s.user, role: s.role, session: s}, true
+	}
+	return identity{}, false
+}
+
+// randomToken returns 32 random bytes in hex
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// safeMethod reports whether a request method can't change anything
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// SetAuth requires a login or API token for the API. It must be called before
+// Start.
+func (s *Server) SetAuth(auth *Auth) {
+	s.auth = auth
+}
+
+// authenticate wraps a handler so API requests need a bearer token or a
+// session cookie, and session requests that change something need the
+// session's CSRF token. The dashboard page, static files and the login and
+// session endpoints stay open.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	if s.auth == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == "/api/login" || r.URL.Path == "/api/session" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id, ok := s.auth.authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="youkaidns"`)
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		if id.session != nil && !safeMethod(r.Method) && !validCSRF(r, id.session) {
+			http.Error(w, "Missing or invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+	})
+}
+
+// validCSRF reports whether a request carries its session's CSRF token
+func validCSRF(r *http.Request, s *session) bool {
+	token := r.Header.Get(csrfHeader)
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.csrf)) == 1
+}
+
+// requestRole returns the role of an API request; without authentication
+// every request may do anything
+func requestRole(r *http.Request) (string, Role) {
+	id, ok := r.Context().Value(identityKey{}).(identity)
+	if !ok {
+		return "", RoleOperator
+	}
+	return id.name, id.role
+}
+
+// sessionInfo is what the dashboard learns about its login
+type sessionInfo struct {
+	AuthRequired bool   `json:"auth_required"`
+	Username     string `json:"username,omitempty"`
+	Role         Role   `json:"role"`
+	CSRFToken    string `json:"csrf_token,omitempty"`
+}
+
+// handleLogin starts a session (POST with a JSON body {"username": "...",
+// "password": "..."}) and sets the session cookie
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.auth == nil {
+		http.Error(w, "Authentication is not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	id, sess, ok := s.auth.login(req.Username, req.Password)
+	if !ok {
+		s.audit.Record(server.AuditEvent{
+			Source:  clientHost(r),
+			Service: "web",
+			Target:  r.Method + " " + r.URL.Path,
+			Reason:  fmt.Sprintf("login failed for %q", req.Username),
+		})
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	log.Printf("Dashboard login: %s (%s)", sess.user, sess.role)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		Expires:  sess.expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	writeSessionInfo(w, sessionInfo{AuthRequired: true, Username: sess.user, Role: sess.role, CSRFToken: sess.csrf})
+}
+
+// handleLogout ends the session of the request (POST with the CSRF token)
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.auth != nil {
+		if id, sess := s.auth.session(r); sess != nil {
+			s.auth.logout(id)
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSession tells the dashboard whether it must log in, and if logged in
+// as whom, with the CSRF token to send
+func (s *Server) handleSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.auth == nil {
+		writeSessionInfo(w, sessionInfo{Role: RoleOperator})
+		return
+	}
+
+	_, sess := s.auth.session(r)
+	if sess == nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	writeSessionInfo(w, sessionInfo{AuthRequired: true, Username: sess.user, Role: sess.role, CSRFToken: sess.csrf})
+}
+
+// writeSessionInfo writes session info as JSON
+func writeSessionInfo(w http.ResponseWriter, info sessionInfo) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
+	}
+}
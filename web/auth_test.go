@@ -0,0 +1,257 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"youkaidns/config"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Test logins and tokens of newAuthServer
+const (
+	testPassword      = "correct horse"
+	testOperatorToken = "operator-token"
+	testViewerToken   = "viewer-token"
+)
+
+// newAuthServer returns a test dashboard with the users admin (operator) and
+// watcher (viewer) and an operator and a viewer token
+func newAuthServer(t *testing.T) *Server {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenHash := func(token string) string {
+		sum := sha256.Sum256([]byte(token))
+		return hex.EncodeToString(sum[:])
+	}
+	auth, err := NewAuth(&config.AuthConfig{
+		Users: []config.UserConfig{
+			{Username: "admin", PasswordHash: string(hash), Role: "operator"},
+			{Username: "watcher", PasswordHash: string(hash)},
+		},
+		Tokens: []config.TokenConfig{
+			{Name: "ci", SHA256: tokenHash(testOperatorToken), Role: "operator"},
+			{Name: "grafana", SHA256: tokenHash(testViewerToken), Role: "viewer"},
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer(t)
+	s.SetAuth(auth)
+	return s
+}
+
+// login logs in and returns the session cookie and CSRF token
+func login(t *testing.T, s *Server, username string) (*http.Cookie, string) {
+	t.Helper()
+	body := `{"username": "` + username + `", "password": "` + testPassword + `"}`
+	w := serve(s, httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("login as %s: status %d", username, w.Code)
+	}
+	var info sessionInfo
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookie || !cookies[0].HttpOnly || info.CSRFToken == "" {
+		t.Fatalf("login as %s: cookies %v, session %+v", username, cookies, info)
+	}
+	return cookies[0], info.CSRFToken
+}
+
+// queueTask is a POST that passes authentication and fails after it, with
+// 404 for the unknown agent
+func queueTask() *http.Request {
+	return httptest.NewRequest(http.MethodPost, "/api/tasks", strings.NewReader(`{"agent": "nobody", "command": "id"}`))
+}
+
+func TestLogin(t *testing.T) {
+	s := newAuthServer(t)
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"bad password", `{"username": "admin", "password": "wrong"}`, http.StatusUnauthorized},
+		{"unknown user", `{"username": "nobody", "password": "` + testPassword + `"}`, http.StatusUnauthorized},
+		{"empty password", `{"username": "admin"}`, http.StatusUnauthorized},
+		{"bad JSON", `{"username": `, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := serve(s, httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(tt.body)))
+		if w.Code != tt.want || len(w.Result().Cookies()) != 0 {
+			t.Errorf("%s: status %d with %d cookies, want %d without", tt.name, w.Code, len(w.Result().Cookies()), tt.want)
+		}
+	}
+	if w := serve(s, httptest.NewRequest(http.MethodGet, "/api/login", nil)); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET login: status %d", w.Code)
+	}
+
+	cookie, csrf := login(t, s, "admin")
+	r := httptest.NewRequest(http.MethodGet, "/api/session", nil)
+	r.AddCookie(cookie)
+	w := serve(s, r)
+	var info sessionInfo
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if want := (sessionInfo{AuthRequired: true, Username: "admin", Role: RoleOperator, CSRFToken: csrf}); info != want {
+		t.Fatalf("session %+v, want %+v", info, want)
+	}
+
+	// Logging out ends the session
+	r = httptest.NewRequest(http.MethodPost, "/api/logout", nil)
+	r.AddCookie(cookie)
+	r.Header.Set(csrfHeader, csrf)
+	if w := serve(s, r); w.Code != http.StatusNoContent {
+		t.Fatalf("logout: status %d", w.Code)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/api/stats", nil)
+	r.AddCookie(cookie)
+	if w := serve(s, r); w.Code != http.StatusUnauthorized {
+		t.Fatalf("after logout: status %d", w.Code)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	s := newAuthServer(t)
+	cookie, _ := login(t, s, "watcher")
+
+	r := httptest.NewRequest(http.MethodGet, "/api/stats", nil)
+	r.AddCookie(cookie)
+	if w := serve(s, r); w.Code != http.StatusOK {
+		t.Fatalf("live session: status %d", w.Code)
+	}
+
+	s.auth.sessionMu.Lock()
+	s.auth.sessions[cookie.Value].expires = time.Now().Add(-time.Second)
+	s.auth.sessionMu.Unlock()
+
+	for _, path := range []string{"/api/stats", "/api/session"} {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.AddCookie(cookie)
+		if w := serve(s, r); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s with an expired session: status %d", path, w.Code)
+		}
+	}
+	s.auth.sessionMu.Lock()
+	_, kept := s.auth.sessions[cookie.Value]
+	s.auth.sessionMu.Unlock()
+	if kept {
+		t.Fatal("expired session kept")
+	}
+
+	// A made-up session ID is no better
+	r = httptest.NewRequest(http.MethodGet, "/api/stats", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: randomToken()})
+	if w := serve(s, r); w.Code != http.StatusUnauthorized {
+		t.Fatalf("unknown session: status %d", w.Code)
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	s := newAuthServer(t)
+	cookie, csrf := login(t, s, "admin")
+	_, otherCSRF := login(t, s, "admin")
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"missing", "", http.StatusForbidden},
+		{"wrong", "not-the-token", http.StatusForbidden},
+		{"another session's", otherCSRF, http.StatusForbidden},
+		{"valid", csrf, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		r := queueTask()
+		r.AddCookie(cookie)
+		if tt.token != "" {
+			r.Header.Set(csrfHeader, tt.token)
+		}
+		if w := serve(s, r); w.Code != tt.want {
+			t.Errorf("%s CSRF token: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+
+	// Reads don't need it
+	r := httptest.NewRequest(http.MethodGet, "/api/tasks", nil)
+	r.AddCookie(cookie)
+	if w := serve(s, r); w.Code != http.StatusOK {
+		t.Fatalf("GET without CSRF token: status %d", w.Code)
+	}
+}
+
+func TestBearerTokens(t *testing.T) {
+	s := newAuthServer(t)
+
+	tests := []struct {
+		name   string
+		header string
+		r      *http.Request
+		want   int
+	}{
+		{"no credentials", "", httptest.NewRequest(http.MethodGet, "/api/stats", nil), http.StatusUnauthorized},
+		{"unknown token", "Bearer nope", httptest.NewRequest(http.MethodGet, "/api/stats", nil), http.StatusUnauthorized},
+		{"not bearer", "Basic " + testOperatorToken, httptest.NewRequest(http.MethodGet, "/api/stats", nil), http.StatusUnauthorized},
+		{"viewer reads", "Bearer " + testViewerToken, httptest.NewRequest(http.MethodGet, "/api/stats", nil), http.StatusOK},
+		{"viewer queues", "Bearer " + testViewerToken, queueTask(), http.StatusForbidden},
+		// Tokens aren't sent by browsers on their own, so they need no CSRF token
+		{"operator queues", "Bearer " + testOperatorToken, queueTask(), http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if tt.header != "" {
+			tt.r.Header.Set("Authorization", tt.header)
+		}
+		w := serve(s, tt.r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no WWW-Authenticate challenge", tt.name)
+		}
+	}
+
+	// The dashboard page and login stay open
+	if w := serve(s, httptest.NewRequest(http.MethodGet, "/", nil)); w.Code != http.StatusOK {
+		t.Fatalf("dashboard: status %d", w.Code)
+	}
+}
+
+func TestNewAuthRejects(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := config.UserConfig{Username: "admin", PasswordHash: string(hash)}
+
+	tests := []struct {
+		name string
+		cfg  config.AuthConfig
+	}{
+		{"plain password", config.AuthConfig{Users: []config.UserConfig{{Username: "admin", PasswordHash: testPassword}}}},
+		{"duplicate user", config.AuthConfig{Users: []config.UserConfig{user, user}}},
+		{"unknown role", config.AuthConfig{Users: []config.UserConfig{{Username: "admin", PasswordHash: string(hash), Role: "root"}}}},
+		{"token not hex", config.AuthConfig{Tokens: []config.TokenConfig{{Name: "ci", SHA256: "zz"}}}},
+	}
+	for _, tt := range tests {
+		if _, err := NewAuth(&tt.cfg, 0); err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+}
@@ -1,11 +1,14 @@
 package web
 
 import (
+	"crypto/tls"
 	"embed"
 	"fmt"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"strings"
 	"youkaidns/server"
 	"youkaidns/stats"
 )
@@ -20,18 +23,53 @@ type Server struct {
 	stats     *stats.Stats
 	dnsServer *server.Server
 	mux       *http.ServeMux
+	api       *API
+
+	// Clients allowed to use the dashboard and API, and where denied
+	// requests are recorded
+	acl   *server.ACL
+	audit *server.AuditLog
+
+	// Logins and API tokens (nil leaves the API open), and the origins
+	// allowed to call the API from other sites
+	auth        *Auth
+	corsOrigins []string
+
+	// HTTPS settings, nil to serve plain HTTP
+	tls *TLSConfig
 }
 
 // NewServer creates a new web server
 func NewServer(port int, s *stats.Stats, listenIP string, dnsServer *server.Server) *Server {
 	api := NewAPI(s, dnsServer)
 	mux := http.NewServeMux()
+	srv := &Server{
+		port:      port,
+		listenIP:  listenIP,
+		stats:     s,
+		dnsServer: dnsServer,
+		mux:       mux,
+		api:       api,
+	}
+
+	// Login endpoints
+	mux.HandleFunc("/api/login", srv.handleLogin)
+	mux.HandleFunc("/api/logout", srv.handleLogout)
+	mux.HandleFunc("/api/session", srv.handleSession)
 
 	// API endpoints
 	mux.HandleFunc("/api/stats", api.HandleStats)
 	mux.HandleFunc("/api/transfers", api.HandleTransfers)
 	mux.HandleFunc("/api/files", api.HandleFiles)
 	mux.HandleFunc("/api/download", api.HandleDownload)
+	mux.HandleFunc("/api/history", api.HandleHistory)
+	mux.HandleFunc("/api/outbox", api.HandleOutbox)
+	mux.HandleFunc("/api/zone", api.HandleZone)
+	mux.HandleFunc("/api/domains", api.HandleDomains)
+	mux.HandleFunc("/api/hosts", api.HandleHosts)
+	mux.HandleFunc("/api/sessions", api.HandleSessions)
+	mux.HandleFunc("/api/tasks", api.HandleTasks)
+	mux.HandleFunc("/api/tasks/result", api.HandleTaskResult)
 
 	// Static files (embedded)
 	staticFS, err := fs.Sub(staticFiles, "static")
@@ -43,20 +81,122 @@ func NewServer(port int, s *stats.Stats, listenIP string, dnsServer *server.Serv
 	mux.Handle("/static/", http.StripPrefix("/static/", fs))
 	mux.HandleFunc("/", serveDashboard)
 
-	return &Server{
-		port:      port,
-		listenIP:  listenIP,
-		stats:     s,
-		dnsServer: dnsServer,
-		mux:       mux,
-	}
+	return srv
+}
+
+// SetACL restricts the dashboard and API to the clients acl permits; other
+// clients get 403 Forbidden and are recorded in audit. It must be called
+// before Start.
+func (s *Server) SetACL(acl *server.ACL, audit *server.AuditLog) {
+	s.acl = acl
+	s.audit = audit
+	s.api.audit = audit
 }
 
-// Start starts the web server
+// Start starts the web server, over HTTPS if SetTLS was called
 func (s *Server) Start() error {
 	addr := fmt.Sprintf("%s:%d", s.listenIP, s.port)
-	log.Printf("Web dashboard listening on http://%s", addr)
-	return http.ListenAndServe(addr, s.mux)
+	handler := s.handler()
+	if s.tls == nil {
+		log.Printf("Web dashboard listening on http://%s", addr)
+		return http.ListenAndServe(addr, handler)
+	}
+
+	if s.tls.RedirectPort > 0 {
+		go s.serveRedirect()
+	}
+	log.Printf("Web dashboard listening on https://%s", addr)
+	srv := &http.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+	return srv.ListenAndServeTLS(s.tls.CertFile, s.tls.KeyFile)
+}
+
+// handler returns the dashboard and API behind the ACL, CORS and login checks
+func (s *Server) handler() http.Handler {
+	return s.restrict(s.cors(s.authenticate(s.mux)))
+}
+
+// SetCORS sets the origins (scheme://host[:port]) whose pages may call the
+// API, "*" for any. Without any, only the dashboard's own origin can. It
+// must be called before Start.
+func (s *Server) SetCORS(origins []string) {
+	s.corsOrigins = origins
+}
+
+// cors wraps a handler with the CORS policy. Cross-origin callers are
+// expected to use bearer tokens, so credentials (cookies) are never allowed.
+func (s *Server) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+
+		allowed := ""
+		for _, o := range s.corsOrigins {
+			if o == "*" || strings.EqualFold(o, origin) {
+				allowed = o
+				break
+			}
+		}
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if allowed == "" {
+			if preflight {
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if allowed != "*" {
+			allowed = origin
+		}
+		w.Header().Set("Access-Control-Allow-Origin", allowed)
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// restrict wraps a handler with the ACL check
+func (s *Server) restrict(next http.Handler) http.Handler {
+	if s.acl == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := clientHost(r)
+		if !s.acl.Permits(net.ParseIP(host)) {
+			s.audit.Record(server.AuditEvent{
+				Source:  host,
+				Service: "web",
+				Target:  r.Method + " " + r.URL.Path,
+				Reason:  "denied by ACL",
+			})
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientHost returns the IP address a request came from
+func clientHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
 // serveDashboard serves the dashboard HTML
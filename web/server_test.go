@@ -0,0 +1,90 @@
+package web
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"youkaidns/server"
+	"youkaidns/stats"
+)
+
+// testDomain is the domain the test DNS server serves
+const testDomain = "t.test"
+
+// testClient is the address test requests come from (httptest's default)
+const testClient = "192.0.2.1"
+
+// newTestServer returns a dashboard for a DNS server saving into a temp
+// directory
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	st := stats.NewStats()
+	dnsServer := server.NewServer(0, st, false, testDomain, filepath.Join(t.TempDir(), "out"))
+	return NewServer(0, st, "localhost", dnsServer)
+}
+
+// serve runs a request through the dashboard's full handler chain
+func serve(s *Server, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.handler().ServeHTTP(w, r)
+	return w
+}
+
+func TestWebACL(t *testing.T) {
+	s := newTestServer(t)
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := server.OpenAuditLog(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl, err := server.ParseACL([]string{"192.0.2.0/24"}, []string{testClient})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetACL(acl, audit)
+
+	tests := []struct {
+		remote string
+		want   int
+	}{
+		{testClient + ":1234", http.StatusForbidden}, // Denied
+		{"192.0.2.2:1234", http.StatusOK},            // Allowed
+		{"198.51.100.7:1234", http.StatusForbidden},  // Not allowed
+		{"[2001:db8::1]:1234", http.StatusForbidden}, // Not allowed
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/stats", nil)
+		r.RemoteAddr = tt.remote
+		if w := serve(s, r); w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.remote, w.Code, tt.want)
+		}
+	}
+
+	if err := audit.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sources := make(map[string]bool)
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		var event server.AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Service != "web" || event.Target != "GET /api/stats" {
+			t.Errorf("audit event %+v", event)
+		}
+		sources[event.Source] = true
+	}
+	if len(sources) != 3 || !sources[testClient] || !sources["2001:db8::1"] {
+		t.Fatalf("audited sources %v", sources)
+	}
+}
@@ -3,6 +3,12 @@ const UPDATE_INTERVAL = 2000;
 
 let updateTimer = null;
 
+// CSRF token of the dashboard login, sent with requests that change something
+let csrfToken = '';
+
+// Role of the dashboard login: viewers get no download or other operator controls
+let userRole = 'viewer';
+
 // Track previous transfer state for speed calculation
 const previousTransfers = new Map(); // hash -> { receivedParts, timestamp }
 
@@ -71,6 +77,10 @@ function updateDashboard(data) {
         });
     }
     
+    // Update rejected records and throttled queries by source
+    updateSourceCounts('rejections-by-source', data.rejections_by_source, 'No rejected records');
+    updateSourceCounts('throttled-by-source', data.throttled_by_source, 'No throttled queries');
+
     // Update response time statistics
     const minMs = parseDuration(data.response_time.min);
     const maxMs = parseDuration(data.response_time.max);
@@ -126,7 +136,11 @@ function updateTransfers(transfers) {
         const receivedParts = transfer.received_parts || 0;
         const totalParts = transfer.total_parts || 0;
         const missingChunks = transfer.missing_chunks || [];
+        const missingCount = transfer.missing_count || missingChunks.length;
         const chunkSize = transfer.chunk_size || 0;
+        const compressed = transfer.compression && transfer.compression !== 'none';
+        const encrypted = transfer.cipher && transfer.cipher !== 'none';
+        const fec = transfer.fec && transfer.fec !== 'none';
 
         // Calculate transfer speed
         let speedText = 'N/A';
@@ -160,8 +174,26 @@ function updateTransfers(transfers) {
                 </div>
                 <div class="transfer-info-item">
                     <span class="transfer-info-label">File Size</span>
-                    <span class="transfer-info-value">${transfer.total_bytes > 0 ? formatFileSize(transfer.total_bytes) : 'Unknown'}</span>
+                    <span class="transfer-info-value">${transfer.file_bytes > 0 ? formatFileSize(transfer.file_bytes) : 'Unknown'}</span>
+                </div>
+                ${compressed ? `
+                <div class="transfer-info-item">
+                    <span class="transfer-info-label">On the Wire</span>
+                    <span class="transfer-info-value">${formatFileSize(transfer.wire_bytes)} ${escapeHtml(transfer.compression)}${transfer.compression_ratio > 0 ? ` (${transfer.compression_ratio.toFixed(1)}x)` : ''}</span>
+                </div>
+                ` : ''}
+                ${encrypted ? `
+                <div class="transfer-info-item">
+                    <span class="transfer-info-label">Encryption</span>
+                    <span class="transfer-info-value">${escapeHtml(transfer.cipher)}</span>
                 </div>
+                ` : ''}
+                ${fec ? `
+                <div class="transfer-info-item">
+                    <span class="transfer-info-label">FEC</span>
+                    <span class="transfer-info-value">${escapeHtml(transfer.fec)}, ${transfer.recovered_parts || 0} recovered</span>
+                </div>
+                ` : ''}
                 <div class="transfer-info-item">
                     <span class="transfer-info-label">Progress</span>
                     <span class="transfer-info-value">${receivedParts} / ${totalParts} chunks</span>
@@ -187,7 +219,7 @@ function updateTransfers(transfers) {
             ${missingChunks.length > 0 ? `
                 <div class="missing-chunks">
                     <span class="missing-chunks-label">Missing chunks:</span>
-                    <span class="missing-chunks-list">${missingChunks.slice(0, 20).join(', ')}${missingChunks.length > 20 ? '...' : ''}</span>
+                    <span class="missing-chunks-list">${missingChunks.slice(0, 20).join(', ')}${missingCount > 20 ? ` ... (${missingCount} in all)` : ''}</span>
                 </div>
             ` : ''}
         `;
@@ -203,17 +235,43 @@ function updateTransfers(transfers) {
     }
 }
 
-// Escape HTML to prevent XSS
+// Escape text for HTML content and quoted attributes, to prevent XSS
 function escapeHtml(text) {
-    const div = document.createElement('div');
-    div.textContent = text;
-    return div.innerHTML;
+    return String(text ?? '')
+        .replace(/&/g, '&amp;')
+        .replace(/</g, '&lt;')
+        .replace(/>/g, '&gt;')
+        .replace(/"/g, '&quot;')
+        .replace(/'/g, '&#39;');
+}
+
+// Show per-source counts, largest first
+function updateSourceCounts(id, counts, emptyText) {
+    const container = document.getElementById(id);
+    container.innerHTML = '';
+
+    counts = counts || {};
+    if (Object.keys(counts).length === 0) {
+        container.innerHTML = `<p style="color: #999; text-align: center; padding: 20px;">${emptyText}</p>`;
+        return;
+    }
+    Object.entries(counts)
+        .sort((a, b) => b[1] - a[1])
+        .forEach(([source, count]) => {
+            const item = document.createElement('div');
+            item.className = 'type-item';
+            item.innerHTML = `
+                <span class="type-label">${escapeHtml(source)}</span>
+                <span class="type-count">${count.toLocaleString()}</span>
+            `;
+            container.appendChild(item);
+        });
 }
 
 // Fetch stats from API
 async function fetchStats() {
     try {
-        const response = await fetch('/api/stats');
+        const response = await api('/api/stats' + domainQuery());
         if (!response.ok) {
             throw new Error('Failed to fetch stats');
         }
@@ -221,19 +279,29 @@ async function fetchStats() {
         updateDashboard(data);
     } catch (error) {
         console.error('Error fetching stats:', error);
-        // Show error message
-        const errorMsg = document.createElement('div');
-        errorMsg.style.cssText = 'position: fixed; top: 20px; right: 20px; background: #ff4444; color: white; padding: 15px; border-radius: 8px; box-shadow: 0 4px 6px rgba(0,0,0,0.2);';
-        errorMsg.textContent = 'Error fetching stats. Retrying...';
-        document.body.appendChild(errorMsg);
-        setTimeout(() => errorMsg.remove(), 3000);
+        showError('Error fetching stats. Retrying...');
     }
 }
 
+// Show an error message for a few seconds
+function showError(message) {
+    const errorMsg = document.createElement('div');
+    errorMsg.style.cssText = 'position: fixed; top: 20px; right: 20px; background: #ff4444; color: white; padding: 15px; border-radius: 8px; box-shadow: 0 4px 6px rgba(0,0,0,0.2);';
+    errorMsg.textContent = message;
+    document.body.appendChild(errorMsg);
+    setTimeout(() => errorMsg.remove(), 3000);
+}
+
+// Show the error text of a failed change
+async function showResponseError(response, action) {
+    const text = (await response.text()).trim();
+    showError(`${action} failed: ${text || response.status}`);
+}
+
 // Fetch file transfers from API
 async function fetchTransfers() {
     try {
-        const response = await fetch('/api/transfers');
+        const response = await api('/api/transfers' + domainQuery());
         if (!response.ok) {
             throw new Error('Failed to fetch transfers');
         }
@@ -281,27 +349,58 @@ function updateFiles(files) {
         const fileSize = file.size || 0;
         const modTime = file.mod_time || '';
 
+        // Bundles are directories on the server, so there is nothing to download;
+        // viewers may not download at all
+        const downloadable = !file.bundle && isOperator();
         fileDiv.innerHTML = `
             <div class="file-info">
-                <div class="file-name">${fileName}</div>
+                <div class="file-name">${fileName}${file.bundle ? '/' : ''}</div>
                 <div class="file-meta">
                     <span class="file-size">${formatFileSize(fileSize)}</span>
+                    ${file.bundle ? `<span class="file-size">${file.files || 0} files</span>` : ''}
                     <span class="file-date">${formatDate(modTime)}</span>
                 </div>
             </div>
-            <a href="/api/download?file=${encodeURIComponent(fileName)}" class="download-btn" download="${fileName}">
-                Download
-            </a>
+            <div class="file-actions">
+                ${!downloadable ? '' : `
+                <a href="/api/download?file=${encodeURIComponent(file.name || '')}&domain=${encodeURIComponent(file.domain || '')}" class="download-btn" download="${fileName}">
+                    Download
+                </a>
+                `}
+                ${!isOperator() ? '' : '<button type="button" class="download-btn delete-btn">Delete</button>'}
+            </div>
         `;
+        const deleteButton = fileDiv.querySelector('.delete-btn');
+        if (deleteButton) {
+            deleteButton.addEventListener('click', () => deleteFile(file));
+        }
 
         container.appendChild(fileDiv);
     });
 }
 
+// Delete a received file after asking
+async function deleteFile(file) {
+    if (!confirm(`Delete ${file.name}${file.bundle ? '/' : ''}?`)) {
+        return;
+    }
+    const params = new URLSearchParams({ file: file.name || '', domain: file.domain || '' });
+    try {
+        const response = await api('/api/files?' + params.toString(), { method: 'DELETE' });
+        if (!response.ok) {
+            await showResponseError(response, 'Delete');
+            return;
+        }
+        fetchFiles();
+    } catch (error) {
+        console.error('Error deleting file:', error);
+    }
+}
+
 // Fetch received files from API
 async function fetchFiles() {
     try {
-        const response = await fetch('/api/files');
+        const response = await api('/api/files' + domainQuery());
         if (!response.ok) {
             throw new Error('Failed to fetch files');
         }
@@ -312,15 +411,475 @@ async function fetchFiles() {
     }
 }
 
+// Update outbox display
+function updateOutbox(files) {
+    const container = document.getElementById('outbox-files');
+    container.innerHTML = '';
+
+    if (!files || files.length === 0) {
+        container.innerHTML = '<p style="color: #999; text-align: center; padding: 20px;">No files in the outbox</p>';
+        return;
+    }
+
+    files.forEach(file => {
+        const fileDiv = document.createElement('div');
+        fileDiv.className = 'file-item';
+        fileDiv.innerHTML = `
+            <div class="file-info">
+                <div class="file-name">${escapeHtml(file.name)}</div>
+                <div class="file-meta">
+                    <span class="file-size">${formatFileSize(file.size || 0)}</span>
+                    <span class="file-size">id ${escapeHtml(file.id)}</span>
+                    <span class="file-date">${formatDate(file.mod_time)}</span>
+                </div>
+            </div>
+            ${!isOperator() ? '' : '<button type="button" class="download-btn delete-btn">Delete</button>'}
+        `;
+        const deleteButton = fileDiv.querySelector('.delete-btn');
+        if (deleteButton) {
+            deleteButton.addEventListener('click', () => deleteOutboxFile(file.name));
+        }
+        container.appendChild(fileDiv);
+    });
+}
+
+// Fetch outbox files from API
+async function fetchOutbox() {
+    try {
+        const response = await api('/api/outbox');
+        if (!response.ok) {
+            throw new Error('Failed to fetch outbox');
+        }
+        const data = await response.json();
+        updateOutbox(data);
+    } catch (error) {
+        console.error('Error fetching outbox:', error);
+    }
+}
+
+// Upload the chosen file to the outbox
+async function uploadOutboxFile() {
+    const input = document.getElementById('outbox-file');
+    const file = input.files[0];
+    if (!file) {
+        return;
+    }
+    try {
+        const response = await api('/api/outbox?name=' + encodeURIComponent(file.name), {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/octet-stream' },
+            body: file
+        });
+        if (!response.ok) {
+            await showResponseError(response, 'Upload');
+            return;
+        }
+        input.value = '';
+        fetchOutbox();
+    } catch (error) {
+        console.error('Error uploading file:', error);
+    }
+}
+
+// Delete an outbox file after asking
+async function deleteOutboxFile(name) {
+    if (!confirm(`Delete ${name} from the outbox?`)) {
+        return;
+    }
+    try {
+        const response = await api('/api/outbox?name=' + encodeURIComponent(name), { method: 'DELETE' });
+        if (!response.ok) {
+            await showResponseError(response, 'Delete');
+            return;
+        }
+        fetchOutbox();
+    } catch (error) {
+        console.error('Error deleting outbox file:', error);
+    }
+}
+
+// Update zone records display
+function updateZone(records) {
+    const container = document.getElementById('zone-records');
+    container.innerHTML = '';
+
+    if (!records || records.length === 0) {
+        container.innerHTML = '<p style="color: #999; text-align: center; padding: 20px;">No zone records</p>';
+        return;
+    }
+
+    const table = document.createElement('table');
+    table.className = 'history-table';
+    table.innerHTML = `
+        <thead>
+            <tr>
+                <th>Name</th>
+                <th>Type</th>
+                <th>Value</th>
+                ${isOperator() ? '<th></th>' : ''}
+            </tr>
+        </thead>
+    `;
+
+    const tbody = document.createElement('tbody');
+    records.forEach(record => {
+        const row = document.createElement('tr');
+        row.innerHTML = `
+            <td>${escapeHtml(record.name)}</td>
+            <td>${escapeHtml(record.type)}</td>
+            <td>${escapeHtml(record.value)}</td>
+            ${!isOperator() ? '' : '<td><button type="button" class="download-btn delete-btn">Remove</button></td>'}
+        `;
+        const removeButton = row.querySelector('.delete-btn');
+        if (removeButton) {
+            removeButton.addEventListener('click', () => removeZoneRecord(record));
+        }
+        tbody.appendChild(row);
+    });
+    table.appendChild(tbody);
+    container.appendChild(table);
+}
+
+// Fetch zone records from API
+async function fetchZone() {
+    try {
+        const response = await api('/api/zone');
+        if (!response.ok) {
+            throw new Error('Failed to fetch zone records');
+        }
+        const data = await response.json();
+        updateZone(data);
+    } catch (error) {
+        console.error('Error fetching zone records:', error);
+    }
+}
+
+// Add the zone record in the form
+async function addZoneRecord(event) {
+    event.preventDefault();
+    const record = {
+        name: document.getElementById('zone-name').value.trim(),
+        type: document.getElementById('zone-type').value,
+        value: document.getElementById('zone-value').value
+    };
+    try {
+        const response = await api('/api/zone', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(record)
+        });
+        if (!response.ok) {
+            await showResponseError(response, 'Adding record');
+            return;
+        }
+        document.getElementById('zone-name').value = '';
+        document.getElementById('zone-value').value = '';
+        fetchZone();
+    } catch (error) {
+        console.error('Error adding zone record:', error);
+    }
+}
+
+// Remove a zone record after asking
+async function removeZoneRecord(record) {
+    if (!confirm(`Remove ${record.name} ${record.type} ${record.value}?`)) {
+        return;
+    }
+    const params = new URLSearchParams({ name: record.name, type: record.type, value: record.value });
+    try {
+        const response = await api('/api/zone?' + params.toString(), { method: 'DELETE' });
+        if (!response.ok) {
+            await showResponseError(response, 'Removing record');
+            return;
+        }
+        fetchZone();
+    } catch (error) {
+        console.error('Error removing zone record:', error);
+    }
+}
+
+// Update hosts display
+function updateHosts(hosts) {
+    const container = document.getElementById('hosts');
+    container.innerHTML = '';
+
+    if (!hosts || hosts.length === 0) {
+        container.innerHTML = '<p style="color: #999; text-align: center; padding: 20px;">No hosts have checked in</p>';
+        return;
+    }
+
+    const table = document.createElement('table');
+    table.className = 'history-table';
+    table.innerHTML = `
+        <thead>
+            <tr>
+                <th>Host</th>
+                <th>First Seen</th>
+                <th>Last Seen</th>
+                <th>Transfers</th>
+                <th>Bytes</th>
+                <th>Resolvers</th>
+            </tr>
+        </thead>
+    `;
+
+    const tbody = document.createElement('tbody');
+    hosts.forEach(host => {
+        const row = document.createElement('tr');
+        const resolvers = (host.resolvers || []).map(r => escapeHtml(r.ip)).join(', ');
+        row.innerHTML = `
+            <td>${escapeHtml(host.id)}</td>
+            <td>${formatDate(host.first_seen)}</td>
+            <td>${formatDate(host.last_seen)}</td>
+            <td>${host.transfers || 0}${host.failed ? ` <span class="history-saved-as">(${host.failed} failed)</span>` : ''}</td>
+            <td>${formatFileSize(host.bytes || 0)}</td>
+            <td>${resolvers}</td>
+        `;
+        tbody.appendChild(row);
+    });
+    table.appendChild(tbody);
+    container.appendChild(table);
+}
+
+// Fetch hosts from API
+async function fetchHosts() {
+    try {
+        const response = await api('/api/hosts');
+        if (!response.ok) {
+            throw new Error('Failed to fetch hosts');
+        }
+        const data = await response.json();
+        updateHosts(data);
+    } catch (error) {
+        console.error('Error fetching hosts:', error);
+    }
+}
+
+// Update transfer history display
+function updateHistory(history) {
+    const container = document.getElementById('transfer-history');
+    container.innerHTML = '';
+
+    if (!history || history.length === 0) {
+        container.innerHTML = '<p style="color: #999; text-align: center; padding: 20px;">No finished transfers</p>';
+        return;
+    }
+
+    const table = document.createElement('table');
+    table.className = 'history-table';
+    table.innerHTML = `
+        <thead>
+            <tr>
+                <th>Finished</th>
+                <th>File</th>
+                <th>Hash</th>
+                <th>Source</th>
+                <th>Size</th>
+                <th>Duration</th>
+                <th>Retries</th>
+                <th>Status</th>
+            </tr>
+        </thead>
+    `;
+
+    const tbody = document.createElement('tbody');
+    history.forEach(entry => {
+        const row = document.createElement('tr');
+        const savedAs = entry.file && entry.file !== entry.original_filename
+            ? ` <span class="history-saved-as">&rarr; ${escapeHtml(entry.file)}</span>`
+            : '';
+        row.innerHTML = `
+            <td>${formatDate(entry.finished_at)}</td>
+            <td>${escapeHtml(entry.original_filename || 'Unknown')}${savedAs}</td>
+            <td>${escapeHtml(entry.hash || '')}</td>
+            <td>${escapeHtml(entry.source_ip || '')}</td>
+            <td>${entry.total_bytes > 0 ? formatFileSize(entry.total_bytes) : 'Unknown'}</td>
+            <td>${formatDuration(entry.duration_ms || 0)}</td>
+            <td>${entry.retries || 0}</td>
+            <td><span class="transfer-status ${escapeHtml(entry.status)}" title="${escapeHtml(entry.error || '')}">${escapeHtml(entry.status)}</span></td>
+        `;
+        tbody.appendChild(row);
+    });
+    table.appendChild(tbody);
+    container.appendChild(table);
+}
+
+// Fetch transfer history from API using the current filters
+async function fetchHistory() {
+    const params = new URLSearchParams({ limit: '50' });
+    const filename = document.getElementById('history-filename').value.trim();
+    const source = document.getElementById('history-source').value.trim();
+    const status = document.getElementById('history-status').value;
+    const domain = document.getElementById('domain-filter').value;
+    if (domain) params.set('domain', domain);
+    if (filename) params.set('filename', filename);
+    if (source) params.set('source', source);
+    if (status) params.set('status', status);
+
+    try {
+        const response = await api('/api/history?' + params.toString());
+        if (!response.ok) {
+            throw new Error('Failed to fetch history');
+        }
+        const data = await response.json();
+        updateHistory(data);
+    } catch (error) {
+        console.error('Error fetching history:', error);
+    }
+}
+
+// Query string selecting the domain chosen in the header, empty for all
+function domainQuery() {
+    const domain = document.getElementById('domain-filter').value;
+    return domain ? '?domain=' + encodeURIComponent(domain) : '';
+}
+
+// Fill the domain selector from the API, keeping the current choice
+async function fetchDomains() {
+    try {
+        const response = await api('/api/domains');
+        if (!response.ok) {
+            throw new Error('Failed to fetch domains');
+        }
+        const domains = await response.json();
+        const select = document.getElementById('domain-filter');
+        const current = select.value;
+        select.innerHTML = '<option value="">All domains</option>';
+        (domains || []).forEach(domain => {
+            if (!domain.name) return; // The catch-all domain has no name to filter by
+            const option = document.createElement('option');
+            option.value = domain.name;
+            option.textContent = domain.name;
+            select.appendChild(option);
+        });
+        select.value = current;
+    } catch (error) {
+        console.error('Error fetching domains:', error);
+    }
+}
+
+// Refresh everything the domain selector applies to
+function refreshDomainViews() {
+    fetchStats();
+    fetchTransfers();
+    fetchFiles();
+    fetchHistory();
+}
+
+// Call the API with the login's CSRF token; a 401 shows the login form
+async function api(url, options = {}) {
+    const method = (options.method || 'GET').toUpperCase();
+    if (method !== 'GET' && method !== 'HEAD') {
+        options.headers = Object.assign({}, options.headers, { 'X-CSRF-Token': csrfToken });
+    }
+    const response = await fetch(url, options);
+    if (response.status === 401) {
+        showLogin();
+    }
+    return response;
+}
+
+// Whether the login may use operator controls (downloads, deletes, uploads
+// and zone changes)
+function isOperator() {
+    return userRole === 'operator';
+}
+
+// Show the login form and pause refreshing
+function showLogin() {
+    stopAutoRefresh();
+    document.getElementById('user-info').hidden = true;
+    document.getElementById('login-overlay').hidden = false;
+    document.getElementById('login-username').focus();
+}
+
+// Start the dashboard for a login (or without one if auth is off)
+function startSession(session) {
+    csrfToken = session.csrf_token || '';
+    userRole = session.role || 'viewer';
+    document.getElementById('login-overlay').hidden = true;
+    document.getElementById('user-info').hidden = !session.auth_required;
+    document.getElementById('user-name').textContent = session.username ? `${session.username} (${userRole})` : '';
+    // Viewers get no upload or zone editing controls
+    document.getElementById('outbox-controls').hidden = !isOperator();
+    document.getElementById('zone-form').hidden = !isOperator();
+    fetchDomains();
+    startAutoRefresh();
+}
+
+// Find out whether the dashboard needs a login
+async function checkSession() {
+    try {
+        const response = await fetch('/api/session');
+        if (response.status === 401) {
+            showLogin();
+            return;
+        }
+        if (!response.ok) {
+            throw new Error('Failed to fetch session');
+        }
+        startSession(await response.json());
+    } catch (error) {
+        console.error('Error fetching session:', error);
+    }
+}
+
+// Log in with the form's username and password
+async function login(event) {
+    event.preventDefault();
+    const errorText = document.getElementById('login-error');
+    errorText.textContent = '';
+    try {
+        const response = await fetch('/api/login', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({
+                username: document.getElementById('login-username').value,
+                password: document.getElementById('login-password').value
+            })
+        });
+        if (!response.ok) {
+            errorText.textContent = response.status === 401 ? 'Invalid username or password' : 'Login failed';
+            return;
+        }
+        document.getElementById('login-password').value = '';
+        startSession(await response.json());
+    } catch (error) {
+        console.error('Error logging in:', error);
+        errorText.textContent = 'Login failed';
+    }
+}
+
+// End the login
+async function logout() {
+    try {
+        await api('/api/logout', { method: 'POST' });
+    } catch (error) {
+        console.error('Error logging out:', error);
+    }
+    csrfToken = '';
+    userRole = 'viewer';
+    showLogin();
+}
+
 // Start auto-refresh
 function startAutoRefresh() {
+    stopAutoRefresh();
     fetchStats(); // Initial fetch
     fetchTransfers(); // Initial fetch
     fetchFiles(); // Initial fetch
+    fetchOutbox(); // Initial fetch
+    fetchZone(); // Initial fetch
+    fetchHosts(); // Initial fetch
+    fetchHistory(); // Initial fetch
     updateTimer = setInterval(() => {
         fetchStats();
         fetchTransfers();
         fetchFiles();
+        fetchOutbox();
+        fetchZone();
+        fetchHosts();
+        fetchHistory();
     }, UPDATE_INTERVAL);
 }
 
@@ -334,7 +893,15 @@ function stopAutoRefresh() {
 
 // Initialize on page load
 document.addEventListener('DOMContentLoaded', () => {
-    startAutoRefresh();
+    ['history-filename', 'history-source', 'history-status'].forEach(id => {
+        document.getElementById(id).addEventListener('change', fetchHistory);
+    });
+    document.getElementById('domain-filter').addEventListener('change', refreshDomainViews);
+    document.getElementById('login-form').addEventListener('submit', login);
+    document.getElementById('logout-button').addEventListener('click', logout);
+    document.getElementById('outbox-upload').addEventListener('click', uploadOutboxFile);
+    document.getElementById('zone-form').addEventListener('submit', addZoneRecord);
+    checkSession();
 });
 
 // Cleanup on page unload
@@ -0,0 +1,202 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default files of a generated self-signed certificate
+const (
+	DefaultSelfSignedCert = "youkaidns-web.crt"
+	DefaultSelfSignedKey  = "youkaidns-web.key"
+)
+
+// selfSignedValidity is how long a generated certificate is valid. It is
+// regenerated once it has less than selfSignedRenewal left.
+const (
+	selfSignedValidity = 365 * 24 * time.Hour
+	selfSignedRenewal  = 7 * 24 * time.Hour
+)
+
+// TLSConfig configures HTTPS for the dashboard
+type TLSConfig struct {
+	CertFile string // PEM certificate (chain)
+	KeyFile  string // PEM private key
+
+	// Generate a self-signed certificate into CertFile and KeyFile
+	// (DefaultSelfSignedCert and DefaultSelfSignedKey if empty), reusing it
+	// on later starts until it is about to expire
+	SelfSigned bool
+
+	// Port of a plain HTTP listener that redirects to HTTPS, 0 for none
+	RedirectPort int
+}
+
+// SetTLS serves the dashboard over HTTPS, generating the self-signed
+// certificate first if asked to. It must be called before Start.
+func (s *Server) SetTLS(cfg TLSConfig) error {
+	if cfg.SelfSigned {
+		if cfg.CertFile == "" {
+			cfg.CertFile = DefaultSelfSignedCert
+		}
+		if cfg.KeyFile == "" {
+			cfg.KeyFile = DefaultSelfSignedKey
+		}
+		if err := ensureSelfSigned(cfg.CertFile, cfg.KeyFile, s.listenIP); err != nil {
+			return err
+		}
+	}
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return errors.New("both a certificate and a key file are needed")
+	}
+
+	// Load once now so a bad pair fails at startup rather than on the first
+	// connection
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		sum := sha256.Sum256(leaf.Raw)
+		log.Printf("Web TLS certificate: %s (%s, expires %s, SHA-256 %X)", cfg.CertFile, leaf.Subject.CommonName, leaf.NotAfter.Format("2006-01-02"), sum)
+	}
+
+	s.tls = &cfg
+	return nil
+}
+
+// TLSEnabled reports whether the dashboard is served over HTTPS
+func (s *Server) TLSEnabled() bool {
+	return s.tls != nil
+}
+
+// ensureSelfSigned generates a self-signed certificate for the listen
+// address, unless a usable one is already at certFile
+func ensureSelfSigned(certFile string, keyFile string, listenIP string) error {
+	if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil && time.Until(leaf.NotAfter) > selfSignedRenewal {
+			return nil
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "YoukaiDNS dashboard"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" && hostname != "localhost" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if ip := net.ParseIP(listenIP); ip != nil && !ip.IsUnspecified() && !ip.IsLoopback() {
+		template.IPAddresses = append(template.IPAddresses, ip)
+	} else if ip == nil && listenIP != "" && listenIP != "localhost" {
+		template.DNSNames = append(template.DNSNames, listenIP)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := writePEM(keyFile, "PRIVATE KEY", keyDER, 0600); err != nil {
+		return err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return err
+	}
+	log.Printf("Generated self-signed web certificate %s (key %s) for %s", certFile, keyFile, strings.Join(append(template.DNSNames, ipStrings(template.IPAddresses)...), ", "))
+	return nil
+}
+
+// writePEM writes one PEM block to a file, creating its directory
+func writePEM(path string, blockType string, der []byte, perm os.FileMode) error {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ipStrings formats IP addresses
+func ipStrings(ips []net.IP) []string {
+	out := make([]string, len(ips))
+	for i, ip := range ips {
+		out[i] = ip.String()
+	}
+	return out
+}
+
+// serveRedirect runs the plain HTTP listener that redirects every request to
+// the HTTPS dashboard
+func (s *Server) serveRedirect() {
+	addr := fmt.Sprintf("%s:%d", s.listenIP, s.tls.RedirectPort)
+	log.Printf("Redirecting http://%s to HTTPS", addr)
+
+	if err := http.ListenAndServe(addr, s.restrict(s.redirectHandler())); err != nil {
+		log.Printf("Error running HTTP redirect listener: %v", err)
+	}
+}
+
+// redirectHandler redirects a request to the same path on the HTTPS port of
+// the host it was sent to
+func (s *Server) redirectHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]" // IPv6 literal
+		}
+		if s.port != 443 {
+			host += ":" + strconv.Itoa(s.port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
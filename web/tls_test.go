@@ -0,0 +1,214 @@
+package web
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readCert loads a certificate and key pair and returns the certificate
+func readCert(t *testing.T, certFile, keyFile string) *x509.Certificate {
+	t.Helper()
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf
+}
+
+// writeCert writes a self-signed certificate for localhost that expires
+// after validity
+func writeCert(t *testing.T, certFile, keyFile string, validity time.Duration) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validity),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writePEM(keyFile, "PRIVATE KEY", keyDER, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSelfSignedCertificate(t *testing.T) {
+	s := newTestServer(t)
+	s.listenIP = "192.0.2.10"
+	dir := filepath.Join(t.TempDir(), "tls")
+	certFile, keyFile := filepath.Join(dir, "web.crt"), filepath.Join(dir, "web.key")
+
+	if err := s.SetTLS(TLSConfig{SelfSigned: true, CertFile: certFile, KeyFile: keyFile}); err != nil {
+		t.Fatal(err)
+	}
+	if !s.TLSEnabled() {
+		t.Fatal("TLS not enabled")
+	}
+
+	leaf := readCert(t, certFile, keyFile)
+	if err := leaf.VerifyHostname("localhost"); err != nil {
+		t.Error(err)
+	}
+	for _, ip := range []string{"127.0.0.1", "::1", "192.0.2.10"} {
+		if err := leaf.VerifyHostname(ip); err != nil {
+			t.Error(err)
+		}
+	}
+	if validity := leaf.NotAfter.Sub(time.Now()); validity < selfSignedValidity-time.Hour {
+		t.Errorf("valid for %s", validity)
+	}
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode %v, want 0600", info.Mode().Perm())
+	}
+
+	// A later start reuses the certificate
+	before, _ := os.ReadFile(certFile)
+	if err := s.SetTLS(TLSConfig{SelfSigned: true, CertFile: certFile, KeyFile: keyFile}); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.ReadFile(certFile); !bytes.Equal(before, after) {
+		t.Fatal("usable certificate regenerated")
+	}
+
+	// One about to expire is replaced
+	writeCert(t, certFile, keyFile, selfSignedRenewal/2)
+	if err := s.SetTLS(TLSConfig{SelfSigned: true, CertFile: certFile, KeyFile: keyFile}); err != nil {
+		t.Fatal(err)
+	}
+	if leaf := readCert(t, certFile, keyFile); time.Until(leaf.NotAfter) <= selfSignedRenewal {
+		t.Fatalf("expiring certificate kept (expires %s)", leaf.NotAfter)
+	}
+}
+
+func TestSetTLSRejects(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "a.crt"), filepath.Join(dir, "a.key")
+	otherCert, otherKey := filepath.Join(dir, "b.crt"), filepath.Join(dir, "b.key")
+	writeCert(t, certFile, keyFile, time.Hour)
+	writeCert(t, otherCert, otherKey, time.Hour)
+
+	tests := []struct {
+		name string
+		cfg  TLSConfig
+	}{
+		{"no key", TLSConfig{CertFile: certFile}},
+		{"missing files", TLSConfig{CertFile: filepath.Join(dir, "none.crt"), KeyFile: filepath.Join(dir, "none.key")}},
+		{"mismatched pair", TLSConfig{CertFile: certFile, KeyFile: otherKey}},
+	}
+	for _, tt := range tests {
+		s := newTestServer(t)
+		if err := s.SetTLS(tt.cfg); err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+		if s.TLSEnabled() {
+			t.Errorf("%s: TLS enabled", tt.name)
+		}
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		port int
+		host string
+		path string
+		want string
+	}{
+		{8443, "example.com:8080", "/api/stats?domain=t.test", "https://example.com:8443/api/stats?domain=t.test"},
+		{8443, "example.com", "/", "https://example.com:8443/"},
+		{443, "example.com:80", "/static/app.js", "https://example.com/static/app.js"},
+		{8443, "[2001:db8::1]:8080", "/", "https://[2001:db8::1]:8443/"},
+	}
+	for _, tt := range tests {
+		s := newTestServer(t)
+		s.port = tt.port
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		r.Host = tt.host
+		w := httptest.NewRecorder()
+		s.redirectHandler().ServeHTTP(w, r)
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != tt.want {
+			t.Errorf("%s%s: %d to %q, want %q", tt.host, tt.path, w.Code, w.Header().Get("Location"), tt.want)
+		}
+	}
+}
+
+func TestSecureCookieOverTLS(t *testing.T) {
+	s := newAuthServer(t)
+	for _, overTLS := range []bool{false, true} {
+		r := httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(`{"username": "admin", "password": "`+testPassword+`"}`))
+		if overTLS {
+			r.TLS = &tls.ConnectionState{}
+		}
+		cookies := serve(s, r).Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Secure != overTLS {
+			t.Errorf("over TLS %v: cookies %v", overTLS, cookies)
+		}
+	}
+}
+
+func TestCertificateServes(t *testing.T) {
+	s := newTestServer(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "web.crt"), filepath.Join(dir, "web.key")
+	if err := s.SetTLS(TLSConfig{SelfSigned: true, CertFile: certFile, KeyFile: keyFile}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A client trusting the generated certificate reaches the dashboard
+	srv := httptest.NewUnstartedServer(s.handler())
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{pair}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(readCert(t, certFile, keyFile))
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "localhost"}}}
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	resp, err := client.Get("https://127.0.0.1:" + port + "/api/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+}